@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// runAbortiveClose has the server close every connection with a zero linger
+// time and no data, so that the client sees RST rather than FIN, and fails
+// unless every client read ends in a reset. The netstack run also reports
+// the reset counters from both stacks.
+func runAbortiveClose(ctx context.Context, nConns int, opts stackOptions) error {
+	native := &netTransport{addr: net.ParseIP("::1"), abortiveClose: true}
+	server, client, err := setupGonetPair(opts)
+	if err != nil {
+		return err
+	}
+	server.abortiveClose = true
+	paths := []struct {
+		name   string
+		server Transport
+		client Transport
+		port   uint16
+	}{
+		{"net", native, native, 6789},
+		{"gonet", server, client, 1234},
+	}
+	failed := false
+	for _, path := range paths {
+		go payloadServer(path.server, path.port, nil)
+		time.Sleep(time.Millisecond)
+		// Every connection is meant to fail, so they are recorded here, a
+		// reset as a success and a clean close as bad data.
+		received, errs := collectConns(withResult(ctx, nil), path.client, path.port, nConns, nil)
+		var failures failureCounts
+		for _, err := range errs {
+			failures.add(err)
+			if classifyError(err) == failReset {
+				resultFrom(ctx).addResult(nil, true)
+			} else {
+				resultFrom(ctx).addResult(err, false)
+			}
+		}
+		for range received {
+			resultFrom(ctx).addResult(nil, false)
+		}
+		fmt.Printf("%s: %d/%d connections reset, %d closed cleanly, failures: %s\n",
+			path.name, failures[failReset], nConns, len(received), &failures)
+		if failures[failReset] != int64(nConns) {
+			failed = true
+		}
+	}
+	serverTCP := server.netStack.Stats().TCP
+	clientTCP := client.netStack.Stats().TCP
+	fmt.Printf("gonet: server sent %d resets, %d established resets; client received %d resets, %d established resets\n",
+		serverTCP.ResetsSent.Value(), serverTCP.EstablishedResets.Value(),
+		clientTCP.ResetsReceived.Value(), clientTCP.EstablishedResets.Value())
+	if failed {
+		return fmt.Errorf("not every abortive close was seen as a reset")
+	}
+	return ctx.Err()
+}
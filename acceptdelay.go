@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// acceptQueue follows how many connections a delayed accept server has
+// waiting: clients count those they have dialed and the server those it has
+// accepted, and the server samples the difference before each Accept. A
+// dial returns once netstack has completed the handshake and queued the
+// connection, so the difference is the accept queue's depth, give or take
+// the dials in flight.
+type acceptQueue struct {
+	dialed   int64
+	accepted int64
+	maxDepth int64
+}
+
+func (q *acceptQueue) sample() {
+	depth := atomic.LoadInt64(&q.dialed) - atomic.LoadInt64(&q.accepted)
+	for {
+		old := atomic.LoadInt64(&q.maxDepth)
+		if depth <= old || atomic.CompareAndSwapInt64(&q.maxDepth, old, depth) {
+			return
+		}
+	}
+}
+
+// delayedAcceptServer is testServer waiting delay before each Accept, as an
+// overloaded server, slow to get round to its listener, would.
+func delayedAcceptServer(t Transport, port uint16, delay time.Duration, q *acceptQueue) {
+	li, err := serverListen(t, port)
+	if err != nil {
+		fmt.Printf("Listen error: %s\n", err)
+		return
+	}
+	for {
+		time.Sleep(delay)
+		q.sample()
+		sc, err := li.Accept()
+		if err != nil {
+			logAcceptError(err)
+			return
+		}
+		atomic.AddInt64(&q.accepted, 1)
+		go serveConn(sc, []byte(testMsg))
+	}
+}
+
+// acceptPhaseTimeout is how long each server of a delayed accept check gets
+// beyond the time its delays add up to.
+const acceptPhaseTimeout = 5 * time.Second
+
+// delayedAcceptTimeout is how long a delayed accept check of nConns
+// connections with delay may take: both its servers' phases in full.
+func delayedAcceptTimeout(delay time.Duration, nConns int) time.Duration {
+	return 2 * (acceptPhaseTimeout + time.Duration(nConns)*delay)
+}
+
+// runDelayedAccept has nConns gonet clients dial at once a server that
+// accepts with no delay and then one that waits delay before each Accept,
+// its listener's backlog being backlog, and compares what the clients see:
+// how long their dials took, how long from dialing until the first byte of
+// the test message arrived, how deep the accept queue got, and how many
+// SYNs and final ACKs the listener dropped, or answered with SYN cookies,
+// once its queue was full. netstack answers SYNs with cookies once the
+// queue is full, so dials still return promptly, and the backlog's effect
+// shows instead in the time to the first byte, as the connections whose
+// final ACK was dropped wait for retransmissions. Connections stalled by
+// the overflow are what runGonet shows, so each server gets
+// acceptPhaseTimeout beyond the time its delays add up to, after which its
+// stalled connections count as failed and the next one starts.
+func runDelayedAccept(ctx context.Context, delay time.Duration, backlog int, nConns int, opts stackOptions) error {
+	intact := 0
+	for _, d := range []time.Duration{0, delay} {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		server, client, err := setupGonetPair(opts)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(ctx, acceptPhaseTimeout+time.Duration(nConns)*d)
+		server.backlog = backlog
+		q := &acceptQueue{}
+		go delayedAcceptServer(server, 1234, d, q)
+		time.Sleep(time.Millisecond)
+		var mu sync.Mutex
+		var dials, ttfbs []time.Duration
+		var ok int64
+		wg := &sync.WaitGroup{}
+		wg.Add(nConns)
+		for i := 0; i < nConns; i++ {
+			go func() {
+				defer wg.Done()
+				id := newConnID()
+				start := time.Now()
+				c, err := client.Dial(ctx, 1234)
+				if err != nil {
+					resultFrom(ctx).addResult(err, false)
+					logConn(id, "dial TCP error: %s%s", err, dialErrorHint(err))
+					return
+				}
+				dialed := time.Since(start)
+				atomic.AddInt64(&q.dialed, 1)
+				ttfb, b, err := readFirstByte(ctx, c, start)
+				_ = c.Close()
+				resultFrom(ctx).addResult(err, bytes.Equal(b, []byte(testMsg)))
+				switch {
+				case err != nil:
+					logConn(id, "%s", err)
+					return
+				case !bytes.Equal(b, []byte(testMsg)):
+					logConn(id, "incorrect data received: %q", b)
+					return
+				}
+				atomic.AddInt64(&ok, 1)
+				mu.Lock()
+				defer mu.Unlock()
+				dials = append(dials, dialed)
+				ttfbs = append(ttfbs, ttfb)
+			}()
+		}
+		wg.Wait()
+		cancel()
+		st := server.netStack.Stats().TCP
+		fmt.Printf("accept delay %s, backlog %d: %d/%d connections intact, max accept queue %d\n", d, backlog,
+			ok, nConns, atomic.LoadInt64(&q.maxDepth))
+		fmt.Printf("accept delay %s: dial %s\n", d, formatPercentiles(dials))
+		fmt.Printf("accept delay %s: connect to first byte %s\n", d, formatPercentiles(ttfbs))
+		fmt.Printf("accept delay %s: SYN drops %d, ACK drops %d, SYN cookies sent %d\n", d,
+			st.ListenOverflowSynDrop.Value(), st.ListenOverflowAckDrop.Value(), st.ListenOverflowSynCookieSent.Value())
+		intact += int(ok)
+	}
+	if intact != 2*nConns {
+		return fmt.Errorf("%d connections failed", 2*nConns-intact)
+	}
+	return nil
+}
+
+// readFirstByte reads the test message from c, returning the time from start
+// until its first byte arrived, and records the transfer in the run's
+// result as receiveConn would.
+func readFirstByte(ctx context.Context, c net.Conn, start time.Time) (time.Duration, []byte, error) {
+	defer resultFrom(ctx).startTransfer()()
+	stop := bindDeadline(ctx, c)
+	defer stop()
+	b := make([]byte, len(testMsg))
+	if _, err := io.ReadFull(c, b[:1]); err != nil {
+		return 0, nil, fmt.Errorf("read TCP error: %w", err)
+	}
+	ttfb := time.Since(start)
+	if _, err := io.ReadFull(c, b[1:]); err != nil {
+		return ttfb, b, fmt.Errorf("read TCP error: %w", err)
+	}
+	resultFrom(ctx).addTransfer(ttfb, time.Since(start), len(b))
+	return ttfb, b, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"text/tabwriter"
+	"time"
+)
+
+// allocCount is a count of heap allocations and the bytes they came to.
+type allocCount struct {
+	objects uint64
+	bytes   uint64
+}
+
+// readAllocs returns the process's heap allocations so far. The runtime
+// counts them across every goroutine, so during a run they include the
+// server's allocations and those of netstack's own goroutines.
+func readAllocs() allocCount {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	return allocCount{objects: mem.Mallocs, bytes: mem.TotalAlloc}
+}
+
+func (a allocCount) sub(b allocCount) allocCount {
+	return allocCount{objects: a.objects - b.objects, bytes: a.bytes - b.bytes}
+}
+
+// perConn formats a as allocations and bytes per connection over n.
+func (a allocCount) perConn(n int) string {
+	if n == 0 {
+		return "-\t-"
+	}
+	return fmt.Sprintf("%.0f\t%.0f", float64(a.objects)/float64(n), float64(a.bytes)/float64(n))
+}
+
+// runAllocs measures the heap allocations per connection of a fixed
+// workload, nConns connections each receiving a 16KiB payload, over native
+// TCP and gonet. Connections are made one at a time and all dialed before
+// any is read, so that the allocations can be split between setting a
+// connection up and moving its data, and both sides of each connection are
+// counted.
+func runAllocs(ctx context.Context, nConns int, opts stackOptions) error {
+	payload := randomPayload(newLockedRand(opts.seed), 16*1024)
+	server, client, err := setupGonetPair(opts)
+	if err != nil {
+		return err
+	}
+	paths := []struct {
+		name   string
+		server Transport
+		client Transport
+		port   uint16
+	}{
+		{"net", &netTransport{addr: net.ParseIP("::1")}, &netTransport{addr: net.ParseIP("::1")}, 9123},
+		{"gonet", server, client, 1234},
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PATH\tDIAL ALLOCS/CONN\tDIAL B/CONN\tTRANSFER ALLOCS/CONN\tTRANSFER B/CONN\tTOTAL ALLOCS/CONN\tTOTAL B/CONN")
+	totals := make(map[string]allocCount)
+	for _, path := range paths {
+		go payloadServer(path.server, path.port, payload)
+		time.Sleep(time.Millisecond)
+		type dialed struct {
+			c     net.Conn
+			start time.Time
+		}
+		conns := make([]dialed, 0, nConns)
+		before := readAllocs()
+		for i := 0; i < nConns; i++ {
+			start := time.Now()
+			c, err := path.client.Dial(ctx, path.port)
+			if err != nil {
+				resultFrom(ctx).addResult(err, false)
+				logConn(newConnID(), "dial TCP error: %s%s", err, dialErrorHint(err))
+				continue
+			}
+			conns = append(conns, dialed{c, start})
+		}
+		dial := readAllocs().sub(before)
+		before = readAllocs()
+		for _, d := range conns {
+			b, err := receiveConn(ctx, d.c, d.start)
+			resultFrom(ctx).addResult(err, bytes.Equal(b, payload))
+		}
+		transfer := readAllocs().sub(before)
+		total := allocCount{objects: dial.objects + transfer.objects, bytes: dial.bytes + transfer.bytes}
+		totals[path.name] = total
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", path.name, dial.perConn(len(conns)), transfer.perConn(len(conns)), total.perConn(len(conns)))
+		if ctx.Err() != nil {
+			_ = tw.Flush()
+			return ctx.Err()
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if n := totals["net"]; n.objects > 0 && n.bytes > 0 {
+		g := totals["gonet"]
+		fmt.Printf("gonet allocates %.1fx the objects and %.1fx the bytes of native TCP per connection\n",
+			float64(g.objects)/float64(n.objects), float64(g.bytes)/float64(n.bytes))
+	}
+	return nil
+}
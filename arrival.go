@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// pacer returns how long to wait before launching connection i of a run,
+// for i from 1 on; connection 0 is always launched straight away.
+type pacer func(i int) time.Duration
+
+// arrivalPatterns maps the -arrival names to pacers launching connections
+// at an average of rate a second. burst is the size of each burst for
+// "burst"; the others ignore it.
+var arrivalPatterns = map[string]func(rng *rand.Rand, rate float64, burst int) pacer{
+	// all launches every connection at once, which is what the runs do by
+	// default.
+	"all": func(*rand.Rand, float64, int) pacer {
+		return func(int) time.Duration { return 0 }
+	},
+	"constant": func(_ *rand.Rand, rate float64, _ int) pacer {
+		return func(int) time.Duration { return time.Duration(float64(time.Second) / rate) }
+	},
+	// poisson spaces the connections by exponentially distributed gaps.
+	"poisson": func(rng *rand.Rand, rate float64, _ int) pacer {
+		return func(int) time.Duration { return time.Duration(rng.ExpFloat64() / rate * float64(time.Second)) }
+	},
+	// burst launches burst connections at once, then waits long enough to
+	// keep to the average rate.
+	"burst": func(_ *rand.Rand, rate float64, burst int) pacer {
+		return func(i int) time.Duration {
+			if i%burst != 0 {
+				return 0
+			}
+			return time.Duration(float64(burst) / rate * float64(time.Second))
+		}
+	},
+}
+
+// arrival is the pattern connections are launched in, with the average
+// rate it aims for, or a zero rate for all at once.
+type arrival struct {
+	name string
+	rate float64
+	pace pacer
+}
+
+type arrivalKey struct{}
+
+func withArrival(ctx context.Context, a *arrival) context.Context {
+	return context.WithValue(ctx, arrivalKey{}, a)
+}
+
+// arrivalFrom returns the arrival pattern attached to ctx, or nil if
+// connections are launched all at once.
+func arrivalFrom(ctx context.Context) *arrival {
+	a, _ := ctx.Value(arrivalKey{}).(*arrival)
+	return a
+}
+
+// launch calls start nConns times, spaced by the run's arrival pattern, and
+// reports the rate achieved. Once ctx is done the remaining connections are
+// started straight away, so that they fail and are counted.
+func launch(ctx context.Context, nConns int, start func()) {
+	a := arrivalFrom(ctx)
+	if a == nil {
+		for i := 0; i < nConns; i++ {
+			start()
+		}
+		return
+	}
+	begin := time.Now()
+	next := begin
+	for i := 0; i < nConns; i++ {
+		// Gaps are measured from when the last connection was due rather
+		// than when it was launched, so that lateness doesn't accumulate.
+		if i > 0 {
+			next = next.Add(a.pace(i))
+		}
+		if wait := time.Until(next); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+			}
+		}
+		start()
+	}
+	if elapsed := time.Since(begin); nConns > 1 && elapsed > 0 {
+		fmt.Printf("%s arrivals: %d connections in %s, %.1f/s (target %.1f/s)\n",
+			a.name, nConns, elapsed.Round(time.Millisecond), float64(nConns-1)/elapsed.Seconds(), a.rate)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// c10kLevels are the numbers of concurrent workers a C10K run steps
+// through, for each path.
+var c10kLevels = []int{100, 1000, 10000}
+
+// c10kDialTimeout bounds each C10K dial, so that a worker whose SYN is
+// dropped counts a failure and moves on rather than sitting out the level.
+const c10kDialTimeout = 2 * time.Second
+
+// c10kBreakdown is the failure rate above which a path is taken to have
+// broken down at a level.
+const c10kBreakdown = 0.01
+
+// highWater samples the process's resource use while a C10K level runs and
+// keeps the peaks.
+type highWater struct {
+	goroutines int
+	fds        int
+	heap       uint64
+	// endpoints is the most endpoints registered with the client stack at
+	// once, which for gonet includes those in TIME-WAIT. It is zero for the
+	// native path, whose endpoints are in the kernel.
+	endpoints int
+}
+
+func (h *highWater) sample(t Transport) {
+	if n := runtime.NumGoroutine(); n > h.goroutines {
+		h.goroutines = n
+	}
+	if fds, err := os.ReadDir("/proc/self/fd"); err == nil && len(fds) > h.fds {
+		h.fds = len(fds)
+	}
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	if ms.HeapInuse > h.heap {
+		h.heap = ms.HeapInuse
+	}
+	if g, ok := t.(*gonetTransport); ok {
+		if n := len(g.netStack.RegisteredEndpoints()); n > h.endpoints {
+			h.endpoints = n
+		}
+	}
+}
+
+// watch samples every 100ms until stop is closed, then returns the peaks.
+func (h *highWater) watch(t Transport, stop <-chan struct{}) *highWater {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		h.sample(t)
+		select {
+		case <-ticker.C:
+		case <-stop:
+			h.sample(t)
+			return h
+		}
+	}
+}
+
+// c10kWorker opens and closes connections one after another until until,
+// counting those it made and the failures by category.
+func c10kWorker(ctx context.Context, t Transport, port uint16, until time.Time, succeeded *int64, failures *failureCounts) {
+	for time.Now().Before(until) && ctx.Err() == nil {
+		id := newConnID()
+		dctx, cancel := context.WithTimeout(ctx, c10kDialTimeout)
+		c, err := t.Dial(dctx, port)
+		cancel()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			failures.add(err)
+			resultFrom(ctx).addResult(err, false)
+			logConn(id, "dial TCP error: %s%s", err, dialErrorHint(err))
+			// Back off briefly so that a path that is failing fast doesn't
+			// spin its workers.
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		atomic.AddInt64(succeeded, 1)
+		resultFrom(ctx).addResult(nil, true)
+		if err := c.Close(); err != nil {
+			logConn(id, "close TCP error: %s", err)
+		}
+	}
+}
+
+// runC10K churns short-lived connections over native TCP and gonet with each
+// of c10kLevels concurrent workers for duration per level. Each worker dials,
+// closes and dials again, the client closing first, as a busy front end
+// would; the server it talks to is churnServer. For each path and level it
+// reports the sustained connection rate, the failure rate, and the peak
+// goroutines, file descriptors, heap and stack endpoints, and then the level
+// at which each path broke down: where its failures first went above 1%, or
+// failing that where its rate stopped growing.
+func runC10K(ctx context.Context, duration time.Duration, opts stackOptions) error {
+	type level struct {
+		workers int
+		rate    float64
+	}
+	paths := []struct {
+		name   string
+		gonet  bool
+		levels []level
+	}{
+		{name: "net"},
+		{name: "gonet", gonet: true},
+	}
+levels:
+	for i, workers := range c10kLevels {
+		for p := range paths {
+			path := &paths[p]
+			var server, client Transport
+			port := uint16(9456 + i)
+			if path.gonet {
+				s, c, err := setupGonetPair(opts)
+				if err != nil {
+					return err
+				}
+				server, client, port = s, c, 1234
+			} else {
+				server, client = &netTransport{addr: net.ParseIP("::1")}, &netTransport{addr: net.ParseIP("::1")}
+			}
+			go churnServer(server, port)
+			time.Sleep(time.Millisecond)
+			var succeeded int64
+			var failures failureCounts
+			stop := make(chan struct{})
+			peaks := make(chan *highWater)
+			go func() { peaks <- (&highWater{}).watch(client, stop) }()
+			start := time.Now()
+			until := start.Add(duration)
+			wg := &sync.WaitGroup{}
+			wg.Add(workers)
+			for j := 0; j < workers; j++ {
+				go func() {
+					defer wg.Done()
+					c10kWorker(ctx, client, port, until, &succeeded, &failures)
+				}()
+			}
+			wg.Wait()
+			elapsed := time.Since(start)
+			close(stop)
+			hw := <-peaks
+			if ctx.Err() != nil {
+				break levels
+			}
+			failed := failures.total()
+			failRate := 0.0
+			if total := succeeded + failed; total > 0 {
+				failRate = float64(failed) / float64(total)
+			}
+			rate := float64(succeeded) / elapsed.Seconds()
+			fmt.Printf("%s, %d workers: %.0f conn/s, %.2f%% failed (%s); peak %d goroutines, %d fds, %.1f MiB heap",
+				path.name, workers, rate, 100*failRate, &failures, hw.goroutines, hw.fds, float64(hw.heap)/(1<<20))
+			if path.gonet {
+				fmt.Printf(", %d endpoints", hw.endpoints)
+			}
+			fmt.Printf("\n")
+			if failRate > c10kBreakdown {
+				rate = -1
+			}
+			path.levels = append(path.levels, level{workers, rate})
+		}
+	}
+	for _, path := range paths {
+		if len(path.levels) == 0 {
+			continue
+		}
+		best := path.levels[0]
+		broke := ""
+		for _, l := range path.levels {
+			if l.rate < 0 {
+				broke = fmt.Sprintf("failures above %.0f%% from %d workers", 100*c10kBreakdown, l.workers)
+				break
+			}
+			if l.rate > best.rate {
+				best = l
+			}
+		}
+		if broke == "" {
+			broke = fmt.Sprintf("no level had failures above %.0f%%", 100*c10kBreakdown)
+		}
+		if best.rate < 0 {
+			fmt.Printf("%s: %s\n", path.name, broke)
+			continue
+		}
+		fmt.Printf("%s: rate peaked at %.0f conn/s with %d workers; %s\n", path.name, best.rate, best.workers, broke)
+	}
+	return ctx.Err()
+}
+
+// c10kTimeout is how long a C10K run of duration per level may take: each
+// level can overrun by a dial timeout as its last dials finish.
+func c10kTimeout(duration time.Duration) time.Duration {
+	return time.Duration(2*len(c10kLevels)) * (duration + c10kDialTimeout)
+}
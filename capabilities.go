@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"strings"
+)
+
+// The capabilities the harness probes for, by the name they are reported
+// and gated under.
+const (
+	capTimeWaitReuse     = "TIME-WAIT reuse"
+	capTimeWaitTimeout   = "TIME-WAIT timeout"
+	capDelay             = "TCP delay"
+	capCongestionControl = "congestion control"
+	capReceiveBuffer     = "receive buffer sizes"
+	capSendBuffer        = "send buffer sizes"
+	capSACK              = "SACK"
+	capModerateReceive   = "receive buffer moderation"
+	capSynCookies        = "SYN cookies"
+	capMinRTO            = "minimum RTO"
+	capDefaultTTL        = "IPv6 default TTL"
+)
+
+// tcpOption is a TCP protocol option that probes set back to the value they
+// read.
+type tcpOption interface {
+	tcpip.GettableTransportProtocolOption
+	tcpip.SettableTransportProtocolOption
+}
+
+// probes are the options behind each capability. Each reads its option's
+// value and writes the same value back, which a gvisor that doesn't know
+// the option refuses without anything changing.
+var probes = []struct {
+	name  string
+	probe func(s *stack.Stack) tcpip.Error
+}{
+	{capTimeWaitReuse, probeTCP(new(tcpip.TCPTimeWaitReuseOption))},
+	{capTimeWaitTimeout, probeTCP(new(tcpip.TCPTimeWaitTimeoutOption))},
+	{capDelay, probeTCP(new(tcpip.TCPDelayEnabled))},
+	{capCongestionControl, probeTCP(new(tcpip.CongestionControlOption))},
+	{capReceiveBuffer, probeTCP(new(tcpip.TCPReceiveBufferSizeRangeOption))},
+	{capSendBuffer, probeTCP(new(tcpip.TCPSendBufferSizeRangeOption))},
+	{capSACK, probeTCP(new(tcpip.TCPSACKEnabled))},
+	{capModerateReceive, probeTCP(new(tcpip.TCPModerateReceiveBufferOption))},
+	{capSynCookies, probeTCP(new(tcpip.TCPAlwaysUseSynCookies))},
+	{capMinRTO, probeTCP(new(tcpip.TCPMinRTOOption))},
+	{capDefaultTTL, func(s *stack.Stack) tcpip.Error {
+		var opt tcpip.DefaultTTLOption
+		if tcpErr := s.NetworkProtocolOption(ipv6.ProtocolNumber, &opt); tcpErr != nil {
+			return tcpErr
+		}
+		return s.SetNetworkProtocolOption(ipv6.ProtocolNumber, &opt)
+	}},
+}
+
+func probeTCP(opt tcpOption) func(s *stack.Stack) tcpip.Error {
+	return func(s *stack.Stack) tcpip.Error {
+		if tcpErr := s.TransportProtocolOption(tcp.ProtocolNumber, opt); tcpErr != nil {
+			return tcpErr
+		}
+		return s.SetTransportProtocolOption(tcp.ProtocolNumber, opt)
+	}
+}
+
+// capabilities records which of the probed options the linked gvisor
+// supports, and why those it doesn't were refused.
+type capabilities struct {
+	unsupported map[string]tcpip.Error
+	// congestionControls are the algorithms netstack says it has.
+	congestionControls []string
+}
+
+// probeCapabilities probes a stack built with opts' protocols, and none of
+// its tuning, for each capability.
+func probeCapabilities(opts stackOptions) (*capabilities, error) {
+	s, err := newStack(stackOptions{
+		networkProtocols:   opts.networkProtocols,
+		transportProtocols: opts.transportProtocols,
+		seed:               opts.seed,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	caps := &capabilities{unsupported: make(map[string]tcpip.Error)}
+	for _, p := range probes {
+		if tcpErr := p.probe(s); tcpErr != nil {
+			caps.unsupported[p.name] = tcpErr
+		}
+	}
+	var avail tcpip.TCPAvailableCongestionControlOption
+	if tcpErr := s.TransportProtocolOption(tcp.ProtocolNumber, &avail); tcpErr == nil {
+		caps.congestionControls = strings.Fields(string(avail))
+	}
+	return caps, nil
+}
+
+// supports reports whether the capability name is available.
+func (c *capabilities) supports(name string) bool {
+	_, refused := c.unsupported[name]
+	return !refused
+}
+
+// require reports whether the capability what needs is available, saying
+// that what is skipped if it isn't.
+func (c *capabilities) require(what, name string) bool {
+	if c.supports(name) {
+		return true
+	}
+	fmt.Printf("skipping %s: this gvisor doesn't support %s (%s)\n", what, name, c.unsupported[name])
+	return false
+}
+
+func (c *capabilities) String() string {
+	var supported, unsupported []string
+	for _, p := range probes {
+		if c.supports(p.name) {
+			supported = append(supported, p.name)
+		} else {
+			unsupported = append(unsupported, p.name)
+		}
+	}
+	s := fmt.Sprintf("supported %s", strings.Join(supported, ", "))
+	if len(unsupported) > 0 {
+		s += fmt.Sprintf("; unsupported %s", strings.Join(unsupported, ", "))
+	}
+	if len(c.congestionControls) > 0 {
+		s += fmt.Sprintf("; congestion controls %s", strings.Join(c.congestionControls, ", "))
+	}
+	return s
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"testing"
+)
+
+func TestCapabilities(t *testing.T) {
+	if err := checkCapabilities(testOptions()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkCapabilities probes a stack without TCP, which must refuse every TCP
+// option, as a gvisor without them would, and checks that the modes needing
+// them are skipped rather than run.
+func checkCapabilities(opts stackOptions) error {
+	opts.transportProtocols = []stack.TransportProtocolFactory{udp.NewProtocol}
+	caps, err := probeCapabilities(opts)
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{capTimeWaitReuse, capDelay, capCongestionControl, capSACK} {
+		if caps.supports(name) {
+			return fmt.Errorf("a stack without TCP claims to support %s", name)
+		}
+	}
+	if !caps.supports(capDefaultTTL) {
+		return fmt.Errorf("a stack without TCP doesn't support %s: %s", capDefaultTTL, caps.unsupported[capDefaultTTL])
+	}
+	if caps.require("the capability check's TCP mode", capDelay) {
+		return fmt.Errorf("a TCP mode was not skipped without TCP")
+	}
+	fmt.Printf("capabilities without TCP: %s\n", caps)
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// capture says what clients do with the data they receive, besides
+// verifying it: write it to one file per connection in dir, or throw it
+// away if dir is "discard". With verify off, the data is only captured and
+// every connection that reads to EOF counts as a success. With sample over
+// one, only one connection in sample is verified, and the rest are treated as
+// though verify were off.
+type capture struct {
+	dir    string
+	verify bool
+	sample int
+}
+
+type captureKey struct{}
+
+func withCapture(ctx context.Context, c *capture) context.Context {
+	return context.WithValue(ctx, captureKey{}, c)
+}
+
+// captureFrom returns the capture attached to ctx, or nil if received data
+// is only verified.
+func captureFrom(ctx context.Context) *capture {
+	c, _ := ctx.Value(captureKey{}).(*capture)
+	return c
+}
+
+// path returns the file connection id's data is captured in.
+func (c *capture) path(id int64) string {
+	return filepath.Join(c.dir, fmt.Sprintf("conn-%d.bin", id))
+}
+
+// captureConn returns where connection id should receive its data into:
+// verify, which checks it, and the connection's capture file if the run is
+// capturing. The returned bool reports whether the data can be checked,
+// which it can't with verification off. done must be called once the data
+// has been received.
+func captureConn(ctx context.Context, id int64, verify io.Writer) (w io.Writer, verifying bool, done func() error, err error) {
+	c := captureFrom(ctx)
+	if c == nil {
+		return verify, true, func() error { return nil }, nil
+	}
+	var f io.WriteCloser = nopWriteCloser{io.Discard}
+	if c.dir != "discard" {
+		f, err = os.Create(c.path(id))
+		if err != nil {
+			return nil, false, nil, err
+		}
+	}
+	if !c.verify || c.sample > 1 && id%int64(c.sample) != 0 {
+		return f, false, f.Close, nil
+	}
+	return io.MultiWriter(verify, f), true, f.Close, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// chunkedServer is payloadServer writing the payload chunk bytes at a time
+// with a pause of delay between writes, like a slow producer, so that each
+// client sees it arrive over many reads rather than a few.
+func chunkedServer(t Transport, port uint16, payload []byte, chunk int, delay time.Duration) {
+	li, err := serverListen(t, port)
+	if err != nil {
+		fmt.Printf("Listen error: %s\n", err)
+		return
+	}
+	for {
+		sc, err := li.Accept()
+		if err != nil {
+			logAcceptError(err)
+			return
+		}
+		go serveChunks(sc, payload, chunk, delay)
+	}
+}
+
+// serveChunks is serveConn writing payload in chunks.
+func serveChunks(sc net.Conn, payload []byte, chunk int, delay time.Duration) {
+	for off := 0; off < len(payload); off += chunk {
+		if off > 0 && delay > 0 {
+			time.Sleep(delay)
+		}
+		end := off + chunk
+		if end > len(payload) {
+			end = len(payload)
+		}
+		if _, err := sc.Write(payload[off:end]); err != nil {
+			fmt.Printf("write error: %s\n", err)
+			break
+		}
+	}
+	if err := sc.Close(); err != nil {
+		fmt.Printf("close error: %s\n", err)
+	}
+}
+
+// chunkedPayload is how much runChunked sends each connection.
+const chunkedPayload = 256 * 1024
+
+// chunkedTimeout is how long a runChunked of chunk and delay takes at least:
+// each of its two paths has its servers write their chunks delay apart, its
+// connections at the same time.
+func chunkedTimeout(chunk int, delay time.Duration) time.Duration {
+	nChunks := (chunkedPayload + chunk - 1) / chunk
+	return 2 * time.Duration(nChunks) * delay
+}
+
+// runChunked sends a payload written chunk bytes at a time, delay apart, to
+// nConns connections each of native TCP and gonet, failing unless every
+// client reassembled the chunks into the payload.
+func runChunked(ctx context.Context, nConns int, chunk int, delay time.Duration, opts stackOptions) error {
+	payload := randomPayload(newLockedRand(opts.seed), chunkedPayload)
+	nChunks := (len(payload) + chunk - 1) / chunk
+	native := &netTransport{addr: net.ParseIP("::1")}
+	server, client, err := setupGonetPair(opts)
+	if err != nil {
+		return err
+	}
+	paths := []struct {
+		name   string
+		server Transport
+		client Transport
+		port   uint16
+	}{
+		{"net", native, native, 9806},
+		{"gonet", server, client, 1234},
+	}
+	failed := false
+	for _, path := range paths {
+		go chunkedServer(path.server, path.port, payload, chunk, delay)
+		time.Sleep(time.Millisecond)
+		received, errs := collectConns(ctx, path.client, path.port, nConns, payload)
+		intact := 0
+		for _, b := range received {
+			if bytes.Equal(b, payload) {
+				intact++
+			}
+		}
+		for _, err := range errs {
+			fmt.Printf("%s: %s\n", path.name, err)
+		}
+		fmt.Printf("%s: %d/%d connections reassembled %d chunks of %d bytes intact\n",
+			path.name, intact, nConns, nChunks, chunk)
+		if intact != nConns {
+			failed = true
+		}
+	}
+	if failed {
+		return fmt.Errorf("not every connection reassembled the chunks intact")
+	}
+	return ctx.Err()
+}
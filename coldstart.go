@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"time"
+)
+
+// runColdStart times setupStack, which creates a stack with its protocols
+// and tuning and gives it a socketpair NIC, an address and its routes, for
+// nStacks fresh stacks one after another, and reports the creation times'
+// percentiles, the first stack's apart as the only one made with nothing
+// warmed up by the last, and the heap allocations each took. This is what a
+// sandbox creating a netstack per task pays before it moves any data, which
+// the transfer benchmarks leave out. The socketpair is made before the clock
+// starts and each stack is torn down after it stops, so neither is counted;
+// fdbased keeps a stop eventfd per stack that nothing closes, so each stack
+// still costs a descriptor for the rest of the process.
+func runColdStart(ctx context.Context, nStacks int, opts stackOptions) error {
+	addr, _ := pairAddresses(opts)
+	var times []time.Duration
+	var first time.Duration
+	var total allocCount
+	for i := 0; i < nStacks; i++ {
+		fds1, fds2, err := socketpairs(opts.sockType, 1)
+		if err != nil {
+			return err
+		}
+		runtime.GC()
+		before := readAllocs()
+		start := time.Now()
+		s, err := setupStack(fds1, addr, opts)
+		elapsed := time.Since(start)
+		allocs := readAllocs().sub(before)
+		if err != nil {
+			teardownStacks(append(fds1, fds2...))
+			return err
+		}
+		teardownStacks(append(fds1, fds2...), s)
+		if i == 0 {
+			first = elapsed
+		}
+		times = append(times, elapsed)
+		total.objects += allocs.objects
+		total.bytes += allocs.bytes
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	fmt.Printf("setupStack: %s, the first %s\n", formatPercentiles(times), first)
+	fmt.Printf("setupStack allocations: %.0f objects and %.0f bytes per stack\n",
+		float64(total.objects)/float64(nStacks), float64(total.bytes)/float64(nStacks))
+	return nil
+}
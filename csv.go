@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// csvColumns is the schema of the per-connection CSV output, one row per
+// client connection:
+//
+//	run          name of the run the connection belonged to
+//	id           connection ID, as in the conn lines of the output
+//	direction    local and remote address, "local>remote", or ">port N"
+//	             for a connection that failed to dial
+//	dial_ns      time the dial took, empty if it failed
+//	ttfb_ns      time from the start of the dial to the first byte, empty if
+//	             none arrived
+//	transfer_ns  time from the start of the dial to EOF, empty if it wasn't
+//	             reached
+//	bytes        bytes received
+//	status       ok, bad data, or the failure category, e.g. timeout
+//	tag          the connection's tag, as withTag set it, if any
+var csvColumns = []string{"run", "id", "direction", "dial_ns", "ttfb_ns", "transfer_ns", "bytes", "status", "tag"}
+
+// connRecord is one client connection's row of CSV output, filled in as the
+// connection goes and added to its run's result when it finishes.
+type connRecord struct {
+	r         *RunResult
+	once      sync.Once
+	id        int64
+	direction string
+	dial      time.Duration
+	ttfb      time.Duration
+	transfer  time.Duration
+	bytes     int64
+	status    string
+	tag       string
+}
+
+type connRecordKey struct{}
+
+// withConnRecord returns ctx carrying a record for connection id, if the
+// run it belongs to records connections or the connection is tagged, along
+// with the record, which is otherwise nil.
+func withConnRecord(ctx context.Context, id int64) (context.Context, *connRecord) {
+	r := resultFrom(ctx)
+	tag := tagFrom(ctx)
+	if r == nil || !r.recordConns && tag == "" {
+		return ctx, nil
+	}
+	rec := &connRecord{r: r, id: id, tag: tag}
+	return context.WithValue(ctx, connRecordKey{}, rec), rec
+}
+
+// connRecordFrom returns the record ctx carries, or nil.
+func connRecordFrom(ctx context.Context) *connRecord {
+	rec, _ := ctx.Value(connRecordKey{}).(*connRecord)
+	return rec
+}
+
+// dialed records the outcome of dialing port: the connection's addresses if
+// it connected, and how long that took. c is nil if the dial failed.
+func (rec *connRecord) dialed(c net.Conn, port uint16, d time.Duration) {
+	if rec == nil {
+		return
+	}
+	if c == nil {
+		rec.direction = fmt.Sprintf(">port %d", port)
+		return
+	}
+	rec.direction = fmt.Sprintf("%s>%s", c.LocalAddr(), c.RemoteAddr())
+	rec.dial = d
+}
+
+// transferred records what receiveStream read.
+func (rec *connRecord) transferred(ttfb, transfer time.Duration, n int64) {
+	if rec == nil {
+		return
+	}
+	rec.ttfb, rec.transfer, rec.bytes = ttfb, transfer, n
+}
+
+// finish records the connection's outcome, as addResult takes it, and adds
+// the record to the run's result. Only the first outcome counts.
+func (rec *connRecord) finish(err error, intact bool) {
+	if rec == nil {
+		return
+	}
+	rec.once.Do(func() {
+		switch {
+		case err != nil:
+			rec.status = classifyError(err).String()
+		case intact:
+			rec.status = "ok"
+		default:
+			rec.status = "bad data"
+		}
+		rec.r.mu.Lock()
+		defer rec.r.mu.Unlock()
+		rec.r.conns = append(rec.r.conns, rec)
+	})
+}
+
+// writeCSV writes the connections the results recorded as CSV, with a
+// header row of csvColumns.
+func writeCSV(w io.Writer, results []*RunResult) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvColumns); err != nil {
+		return err
+	}
+	duration := func(d time.Duration) string {
+		if d == 0 {
+			return ""
+		}
+		return strconv.FormatInt(d.Nanoseconds(), 10)
+	}
+	for _, r := range results {
+		r.mu.Lock()
+		conns := append([]*connRecord(nil), r.conns...)
+		r.mu.Unlock()
+		for _, rec := range conns {
+			if err := cw.Write([]string{r.Name, strconv.FormatInt(rec.id, 10), rec.direction, duration(rec.dial),
+				duration(rec.ttfb), duration(rec.transfer), strconv.FormatInt(rec.bytes, 10), rec.status, rec.tag}); err != nil {
+				return err
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeCSVFile is writeCSV to path, or to stdout for "-".
+func writeCSVFile(path string, results []*RunResult) error {
+	if path == "-" {
+		return writeCSV(os.Stdout, results)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := writeCSV(f, results); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"time"
+)
+
+// debugShutdownTimeout is how long stopping the debug server waits for
+// requests in progress, a CPU profile say, before closing their connections.
+const debugShutdownTimeout = 5 * time.Second
+
+func init() {
+	expvar.Publish("run", expvar.Func(func() interface{} {
+		if r := activeResult(); r != nil {
+			return r.Name
+		}
+		return nil
+	}))
+}
+
+// startDebugServer serves pprof under /debug/pprof/ and expvar, including the
+// run in progress, under /debug/vars on addr. It returns the address it
+// listens on, which tells the port when addr asks for any, and a function
+// that shuts the server down, waiting up to debugShutdownTimeout for
+// requests in progress, and returns once the port is released. Handlers are
+// on a mux of the server's own rather than http.DefaultServeMux, so that
+// nothing else registered there is exposed and a stopped server leaves
+// nothing behind.
+func startDebugServer(addr string) (net.Addr, func() error, error) {
+	li, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	srv := &http.Server{Handler: mux}
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Serve(li)
+	}()
+	stop := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), debugShutdownTimeout)
+		defer cancel()
+		err := srv.Shutdown(ctx)
+		if err != nil {
+			_ = srv.Close()
+		}
+		if serveErr := <-done; !errors.Is(serveErr, http.ErrServerClosed) && err == nil {
+			err = serveErr
+		}
+		return err
+	}
+	return li.Addr(), stop, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDebugServer(t *testing.T) {
+	if err := checkDebugServer(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkDebugServer starts the debug server on an ephemeral port, fetches its
+// expvars, stops it, and checks that the port was released: nothing answers
+// on it any more and it can be listened on again.
+func checkDebugServer() error {
+	addr, stop, err := startDebugServer("[::1]:0")
+	if err != nil {
+		return fmt.Errorf("debug server: %w", err)
+	}
+	url := fmt.Sprintf("http://%s/debug/vars", addr)
+	client := &http.Client{Timeout: time.Second, Transport: &http.Transport{DisableKeepAlives: true}}
+	resp, err := client.Get(url)
+	if err != nil {
+		_ = stop()
+		return fmt.Errorf("debug server: %w", err)
+	}
+	_, err = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if err == nil && resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	if err != nil {
+		_ = stop()
+		return fmt.Errorf("debug server: %w", err)
+	}
+	if err := stop(); err != nil {
+		return fmt.Errorf("debug server shutdown: %w", err)
+	}
+	if c, err := net.DialTimeout("tcp", addr.String(), time.Second); err == nil {
+		c.Close()
+		return fmt.Errorf("debug server on %s still accepts connections after shutdown", addr)
+	}
+	li, err := net.Listen("tcp", addr.String())
+	if err != nil {
+		return fmt.Errorf("debug server port not released after shutdown: %w", err)
+	}
+	li.Close()
+	fmt.Printf("debug server on %s served and shut down cleanly\n", addr)
+	return nil
+}
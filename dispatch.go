@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// runDispatch transfers the same payload over nConns gonet connections once
+// per fdbased dispatch mode and reports the throughput, TTFB and CPU time of
+// each.
+func runDispatch(ctx context.Context, nConns int, opts stackOptions) error {
+	payload := randomPayload(rand.New(rand.NewSource(opts.seed)), 1024*1024)
+	for _, name := range []string{"readv", "recvmmsg"} {
+		dopts := opts
+		dopts.dispatchMode = dispatchModes[name]
+		server, client, err := setupGonetPair(dopts)
+		if err != nil {
+			return err
+		}
+		go payloadServer(server, 1234, payload)
+		time.Sleep(time.Millisecond)
+		r := &RunResult{Name: name}
+		cpu := cpuTime()
+		start := time.Now()
+		wg := &sync.WaitGroup{}
+		wg.Add(nConns)
+		go runPayloadConns(withResult(ctx, r), client, 1234, payload, nConns, wg)
+		wg.Wait()
+		elapsed := time.Since(start)
+		cpu = cpuTime() - cpu
+		fmt.Printf("%s: %d bytes in %s (%.1f MB/s), CPU %s, TTFB %s\n",
+			name, r.Bytes, elapsed, float64(r.Bytes)/elapsed.Seconds()/1e6, cpu, formatPercentiles(r.TTFB))
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	return nil
+}
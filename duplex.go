@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// duplexChunk is the size of the writes the duplex clients make, and of the
+// echoes whose round trips they time.
+const duplexChunk = 16 * 1024
+
+// closeWriter is implemented by both net.TCPConn and gonet.TCPConn.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// halfDuplex sends payload over c to an echoServer a chunk at a time,
+// waiting for each chunk to come back before sending the next, as echo
+// does. It returns the round trip time of each chunk.
+func halfDuplex(ctx context.Context, c net.Conn, payload []byte) ([]time.Duration, error) {
+	stop := bindDeadline(ctx, c)
+	defer stop()
+	var rtts []time.Duration
+	b := make([]byte, duplexChunk)
+	for off := 0; off < len(payload); off += duplexChunk {
+		end := off + duplexChunk
+		if end > len(payload) {
+			end = len(payload)
+		}
+		chunk := payload[off:end]
+		start := time.Now()
+		if _, err := c.Write(chunk); err != nil {
+			return rtts, fmt.Errorf("write TCP error at offset %d: %w", off, err)
+		}
+		if _, err := io.ReadFull(c, b[:len(chunk)]); err != nil {
+			return rtts, fmt.Errorf("read TCP error at offset %d: %w", off, err)
+		}
+		rtts = append(rtts, time.Since(start))
+		if !bytes.Equal(b[:len(chunk)], chunk) {
+			return rtts, fmt.Errorf("incorrect data echoed at offset %d", off)
+		}
+	}
+	return rtts, finishEcho(c)
+}
+
+// fullDuplex sends payload over c to an echoServer from one goroutine while
+// another reads the echo back, so that the connection carries data both
+// ways at once. Each chunk's round trip is timed from when the writer
+// started on it to when the reader had all of it back, which includes any
+// time the write spent blocked on a full window. The writer half-closes the
+// connection once it is done, which ends the echo; if the reader fails
+// first it closes the connection, to unblock the writer, and both are gone
+// by the time fullDuplex returns.
+func fullDuplex(ctx context.Context, c net.Conn, payload []byte) ([]time.Duration, error) {
+	stop := bindDeadline(ctx, c)
+	defer stop()
+	nChunks := (len(payload) + duplexChunk - 1) / duplexChunk
+	started := make(chan time.Time, nChunks)
+	written := make(chan error, 1)
+	go func() {
+		defer close(started)
+		for off := 0; off < len(payload); off += duplexChunk {
+			end := off + duplexChunk
+			if end > len(payload) {
+				end = len(payload)
+			}
+			started <- time.Now()
+			if _, err := c.Write(payload[off:end]); err != nil {
+				written <- fmt.Errorf("write TCP error at offset %d: %w", off, err)
+				return
+			}
+		}
+		written <- nil
+	}()
+	rtts, err := readEchoes(c, payload, started)
+	if err != nil {
+		_ = c.Close()
+		<-written
+		return rtts, err
+	}
+	if err := <-written; err != nil {
+		return rtts, err
+	}
+	return rtts, finishEcho(c)
+}
+
+// readEchoes is fullDuplex's reader: it reads payload back from c a chunk
+// at a time, timing each from the time started gives for it.
+func readEchoes(c net.Conn, payload []byte, started <-chan time.Time) ([]time.Duration, error) {
+	var rtts []time.Duration
+	b := make([]byte, duplexChunk)
+	for off := 0; off < len(payload); off += duplexChunk {
+		end := off + duplexChunk
+		if end > len(payload) {
+			end = len(payload)
+		}
+		chunk := payload[off:end]
+		if _, err := io.ReadFull(c, b[:len(chunk)]); err != nil {
+			return rtts, fmt.Errorf("read TCP error at offset %d: %w", off, err)
+		}
+		if start, ok := <-started; ok {
+			rtts = append(rtts, time.Since(start))
+		}
+		if !bytes.Equal(b[:len(chunk)], chunk) {
+			return rtts, fmt.Errorf("incorrect data echoed at offset %d", off)
+		}
+	}
+	return rtts, nil
+}
+
+// finishEcho half-closes c, once everything sent has come back, and checks
+// that the echoServer then closes its end without sending anything more.
+func finishEcho(c net.Conn) error {
+	if cw, ok := c.(closeWriter); ok {
+		if err := cw.CloseWrite(); err != nil {
+			return fmt.Errorf("close write TCP error: %w", err)
+		}
+	}
+	n, err := io.Copy(io.Discard, c)
+	if err != nil {
+		return fmt.Errorf("read TCP error after the echo: %w", err)
+	}
+	if n != 0 {
+		return fmt.Errorf("%d bytes echoed past the end of the payload", n)
+	}
+	return nil
+}
+
+// runDuplex has nConns clients each echo a 1MiB payload off an
+// echoServer, over native TCP and gonet, first half-duplex, waiting for
+// each chunk before sending the next, and then full-duplex, with a reader
+// and a writer goroutine per connection, so that every connection has data
+// in flight both ways at once. It reports the throughput each way and the
+// round trip times of the chunks for each.
+func runDuplex(ctx context.Context, nConns int, opts stackOptions) error {
+	payload := randomPayload(newLockedRand(opts.seed), 1024*1024)
+	server, client, err := setupGonetPair(opts)
+	if err != nil {
+		return err
+	}
+	// The clients all dial at once, and a full accept queue loses
+	// connections to the bug runGonet shows, which is not what this checks.
+	server.backlog = 64
+	paths := []struct {
+		name   string
+		server Transport
+		client Transport
+		port   uint16
+	}{
+		{"net", &netTransport{addr: net.ParseIP("::1")}, &netTransport{addr: net.ParseIP("::1")}, 9803},
+		{"gonet", server, client, 1234},
+	}
+	models := []struct {
+		name string
+		echo func(ctx context.Context, c net.Conn, payload []byte) ([]time.Duration, error)
+	}{
+		{"half-duplex", halfDuplex},
+		{"full-duplex", fullDuplex},
+	}
+	failed := false
+	for _, path := range paths {
+		go echoServer(path.server, path.port)
+		time.Sleep(time.Millisecond)
+		for _, model := range models {
+			var mu sync.Mutex
+			var rtts []time.Duration
+			var intact int64
+			start := time.Now()
+			wg := &sync.WaitGroup{}
+			wg.Add(nConns)
+			for i := 0; i < nConns; i++ {
+				go func() {
+					defer wg.Done()
+					id := newConnID()
+					c, err := path.client.Dial(ctx, path.port)
+					if err != nil {
+						resultFrom(ctx).addResult(err, false)
+						logConn(id, "dial TCP error: %s%s", err, dialErrorHint(err))
+						return
+					}
+					defer c.Close()
+					r, err := model.echo(ctx, c, payload)
+					mu.Lock()
+					rtts = append(rtts, r...)
+					mu.Unlock()
+					resultFrom(ctx).addResult(err, err == nil)
+					if err != nil {
+						logConn(id, "%s: %s", model.name, err)
+						return
+					}
+					atomic.AddInt64(&intact, 1)
+				}()
+			}
+			wg.Wait()
+			elapsed := time.Since(start)
+			fmt.Printf("%s %s: %d/%d connections intact, %.1f MB/s each way, chunk round trip %s\n",
+				path.name, model.name, intact, nConns, float64(intact)*float64(len(payload))/elapsed.Seconds()/1e6,
+				formatPercentiles(rtts))
+			if intact != int64(nConns) {
+				failed = true
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+		}
+	}
+	if failed {
+		return fmt.Errorf("not every echo came back intact")
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+)
+
+// environment describes what a set of runs was measured on, so that results
+// from different machines, Go versions or configurations aren't mistaken for
+// comparable.
+type environment struct {
+	GoVersion  string `json:"go_version"`
+	OS         string `json:"os"`
+	Arch       string `json:"arch"`
+	NumCPU     int    `json:"num_cpu"`
+	GOMAXPROCS int    `json:"gomaxprocs"`
+	Gvisor     string `json:"gvisor_version"`
+	// Options holds the flags given on the command line, which together
+	// with the version defaults determine the stack configuration.
+	Options map[string]string `json:"options"`
+	// Stacks describes the tuning of the two stacks of a gonet pair, which
+	// differ if -stack2 is given.
+	Stacks []string `json:"stacks,omitempty"`
+}
+
+// currentEnvironment returns the environment of this process. It must be
+// called after flag.Parse.
+func currentEnvironment() *environment {
+	env := &environment{
+		GoVersion:  runtime.Version(),
+		OS:         runtime.GOOS,
+		Arch:       runtime.GOARCH,
+		NumCPU:     runtime.NumCPU(),
+		GOMAXPROCS: runtime.GOMAXPROCS(0),
+		Gvisor:     "unknown",
+		Options:    make(map[string]string),
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range info.Deps {
+			if dep.Path == "gvisor.dev/gvisor" {
+				env.Gvisor = dep.Version
+				if dep.Replace != nil {
+					env.Gvisor += " => " + dep.Replace.Path + " " + dep.Replace.Version
+				}
+			}
+		}
+	}
+	flag.Visit(func(f *flag.Flag) {
+		env.Options[f.Name] = f.Value.String()
+	})
+	return env
+}
+
+func (e *environment) String() string {
+	names := make([]string, 0, len(e.Options))
+	for name := range e.Options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	opts := make([]string, len(names))
+	for i, name := range names {
+		opts[i] = fmt.Sprintf("-%s=%s", name, e.Options[name])
+	}
+	return fmt.Sprintf("%s %s/%s, %d CPUs, GOMAXPROCS %d, gvisor %s, options: %s",
+		e.GoVersion, e.OS, e.Arch, e.NumCPU, e.GOMAXPROCS, e.Gvisor, strings.Join(opts, " "))
+}
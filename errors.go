@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+var (
+	// errStackSetup is matched by every error from newStack and setupStack.
+	errStackSetup = errors.New("stack setup failed")
+	// errCreateNIC is matched by the errors from creating a stack's link
+	// endpoint or NIC, as well as by errStackSetup.
+	errCreateNIC = errors.New("NIC creation failed")
+	// errRoutingLoop is matched by the error from a gonet dial abandoned
+	// because its packets were going round in a loop.
+	errRoutingLoop = errors.New("routing loop")
+	// errPanic is matched by the error a connection's goroutine is recorded
+	// as failing with when it panics; see recoverConn.
+	errPanic = errors.New("panic")
+)
+
+// setupError is an error setting up a stack: op is the step that failed,
+// err why, and kind which of the sentinel errors above it matches.
+type setupError struct {
+	kind error
+	op   string
+	err  error
+}
+
+func (e *setupError) Error() string {
+	return e.op + ": " + e.err.Error()
+}
+
+func (e *setupError) Unwrap() error {
+	return e.err
+}
+
+func (e *setupError) Is(target error) bool {
+	return target == errStackSetup || target == e.kind
+}
+
+// stackErr returns err as a failure of the stack setup step op.
+func stackErr(op string, err error) error {
+	return &setupError{kind: errStackSetup, op: op, err: err}
+}
+
+// nicErr returns err as a failure of the NIC creation step op.
+func nicErr(op string, err error) error {
+	return &setupError{kind: errCreateNIC, op: op, err: err}
+}
+
+// tcpipError adapts a tcpip.Error, which is not a Go error, so that it can be
+// wrapped with %w. unwrapTCPIP gets it back out.
+type tcpipError struct {
+	err tcpip.Error
+}
+
+// wrapTCPIP returns tcpErr as an error.
+func wrapTCPIP(tcpErr tcpip.Error) error {
+	return &tcpipError{err: tcpErr}
+}
+
+func (e *tcpipError) Error() string {
+	return e.err.String()
+}
+
+// unwrapTCPIP returns the tcpip.Error in err's chain, or nil if there is
+// none, so that callers can check for a specific one, e.g.
+//
+//	if _, ok := unwrapTCPIP(err).(*tcpip.ErrUnknownNICID); ok { ... }
+func unwrapTCPIP(err error) tcpip.Error {
+	var e *tcpipError
+	if !errors.As(err, &e) {
+		return nil
+	}
+	return e.err
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"time"
+)
+
+// extHdrRouter is spliced into a socketpair like pmtuRouter, inserting the
+// 8-byte extension header hdr after the fixed header of every IPv6 packet
+// going from the first end to the second. Netstack never sends extension
+// headers itself, so this is the only way to get them in front of it.
+type extHdrRouter struct {
+	hdr []byte
+}
+
+// relay is the router's packetRelay, sending packets going from the first
+// end to the second on with the header inserted in place of the original.
+func (r *extHdrRouter) relay(dir int, pkt []byte, send func(int, []byte) error) bool {
+	if dir != 0 || pkt == nil {
+		return true
+	}
+	_ = send(dir, r.insert(pkt))
+	return false
+}
+
+// insert returns pkt with the router's extension header chained in front
+// of whatever followed the fixed header. The upper layer length, and so its
+// checksum, is unchanged.
+func (r *extHdrRouter) insert(pkt []byte) []byte {
+	if len(pkt) < header.IPv6MinimumSize || header.IPVersion(pkt) != header.IPv6Version {
+		return pkt
+	}
+	ip := header.IPv6(pkt)
+	out := make([]byte, 0, len(pkt)+len(r.hdr))
+	out = append(out, pkt[:header.IPv6MinimumSize]...)
+	out = append(out, r.hdr...)
+	out = append(out, pkt[header.IPv6MinimumSize:]...)
+	out[header.IPv6MinimumSize] = ip.NextHeader()
+	out[6] = r.hdr[0]
+	binary.BigEndian.PutUint16(out[4:], ip.PayloadLength()+uint16(len(r.hdr)))
+	return out
+}
+
+// extHdrCases are the extension headers runExtHeaders sends, with the first
+// byte holding the extension header's own protocol number until insert
+// chains it in, and whether RFC 8200 says the receiver must accept them.
+var extHdrCases = []struct {
+	name   string
+	hdr    []byte
+	accept bool
+}{
+	// Hop-by-Hop Options with a single PadN option, which must be skipped.
+	{"hop-by-hop", []byte{byte(header.IPv6HopByHopOptionsExtHdrIdentifier), 0, 1, 4, 0, 0, 0, 0}, true},
+	// A Routing header of an unknown type with no segments left, which must
+	// be ignored.
+	{"routing, 0 segments left", []byte{byte(header.IPv6RoutingExtHdrIdentifier), 0, 253, 0, 0, 0, 0, 0}, true},
+	// The same with a segment left, which must be discarded with a
+	// Parameter Problem.
+	{"routing, 1 segment left", []byte{byte(header.IPv6RoutingExtHdrIdentifier), 0, 253, 1, 0, 0, 0, 0}, false},
+}
+
+// runExtHeaders sends the test message to nConns gonet connections over a
+// link that adds each of extHdrCases to the client's packets in turn, and
+// checks that the server accepted or rejected them as it should.
+func runExtHeaders(ctx context.Context, nConns int, opts stackOptions) error {
+	addr1, addr2 := pairAddresses(opts)
+	failed := false
+	for _, tc := range extHdrCases {
+		router := &extHdrRouter{hdr: tc.hdr}
+		fd1, fd2, err := spliceSocketpairs(opts.sockType, router.relay)
+		if err != nil {
+			return err
+		}
+		// The client's packets grow by the header, so they must start out
+		// that much smaller to still fit the server's link.
+		copts := opts
+		if copts.mtu == 0 {
+			copts.mtu = 1500
+		}
+		copts.mtu -= uint32(len(tc.hdr))
+		client, err := setupStack([]int{fd1}, addr2, copts)
+		if err != nil {
+			return err
+		}
+		server, err := setupStack([]int{fd2}, addr1, opts)
+		if err != nil {
+			return err
+		}
+		serverT, clientT := gonetPair(server, addr1, client, addr2)
+		go testServer(serverT, 1234)
+		time.Sleep(time.Millisecond)
+		// Rejected packets are dropped without a word to TCP, so the dials
+		// only time out, and are left out of the run's result.
+		dctx, cancel := ctx, context.CancelFunc(func() {})
+		if !tc.accept {
+			dctx, cancel = context.WithTimeout(withResult(ctx, nil), 500*time.Millisecond)
+		}
+		received, _ := collectConns(dctx, clientT, 1234, nConns, []byte(testMsg))
+		cancel()
+		intact := 0
+		for _, b := range received {
+			if bytes.Equal(b, []byte(testMsg)) {
+				intact++
+			}
+		}
+		sst, cst := server.Stats(), client.Stats()
+		fmt.Printf("%s: %d/%d connections intact; server received %d packets, %d malformed, sent %d Parameter Problem; client received %d Parameter Problem\n",
+			tc.name, intact, nConns, sst.IP.PacketsReceived.Value(), sst.IP.MalformedPacketsReceived.Value(),
+			sst.ICMP.V6.PacketsSent.ParamProblem.Value(), cst.ICMP.V6.PacketsReceived.ParamProblem.Value())
+		switch {
+		case tc.accept && intact != nConns:
+			fmt.Printf("%s: should have been accepted\n", tc.name)
+			failed = true
+		case !tc.accept && (intact != 0 || sst.ICMP.V6.PacketsSent.ParamProblem.Value() == 0):
+			fmt.Printf("%s: should have been rejected with a Parameter Problem\n", tc.name)
+			failed = true
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	if failed {
+		return fmt.Errorf("extension headers were not handled as RFC 8200 requires")
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// failureCategory classifies why a connection attempt or transfer failed.
+type failureCategory int
+
+const (
+	failTimeout failureCategory = iota
+	failRefused
+	failReset
+	failNoPort
+	failNoFD
+	failLoop
+	failPanic
+	failOther
+	numFailureCategories
+)
+
+var failureNames = [numFailureCategories]string{
+	failTimeout: "timeout",
+	failRefused: "refused",
+	failReset:   "reset",
+	failNoPort:  "no port",
+	failNoFD:    "no fd",
+	failLoop:    "loop",
+	failPanic:   "panic",
+	failOther:   "other",
+}
+
+func (c failureCategory) String() string {
+	return failureNames[c]
+}
+
+// classifyError maps err onto a failureCategory. gonet reports netstack
+// errors as plain strings, so those are matched by their tcpip.Error text
+// alongside the errno values the native path returns.
+func classifyError(err error) failureCategory {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errRoutingLoop):
+		return failLoop
+	case errors.Is(err, errPanic):
+		return failPanic
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return failTimeout
+	case errors.Is(err, syscall.ECONNREFUSED), strings.Contains(err.Error(), "connection was refused"):
+		return failRefused
+	case errors.Is(err, syscall.ECONNRESET), strings.Contains(err.Error(), "connection reset by peer"):
+		return failReset
+	case errors.Is(err, syscall.EADDRNOTAVAIL), errors.Is(err, syscall.EADDRINUSE),
+		strings.Contains(err.Error(), "no ports are available"):
+		return failNoPort
+	case errors.Is(err, syscall.EMFILE), errors.Is(err, syscall.ENFILE):
+		return failNoFD
+	}
+	return failOther
+}
+
+// failureCounts counts failures by category. It is updated atomically.
+type failureCounts [numFailureCategories]int64
+
+func (f *failureCounts) add(err error) {
+	atomic.AddInt64(&f[classifyError(err)], 1)
+}
+
+func (f *failureCounts) total() int64 {
+	var n int64
+	for i := range f {
+		n += atomic.LoadInt64(&f[i])
+	}
+	return n
+}
+
+func (f *failureCounts) String() string {
+	var parts []string
+	for i := range f {
+		if n := atomic.LoadInt64(&f[i]); n != 0 {
+			parts = append(parts, fmt.Sprintf("%s %d", failureCategory(i), n))
+		}
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	if atomic.LoadInt64(&f[failNoFD]) != 0 {
+		parts = append(parts, fdLimitHint)
+	}
+	return strings.Join(parts, ", ")
+}
+
+const fdLimitHint = "out of file descriptors; raise the limit with ulimit -n"
+
+// dialErrorHint returns a suggestion to follow a dial error with, if there
+// is one.
+func dialErrorHint(err error) string {
+	if classifyError(err) == failNoFD {
+		return " (" + fdLimitHint + ")"
+	}
+	return ""
+}
+
+// raiseFileLimit raises the soft open file limit to the hard limit, so that
+// runs with many connections don't fail for want of descriptors when more
+// are available for the asking. It returns the limit now in effect.
+func raiseFileLimit() (uint64, error) {
+	var lim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim); err != nil {
+		return 0, err
+	}
+	if lim.Cur >= lim.Max {
+		return lim.Cur, nil
+	}
+	lim.Cur = lim.Max
+	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &lim); err != nil {
+		return 0, err
+	}
+	return lim.Cur, nil
+}
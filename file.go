@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// fileServer is payloadServer streaming the contents of the file at path to
+// each connection, so that the file is never held in memory.
+func fileServer(t Transport, port uint16, path string) {
+	li, err := serverListen(t, port)
+	if err != nil {
+		fmt.Printf("Listen error: %s\n", err)
+		return
+	}
+	for {
+		sc, err := li.Accept()
+		if err != nil {
+			logAcceptError(err)
+			return
+		}
+		go serveFile(sc, path)
+	}
+}
+
+// serveFile copies the file at path to sc and closes it.
+func serveFile(sc net.Conn, path string) {
+	defer func() {
+		if err := sc.Close(); err != nil {
+			fmt.Printf("close error: %s\n", err)
+		}
+	}()
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Printf("open error: %s\n", err)
+		return
+	}
+	defer f.Close()
+	if _, err := io.Copy(sc, f); err != nil {
+		fmt.Printf("write error: %s\n", err)
+	}
+}
+
+// hashFile returns the SHA-256 digest and size of the file at path.
+func hashFile(path string) ([]byte, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return nil, 0, err
+	}
+	return h.Sum(nil), n, nil
+}
+
+// runFileConns is runPayloadConns for a fileServer, checking each
+// connection's data against the file's digest and size rather than against
+// a copy of it, and counting the intact ones in received.
+func runFileConns(ctx context.Context, t Transport, port uint16, sum []byte, size int64, nConns int, received *int64, wg *sync.WaitGroup) {
+	for i := 0; i < nConns; i++ {
+		go func() {
+			defer wg.Done()
+			id := newConnID()
+			start := time.Now()
+			c, err := t.Dial(ctx, port)
+			if err != nil {
+				resultFrom(ctx).addResult(err, false)
+				logConn(id, "dial TCP error: %s%s", err, dialErrorHint(err))
+				return
+			}
+			h := sha256.New()
+			w, verifying, done, err := captureConn(ctx, id, h)
+			if err != nil {
+				_ = c.Close()
+				resultFrom(ctx).addResult(err, false)
+				logConn(id, "capture error: %s", err)
+				return
+			}
+			n, err := receiveStream(ctx, c, start, w)
+			if cerr := done(); cerr != nil && err == nil {
+				err = fmt.Errorf("capture error: %w", cerr)
+			}
+			intact := !verifying || n == size && bytes.Equal(h.Sum(nil), sum)
+			resultFrom(ctx).addResult(err, intact)
+			if err != nil {
+				logConn(id, "%s", err)
+				return
+			}
+			if !verifying {
+				resultFrom(ctx).addUnverified()
+			}
+			if intact {
+				atomic.AddInt64(received, 1)
+			} else {
+				logConn(id, "incorrect data received: expected %d bytes with SHA-256 %x but got %d bytes with %x",
+					size, sum, n, h.Sum(nil))
+			}
+		}()
+	}
+}
+
+// runFile transfers the file at name over nConns connections each of native
+// TCP and gonet, failing unless every connection received it intact.
+func runFile(ctx context.Context, name string, nConns int, opts stackOptions) error {
+	sum, size, err := hashFile(name)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: %d bytes, SHA-256 %x\n", name, size, sum)
+	native := &netTransport{addr: net.ParseIP("::1")}
+	server, client, err := setupGonetPair(opts)
+	if err != nil {
+		return err
+	}
+	paths := []struct {
+		name   string
+		server Transport
+		client Transport
+		port   uint16
+	}{
+		{"net", native, native, 9805},
+		{"gonet", server, client, 1234},
+	}
+	failed := false
+	for _, path := range paths {
+		go fileServer(path.server, path.port, name)
+		time.Sleep(time.Millisecond)
+		var received int64
+		wg := &sync.WaitGroup{}
+		wg.Add(nConns)
+		runFileConns(ctx, path.client, path.port, sum, size, nConns, &received, wg)
+		wg.Wait()
+		fmt.Printf("%s: %d/%d connections received the file intact\n", path.name, received, nConns)
+		if received != int64(nConns) {
+			failed = true
+		}
+	}
+	if failed {
+		return fmt.Errorf("not every connection received the file intact")
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// maxFrame bounds the frame size readFrame will accept, so that a corrupt
+// header can't make it allocate without limit.
+const maxFrame = 1 << 20
+
+// closeMarker is the header of the frame a sender writes to signal it has
+// nothing more to send, while keeping the connection open. No length can be
+// that large, so no data frame is mistaken for it.
+const closeMarker = 0xffffffff
+
+// errCloseMarker is returned by readFrame on reading the close marker.
+var errCloseMarker = errors.New("close marker")
+
+// writeFrame writes b preceded by its length as a 4-byte big-endian header.
+// The header and body go out in separate writes, as a naive framing layer's
+// would, which is exactly the write-write-read pattern that Nagle's
+// algorithm and delayed ACKs together penalise.
+func writeFrame(w io.Writer, b []byte) error {
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(b)))
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// writeCloseMarker writes the close marker.
+func writeCloseMarker(w io.Writer) error {
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], closeMarker)
+	_, err := w.Write(hdr[:])
+	return err
+}
+
+// readFrame reads one frame written by writeFrame, or returns
+// errCloseMarker if the sender wrote the close marker instead.
+func readFrame(r io.Reader) ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n == closeMarker {
+		return nil, errCloseMarker
+	}
+	if n > maxFrame {
+		return nil, fmt.Errorf("frame of %d bytes exceeds the %d byte limit", n, maxFrame)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
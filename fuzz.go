@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// fuzzMaxPayload is the largest payload the fuzz checks send, which keeps
+// each case fast.
+const fuzzMaxPayload = 256 * 1024
+
+// fuzzFirstPort is the server port of runFuzz's first case, the others
+// following it, and maxFuzzCases how many cases that leaves ports for.
+const (
+	fuzzFirstPort = 2000
+	maxFuzzCases  = 1<<16 - fuzzFirstPort
+)
+
+// fuzzPayloads returns n payloads of at most maxSize bytes: the edge cases
+// first, then random sizes. Some of the random payloads are mostly zeros, as
+// runs of NULs are what a string-minded bug would trip on.
+func fuzzPayloads(rng *rand.Rand, n int, maxSize int) [][]byte {
+	payloads := [][]byte{
+		{},
+		{0},
+		make([]byte, 1024),
+		[]byte(testMsg),
+		randomPayload(rng, maxSize),
+	}
+	for len(payloads) < n {
+		b := randomPayload(rng, rng.Intn(maxSize+1))
+		if rng.Intn(4) == 0 {
+			for i := range b {
+				if rng.Intn(8) != 0 {
+					b[i] = 0
+				}
+			}
+		}
+		payloads = append(payloads, b)
+	}
+	return payloads[:n]
+}
+
+// transferIntact dials port on client once and checks that the connection
+// receives exactly payload. It is the check runFuzz and FuzzTransfer make of
+// each payload.
+func transferIntact(ctx context.Context, client Transport, port uint16, payload []byte) error {
+	received, errs := collectConns(ctx, client, port, 1, payload)
+	switch {
+	case len(errs) != 0:
+		return errs[0]
+	case !bytes.Equal(received[0], payload):
+		return fmt.Errorf("received %d bytes that differ from the payload", len(received[0]))
+	}
+	return nil
+}
+
+// runFuzz sends each of nCases payloads from fuzzPayloads over gonet and
+// fails if any connection does not receive exactly what was sent. Each case
+// gets its own server port, so a failure points at a single payload, which
+// the seed reproduces.
+func runFuzz(ctx context.Context, nCases int, opts stackOptions) error {
+	server, client, err := setupGonetPair(opts)
+	if err != nil {
+		return err
+	}
+	rng := rand.New(rand.NewSource(opts.seed))
+	failed := 0
+	for i, payload := range fuzzPayloads(rng, nCases, fuzzMaxPayload) {
+		port := uint16(fuzzFirstPort + i)
+		go payloadServer(server, port, payload)
+		time.Sleep(time.Millisecond)
+		if err := transferIntact(ctx, client, port, payload); err != nil {
+			fmt.Printf("case %d (%d bytes): %s\n", i, len(payload), err)
+			failed++
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	fmt.Printf("%d/%d payloads transferred intact\n", nCases-failed, nCases)
+	if failed > 0 {
+		return fmt.Errorf("%d payloads were not transferred intact", failed)
+	}
+	return nil
+}
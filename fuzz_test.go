@@ -0,0 +1,50 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// FuzzTransfer sends each input over gonet and checks that it arrives
+// intact, as runFuzz does for its seeded payloads, which make the corpus's
+// seeds, kept small so that minimizing one the fuzzer finds interesting
+// doesn't take long. Each input gets a listener of its own, on ports from
+// 2000 up, so that a connection left over from one input can't be served
+// payload meant for the next, and TIME-WAIT is kept short, as a fuzzer's
+// thousands of connections a second would otherwise pile up in it and slow
+// the stacks down. Inputs over fuzzMaxPayload are skipped, to keep each one
+// fast.
+func FuzzTransfer(f *testing.F) {
+	for _, payload := range fuzzPayloads(rand.New(rand.NewSource(1)), 5, 16*1024) {
+		f.Add(payload)
+	}
+	opts := testOptions()
+	opts.timeWaitTimeout = 10 * time.Millisecond
+	server, client, err := setupGonetPair(opts)
+	if err != nil {
+		f.Fatal(err)
+	}
+	n := 0
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		if len(payload) > fuzzMaxPayload {
+			t.Skip()
+		}
+		port := uint16(fuzzFirstPort + n%10000)
+		n++
+		li, err := server.Listen(port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer li.Close()
+		go func() {
+			sc, err := li.Accept()
+			if err == nil {
+				serveConn(sc, payload)
+			}
+		}()
+		if err := transferIntact(testContext(t), client, port, payload); err != nil {
+			t.Fatalf("%d bytes: %s", len(payload), err)
+		}
+	})
+}
@@ -5,5 +5,6 @@ go 1.16
 require (
 	github.com/bits-and-blooms/bitset v1.2.0 // indirect
 	github.com/coreos/go-systemd/v22 v22.3.2 // indirect
+	golang.org/x/sys v0.0.0-20211019181941-9d821ace8654
 	gvisor.dev/gvisor v0.0.0-20220311014831-b314d81fbac7
 )
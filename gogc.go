@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// gcOff is the GOGC setting that turns the collector off, as "off" does in
+// the GOGC environment variable.
+const gcOff = -1
+
+// parseGCPercents parses a comma-separated list of GOGC settings: positive
+// percentages, or "off".
+func parseGCPercents(s string) ([]int, error) {
+	var percents []int
+	for _, f := range strings.Split(s, ",") {
+		if f == "off" {
+			percents = append(percents, gcOff)
+			continue
+		}
+		n, err := strconv.Atoi(f)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid GOGC %q", f)
+		}
+		percents = append(percents, n)
+	}
+	return percents, nil
+}
+
+func formatGCPercent(p int) string {
+	if p == gcOff {
+		return "off"
+	}
+	return strconv.Itoa(p)
+}
+
+// gcStats is what the collector did while a GOGC setting was in force.
+type gcStats struct {
+	cycles   uint32
+	pauses   time.Duration
+	maxPause time.Duration
+}
+
+// gcSince returns the collections since before, whose stats were read then.
+// Only the last 256 pauses are kept by the runtime, so the longest is taken
+// from those if there were more.
+func gcSince(before *runtime.MemStats) gcStats {
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+	st := gcStats{
+		cycles: after.NumGC - before.NumGC,
+		pauses: time.Duration(after.PauseTotalNs - before.PauseTotalNs),
+	}
+	n := st.cycles
+	if n > uint32(len(after.PauseNs)) {
+		n = uint32(len(after.PauseNs))
+	}
+	for i := uint32(0); i < n; i++ {
+		pause := time.Duration(after.PauseNs[(after.NumGC-i+255)%256])
+		if pause > st.maxPause {
+			st.maxPause = pause
+		}
+	}
+	return st
+}
+
+// runGOGCSweep transfers a 1MiB payload to nConns gonet connections under
+// each of the GOGC settings percents, on a fresh stack pair each time, and
+// reports the throughput and the collector's pauses at each as a table.
+// netstack allocates a buffer or more per packet, so how often the
+// collector runs shows in both. The GOGC in force before is restored after.
+func runGOGCSweep(ctx context.Context, percents []int, nConns int, opts stackOptions) error {
+	payload := randomPayload(newLockedRand(opts.seed), 1024*1024)
+	orig := debug.SetGCPercent(100)
+	defer debug.SetGCPercent(orig)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "GOGC\tINTACT\tMB/S\tGCS\tPAUSE TOTAL\tPAUSE MAX")
+	failed := false
+	for _, p := range percents {
+		server, client, err := setupGonetPair(opts)
+		if err != nil {
+			return err
+		}
+		go payloadServer(server, 1234, payload)
+		time.Sleep(time.Millisecond)
+		debug.SetGCPercent(p)
+		// Collecting first keeps the previous setting's garbage from being
+		// charged to this one.
+		runtime.GC()
+		var before runtime.MemStats
+		runtime.ReadMemStats(&before)
+		start := time.Now()
+		received, errs := collectConns(ctx, client, 1234, nConns, payload)
+		elapsed := time.Since(start)
+		st := gcSince(&before)
+		debug.SetGCPercent(100)
+		intact := 0
+		for _, b := range received {
+			if bytes.Equal(b, payload) {
+				intact++
+			}
+		}
+		for _, err := range errs {
+			fmt.Printf("GOGC %s: %s\n", formatGCPercent(p), err)
+		}
+		if intact != nConns {
+			failed = true
+		}
+		fmt.Fprintf(tw, "%s\t%d/%d\t%.1f\t%d\t%s\t%s\n", formatGCPercent(p), intact, nConns,
+			float64(len(received)*len(payload))/elapsed.Seconds()/1e6, st.cycles,
+			st.pauses.Round(time.Microsecond), st.maxPause.Round(time.Microsecond))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if failed {
+		return fmt.Errorf("not every connection received the payload intact")
+	}
+	return nil
+}
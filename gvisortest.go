@@ -1,41 +1,239 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"gvisor.dev/gvisor/pkg/tcpip"
-	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
 	"gvisor.dev/gvisor/pkg/tcpip/link/fdbased"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"hash"
 	"io"
+	"math/rand"
 	"net"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
 var testMsg = "Hello, world!"
 
-func setupStack(fd int, addr tcpip.Address) (*stack.Stack, error) {
+// socketTypes maps the -socktype names to the socketpair type used for the
+// link between the two gonet stacks. fdbased treats every read from the fd
+// as exactly one packet, so the socket type must preserve message boundaries:
+//
+//	seqpacket: boundaries preserved; works with the Readv and RecvMMsg dispatchers.
+//	dgram:     boundaries preserved; works with the Readv and RecvMMsg dispatchers.
+//	stream:    no boundaries, so packets are split and coalesced arbitrarily;
+//	           not usable with any dispatcher and only useful to show the breakage.
+//
+// PacketMMap requires an AF_PACKET socket and so can't be used with any of these.
+var socketTypes = map[string]int{
+	"seqpacket": syscall.SOCK_SEQPACKET,
+	"dgram":     syscall.SOCK_DGRAM,
+	"stream":    syscall.SOCK_STREAM,
+}
+
+// stackOptions holds the tunables applied by setupStack and setupStackPair.
+type stackOptions struct {
+	// networkProtocols and transportProtocols are the protocols the stack is
+	// created with. Nil means ipv4 and ipv6, and udp and tcp respectively.
+	networkProtocols   []stack.NetworkProtocolFactory
+	transportProtocols []stack.TransportProtocolFactory
+	// sockType is the socketpair type linking the two stacks; see socketTypes.
+	sockType int
+	// queues is the number of socketpairs, and so fds per endpoint, used for
+	// multiqueue operation. Zero means one.
+	queues int
+	// checksumOffload sets both TX and RX checksum offload on the endpoint,
+	// so netstack neither computes nor verifies checksums and trusts the
+	// link to deliver intact packets.
+	checksumOffload bool
+	// seed seeds the stack's random number generators, which drive ephemeral
+	// port selection and initial sequence numbers, and any payload generated
+	// for the run, so that runs with the same seed are reproducible.
+	seed int64
+	// mtu is the link MTU of the endpoint. Zero means 1500.
+	mtu uint32
+	// timeWaitReuse, if set, controls whether ports held by TIME-WAIT
+	// endpoints may be reused for new connections.
+	timeWaitReuse *tcpip.TCPTimeWaitReuseOption
+	// timeWaitTimeout, if non-zero, is how long endpoints stay in TIME-WAIT.
+	timeWaitTimeout time.Duration
+	// nagle enables Nagle's algorithm on new TCP endpoints. netstack
+	// defaults to it being off, like TCP_NODELAY, and gonet offers no way to
+	// change it per connection.
+	nagle bool
+	// gateway, if set, adds a default route for its address family through
+	// that address, which must be on-link.
+	gateway tcpip.Address
+	// dispatchMode is how fdbased reads inbound packets; see dispatchModes.
+	dispatchMode fdbased.PacketDispatchMode
+	// addr1 and addr2 are the addresses of the two stacks of a pair, which
+	// listen on their own and dial the other's. Empty means FD00::1 and
+	// FD00::2 respectively.
+	addr1, addr2 tcpip.Address
+	// pinCPUs, if set, are CPUs to pin stacks' dispatch threads to: a stack
+	// uses the first, and the second stack of a pair the next.
+	pinCPUs []int
+	// linkMTU, if set, governs the MTU of both stacks' NICs, so that it can
+	// be changed while they run; see linkMTU.
+	linkMTU *linkMTU
+	// latency, if non-zero, is added to every packet crossing the link
+	// between the stacks of a pair, in either direction, making the round
+	// trip time twice that; see delayedSocketpairs.
+	latency time.Duration
+	// congestionControl, receiveBuffer and sendBuffer tune TCP on the stack;
+	// see stackTuning.
+	congestionControl string
+	receiveBuffer     int
+	sendBuffer        int
+	// countWindows splices a windowTap into the link between the stacks of a
+	// pair, counting window updates and zero windows in the run's result.
+	countWindows bool
+	// peer, if set, is the tuning of the second stack of a pair where it
+	// differs from the first's; see second.
+	peer *stackTuning
+}
+
+// networkProtocols and transportProtocols map the -netprotos and
+// -transprotos names to protocol factories.
+var networkProtocols = map[string]stack.NetworkProtocolFactory{
+	"ipv4": ipv4.NewProtocol,
+	"ipv6": ipv6.NewProtocol,
+}
+
+var transportProtocols = map[string]stack.TransportProtocolFactory{
+	"tcp": tcp.NewProtocol,
+	"udp": udp.NewProtocol,
+}
+
+// timeWaitReuseModes maps the -twreuse names to netstack's reuse policies.
+// netstack defaults to loopback, which never applies to the FD00:: links.
+var timeWaitReuseModes = map[string]tcpip.TCPTimeWaitReuseOption{
+	"disabled": tcpip.TCPTimeWaitReuseDisabled,
+	"global":   tcpip.TCPTimeWaitReuseGlobal,
+	"loopback": tcpip.TCPTimeWaitReuseLoopbackOnly,
+}
+
+// dispatchModes maps the -dispatch names to fdbased's inbound dispatchers.
+// Both read in a loop that blocks in poll(2) when the fd is drained; they
+// differ in that readv takes one packet per syscall and recvmmsg a batch.
+// PacketMMap needs an AF_PACKET fd, so it can't be used on a socketpair.
+var dispatchModes = map[string]fdbased.PacketDispatchMode{
+	"readv":    fdbased.Readv,
+	"recvmmsg": fdbased.RecvMMsg,
+}
+
+// seedsPerStack is how many seeds from opts.seed up a stack uses, for its
+// RandSource and its SecureRNG, and so how far apart the seeds of stacks
+// that must not share one are.
+const seedsPerStack = 2
+
+// newStack creates a stack with opts' protocols and TCP options, but no
+// NICs.
+func newStack(opts stackOptions) (*stack.Stack, error) {
+	netProtos := opts.networkProtocols
+	if netProtos == nil {
+		netProtos = []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol}
+	}
+	transProtos := opts.transportProtocols
+	if transProtos == nil {
+		transProtos = []stack.TransportProtocolFactory{udp.NewProtocol, tcp.NewProtocol}
+	}
+	if len(netProtos) == 0 {
+		return nil, stackErr("configure protocols", errors.New("no network protocols configured"))
+	}
+	if len(transProtos) == 0 {
+		return nil, stackErr("configure protocols", errors.New("no transport protocols configured"))
+	}
+	// SecureRNG is seeded too; that is fine for a test harness and keeps
+	// things like SYN cookie secrets reproducible.
 	netStack := stack.New(stack.Options{
-		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
-		TransportProtocols: []stack.TransportProtocolFactory{udp.NewProtocol, tcp.NewProtocol},
+		NetworkProtocols:   netProtos,
+		TransportProtocols: transProtos,
 		HandleLocal:        true,
+		RandSource:         &lockedSource{src: rand.NewSource(opts.seed)},
+		SecureRNG:          newLockedRand(opts.seed + 1),
 	})
+	if opts.timeWaitReuse != nil {
+		opt := *opts.timeWaitReuse
+		if tcpErr := netStack.SetTransportProtocolOption(tcp.ProtocolNumber, &opt); tcpErr != nil {
+			return nil, stackErr("set TIME-WAIT reuse", wrapTCPIP(tcpErr))
+		}
+	}
+	if opts.timeWaitTimeout != 0 {
+		opt := tcpip.TCPTimeWaitTimeoutOption(opts.timeWaitTimeout)
+		if tcpErr := netStack.SetTransportProtocolOption(tcp.ProtocolNumber, &opt); tcpErr != nil {
+			return nil, stackErr("set TIME-WAIT timeout", wrapTCPIP(tcpErr))
+		}
+	}
+	if opts.nagle {
+		opt := tcpip.TCPDelayEnabled(true)
+		if tcpErr := netStack.SetTransportProtocolOption(tcp.ProtocolNumber, &opt); tcpErr != nil {
+			return nil, stackErr("set TCP delay", wrapTCPIP(tcpErr))
+		}
+	}
+	if err := applyTuning(netStack, opts); err != nil {
+		return nil, err
+	}
+	return netStack, nil
+}
+
+func setupStack(fds []int, addr tcpip.Address, opts stackOptions) (*stack.Stack, error) {
+	if subnet := localSubnet(); len(addr) != header.IPv6AddressSize || !subnet.Contains(addr) {
+		return nil, stackErr("check address", fmt.Errorf("%s is not an IPv6 address in %s", addr, &subnet))
+	}
+	mtu := opts.mtu
+	if mtu == 0 {
+		mtu = 1500
+	}
+	netStack, err := newStack(opts)
+	if err != nil {
+		return nil, err
+	}
 	endpoint, err := fdbased.New(&fdbased.Options{
-		FDs:        []int{fd},
-		MTU:        1500,
+		FDs:                fds,
+		MTU:                mtu,
+		TXChecksumOffload:  opts.checksumOffload,
+		RXChecksumOffload:  opts.checksumOffload,
+		PacketDispatchMode: opts.dispatchMode,
 	})
 	if err != nil {
+		return nil, nicErr("create link endpoint", err)
+	}
+	if opts.linkMTU != nil {
+		endpoint = opts.linkMTU.wrap(endpoint)
+	}
+	if len(opts.pinCPUs) > 0 {
+		endpoint = newPinnedEndpoint(endpoint, fmt.Sprintf("stack %s", addr), opts.pinCPUs[0])
+	}
+	if err := addNIC(netStack, endpoint, addr, opts); err != nil {
 		return nil, err
 	}
-	netStack.CreateNICWithOptions(1, endpoint, stack.NICOptions{
-		Name:     "1",
-	})
-	netStack.AddProtocolAddress(1,
+	return netStack, nil
+}
+
+// addNIC attaches endpoint to netStack as NIC 1 with address addr, a route to
+// the local subnet through it, and the default route if opts has a gateway.
+func addNIC(netStack *stack.Stack, endpoint stack.LinkEndpoint, addr tcpip.Address, opts stackOptions) error {
+	if tcpErr := netStack.CreateNICWithOptions(1, endpoint, stack.NICOptions{
+		Name: "1",
+	}); tcpErr != nil {
+		return nicErr("create NIC", wrapTCPIP(tcpErr))
+	}
+	if tcpErr := netStack.AddProtocolAddress(1,
 		tcpip.ProtocolAddress{
 			Protocol: ipv6.ProtocolNumber,
 			AddressWithPrefix: tcpip.AddressWithPrefix{
@@ -44,44 +242,104 @@ func setupStack(fd int, addr tcpip.Address) (*stack.Stack, error) {
 			},
 		},
 		stack.AddressProperties{},
-	)
-	localNet := tcpip.AddressWithPrefix{
-		Address:   tcpip.Address(net.ParseIP("FD00::0")),
-		PrefixLen: 8,
+	); tcpErr != nil {
+		return stackErr("add address", wrapTCPIP(tcpErr))
 	}
+	subnet := localSubnet()
 	netStack.AddRoute(tcpip.Route{
-		Destination: localNet.Subnet(),
+		Destination: subnet,
 		NIC:         1,
 	})
-	return netStack, nil
+	if opts.gateway != "" {
+		if !subnet.Contains(opts.gateway) {
+			return stackErr("add default route", fmt.Errorf("gateway %s is not on-link in %s", opts.gateway, &subnet))
+		}
+		netStack.AddRoute(defaultRoute(opts.gateway))
+	}
+	return nil
 }
 
-func gonetListener(netStack *stack.Stack, port uint16) func() (net.Listener, error) {
-	return func() (net.Listener, error) {
-		return gonet.ListenTCP(
-			netStack,
-			tcpip.FullAddress{
-				NIC:  1,
-				Port: port,
-			},
-			ipv6.ProtocolNumber)
+// localSubnet is the on-link route every socketpair-linked stack gets, and
+// so the range their addresses must come from.
+func localSubnet() tcpip.Subnet {
+	return tcpip.AddressWithPrefix{
+		Address:   tcpip.Address(net.ParseIP("FD00::0")),
+		PrefixLen: 8,
+	}.Subnet()
+}
+
+// pairAddresses returns the addresses of the two stacks of a pair.
+func pairAddresses(opts stackOptions) (tcpip.Address, tcpip.Address) {
+	addr1, addr2 := opts.addr1, opts.addr2
+	if addr1 == "" {
+		addr1 = tcpip.Address(net.ParseIP("FD00::1"))
 	}
+	if addr2 == "" {
+		addr2 = tcpip.Address(net.ParseIP("FD00::2"))
+	}
+	return addr1, addr2
 }
 
-func netListener(addr net.IP, port int) func() (net.Listener, error) {
-	return func() (net.Listener, error) {
-		return net.ListenTCP(
-			"tcp6",
-			&net.TCPAddr{
-				IP:   addr,
-				Port: port,
-			},
-		)
+// defaultRoute returns a route for all of gateway's address family through
+// gateway on NIC 1.
+func defaultRoute(gateway tcpip.Address) tcpip.Route {
+	dest := header.IPv6EmptySubnet
+	if len(gateway) == header.IPv4AddressSize {
+		dest = header.IPv4EmptySubnet
+	}
+	return tcpip.Route{Destination: dest, Gateway: gateway, NIC: 1}
+}
+
+// serverListen is t.Listen for a server, whose listener the run in progress
+// closes when it finishes. Servers would otherwise keep their ports for the
+// rest of the process, and a later run's native server on the same port
+// would fail to bind while its clients were served by the earlier one.
+func serverListen(t Transport, port uint16) (net.Listener, error) {
+	li, err := t.Listen(port)
+	if err != nil {
+		return nil, err
+	}
+	rl := &runListener{Listener: li}
+	activeResult().addListener(rl)
+	return rl, nil
+}
+
+// runListener is a server's listener that Accept reports as net.ErrClosed
+// once closed, whatever its transport's listener says, so that a server can
+// tell its run having ended from a real accept error.
+type runListener struct {
+	net.Listener
+	closed int32
+}
+
+func (l *runListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil && atomic.LoadInt32(&l.closed) != 0 {
+		return nil, net.ErrClosed
 	}
+	return c, err
 }
 
-func testServer(listenFunc func() (net.Listener, error)) {
-	li, err := listenFunc()
+func (l *runListener) Close() error {
+	atomic.StoreInt32(&l.closed, 1)
+	return l.Listener.Close()
+}
+
+// logAcceptError prints a server's accept error, unless it is just the
+// listener having been closed.
+func logAcceptError(err error) {
+	if !errors.Is(err, net.ErrClosed) {
+		fmt.Printf("accept error: %s\n", err)
+	}
+}
+
+func testServer(t Transport, port uint16) {
+	payloadServer(t, port, []byte(testMsg))
+}
+
+// payloadServer is testServer sending payload instead of the test message.
+func payloadServer(t Transport, port uint16, payload []byte) {
+	li, err := serverListen(t, port)
 	if err != nil {
 		fmt.Printf("Listen error: %s\n", err)
 		return
@@ -89,123 +347,1634 @@ func testServer(listenFunc func() (net.Listener, error)) {
 	for {
 		sc, err := li.Accept()
 		if err != nil {
-			fmt.Printf("accept error: %s\n", err)
+			logAcceptError(err)
 			return
 		}
-		go func() {
-			_, err = sc.Write([]byte(testMsg))
-			if err != nil {
-				fmt.Printf("write error: %s\n", err)
+		go serveConn(sc, payload)
+	}
+}
+
+// serveConn writes payload to sc and closes it. An empty payload is not
+// written at all, so the peer sees an immediate clean close.
+func serveConn(sc net.Conn, payload []byte) {
+	defer recoverServerConn(sc)
+	if len(payload) > 0 {
+		var err error
+		if atomic.LoadInt32(&pooledServers) != 0 {
+			err = writePooled(sc, payload)
+		} else {
+			_, err = sc.Write(payload)
+		}
+		if err != nil {
+			fmt.Printf("write error: %s\n", err)
+		}
+	}
+	start := time.Now()
+	err := sc.Close()
+	activeResult().addServerClose(time.Since(start))
+	if err != nil {
+		fmt.Printf("close error: %s\n", err)
+	}
+}
+
+// bindDeadline makes c's I/O obey ctx: the context deadline becomes the
+// connection deadline, and cancellation unblocks any pending read or write.
+// The returned function must be called once the connection is finished with.
+func bindDeadline(ctx context.Context, c net.Conn) func() {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = c.SetDeadline(deadline)
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = c.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// lastConnID is the ID most recently handed out by newConnID.
+var lastConnID int64
+
+// newConnID returns a process-wide unique ID for a client connection, so
+// that its lines can be picked out of the interleaved output of a run.
+func newConnID() int64 {
+	return atomic.AddInt64(&lastConnID, 1)
+}
+
+// logConn prints a line about connection id.
+func logConn(id int64, format string, args ...interface{}) {
+	fmt.Printf("conn %d: %s\n", id, fmt.Sprintf(format, args...))
+}
+
+// transferConn reads from c until EOF, closes it and checks that the test
+// message arrived intact.
+func transferConn(ctx context.Context, id int64, c net.Conn) {
+	verifyConn(ctx, id, c, []byte(testMsg), time.Now())
+}
+
+// verifyConn is transferConn expecting payload instead of the test message,
+// timing the transfer from start. An empty payload expects EOF straight
+// away: reading nothing before EOF is then a success. If the run is
+// capturing, the data also goes to the connection's capture file. A pooled
+// copy verifies the data by its SHA-256 rather than holding it.
+func verifyConn(ctx context.Context, id int64, c net.Conn, payload []byte, start time.Time) {
+	var buf bytes.Buffer
+	var verify io.Writer = &buf
+	var h hash.Hash
+	pc := pooledCopyFrom(ctx)
+	if pc != nil {
+		var release func()
+		h, release = hasher()
+		defer release()
+		verify = h
+	}
+	w, verifying, done, err := captureConn(ctx, id, verify)
+	if err != nil {
+		_ = c.Close()
+		connRecordFrom(ctx).finish(err, false)
+		resultFrom(ctx).addResult(err, false)
+		logConn(id, "capture error: %s", err)
+		return
+	}
+	n, err := receiveStream(ctx, c, start, w)
+	if cerr := done(); cerr != nil && err == nil {
+		err = fmt.Errorf("capture error: %w", cerr)
+	}
+	b := buf.Bytes()
+	// The length is checked on its own, ahead of the contents, so that a
+	// short read is reported as such.
+	complete := n == int64(len(payload))
+	var intact bool
+	if h != nil {
+		intact = !verifying || complete && sumOf(h) == pc.payloadSum(payload)
+	} else {
+		intact = !verifying || complete && bytes.Equal(b, payload)
+	}
+	connRecordFrom(ctx).finish(err, intact)
+	resultFrom(ctx).addResult(err, intact)
+	if err != nil {
+		logConn(id, "%s", err)
+		return
+	}
+	if !verifying {
+		resultFrom(ctx).addUnverified()
+	}
+	switch {
+	case intact:
+	case !complete:
+		logConn(id, "incorrect length received: expected %d bytes but got %d before EOF", len(payload), n)
+	case h != nil:
+		logConn(id, "incorrect data received: expected SHA-256 %x but got %x", pc.payloadSum(payload), sumOf(h))
+	default:
+		logConn(id, "incorrect data received: expected %s but got %s", abbreviate(payload), abbreviate(b))
+	}
+}
+
+// receiveConn reads from c until EOF and closes it, returning what was read.
+// The times from start to the first byte and to EOF are recorded in the
+// run's result.
+func receiveConn(ctx context.Context, c net.Conn, start time.Time) ([]byte, error) {
+	var b bytes.Buffer
+	if _, err := receiveStream(ctx, c, start, &b); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// receiveStream is receiveConn copying what was read to w as it arrives,
+// rather than holding it in memory, and returning how much there was.
+func receiveStream(ctx context.Context, c net.Conn, start time.Time, w io.Writer) (int64, error) {
+	defer resultFrom(ctx).startTransfer()()
+	stop := bindDeadline(ctx, c)
+	defer stop()
+	var total int64
+	var ttfb time.Duration
+	if pooledCopyFrom(ctx) != nil {
+		var err error
+		if total, ttfb, err = copyStream(ctx, c, start, w); err != nil {
+			return total, err
+		}
+	} else {
+		chunk := make([]byte, readSizeFrom(ctx))
+		for {
+			n, err := c.Read(chunk)
+			if n > 0 {
+				if total == 0 {
+					ttfb = time.Since(start)
+				}
+				total += int64(n)
+				if _, err := w.Write(chunk[:n]); err != nil {
+					return total, err
+				}
+			}
+			if err == io.EOF {
+				break
 			}
-			err = sc.Close()
 			if err != nil {
-				fmt.Printf("close error: %s\n", err)
+				return total, fmt.Errorf("read TCP error: %w", err)
 			}
-		}()
+		}
+	}
+	transfer := time.Since(start)
+	resultFrom(ctx).addTransfer(ttfb, transfer, int(total))
+	connRecordFrom(ctx).transferred(ttfb, transfer, total)
+	closeStart := time.Now()
+	err := c.Close()
+	resultFrom(ctx).addClose(time.Since(closeStart))
+	if err != nil {
+		return total, fmt.Errorf("close TCP error: %w", err)
 	}
+	return total, nil
 }
 
-func gonetDialer(netStack *stack.Stack, addr tcpip.Address, port uint16) func() (net.Conn, error) {
-	return func() (net.Conn, error) {
-		return gonet.DialTCP(
-			netStack,
-			tcpip.FullAddress{
-				NIC:  1,
-				Addr: addr,
-				Port: port,
-			},
-			ipv6.ProtocolNumber)
+// abbreviate shortens b for inclusion in an error message.
+func abbreviate(b []byte) string {
+	if len(b) > 64 {
+		return fmt.Sprintf("%q... (%d bytes)", b[:64], len(b))
 	}
+	return string(b)
 }
 
-func netDialer(addr net.IP, port int) func() (net.Conn, error) {
-	return func() (net.Conn, error) {
-		return net.DialTCP(
-			"tcp6",
-			nil,
-			&net.TCPAddr{
-				IP:   addr,
-				Port: port,
-			},
-		)
-	}
+func runTestConns(ctx context.Context, t Transport, port uint16, nConns int, wg *sync.WaitGroup) {
+	runPayloadConns(ctx, t, port, []byte(testMsg), nConns, wg)
 }
-func runTestConns(dialFunc func() (net.Conn, error), nConns int, wg *sync.WaitGroup) {
-	for i := 0; i < nConns; i++ {
+
+// runPayloadConns is runTestConns expecting payload instead of the test
+// message. The connections are launched in the run's arrival pattern.
+func runPayloadConns(ctx context.Context, t Transport, port uint16, payload []byte, nConns int, wg *sync.WaitGroup) {
+	launch(ctx, nConns, func() {
 		go func() {
 			defer wg.Done()
-			c, err := dialFunc()
+			id := newConnID()
+			ctx, rec := withConnRecord(ctx, id)
+			defer recoverConn(ctx, id)
+			start := time.Now()
+			c, err := t.Dial(ctx, port)
 			if err != nil {
-				fmt.Printf("dial TCP error: %s\n", err)
+				rec.dialed(nil, port, 0)
+				rec.finish(err, false)
+				resultFrom(ctx).addResult(err, false)
+				logConn(id, "dial TCP error: %s%s", err, dialErrorHint(err))
 				return
 			}
-			b, err := io.ReadAll(c)
+			rec.dialed(c, port, time.Since(start))
+			verifyConn(ctx, id, c, payload, start)
+		}()
+	})
+}
+
+// runPooledConns is runTestConns over connections that are already
+// established, so that only the data transfer is exercised. wg must have
+// been incremented once per connection in conns.
+func runPooledConns(ctx context.Context, conns []pooledConn, wg *sync.WaitGroup) {
+	for _, pc := range conns {
+		pc := pc
+		go func() {
+			defer wg.Done()
+			transferConn(ctx, pc.id, pc.Conn)
+		}()
+	}
+}
+
+// pooledConn is an established connection waiting in a pool, along with the
+// ID it was dialed under.
+type pooledConn struct {
+	net.Conn
+	id int64
+}
+
+// dialPool concurrently dials nConns connections and returns the ones that
+// succeeded.
+func dialPool(ctx context.Context, t Transport, port uint16, nConns int) []pooledConn {
+	var mu sync.Mutex
+	conns := make([]pooledConn, 0, nConns)
+	wg := &sync.WaitGroup{}
+	wg.Add(nConns)
+	for i := 0; i < nConns; i++ {
+		go func() {
+			defer wg.Done()
+			id := newConnID()
+			c, err := t.Dial(ctx, port)
 			if err != nil {
-				fmt.Printf("read TCP error: %s\n", err)
+				resultFrom(ctx).addResult(err, false)
+				logConn(id, "dial TCP error: %s%s", err, dialErrorHint(err))
 				return
 			}
-			err = c.Close()
-			if err != nil {
-				fmt.Printf("close TCP error: %s\n", err)
-				return
+			mu.Lock()
+			conns = append(conns, pooledConn{Conn: c, id: id})
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return conns
+}
+
+// runPool times connection setup and data transfer separately by first
+// dialing a pool of connections and only then reading from them.
+func runPool(ctx context.Context, t Transport, port uint16, nConns int) error {
+	start := time.Now()
+	conns := dialPool(ctx, t, port, nConns)
+	dialTime := time.Since(start)
+	start = time.Now()
+	wg := &sync.WaitGroup{}
+	wg.Add(len(conns))
+	runPooledConns(ctx, conns, wg)
+	wg.Wait()
+	fmt.Printf("dialed %d/%d connections in %s, transferred in %s\n", len(conns), nConns, dialTime, time.Since(start))
+	return ctx.Err()
+}
+
+// socketpairs creates n socketpairs of the given type, returning one end of
+// each in the first slice and the other end in the second.
+func socketpairs(sockType int, n int) ([]int, []int, error) {
+	var fds1, fds2 []int
+	for i := 0; i < n; i++ {
+		fds, err := socketpair(syscall.AF_UNIX, sockType, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		fds1 = append(fds1, fds[0])
+		fds2 = append(fds2, fds[1])
+	}
+	return fds1, fds2, nil
+}
+
+// countedSocketpairs is socketpairs with a relay spliced into the middle of
+// each pair, counting the packets that cross it in either direction. fdbased
+// keeps no per-queue statistics, so this is how we see which queues carry
+// traffic. The extra copy makes it unsuitable for throughput measurements.
+func countedSocketpairs(sockType int, counts []int64) ([]int, []int, error) {
+	var fds1, fds2 []int
+	for i := range counts {
+		count := &counts[i]
+		fd1, fd2, err := spliceSocketpairs(sockType, func(_ int, pkt []byte, _ func(int, []byte) error) bool {
+			if pkt != nil {
+				atomic.AddInt64(count, 1)
 			}
-			if string(b) != testMsg {
-				fmt.Printf("incorrect data received: expected %s but got %s\n", testMsg, b)
-				return
+			return true
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		fds1 = append(fds1, fd1)
+		fds2 = append(fds2, fd2)
+	}
+	return fds1, fds2, nil
+}
+
+// setupStackPair creates two stacks joined by opts.queues socketpairs of type
+// opts.sockType, delayed by opts.latency if it is set and tapped by a
+// windowTap if opts.countWindows is. Where a sandbox forbids socketpairs, it
+// joins them with a pipe endpoint instead; see setupPipePair.
+func setupStackPair(addr1, addr2 tcpip.Address, opts stackOptions) (*stack.Stack, *stack.Stack, error) {
+	queues := opts.queues
+	if queues == 0 {
+		queues = 1
+	}
+	var fds1, fds2 []int
+	var err error
+	if opts.latency > 0 {
+		fds1, fds2, err = delayedSocketpairs(opts.sockType, queues, opts.latency)
+	} else {
+		fds1, fds2, err = socketpairs(opts.sockType, queues)
+	}
+	if sandboxDenied(err) {
+		return setupPipePair(addr1, addr2, opts, err)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if opts.countWindows {
+		if fds1, err = tapWindows(opts.sockType, fds1); err != nil {
+			return nil, nil, err
+		}
+	}
+	return setupStackPairFDs(fds1, fds2, addr1, addr2, opts)
+}
+
+func setupStackPairFDs(fds1, fds2 []int, addr1, addr2 tcpip.Address, opts stackOptions) (*stack.Stack, *stack.Stack, error) {
+	stack1, err := setupStack(fds1, addr1, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	opts.seed += seedsPerStack
+	if len(opts.pinCPUs) > 1 {
+		opts.pinCPUs = append(opts.pinCPUs[1:len(opts.pinCPUs):len(opts.pinCPUs)], opts.pinCPUs[0])
+	}
+	stack2, err := setupStack(fds2, addr2, opts.second())
+	if err != nil {
+		return nil, nil, err
+	}
+	return stack1, stack2, nil
+}
+
+// setupGonetPair is setupStackPair on the pair addresses, returning each
+// stack as a Transport that dials the other.
+func setupGonetPair(opts stackOptions) (*gonetTransport, *gonetTransport, error) {
+	addr1, addr2 := pairAddresses(opts)
+	stack1, stack2, err := setupStackPair(addr1, addr2, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	t1, t2 := gonetPair(stack1, addr1, stack2, addr2)
+	return t1, t2, nil
+}
+
+// awaitServer dials port on t until a connection receives the test message,
+// which shows that the server is bound and serving, retrying until timeout.
+// The probes are left out of the run's result.
+func awaitServer(ctx context.Context, t Transport, port uint16, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(withResult(ctx, nil), timeout)
+	defer cancel()
+	for {
+		c, err := t.Dial(ctx, port)
+		if err == nil {
+			var b []byte
+			b, err = receiveConn(ctx, c, time.Now())
+			if err == nil && string(b) != testMsg {
+				err = fmt.Errorf("incorrect data received: expected %s but got %s", testMsg, abbreviate(b))
 			}
-		}()
+			if err == nil {
+				return nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("server on port %d not ready: %w", port, err)
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+// runPair runs nConns connections in each direction between two transports,
+// each serving the test message on port. Both directions must pass a probe
+// before any of the measured connections are dialed.
+func runPair(ctx context.Context, t1, t2 Transport, port uint16, nConns int) error {
+	go testServer(t1, port)
+	go testServer(t2, port)
+	for _, t := range []Transport{t2, t1} {
+		if err := awaitServer(ctx, t, port, time.Second); err != nil {
+			return err
+		}
 	}
+	wg := &sync.WaitGroup{}
+	wg.Add(nConns * 2)
+	go runTestConns(ctx, t1, port, nConns, wg)
+	go runTestConns(ctx, t2, port, nConns, wg)
+	wg.Wait()
+	return ctx.Err()
 }
 
-func runGonet(nConns int) error {
-	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+func runGonet(ctx context.Context, nConns int, opts stackOptions) error {
+	t1, t2, err := setupGonetPair(opts)
 	if err != nil {
 		return err
 	}
-	addr1 := tcpip.Address(net.ParseIP("FD00::1"))
-	stack1, err := setupStack(fds[0], addr1)
+	return runPair(ctx, t1, t2, 1234, nConns)
+}
+
+func runNet(ctx context.Context, nConns int) error {
+	return runLoopback(ctx, &netTransport{addr: net.ParseIP("::1")}, nConns)
+}
+
+// runLoopback is runPair for a transport that dials itself, using two ports
+// in place of the two ends.
+func runLoopback(ctx context.Context, t Transport, nConns int) error {
+	go testServer(t, 1234)
+	go testServer(t, 4321)
+	time.Sleep(time.Millisecond)
+	wg := &sync.WaitGroup{}
+	wg.Add(nConns * 2)
+	go runTestConns(ctx, t, 1234, nConns, wg)
+	go runTestConns(ctx, t, 4321, nConns, wg)
+	wg.Wait()
+	return ctx.Err()
+}
+
+func reportDistribution(counts []int64) {
+	for i := range counts {
+		fmt.Printf("listener %d: %d connections\n", i, atomic.LoadInt64(&counts[i]))
+	}
+}
+
+// runReusePort dials nConns connections at nListeners SO_REUSEPORT listeners
+// sharing one port of server and reports how they were distributed.
+func runReusePort(ctx context.Context, server Transport, client Transport, port uint16, nConns int, nListeners int) error {
+	counts := make([]int64, nListeners)
+	for i := range counts {
+		go testServer(&countingTransport{Transport: server, accepted: &counts[i]}, port)
+	}
+	time.Sleep(time.Millisecond)
+	wg := &sync.WaitGroup{}
+	wg.Add(nConns)
+	go runTestConns(ctx, client, port, nConns, wg)
+	wg.Wait()
+	reportDistribution(counts)
+	return ctx.Err()
+}
+
+func runNetReusePort(ctx context.Context, nConns int, nListeners int) error {
+	t := &netTransport{addr: net.ParseIP("::1"), reusePort: true}
+	return runReusePort(ctx, t, t, 2345, nConns, nListeners)
+}
+
+// runGonetReusePort is runNetReusePort over netstack: the listeners are on
+// one stack and are dialed from the other.
+func runGonetReusePort(ctx context.Context, nConns int, nListeners int, opts stackOptions) error {
+	server, client, err := setupGonetPair(opts)
 	if err != nil {
 		return err
 	}
-	go testServer(gonetListener(stack1, 1234))
-	addr2 := tcpip.Address(net.ParseIP("FD00::2"))
-	stack2, err := setupStack(fds[1], addr2)
+	server.reusePort = true
+	return runReusePort(ctx, server, client, 1234, nConns, nListeners)
+}
+
+// runGonetListeners runs nListeners test servers on one stack, each on a
+// port of its own from 1234 up, and spreads nConns connections from the
+// other stack evenly across them, to see netstack cope with many listeners
+// at once rather than many connections to one. It reports how many
+// connections each listener accepted out of those dialed to it.
+func runGonetListeners(ctx context.Context, nConns int, nListeners int, opts stackOptions) error {
+	server, client, err := setupGonetPair(opts)
 	if err != nil {
 		return err
 	}
-	go testServer(gonetListener(stack2, 1234))
+	counts := make([]int64, nListeners)
+	for i := range counts {
+		go testServer(&countingTransport{Transport: server, accepted: &counts[i]}, 1234+uint16(i))
+	}
 	time.Sleep(time.Millisecond)
 	wg := &sync.WaitGroup{}
-	wg.Add(nConns*2)
-	go runTestConns(gonetDialer(stack1, addr2, 1234), nConns, wg)
-	go runTestConns(gonetDialer(stack2, addr1, 1234), nConns, wg)
+	wg.Add(nConns)
+	for i := 0; i < nListeners; i++ {
+		go runTestConns(ctx, client, 1234+uint16(i), listenerShare(nConns, nListeners, i), wg)
+	}
 	wg.Wait()
-	return nil
+	for i := range counts {
+		fmt.Printf("listener %d (port %d): %d/%d connections\n", i, 1234+i,
+			atomic.LoadInt64(&counts[i]), listenerShare(nConns, nListeners, i))
+	}
+	return ctx.Err()
 }
 
-func runNet(nConns int) error {
-	go testServer(netListener(net.ParseIP("::1"), 1234))
-	go testServer(netListener(net.ParseIP("::1"), 4321))
+// listenerShare is how many of nConns connections spread evenly across
+// nListeners go to listener i, the first few taking one extra when they
+// don't divide evenly.
+func listenerShare(nConns, nListeners, i int) int {
+	n := nConns / nListeners
+	if i < nConns%nListeners {
+		n++
+	}
+	return n
+}
+
+// runLimited dials nConns connections at a test server on server whose
+// listener handles at most limit of them at a time, and reports how many had
+// to wait for a slot or were turned away. Rejected connections are closed
+// without the test message, so each shows up as an incorrect data error on
+// the client.
+func runLimited(ctx context.Context, server Transport, client Transport, port uint16, nConns int, limit int, reject bool) error {
+	lt := &limitingTransport{Transport: server, limit: limit, reject: reject}
+	go testServer(lt, port)
 	time.Sleep(time.Millisecond)
 	wg := &sync.WaitGroup{}
-	wg.Add(nConns*2)
-	go runTestConns(netDialer(net.ParseIP("::1"), 1234), nConns, wg)
-	go runTestConns(netDialer(net.ParseIP("::1"), 4321), nConns, wg)
+	wg.Add(nConns)
+	go runTestConns(ctx, client, port, nConns, wg)
 	wg.Wait()
-	return nil
+	fmt.Printf("limit %d: %d connections waited for a slot, %d rejected\n",
+		limit, atomic.LoadInt64(&lt.waited), atomic.LoadInt64(&lt.rejected))
+	return ctx.Err()
 }
 
-func doRun(name string, runFunc func() error) {
-	fmt.Printf("Starting %s\n", name)
-	err := runFunc()
+func runNetLimited(ctx context.Context, nConns int, limit int, reject bool) error {
+	t := &netTransport{addr: net.ParseIP("::1")}
+	return runLimited(ctx, t, t, 5432, nConns, limit, reject)
+}
+
+func runGonetLimited(ctx context.Context, nConns int, limit int, reject bool, opts stackOptions) error {
+	server, client, err := setupGonetPair(opts)
 	if err != nil {
-		fmt.Printf("Error: %s\n", err)
+		return err
 	}
-	fmt.Printf("Finished %s\n", name)
+	return runLimited(ctx, server, client, 1234, nConns, limit, reject)
 }
 
-func main() {
-	doRun("runNet 100", func() error { return runNet(100) })
-	doRun("runGonet 10", func() error { return runGonet(10) })
-	doRun("runGonet 100", func() error { return runGonet(100) })
+func runNetPool(ctx context.Context, nConns int) error {
+	t := &netTransport{addr: net.ParseIP("::1")}
+	go testServer(t, 3456)
+	time.Sleep(time.Millisecond)
+	return runPool(ctx, t, 3456, nConns)
+}
+
+func runGonetPool(ctx context.Context, nConns int, opts stackOptions) error {
+	server, client, err := setupGonetPair(opts)
+	if err != nil {
+		return err
+	}
+	go testServer(server, 1234)
+	time.Sleep(time.Millisecond)
+	return runPool(ctx, client, 1234, nConns)
+}
+
+// runChecksumOffload runs the same workload with checksum offload off and
+// on, and fails if either stack counted malformed packets or TCP checksum
+// errors. Since offload disables verification on receipt too, the "on" pass
+// shows that netstack is consistent end to end rather than that the
+// checksums themselves are right; the "off" pass checks the latter.
+func runChecksumOffload(ctx context.Context, nConns int, opts stackOptions) error {
+	failed := false
+	for _, offload := range []bool{false, true} {
+		opts.checksumOffload = offload
+		server, client, err := setupGonetPair(opts)
+		if err != nil {
+			return err
+		}
+		timeTransfer(ctx, server, client, nConns)
+		for i, s := range []*stack.Stack{server.netStack, client.netStack} {
+			malformed, checksum := checksumErrors(s)
+			fmt.Printf("offload %v, stack %d: %d malformed packets, %d TCP checksum errors\n", offload, i+1, malformed, checksum)
+			if malformed != 0 || checksum != 0 {
+				dumpStats(fmt.Sprintf("stack %d", i+1), s)
+				failed = true
+			}
+		}
+	}
+	if failed {
+		return fmt.Errorf("checksum errors detected")
+	}
+	return ctx.Err()
+}
+
+// timeTransfer runs nConns connections from client to a test server on
+// server and returns how long they took.
+func timeTransfer(ctx context.Context, server, client Transport, nConns int) time.Duration {
+	go testServer(server, 1234)
+	time.Sleep(time.Millisecond)
+	start := time.Now()
+	wg := &sync.WaitGroup{}
+	wg.Add(nConns)
+	go runTestConns(ctx, client, 1234, nConns, wg)
+	wg.Wait()
+	return time.Since(start)
+}
+
+// runMultiqueue compares a single-queue link against an opts.queues link,
+// then repeats the multiqueue run through counting relays and fails if any
+// queue carried no packets.
+func runMultiqueue(ctx context.Context, nConns int, opts stackOptions) error {
+	for _, queues := range []int{1, opts.queues} {
+		qopts := opts
+		qopts.queues = queues
+		server, client, err := setupGonetPair(qopts)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("queues %d: %d connections in %s\n", queues, nConns, timeTransfer(ctx, server, client, nConns))
+	}
+	counts := make([]int64, opts.queues)
+	fds1, fds2, err := countedSocketpairs(opts.sockType, counts)
+	if err != nil {
+		return err
+	}
+	addr1, addr2 := pairAddresses(opts)
+	stack1, stack2, err := setupStackPairFDs(fds1, fds2, addr1, addr2, opts)
+	if err != nil {
+		return err
+	}
+	server, client := gonetPair(stack1, addr1, stack2, addr2)
+	timeTransfer(ctx, server, client, nConns)
+	idle := 0
+	for i := range counts {
+		n := atomic.LoadInt64(&counts[i])
+		fmt.Printf("queue %d: %d packets\n", i, n)
+		if n == 0 {
+			idle++
+		}
+	}
+	if idle > 0 {
+		return fmt.Errorf("%d of %d queues carried no traffic", idle, len(counts))
+	}
+	return ctx.Err()
+}
+
+// connectBatch dials nConns connections concurrently, closing each as soon
+// as it is established. It returns the number that succeeded and adds the
+// rest to failures.
+func connectBatch(ctx context.Context, t Transport, port uint16, nConns int, failures *failureCounts) int64 {
+	var succeeded int64
+	wg := &sync.WaitGroup{}
+	wg.Add(nConns)
+	for i := 0; i < nConns; i++ {
+		go func() {
+			defer wg.Done()
+			id := newConnID()
+			c, err := t.Dial(ctx, port)
+			if err != nil {
+				failures.add(err)
+				return
+			}
+			atomic.AddInt64(&succeeded, 1)
+			err = c.Close()
+			if err != nil {
+				logConn(id, "close TCP error: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+	return succeeded
+}
+
+// connectOnly runs a single connectBatch and reports the connection setup
+// rate.
+func connectOnly(ctx context.Context, t Transport, port uint16, nConns int) {
+	var failures failureCounts
+	start := time.Now()
+	succeeded := connectBatch(ctx, t, port, nConns, &failures)
+	elapsed := time.Since(start)
+	fmt.Printf("%d connections in %s (%.0f conns/sec), failures: %s\n",
+		succeeded, elapsed, float64(succeeded)/elapsed.Seconds(), &failures)
+}
+
+func runNetConnectRate(ctx context.Context, nConns int) error {
+	t := &netTransport{addr: net.ParseIP("::1")}
+	go testServer(t, 4567)
+	time.Sleep(time.Millisecond)
+	connectOnly(ctx, t, 4567, nConns)
+	return ctx.Err()
+}
+
+func runGonetConnectRate(ctx context.Context, nConns int, opts stackOptions) error {
+	server, client, err := setupGonetPair(opts)
+	if err != nil {
+		return err
+	}
+	go testServer(server, 1234)
+	time.Sleep(time.Millisecond)
+	connectOnly(ctx, client, 1234, nConns)
+	dumpConnectStats("server", server.netStack)
+	dumpConnectStats("client", client.netStack)
+	return ctx.Err()
+}
+
+// settled reports whether every TCP endpoint on s is either listening or in
+// TIME-WAIT, meaning that all closes have run to completion.
+func settled(s *stack.Stack) bool {
+	for state := range tcpStates(s) {
+		if state != tcp.StateListen && state != tcp.StateTimeWait {
+			return false
+		}
+	}
+	return true
+}
+
+// runTeardown checks that every connection is torn down cleanly: both the
+// open counters advance by nConns, CurrentEstablished returns to its
+// baseline, and no endpoint is left in any state other than LISTEN or
+// TIME-WAIT. The server closes first, so it is the one expected to hold the
+// TIME-WAIT endpoints.
+func runTeardown(ctx context.Context, nConns int, opts stackOptions) error {
+	serverT, clientT, err := setupGonetPair(opts)
+	if err != nil {
+		return err
+	}
+	server, client := serverT.netStack, clientT.netStack
+	timeTransfer(ctx, serverT, clientT, nConns)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	deadline := time.Now().Add(time.Second)
+	for !settled(server) || !settled(client) {
+		if time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	var problems []string
+	if n := client.Stats().TCP.ActiveConnectionOpenings.Value(); n != uint64(nConns) {
+		problems = append(problems, fmt.Sprintf("client made %d active opens, expected %d", n, nConns))
+	}
+	if n := server.Stats().TCP.PassiveConnectionOpenings.Value(); n != uint64(nConns) {
+		problems = append(problems, fmt.Sprintf("server made %d passive opens, expected %d", n, nConns))
+	}
+	for _, st := range []struct {
+		name string
+		s    *stack.Stack
+	}{{"server", server}, {"client", client}} {
+		if n := st.s.Stats().TCP.CurrentEstablished.Value(); n != 0 {
+			problems = append(problems, fmt.Sprintf("%s still has %d established connections", st.name, n))
+		}
+		states := tcpStates(st.s)
+		fmt.Printf("%s endpoints: %s\n", st.name, formatStates(states))
+		for state, n := range states {
+			if state != tcp.StateListen && state != tcp.StateTimeWait {
+				problems = append(problems, fmt.Sprintf("%s has %d endpoints in %s", st.name, n, state))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("unclean teardown: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// churnServer accepts connections and closes each one only once the peer
+// has, so that the client is always the active closer and it is the
+// client's endpoints that go into TIME-WAIT.
+func churnServer(t Transport, port uint16) {
+	li, err := serverListen(t, port)
+	if err != nil {
+		fmt.Printf("Listen error: %s\n", err)
+		return
+	}
+	for {
+		sc, err := li.Accept()
+		if err != nil {
+			logAcceptError(err)
+			return
+		}
+		go func() {
+			_, _ = io.Copy(io.Discard, sc)
+			err := sc.Close()
+			if err != nil {
+				fmt.Printf("close error: %s\n", err)
+			}
+		}()
+	}
+}
+
+// runChurn keeps opening and closing batches of connections for the given
+// duration through a client port range much smaller than the total
+// connection count, once with TIME-WAIT reuse disabled and once with it
+// enabled. Without reuse the client runs out of ports as soon as they are all
+// held in TIME-WAIT. Note that netstack only reuses a TIME-WAIT port once
+// its last timestamp is more than a second old, so the run needs to last
+// several seconds to show the difference.
+func runChurn(ctx context.Context, duration time.Duration, perRound int, opts stackOptions) error {
+	for _, mode := range []string{"disabled", "global"} {
+		reuse := timeWaitReuseModes[mode]
+		mopts := opts
+		mopts.timeWaitReuse = &reuse
+		server, client, err := setupGonetPair(mopts)
+		if err != nil {
+			return err
+		}
+		if tcpErr := client.netStack.SetPortRange(50000, uint16(50000+2*perRound-1)); tcpErr != nil {
+			return fmt.Errorf("set port range: %w", wrapTCPIP(tcpErr))
+		}
+		go churnServer(server, 1234)
+		time.Sleep(time.Millisecond)
+		var failures failureCounts
+		var succeeded int64
+		maxTimeWait := 0
+		start := time.Now()
+		for time.Since(start) < duration && ctx.Err() == nil {
+			n := connectBatch(ctx, client, 1234, perRound, &failures)
+			succeeded += n
+			if tw := tcpStates(client.netStack)[tcp.StateTimeWait]; tw > maxTimeWait {
+				maxTimeWait = tw
+			}
+			if n == 0 {
+				time.Sleep(50 * time.Millisecond)
+			}
+		}
+		fmt.Printf("TIME-WAIT reuse %s: %d connections in %s, max %d in TIME-WAIT, failures: %s\n",
+			mode, succeeded, time.Since(start), maxTimeWait, &failures)
+	}
+	return ctx.Err()
+}
+
+// runPipe is runNet over net.Pipe, giving the floor cost of the goroutine
+// and copy machinery alone.
+func runPipe(ctx context.Context, nConns int) error {
+	return runLoopback(ctx, newPipeTransport(), nConns)
+}
+
+// runUnix is runNet over UNIX domain sockets: kernel sockets, but no TCP/IP.
+func runUnix(ctx context.Context, nConns int) error {
+	t := &unixTransport{dir: os.TempDir()}
+	defer os.Remove(t.path(1234))
+	defer os.Remove(t.path(4321))
+	return runLoopback(ctx, t, nConns)
+}
+
+// runConfig is how doRun sets up a run's result.
+type runConfig struct {
+	// abortThreshold is the failure rate over which the run is cancelled;
+	// see RunResult.
+	abortThreshold float64
+	// maxErrors is how many errors RunErrors keeps.
+	maxErrors int
+	// recordConns is whether to record each connection for the CSV output.
+	recordConns bool
+}
+
+func doRun(name string, timeout time.Duration, cfg runConfig, runFunc func(context.Context) error) *RunResult {
+	fmt.Printf("Starting %s\n", name)
+	r := &RunResult{Name: name, abortThreshold: cfg.abortThreshold, maxErrors: cfg.maxErrors, recordConns: cfg.recordConns}
+	ctx, cancel := context.WithTimeout(withResult(context.Background(), r), timeout)
+	defer cancel()
+	r.cancel = cancel
+	// A run nested in another, as checkRunPanic's is, hands the active
+	// result back when it is done.
+	prev := activeResult()
+	setActiveResult(r)
+	defer setActiveResult(prev)
+	allocs := readAllocs()
+	start := time.Now()
+	r.Err = callRun(ctx, name, runFunc)
+	r.closeListeners()
+	var pe *panicError
+	r.Panicked = errors.As(r.Err, &pe)
+	r.Duration = time.Since(start)
+	allocs = readAllocs().sub(allocs)
+	r.Allocs, r.AllocBytes = allocs.objects, allocs.bytes
+	r.mu.Lock()
+	if r.Aborted != "" {
+		r.Err = fmt.Errorf("aborted by the circuit breaker: %s", r.Aborted)
+	}
+	r.mu.Unlock()
+	// A loop otherwise only shows as the run timing out, or not at all if
+	// the run expects some connections to fail.
+	if n := atomic.LoadInt64(&r.Failures[failLoop]); n > 0 && !errors.Is(r.Err, errRoutingLoop) {
+		if r.Err == nil || errors.Is(r.Err, context.DeadlineExceeded) {
+			r.Err = fmt.Errorf("%w: %d connections caught in one", errRoutingLoop, n)
+		} else {
+			r.Err = fmt.Errorf("%w, and %d connections caught in a routing loop", r.Err, n)
+		}
+	}
+	if r.Err != nil {
+		fmt.Printf("Error: %s\n", r.Err)
+	}
+	fmt.Printf("Finished %s in %s\n", name, r.Duration)
+	return r
+}
+
+func main() {
+	exitCode := 0
+	defer func() {
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
+	}()
+	sockTypeName := flag.String("socktype", "seqpacket", "socketpair type for the gonet link: seqpacket, dgram or stream")
+	reusePort := flag.Int("reuseport", 0, "also run the SO_REUSEPORT modes with this many listeners sharing a port")
+	pool := flag.Bool("pool", false, "also run the modes that dial all connections before transferring any data")
+	checksum := flag.Bool("checksum", false, "also run the checksum offload correctness check")
+	queues := flag.Int("queues", 1, "number of socketpairs (fdbased queues) per gonet link; above 1 also runs the multiqueue comparison")
+	connect := flag.Int("connect", 0, "also run the connection setup rate modes with this many connections")
+	maxConns := flag.Int("maxconns", 0, "also run the accept concurrency modes with servers handling at most this many connections at a time")
+	reject := flag.Bool("reject", false, "with -maxconns, close connections beyond the limit instead of making them wait")
+	abortive := flag.Bool("abort", false, "also run the abortive close (RST) check")
+	nagle := flag.Int("nagle", 0, "also run the small-message latency benchmark with Nagle off and on, sending this many messages")
+	teardown := flag.Bool("teardown", false, "also run the connection teardown check")
+	twReuse := flag.String("twreuse", "", "TIME-WAIT port reuse for the gonet stacks: disabled, global or loopback (default netstack's own)")
+	twTimeout := flag.Duration("twtimeout", 0, "TIME-WAIT duration for the gonet stacks (default netstack's own)")
+	churn := flag.Duration("churn", 0, "also run the TIME-WAIT churn benchmark for this long per reuse mode")
+	linkState := flag.Bool("linkstate", false, "also run the NIC disable/enable check")
+	fuzz := flag.Int("fuzz", 0, "also run the payload fuzz check with this many seeded payloads")
+	pmtud := flag.Bool("pmtud", false, "also run the path MTU discovery check")
+	tunName := flag.String("tun", "", "TUN device to attach a stack to for -fetch; the host must route it onwards")
+	tunAddr := flag.String("tunaddr", "10.99.0.2", "address of the stack on the -tun device")
+	fetchURL := flag.String("fetch", "", "only fetch this URL (with an IP literal host) through the stack on the -tun device")
+	gateway := flag.String("gateway", "", "on-link gateway for a default route on the gonet stacks, or on the -tun stack")
+	mtu := flag.Uint("mtu", 1500, "link MTU of the gonet stacks")
+	congestion := flag.String("cc", "", "TCP congestion control of the gonet stacks, reno or cubic; empty leaves netstack's default")
+	rcvBuf := flag.Int("rcvbuf", 0, "default TCP receive buffer size of the gonet stacks; 0 leaves netstack's default")
+	sndBuf := flag.Int("sndbuf", 0, "default TCP send buffer size of the gonet stacks; 0 leaves netstack's default")
+	stack2Tuning := flag.String("stack2", "", "tuning of the second stack of each gonet pair where it differs, as comma-separated mtu=, cc=, rcvbuf= and sndbuf= settings")
+	dispatch := flag.String("dispatch", "readv", "fdbased inbound dispatch mode for the gonet stacks: readv or recvmmsg")
+	file := flag.String("file", "", "also run the transfer of this file's contents over net and gonet, checked by SHA-256")
+	chunk := flag.Int("chunk", 0, "also run the slow producer check, with servers writing the payload this many bytes at a time")
+	chunkDelay := flag.Duration("chunkdelay", time.Millisecond, "with -chunk, pause between the server's writes")
+	slowRead := flag.Duration("slowread", 0, "also run the flow control check, with clients pausing this long between reads")
+	reconfig := flag.Int("reconfig", 0, "also run the concurrent reconfiguration check, changing addresses and routes this many times a second")
+	handshake := flag.Int("handshake", 0, "also run the handshake RTT measurement, timing this many SYN/SYN-ACK exchanges on the gonet link")
+	extHdr := flag.Bool("exthdr", false, "also run the IPv6 extension header check")
+	pin := flag.String("pin", "", "comma-separated CPUs to pin the gonet stacks' dispatch threads to, the first of each pair to the first and the second to the next")
+	fastOpen := flag.Int("tfo", 0, "also run the TCP Fast Open benchmark with this many connections per path")
+	messages := flag.Int("messages", 0, "also run the framed message check, streaming this many messages to each connection and then a close marker")
+	injectFile := flag.String("inject", "", "also replay the hex-encoded IPv6 packets in this file, one per line, into a lone stack serving port 1234, and print what it sends back")
+	allocProfile := flag.Bool("allocs", false, "also compare the allocations per connection of native TCP and gonet on a fixed workload")
+	injectRST := flag.Bool("rst", false, "also run the reset check, injecting a RST into one gonet connection partway through its transfer")
+	isolation := flag.Int("isolation", 0, "also run the isolation check across this many independent gonet pairs")
+	readSize := flag.Int("readsize", defaultReadSize, "size of the buffer clients read received data into")
+	pooled := flag.Bool("pooled", false, "transfer with io.CopyBuffer through pooled buffers on both sides, clients verifying by SHA-256")
+	readSizes := flag.String("readsizes", "", "also run the read size comparison, with the client reading into a buffer of each of these comma-separated sizes")
+	soak := flag.Duration("soak", 0, "also run the soak test, keeping 10 gonet connections going for this long")
+	soakReconnects := flag.Int("reconnects", 5, "with -soak, how many times in a row a worker reconnects after a failure before giving up")
+	mtuChange := flag.Duration("mtuchange", 0, "also run the MTU change check, changing the gonet link's MTU at this interval during transfers")
+	c10k := flag.Duration("c10k", 0, "also run the C10K benchmark, churning short-lived connections with up to 10000 workers for this long per level")
+	srcPolicy := flag.String("srcpolicy", "", "also run the source address selection check with these comma-separated policies ("+strings.Join(sourcePolicies, ", ")+")")
+	seqCheck := flag.Bool("seqcheck", false, "also run the sequenced stream check, which reports duplicated, reordered, missing or truncated data")
+	latency := flag.Duration("latency", 0, "one-way delay to add to every packet between gonet stacks")
+	countWindows := flag.Bool("countwindows", false, "count the window updates and zero windows crossing the link between gonet stacks, for the summary")
+	windows := flag.String("windows", "", "also run the window clamp benchmark over a delayed link with these comma-separated receive windows in bytes")
+	multiHop := flag.Bool("multihop", false, "also run the multi-hop check, through a chain of three stacks with the middle one forwarding")
+	simOpen := flag.Bool("simopen", false, "also run the simultaneous open check, with both sides dialling at once and neither listening")
+	idleMem := flag.Int("idlemem", 0, "also run the idle connection memory measurement, holding this many connections open per path")
+	readdress := flag.Bool("readdress", false, "also run the address reassignment check, removing, re-adding and moving the server's address under established connections")
+	gogc := flag.String("gogc", "", "also run the GOGC sweep, measuring gonet throughput and GC pauses at each of these comma-separated GOGC settings, e.g. 50,100,400,off")
+	workers := flag.Int("workers", 0, "also run the server model comparison, against a server with a pool of this many handler goroutines")
+	acceptDelay := flag.Duration("acceptdelay", 0, "also run the delayed accept check, with the server waiting this long before each accept")
+	backlog := flag.Int("backlog", 64, "listen backlog of the server in the delayed accept check; below its 50 connections, a full accept queue stalls connections as in runGonet")
+	linkLocal := flag.Bool("linklocal", false, "also run the link-local address check, dialing fe80::1 by zone on a stack with two links")
+	copyBench := flag.Bool("copybench", false, "also run the copy comparison, measuring allocations per connection reading whole payloads against pooled io.CopyBuffer copies")
+	xorEcho := flag.Bool("xorecho", false, "also run the round trip integrity check, with the server echoing data XORed with a known key")
+	listeners := flag.Int("listeners", 0, "also run the multiple listener benchmark with this many test servers on different ports of one stack")
+	migrate := flag.Bool("migrate", false, "also run the migration check, changing the client's address under established connections")
+	connectRate := flag.Float64("connectrate", 0, "also run the rate-limited connection setup modes, establishing this many connections a second from a token bucket")
+	connectBurst := flag.Int("connectburst", 1, "with -connectrate, the token bucket's size, the most connections established at once")
+	udpChecksum := flag.Bool("udpchecksum", false, "also run the UDP checksum check, injecting datagrams with good and bad checksums")
+	duplex := flag.Bool("duplex", false, "also run the duplex echo benchmark, comparing half-duplex echoes against a reader and a writer goroutine per connection")
+	stackClose := flag.Bool("stackclose", false, "also run the stack close check, closing each stack of a gonet pair under open connections")
+	tenantMix := flag.String("tenants", "", "also run the multi-tenant mix over one gonet pair: comma-separated name=conns or name=conns:bytes tenants, reported per tenant")
+	urgent := flag.Bool("urgent", false, "also run the urgent data check, sending a byte of TCP urgent data mid-stream over native TCP and gonet")
+	coldStart := flag.Int("coldstart", 0, "also run the stack creation benchmark, timing setupStack for this many fresh stacks")
+	dispatchBench := flag.Bool("dispatchbench", false, "also run the benchmark comparing the fdbased dispatch modes")
+	addr1 := flag.String("addr1", "fd00::1", "address of the first gonet stack of each pair, within fd00::/8")
+	addr2 := flag.String("addr2", "fd00::2", "address of the second gonet stack of each pair, within fd00::/8")
+	netProtos := flag.String("netprotos", "ipv4,ipv6", "comma-separated network protocols for the gonet stacks")
+	transProtos := flag.String("transprotos", "udp,tcp", "comma-separated transport protocols for the gonet stacks")
+	seed := flag.Int64("seed", 0, "seed for all randomness in the run; 0 picks one from the clock")
+	arrivalName := flag.String("arrival", "all", "how the client connections of each run are launched: all at once, or at -rate by constant, poisson or burst")
+	arrivalRate := flag.Float64("rate", 1000, "with -arrival, the average number of connections launched a second")
+	arrivalBurst := flag.Int("burst", 10, "with -arrival burst, the number of connections launched together")
+	captureDir := flag.String("capture", "", "write each client connection's received data to conn-<id>.bin in this directory, or throw it away if \"discard\"")
+	verify := flag.Bool("verify", true, "check the data clients receive; -verify=false only captures it")
+	sample := flag.Int("sample", 1, "verify the data of only one client connection in this many, counting the rest as transferred once read to EOF")
+	topo := flag.Bool("topology", false, "only print the NICs, addresses and routes of a gonet pair as JSON")
+	interactive := flag.Bool("interactive", false, "only bring up a gonet pair and drive it with commands read from stdin")
+	selfTest := flag.Bool("selftest", false, "only run the gonet/net equivalence check, exiting non-zero if it fails")
+	traceFile := flag.String("trace", "", "write a Go execution trace of the runs to this file (slows the runs down)")
+	mutexProfile := flag.String("mutexprofile", "", "write a mutex contention profile of the runs to this file, for lock contention in netstack (slows the runs down)")
+	mutexFraction := flag.Int("mutexfraction", 1, "with -mutexprofile, sample one in this many contention events")
+	blockProfile := flag.String("blockprofile", "", "write a goroutine blocking profile of the runs to this file (slows the runs down)")
+	blockRate := flag.Int("blockrate", 10000, "with -blockprofile, sample one blocking event per this many nanoseconds blocked")
+	debugAddr := flag.String("debugaddr", "", "serve pprof and expvar over HTTP on this address while the runs go on, e.g. localhost:6060")
+	csvOut := flag.String("csv", "", "also write each client connection's metrics as CSV to this file, or to stdout for -")
+	jsonOut := flag.Bool("json", false, "write the end-of-run summary as JSON instead of a table")
+	ttfb := flag.Bool("ttfb", false, "add the time-to-first-byte and total transfer time percentiles to the end-of-run table")
+	cpu := flag.Bool("cpu", false, "add the CPU time used per byte transferred to the end-of-run table")
+	histograms := flag.Bool("histogram", false, "follow the end-of-run table with a histogram of each run's transfer times")
+	abortThreshold := flag.Float64("maxfail", 0, "cancel a run early once more than this fraction (0-1) of its connections have failed; 0 never does")
+	maxErrors := flag.Int("maxerrors", 100, "keep the first this many connection errors of each run, listed in the JSON summary; later ones are only counted")
+	timeout := flag.Duration("timeout", 10*time.Second, "deadline for each run, after which outstanding connections are cancelled")
+	recordFile := flag.String("record", "", "write the runs' specification, every flag's resolved value including the seed, and how each run ended to this file, for -replay")
+	replayFile := flag.String("replay", "", "rerun with the flags recorded in this -record file, those given on the command line taking precedence, and check that the runs end as recorded")
+	flag.Parse()
+	var spec *runSpec
+	if *replayFile != "" {
+		var err error
+		spec, err = loadSpec(*replayFile)
+		if err == nil {
+			var unknown []string
+			unknown, err = spec.apply()
+			if len(unknown) > 0 {
+				fmt.Printf("replay: ignoring flags this build doesn't have: %s\n", strings.Join(unknown, ", "))
+			}
+		}
+		if err != nil {
+			fmt.Printf("-replay error: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	if *abortThreshold < 0 || *abortThreshold >= 1 {
+		fmt.Printf("invalid -maxfail: %g is not in [0, 1)\n", *abortThreshold)
+		os.Exit(1)
+	}
+	if *maxErrors < 0 {
+		fmt.Printf("invalid -maxerrors: %d is negative\n", *maxErrors)
+		os.Exit(1)
+	}
+	if *connectRate < 0 || *connectBurst < 1 {
+		fmt.Printf("invalid -connectrate %g or -connectburst %d\n", *connectRate, *connectBurst)
+		os.Exit(1)
+	}
+	if *listeners > 65535-1234 {
+		fmt.Printf("invalid -listeners: %d listeners don't fit in the ports from 1234\n", *listeners)
+		os.Exit(1)
+	}
+	if *backlog < 1 {
+		fmt.Printf("invalid -backlog: %d is not positive\n", *backlog)
+		os.Exit(1)
+	}
+	sockType, ok := socketTypes[*sockTypeName]
+	if !ok {
+		fmt.Printf("unknown socket type: %s\n", *sockTypeName)
+		os.Exit(1)
+	}
+	if *seed == 0 {
+		// Set through the flag package, so that the environment reports it.
+		_ = flag.Set("seed", strconv.FormatInt(time.Now().UnixNano(), 10))
+	}
+	fmt.Printf("Seed: %d\n", *seed)
+	env := currentEnvironment()
+	fmt.Printf("Environment: %s\n", env)
+	if spec != nil {
+		if changes := spec.environmentChanges(env); len(changes) > 0 {
+			fmt.Printf("replay: recorded on a different environment, results may differ: %s\n", strings.Join(changes, "; "))
+		}
+	}
+	if _, err := raiseFileLimit(); err != nil {
+		fmt.Printf("file limit error: %s\n", err)
+	}
+	setPooledServers(*pooled)
+	opts := stackOptions{
+		seed:            *seed,
+		sockType:        sockType,
+		queues:          *queues,
+		timeWaitTimeout: *twTimeout,
+		mtu:             uint32(*mtu),
+		latency:         *latency,
+		countWindows:    *countWindows,
+		receiveBuffer:   *rcvBuf,
+		sendBuffer:      *sndBuf,
+	}
+	if *congestion != "" {
+		if err := checkCongestionControl(*congestion); err != nil {
+			fmt.Printf("-cc error: %s\n", err)
+			os.Exit(1)
+		}
+		opts.congestionControl = *congestion
+	}
+	if *rcvBuf < 0 || *sndBuf < 0 {
+		fmt.Printf("invalid buffer size: -rcvbuf %d, -sndbuf %d\n", *rcvBuf, *sndBuf)
+		os.Exit(1)
+	}
+	if *stack2Tuning != "" {
+		peer, err := parseStackTuning(*stack2Tuning)
+		if err != nil {
+			fmt.Printf("-stack2 error: %s\n", err)
+			os.Exit(1)
+		}
+		opts.peer = peer
+	}
+	for _, name := range strings.Split(*netProtos, ",") {
+		proto, ok := networkProtocols[name]
+		if !ok {
+			fmt.Printf("unknown network protocol: %s\n", name)
+			os.Exit(1)
+		}
+		opts.networkProtocols = append(opts.networkProtocols, proto)
+	}
+	for _, name := range strings.Split(*transProtos, ",") {
+		proto, ok := transportProtocols[name]
+		if !ok {
+			fmt.Printf("unknown transport protocol: %s\n", name)
+			os.Exit(1)
+		}
+		opts.transportProtocols = append(opts.transportProtocols, proto)
+	}
+	if *twReuse != "" {
+		reuse, ok := timeWaitReuseModes[*twReuse]
+		if !ok {
+			fmt.Printf("unknown TIME-WAIT reuse mode: %s\n", *twReuse)
+			os.Exit(1)
+		}
+		opts.timeWaitReuse = &reuse
+	}
+	dispatchMode, ok := dispatchModes[*dispatch]
+	if !ok {
+		fmt.Printf("unknown dispatch mode: %s\n", *dispatch)
+		os.Exit(1)
+	}
+	opts.dispatchMode = dispatchMode
+	if *sample < 1 {
+		fmt.Printf("sample error: must be at least 1\n")
+		os.Exit(1)
+	}
+	var capt *capture
+	if *captureDir != "" || !*verify || *sample > 1 {
+		capt = &capture{dir: *captureDir, verify: *verify, sample: *sample}
+		if capt.dir == "" {
+			capt.dir = "discard"
+		}
+		if capt.dir != "discard" {
+			if err := os.MkdirAll(capt.dir, 0o755); err != nil {
+				fmt.Printf("capture error: %s\n", err)
+				os.Exit(1)
+			}
+		}
+	}
+	var arr *arrival
+	if *arrivalName != "all" {
+		newPacer, ok := arrivalPatterns[*arrivalName]
+		if !ok {
+			fmt.Printf("unknown arrival pattern: %s\n", *arrivalName)
+			os.Exit(1)
+		}
+		if *arrivalRate <= 0 || *arrivalBurst <= 0 {
+			fmt.Printf("invalid arrival rate %g or burst %d\n", *arrivalRate, *arrivalBurst)
+			os.Exit(1)
+		}
+		arr = &arrival{name: *arrivalName, rate: *arrivalRate, pace: newPacer(newLockedRand(*seed), *arrivalRate, *arrivalBurst)}
+	}
+	if *readSize <= 0 {
+		fmt.Printf("read size error: must be positive\n")
+		os.Exit(1)
+	}
+	var sweepSizes []int
+	if *readSizes != "" {
+		var err error
+		sweepSizes, err = parseSizes(*readSizes)
+		if err != nil {
+			fmt.Printf("read size error: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	var windowSizes []int
+	if *windows != "" {
+		var err error
+		windowSizes, err = parseSizes(*windows)
+		if err != nil {
+			fmt.Printf("window size error: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	var srcPolicies []string
+	if *srcPolicy != "" {
+		var err error
+		srcPolicies, err = parseSourcePolicies(*srcPolicy)
+		if err != nil {
+			fmt.Printf("source policy error: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	var gcPercents []int
+	if *gogc != "" {
+		var err error
+		gcPercents, err = parseGCPercents(*gogc)
+		if err != nil {
+			fmt.Printf("-gogc error: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	var tenants []tenant
+	if *tenantMix != "" {
+		var err error
+		tenants, err = parseTenants(*tenantMix)
+		if err != nil {
+			fmt.Printf("-tenants error: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	if *soakReconnects < 0 {
+		fmt.Printf("reconnects error: must not be negative\n")
+		os.Exit(1)
+	}
+	if *fuzz > maxFuzzCases {
+		fmt.Printf("fuzz error: at most %d cases, one server port each\n", maxFuzzCases)
+		os.Exit(1)
+	}
+	// runReconfig ticks every second divided by the rate, which is zero
+	// above one change a nanosecond, and NewTicker panics on that.
+	if *reconfig > int(time.Second) {
+		fmt.Printf("reconfig error: at most %d changes a second\n", int(time.Second))
+		os.Exit(1)
+	}
+	var tunStackAddr tcpip.Address
+	if *fetchURL != "" {
+		var err error
+		tunStackAddr, err = parseStackAddress(*tunAddr)
+		if err != nil {
+			fmt.Printf("TUN address error: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	profiles := []struct {
+		name, path string
+		rate       int
+	}{
+		{"mutex", *mutexProfile, *mutexFraction},
+		{"block", *blockProfile, *blockRate},
+	}
+	for _, p := range profiles {
+		if p.path != "" && p.rate < 1 {
+			fmt.Printf("%s profile error: rate must be at least 1\n", p.name)
+			os.Exit(1)
+		}
+	}
+	caps, err := probeCapabilities(opts)
+	if err != nil {
+		fmt.Printf("capability probe error: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Capabilities: %s\n", caps)
+	// Options this gvisor can't set are dropped rather than failing every
+	// stack the runs create.
+	for _, o := range []struct {
+		flag  string
+		cap   string
+		set   bool
+		clear func()
+	}{
+		{"-cc", capCongestionControl, opts.congestionControl != "", func() { opts.congestionControl = "" }},
+		{"-rcvbuf", capReceiveBuffer, opts.receiveBuffer != 0, func() { opts.receiveBuffer = 0 }},
+		{"-sndbuf", capSendBuffer, opts.sendBuffer != 0, func() { opts.sendBuffer = 0 }},
+		{"-twtimeout", capTimeWaitTimeout, opts.timeWaitTimeout != 0, func() { opts.timeWaitTimeout = 0 }},
+		{"-twreuse", capTimeWaitReuse, opts.timeWaitReuse != nil, func() { opts.timeWaitReuse = nil }},
+	} {
+		if o.set && !caps.require(o.flag, o.cap) {
+			o.clear()
+		}
+	}
+	if opts.peer != nil && opts.peer.congestionControl != "" && !caps.require("-stack2 cc", capCongestionControl) {
+		opts.peer.congestionControl = ""
+	}
+	env.Stacks = []string{opts.tuning().String(), opts.second().tuning().String()}
+	fmt.Printf("Stacks: first %s; second %s\n", env.Stacks[0], env.Stacks[1])
+	for _, a := range []struct {
+		flag string
+		dst  *tcpip.Address
+	}{{*addr1, &opts.addr1}, {*addr2, &opts.addr2}} {
+		addr, err := parseStackAddress(a.flag)
+		subnet := localSubnet()
+		if err == nil && (len(addr) != header.IPv6AddressSize || !subnet.Contains(addr)) {
+			err = fmt.Errorf("%s is not within %s", a.flag, &subnet)
+		}
+		if err != nil {
+			fmt.Printf("stack address error: %s\n", err)
+			os.Exit(1)
+		}
+		*a.dst = addr
+	}
+	if opts.addr1 == opts.addr2 {
+		fmt.Printf("stack address error: both stacks have address %s\n", opts.addr1)
+		os.Exit(1)
+	}
+	if *pin != "" {
+		cpus, err := parseCPUs(*pin)
+		if err != nil {
+			fmt.Printf("pin error: %s\n", err)
+			os.Exit(1)
+		}
+		opts.pinCPUs = cpus
+	}
+	if *gateway != "" {
+		gw, err := parseStackAddress(*gateway)
+		if err != nil {
+			fmt.Printf("gateway error: %s\n", err)
+			os.Exit(1)
+		}
+		opts.gateway = gw
+	}
+	if *traceFile != "" {
+		stopTrace, err := startTrace(*traceFile)
+		if err != nil {
+			fmt.Printf("trace error: %s\n", err)
+			os.Exit(1)
+		}
+		defer stopTrace()
+	}
+	for _, p := range profiles {
+		if p.path == "" {
+			continue
+		}
+		stopProfile, err := startContentionProfile(p.name, p.path, p.rate)
+		if err != nil {
+			fmt.Printf("%s profile error: %s\n", p.name, err)
+			os.Exit(1)
+		}
+		defer stopProfile()
+	}
+	if *debugAddr != "" {
+		addr, stopDebug, err := startDebugServer(*debugAddr)
+		if err != nil {
+			fmt.Printf("debug server error: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Debug server on http://%s/debug/\n", addr)
+		defer func() {
+			if err := stopDebug(); err != nil {
+				fmt.Printf("debug server shutdown error: %s\n", err)
+			}
+		}()
+	}
+	var sinks []ResultSink
+	if *jsonOut {
+		sinks = append(sinks, newJSONSink(os.Stdout))
+	} else {
+		sinks = append(sinks, newTableSink(os.Stdout, tableColumns{ttfb: *ttfb, cpu: *cpu}, *histograms))
+	}
+	if *csvOut != "" {
+		sinks = append(sinks, newCSVSink(*csvOut))
+	}
+	if *recordFile != "" {
+		sinks = append(sinks, newRecordSink(*recordFile, env))
+	}
+	var replayed *replayCheck
+	if spec != nil {
+		replayed = &replayCheck{spec: spec}
+		sinks = append(sinks, replayed)
+	}
+	ran := false
+	defer func() {
+		if !ran {
+			return
+		}
+		flushSinks(sinks)
+		if replayed != nil {
+			if err := replayed.verify(); err != nil {
+				fmt.Printf("Replay %s\n", err)
+				exitCode = 1
+			}
+		}
+		if n := atomic.LoadInt64(&serverPanics); n != 0 && !*jsonOut {
+			fmt.Printf("%d server connection handlers panicked\n", n)
+		}
+	}()
+	// runFor is run with its own deadline, for runs meant to go on longer
+	// than -timeout.
+	runFor := func(name string, timeout time.Duration, runFunc func(context.Context) error) *RunResult {
+		r := doRun(name, timeout, runConfig{abortThreshold: *abortThreshold, maxErrors: *maxErrors, recordConns: *csvOut != ""}, func(ctx context.Context) error {
+			return runFunc(withPooledCopy(withReadSize(withArrival(withCapture(ctx, capt), arr), *readSize), *pooled))
+		})
+		r.Env = env
+		ran = true
+		for _, sink := range sinks {
+			sink.Record(r)
+		}
+		return r
+	}
+	run := func(name string, runFunc func(context.Context) error) *RunResult {
+		return runFor(name, *timeout, runFunc)
+	}
+	if *fetchURL != "" {
+		if r := run("runFetch", func(ctx context.Context) error { return runFetch(ctx, *tunName, tunStackAddr, *fetchURL, opts) }); r.Err != nil {
+			exitCode = 1
+		}
+		return
+	}
+	if *topo {
+		server, client, err := setupGonetPair(opts)
+		if err == nil {
+			err = writeTopologies(os.Stdout, map[string]*gonetTransport{"server": server, "client": client})
+		}
+		if err != nil {
+			fmt.Printf("topology error: %s\n", err)
+			exitCode = 1
+		}
+		return
+	}
+	if *interactive {
+		if err := runInteractive(os.Stdin, opts); err != nil {
+			fmt.Printf("interactive error: %s\n", err)
+			exitCode = 1
+		}
+		return
+	}
+	if *selfTest {
+		if r := run("runSelfTest 5", func(ctx context.Context) error { return runSelfTest(ctx, 5, opts) }); r.Err != nil {
+			exitCode = 1
+		}
+		return
+	}
+	run("runPipe 100", func(ctx context.Context) error { return runPipe(ctx, 100) })
+	run("runUnix 100", func(ctx context.Context) error { return runUnix(ctx, 100) })
+	run("runRaw 100", func(ctx context.Context) error { return runRaw(ctx, 100) })
+	run("runNet 100", func(ctx context.Context) error { return runNet(ctx, 100) })
+	run("runGonet 10", func(ctx context.Context) error { return runGonet(ctx, 10, opts) })
+	run("runGonet 100", func(ctx context.Context) error { return runGonet(ctx, 100, opts) })
+	if *reusePort > 0 {
+		run("runNetReusePort 100", func(ctx context.Context) error { return runNetReusePort(ctx, 100, *reusePort) })
+		run("runGonetReusePort 10", func(ctx context.Context) error { return runGonetReusePort(ctx, 10, *reusePort, opts) })
+	}
+	if *pool {
+		run("runNetPool 100", func(ctx context.Context) error { return runNetPool(ctx, 100) })
+		run("runGonetPool 10", func(ctx context.Context) error { return runGonetPool(ctx, 10, opts) })
+	}
+	if *checksum {
+		run("runChecksumOffload 10", func(ctx context.Context) error { return runChecksumOffload(ctx, 10, opts) })
+	}
+	if *connect > 0 {
+		run(fmt.Sprintf("runNetConnectRate %d", *connect), func(ctx context.Context) error { return runNetConnectRate(ctx, *connect) })
+		run(fmt.Sprintf("runGonetConnectRate %d", *connect), func(ctx context.Context) error { return runGonetConnectRate(ctx, *connect, opts) })
+	}
+	if *maxConns > 0 {
+		run("runNetLimited 100", func(ctx context.Context) error { return runNetLimited(ctx, 100, *maxConns, *reject) })
+		run("runGonetLimited 10", func(ctx context.Context) error { return runGonetLimited(ctx, 10, *maxConns, *reject, opts) })
+	}
+	if *abortive {
+		run("runAbortiveClose 10", func(ctx context.Context) error { return runAbortiveClose(ctx, 10, opts) })
+	}
+	if *nagle > 0 && caps.require("runNagle", capDelay) {
+		run(fmt.Sprintf("runNagle %d", *nagle), func(ctx context.Context) error { return runNagle(ctx, *nagle, opts) })
+	}
+	if *messages > 0 {
+		run(fmt.Sprintf("runMessages 10x%d", *messages), func(ctx context.Context) error { return runMessages(ctx, 10, *messages, opts) })
+	}
+	if *teardown {
+		run("runTeardown 10", func(ctx context.Context) error { return runTeardown(ctx, 10, opts) })
+	}
+	if *churn > 0 && caps.require("runChurn", capTimeWaitReuse) {
+		// Two reuse modes, each churning for -churn.
+		runFor(fmt.Sprintf("runChurn %s", *churn), 2**churn+*timeout, func(ctx context.Context) error {
+			return runChurn(ctx, *churn, 50, opts)
+		})
+	}
+	if *coldStart > 0 {
+		run(fmt.Sprintf("runColdStart %d", *coldStart), func(ctx context.Context) error { return runColdStart(ctx, *coldStart, opts) })
+	}
+	if *urgent {
+		run("runUrgent", func(ctx context.Context) error { return runUrgent(ctx, opts) })
+	}
+	if len(tenants) > 0 {
+		run(fmt.Sprintf("runTenants %d", len(tenants)), func(ctx context.Context) error { return runTenants(ctx, tenants, opts) })
+	}
+	if *stackClose {
+		run("runStackClose 10", func(ctx context.Context) error { return runStackClose(ctx, 10, opts) })
+	}
+	if *duplex {
+		run("runDuplex 10", func(ctx context.Context) error { return runDuplex(ctx, 10, opts) })
+	}
+	if *udpChecksum {
+		run("runUDPChecksum", func(ctx context.Context) error { return checkUDPChecksums(opts) })
+	}
+	if *connectRate > 0 {
+		// The limited modes dial as many connections as the unlimited ones
+		// if -connect is given, for comparison, and two seconds' worth if not.
+		n := *connect
+		if n == 0 {
+			n = int(2 * *connectRate)
+			if n < 2 {
+				n = 2
+			}
+		}
+		run(fmt.Sprintf("runNetConnectLimited %d", n), func(ctx context.Context) error {
+			return runNetConnectLimited(ctx, n, *connectRate, *connectBurst)
+		})
+		run(fmt.Sprintf("runGonetConnectLimited %d", n), func(ctx context.Context) error {
+			return runGonetConnectLimited(ctx, n, *connectRate, *connectBurst, opts)
+		})
+	}
+	if *migrate {
+		run("runMigration 5", func(ctx context.Context) error { return runMigration(ctx, 5, opts) })
+	}
+	if *listeners > 0 {
+		run(fmt.Sprintf("runGonetListeners %d", 10**listeners), func(ctx context.Context) error {
+			return runGonetListeners(ctx, 10**listeners, *listeners, opts)
+		})
+	}
+	if *xorEcho {
+		run("runXorEcho 10", func(ctx context.Context) error { return runXorEcho(ctx, 10, opts) })
+	}
+	if *copyBench {
+		run("runCopyComparison 10", func(ctx context.Context) error { return runCopyComparison(ctx, 10, opts) })
+	}
+	if *linkLocal {
+		run("runLinkLocal", func(ctx context.Context) error { return runLinkLocal(ctx, opts) })
+	}
+	if *acceptDelay > 0 {
+		runFor(fmt.Sprintf("runDelayedAccept %s", *acceptDelay), delayedAcceptTimeout(*acceptDelay, 50)+*timeout, func(ctx context.Context) error {
+			return runDelayedAccept(ctx, *acceptDelay, *backlog, 50, opts)
+		})
+	}
+	if *workers > 0 {
+		run(fmt.Sprintf("runServerModels %d", *workers), func(ctx context.Context) error { return runServerModels(ctx, *workers, 10, 5, opts) })
+	}
+	if len(gcPercents) > 0 {
+		run("runGOGCSweep 10", func(ctx context.Context) error { return runGOGCSweep(ctx, gcPercents, 10, opts) })
+	}
+	if *readdress {
+		runFor("runAddressReassignment 5", readdressRunTimeout(5)+*timeout, func(ctx context.Context) error {
+			return runAddressReassignment(ctx, 5, opts)
+		})
+	}
+	if *idleMem > 0 {
+		run(fmt.Sprintf("runIdleMemory %d", *idleMem), func(ctx context.Context) error { return runIdleMemory(ctx, *idleMem, opts) })
+	}
+	if *simOpen {
+		run("runSimultaneousOpen 10", func(ctx context.Context) error { return runSimultaneousOpen(ctx, 10, opts) })
+	}
+	if *multiHop {
+		run("runMultiHop 10", func(ctx context.Context) error { return runMultiHop(ctx, 10, opts) })
+	}
+	if len(windowSizes) > 0 {
+		runFor(fmt.Sprintf("runWindowClamp %s", *windows), time.Duration(len(windowSizes))*time.Second+*timeout, func(ctx context.Context) error {
+			return runWindowClamp(ctx, windowSizes, time.Second, opts)
+		})
+	}
+	if *seqCheck {
+		run("runSeqCheck 10", func(ctx context.Context) error { return runSeqCheck(ctx, 10, opts) })
+	}
+	if len(srcPolicies) > 0 {
+		run(fmt.Sprintf("runSourceSelection %s", *srcPolicy), func(ctx context.Context) error {
+			return runSourceSelection(ctx, srcPolicies, 6, opts)
+		})
+	}
+	if *c10k > 0 {
+		runFor(fmt.Sprintf("runC10K %s", *c10k), c10kTimeout(*c10k)+*timeout, func(ctx context.Context) error {
+			return runC10K(ctx, *c10k, opts)
+		})
+	}
+	if *pmtud {
+		run("runPMTUD 5", func(ctx context.Context) error { return runPMTUD(ctx, 5, opts) })
+		run("runMTUMismatch 5", func(ctx context.Context) error { return runMTUMismatch(ctx, 5, opts) })
+	}
+	if *fuzz > 0 {
+		run(fmt.Sprintf("runFuzz %d", *fuzz), func(ctx context.Context) error { return runFuzz(ctx, *fuzz, opts) })
+	}
+	if *linkState {
+		run("runLinkState 5", func(ctx context.Context) error { return runLinkState(ctx, 5, opts) })
+	}
+	if *dispatchBench {
+		run("runDispatch 10", func(ctx context.Context) error { return runDispatch(ctx, 10, opts) })
+	}
+	if *chunk > 0 {
+		runFor(fmt.Sprintf("runChunked %d", *chunk), chunkedTimeout(*chunk, *chunkDelay)+*timeout, func(ctx context.Context) error {
+			return runChunked(ctx, 10, *chunk, *chunkDelay, opts)
+		})
+	}
+	if *slowRead > 0 {
+		runFor(fmt.Sprintf("runSlowRead %s", *slowRead), slowReadTimeout(*slowRead)+*timeout, func(ctx context.Context) error {
+			return runSlowRead(ctx, 5, *slowRead, opts)
+		})
+	}
+	if *reconfig > 0 {
+		run(fmt.Sprintf("runReconfig %d", *reconfig), func(ctx context.Context) error { return runReconfig(ctx, 10, *reconfig, 2*time.Second, opts) })
+	}
+	if *handshake > 0 {
+		run(fmt.Sprintf("runHandshakeRTT %d", *handshake), func(ctx context.Context) error { return runHandshakeRTT(ctx, *handshake, opts) })
+	}
+	if *extHdr {
+		run("runExtHeaders 5", func(ctx context.Context) error { return runExtHeaders(ctx, 5, opts) })
+	}
+	if *fastOpen > 0 {
+		run(fmt.Sprintf("runFastOpen %d", *fastOpen), func(ctx context.Context) error { return runFastOpen(ctx, *fastOpen, opts) })
+	}
+	if *allocProfile {
+		run("runAllocs 100", func(ctx context.Context) error { return runAllocs(ctx, 100, opts) })
+	}
+	if *mtuChange > 0 {
+		run(fmt.Sprintf("runMTUChange 10 every %s", *mtuChange), func(ctx context.Context) error { return runMTUChange(ctx, 10, *mtuChange, opts) })
+	}
+	if *soak > 0 {
+		runFor(fmt.Sprintf("runSoak 10 for %s", *soak), *soak+*timeout, func(ctx context.Context) error {
+			return runSoak(ctx, 10, *soak, *soakReconnects, opts)
+		})
+	}
+	if len(sweepSizes) > 0 {
+		// A -timeout for each size, readSizePayload keeping each within one.
+		runFor("runReadSizes 10", time.Duration(len(sweepSizes))**timeout, func(ctx context.Context) error {
+			return runReadSizes(ctx, 10, sweepSizes, opts)
+		})
+	}
+	if *isolation > 0 {
+		run(fmt.Sprintf("runIsolation %dx10", *isolation), func(ctx context.Context) error { return runIsolation(ctx, *isolation, 10, opts) })
+	}
+	if *injectRST {
+		run("runResetInjection 10", func(ctx context.Context) error { return runResetInjection(ctx, 10, opts) })
+	}
+	if *injectFile != "" {
+		run("runInject", func(ctx context.Context) error { return runInject(ctx, *injectFile, opts) })
+	}
+	if *file != "" {
+		run("runFile 10", func(ctx context.Context) error { return runFile(ctx, *file, 10, opts) })
+	}
+	if *queues > 1 {
+		run("runMultiqueue 10", func(ctx context.Context) error { return runMultiqueue(ctx, 10, opts) })
+	}
 }
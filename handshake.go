@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"sync"
+	"time"
+)
+
+// synTap is spliced into a socketpair like pmtuRouter, but passes every
+// packet through unchanged, timing each handshake from the SYN crossing the
+// link to the SYN-ACK crossing back. That leaves out everything above the
+// link, in particular goroutine scheduling on both sides.
+type synTap struct {
+	mu   sync.Mutex
+	syns map[synKey]time.Time
+	rtts []time.Duration
+}
+
+// synKey identifies a handshake by its client's address and port.
+type synKey struct {
+	addr tcpip.Address
+	port uint16
+}
+
+// relay is the tap's packetRelay.
+func (t *synTap) relay(_ int, pkt []byte, _ func(int, []byte) error) bool {
+	t.observe(pkt, time.Now())
+	return true
+}
+
+// observe records pkt if it is a SYN or SYN-ACK seen at now. A retransmitted
+// SYN keeps the time of the first, so handshakes that lost their SYN show up
+// as outliers rather than being hidden.
+func (t *synTap) observe(pkt []byte, now time.Time) {
+	if len(pkt) < header.IPv6MinimumSize || header.IPVersion(pkt) != header.IPv6Version {
+		return
+	}
+	ip := header.IPv6(pkt)
+	if ip.TransportProtocol() != header.TCPProtocolNumber || len(ip.Payload()) < header.TCPMinimumSize {
+		return
+	}
+	tcp := header.TCP(ip.Payload())
+	flags := tcp.Flags()
+	if !flags.Contains(header.TCPFlagSyn) {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !flags.Contains(header.TCPFlagAck) {
+		key := synKey{addr: ip.SourceAddress(), port: tcp.SourcePort()}
+		if _, ok := t.syns[key]; !ok {
+			t.syns[key] = now
+		}
+		return
+	}
+	key := synKey{addr: ip.DestinationAddress(), port: tcp.DestinationPort()}
+	if sent, ok := t.syns[key]; ok {
+		t.rtts = append(t.rtts, now.Sub(sent))
+		delete(t.syns, key)
+	}
+}
+
+// runHandshakeRTT dials nConns gonet connections across a synTap and reports
+// the distribution of handshake times seen on the link alongside the time
+// each Dial took, the difference being the cost of everything above it.
+func runHandshakeRTT(ctx context.Context, nConns int, opts stackOptions) error {
+	addr1, addr2 := pairAddresses(opts)
+	tap := &synTap{syns: make(map[synKey]time.Time)}
+	fd1, fd2, err := spliceSocketpairs(opts.sockType, tap.relay)
+	if err != nil {
+		return err
+	}
+	server, client, err := setupStackPairFDs([]int{fd1}, []int{fd2}, addr1, addr2, opts)
+	if err != nil {
+		return err
+	}
+	serverT, clientT := gonetPair(server, addr1, client, addr2)
+	go testServer(serverT, 1234)
+	time.Sleep(time.Millisecond)
+	var mu sync.Mutex
+	var dials []time.Duration
+	wg := &sync.WaitGroup{}
+	wg.Add(nConns)
+	for i := 0; i < nConns; i++ {
+		go func() {
+			defer wg.Done()
+			id := newConnID()
+			start := time.Now()
+			c, err := clientT.Dial(ctx, 1234)
+			if err != nil {
+				resultFrom(ctx).addResult(err, false)
+				logConn(id, "dial TCP error: %s%s", err, dialErrorHint(err))
+				return
+			}
+			mu.Lock()
+			dials = append(dials, time.Since(start))
+			mu.Unlock()
+			verifyConn(ctx, id, c, []byte(testMsg), start)
+		}()
+	}
+	wg.Wait()
+	tap.mu.Lock()
+	rtts := append([]time.Duration(nil), tap.rtts...)
+	unanswered := len(tap.syns)
+	tap.mu.Unlock()
+	fmt.Printf("handshake on the link: %s\n", formatPercentiles(rtts))
+	fmt.Printf("dial: %s\n", formatPercentiles(dials))
+	if unanswered > 0 {
+		fmt.Printf("%d SYNs were never answered\n", unanswered)
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+	"strings"
+	"time"
+)
+
+// numHistBuckets is the number of histogram buckets. Bucket 0 holds times
+// under a microsecond and bucket i those from 2^(i-1) up to 2^i
+// microseconds, so the last one, from about 67s, also takes anything longer.
+const numHistBuckets = 28
+
+// histogram counts durations in power-of-two buckets. Unlike percentiles it
+// keeps the shape of the distribution, so that a run with two populations of
+// connections, say those that were retransmitted and those that weren't,
+// shows two peaks.
+type histogram [numHistBuckets]int64
+
+func histBucket(d time.Duration) int {
+	i := bits.Len64(uint64(d / time.Microsecond))
+	if i >= numHistBuckets {
+		i = numHistBuckets - 1
+	}
+	return i
+}
+
+func (h *histogram) add(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	h[histBucket(d)]++
+}
+
+// histogramBucket is a bucket of a histogram in reportable form: how many
+// durations fell below Below, and at or above the previous bucket's.
+type histogramBucket struct {
+	Below time.Duration `json:"below_ns"`
+	Count int64         `json:"count"`
+}
+
+// buckets returns h's buckets from the first to the last non-empty one, or
+// nil if h is empty.
+func (h *histogram) buckets() []histogramBucket {
+	first, last := -1, -1
+	for i, n := range h {
+		if n != 0 {
+			if first < 0 {
+				first = i
+			}
+			last = i
+		}
+	}
+	if first < 0 {
+		return nil
+	}
+	out := make([]histogramBucket, 0, last-first+1)
+	for i := first; i <= last; i++ {
+		out = append(out, histogramBucket{Below: time.Microsecond << i, Count: h[i]})
+	}
+	return out
+}
+
+// histBarWidth is the length of the longest bar writeHistograms draws.
+const histBarWidth = 40
+
+// writeHistograms draws each run's histogram of transfer times as bars.
+func writeHistograms(w io.Writer, results []*RunResult) error {
+	for _, r := range results {
+		buckets := r.summary().TransferHistogram
+		if buckets == nil {
+			continue
+		}
+		var max int64
+		for _, b := range buckets {
+			if b.Count > max {
+				max = b.Count
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s transfer times:\n", r.Name); err != nil {
+			return err
+		}
+		for _, b := range buckets {
+			bar := strings.Repeat("#", int((b.Count*histBarWidth+max-1)/max))
+			if _, err := fmt.Fprintf(w, "  < %-10s %-*s %d\n", b.Below, histBarWidth, bar, b.Count); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// idleServer accepts connections on port and holds each open, reading
+// nothing it expects, until the client closes it. A connection is sent on
+// accepted once it is being held.
+func idleServer(t Transport, port uint16, accepted chan<- net.Conn) {
+	li, err := serverListen(t, port)
+	if err != nil {
+		fmt.Printf("Listen error: %s\n", err)
+		return
+	}
+	for {
+		sc, err := li.Accept()
+		if err != nil {
+			logAcceptError(err)
+			return
+		}
+		go func() {
+			defer sc.Close()
+			accepted <- sc
+			_, _ = io.Copy(io.Discard, sc)
+		}()
+	}
+}
+
+// idleMemory is what the process holds in memory: live heap and goroutine
+// stacks, read after a forced GC so that garbage isn't counted.
+type idleMemory struct {
+	heap, stacks uint64
+}
+
+func readIdleMemory() idleMemory {
+	runtime.GC()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return idleMemory{heap: ms.HeapAlloc, stacks: ms.StackInuse}
+}
+
+// readSettledMemory is readIdleMemory once the goroutine stacks have stopped
+// shrinking. Each GC shrinks only by half the stacks that goroutines of
+// earlier runs grew and no longer use, so a baseline read after just one
+// would fall over the measurement.
+func readSettledMemory() idleMemory {
+	m := readIdleMemory()
+	for i := 0; i < 10; i++ {
+		next := readIdleMemory()
+		if next.stacks >= m.stacks {
+			return next
+		}
+		m = next
+	}
+	return m
+}
+
+// perConn returns how much m grew over base per connection, which may be
+// negative if the heap shrank meanwhile.
+func (m idleMemory) perConn(base idleMemory, n int) (float64, float64) {
+	return (float64(m.heap) - float64(base.heap)) / float64(n),
+		(float64(m.stacks) - float64(base.stacks)) / float64(n)
+}
+
+// awaitGoroutinesSettled waits up to timeout for the goroutine count to stop
+// changing, as goroutines of earlier runs can still be exiting, so that a
+// baseline read afterwards isn't lowered by them.
+func awaitGoroutinesSettled(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	n, steady := runtime.NumGoroutine(), 0
+	for steady < 5 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		if now := runtime.NumGoroutine(); now != n {
+			n, steady = now, 0
+			continue
+		}
+		steady++
+	}
+}
+
+// runIdleMemory opens nConns connections over native TCP and gonet, holds
+// them idle with the server side accepted, and reports how much the heap
+// and goroutine stacks grew per connection once settled, then closes them.
+// Both ends of each connection are in the process, so the figures cover a
+// client and a server endpoint together. The native path's figures are just
+// the net package's side of things: its socket buffers are kernel memory,
+// which doesn't show up here, while gonet's are on the heap.
+func runIdleMemory(ctx context.Context, nConns int, opts stackOptions) error {
+	server, client, err := setupGonetPair(opts)
+	if err != nil {
+		return err
+	}
+	paths := []struct {
+		name   string
+		server Transport
+		client Transport
+		port   uint16
+	}{
+		{"net", &netTransport{addr: net.ParseIP("::1")}, &netTransport{addr: net.ParseIP("::1")}, 9678},
+		{"gonet", server, client, 1234},
+	}
+	failed := false
+	for _, path := range paths {
+		accepted := make(chan net.Conn, nConns)
+		go idleServer(path.server, path.port, accepted)
+		time.Sleep(time.Millisecond)
+		awaitGoroutinesSettled(time.Second)
+		base := readSettledMemory()
+		var conns []net.Conn
+		for i := 0; i < nConns && ctx.Err() == nil; i++ {
+			id := newConnID()
+			c, err := path.client.Dial(ctx, path.port)
+			if err != nil {
+				resultFrom(ctx).addResult(err, false)
+				logConn(id, "dial TCP error: %s%s", err, dialErrorHint(err))
+				continue
+			}
+			conns = append(conns, c)
+		}
+		var serverConns []net.Conn
+		for len(serverConns) < len(conns) && ctx.Err() == nil {
+			select {
+			case sc := <-accepted:
+				serverConns = append(serverConns, sc)
+			case <-ctx.Done():
+			}
+		}
+		held := len(serverConns)
+		if held > 0 {
+			// A moment for the handshakes' last segments and timers to
+			// settle, so that only the idle state is measured.
+			time.Sleep(100 * time.Millisecond)
+			heap, stacks := readIdleMemory().perConn(base, held)
+			if heap < 0 || stacks < 0 {
+				fmt.Printf("%s: %d idle connections, memory per connection not measured, as the process's shrank meanwhile\n",
+					path.name, held)
+			} else {
+				fmt.Printf("%s: %d idle connections, %.0f bytes of heap and %.0f of goroutine stack each\n",
+					path.name, held, heap, stacks)
+			}
+		}
+		wg := &sync.WaitGroup{}
+		for _, c := range conns {
+			wg.Add(1)
+			go func(c net.Conn) {
+				defer wg.Done()
+				err := c.Close()
+				resultFrom(ctx).addResult(err, err == nil)
+			}(c)
+		}
+		wg.Wait()
+		if held != nConns {
+			fmt.Printf("%s: only %d/%d connections were held\n", path.name, held, nConns)
+			failed = true
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	if failed {
+		return fmt.Errorf("not every idle connection was opened")
+	}
+	return nil
+}
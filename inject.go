@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// injector is a single stack on a channel endpoint, with no peer: packets
+// are injected into its NIC as though the peer had sent them, and whatever
+// the stack sends in response is read back off the endpoint. The peer's
+// address is peer, which the stack routes to on-link like any other address
+// in the local subnet.
+type injector struct {
+	netStack *stack.Stack
+	ep       *channel.Endpoint
+	addr     tcpip.Address
+	peer     tcpip.Address
+}
+
+// newInjector returns an injector whose stack has the first pair address and
+// expects packets from the second.
+func newInjector(opts stackOptions) (*injector, error) {
+	addr, peer := pairAddresses(opts)
+	netStack, err := newStack(opts)
+	if err != nil {
+		return nil, err
+	}
+	mtu := opts.mtu
+	if mtu == 0 {
+		mtu = 1500
+	}
+	ep := channel.New(256, mtu, "")
+	if err := addNIC(netStack, ep, addr, opts); err != nil {
+		return nil, err
+	}
+	return &injector{netStack: netStack, ep: ep, addr: addr, peer: peer}, nil
+}
+
+// Transport returns the injector's stack as a Transport, for listening on.
+// Dialing through it sends a SYN to the peer, which only outgoing will see.
+func (in *injector) Transport() *gonetTransport {
+	return &gonetTransport{netStack: in.netStack, remote: in.peer}
+}
+
+// inject delivers the raw IP packet pkt to the stack's NIC.
+func (in *injector) inject(pkt []byte) {
+	proto := ipv6.ProtocolNumber
+	if len(pkt) > 0 && header.IPVersion(pkt) == header.IPv4Version {
+		proto = ipv4.ProtocolNumber
+	}
+	in.ep.InjectInbound(proto, stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Data: buffer.NewViewFromBytes(pkt).ToVectorisedView(),
+	}))
+}
+
+// outgoing returns the packets the stack sends until none has been sent
+// for wait.
+func (in *injector) outgoing(wait time.Duration) [][]byte {
+	var pkts [][]byte
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), wait)
+		pkt := in.ep.ReadContext(ctx)
+		cancel()
+		if pkt == nil {
+			return pkts
+		}
+		var b []byte
+		for _, v := range pkt.Views() {
+			b = append(b, v...)
+		}
+		pkt.DecRef()
+		pkts = append(pkts, b)
+	}
+}
+
+// ipv6Packet returns an IPv6 packet from src to dst carrying transport,
+// whose checksum, if it has one, must already cover the pseudo-header.
+func ipv6Packet(src, dst tcpip.Address, proto tcpip.TransportProtocolNumber, transport []byte) []byte {
+	pkt := make([]byte, header.IPv6MinimumSize+len(transport))
+	header.IPv6(pkt).Encode(&header.IPv6Fields{
+		PayloadLength:     uint16(len(transport)),
+		TransportProtocol: proto,
+		HopLimit:          64,
+		SrcAddr:           src,
+		DstAddr:           dst,
+	})
+	copy(pkt[header.IPv6MinimumSize:], transport)
+	return pkt
+}
+
+// tcpPacket returns an IPv6 TCP segment from src to dst with the given
+// header fields and payload. The data offset and checksum are filled in.
+func tcpPacket(src, dst tcpip.Address, fields header.TCPFields, payload []byte) []byte {
+	seg := make([]byte, header.TCPMinimumSize+len(payload))
+	fields.DataOffset = header.TCPMinimumSize
+	fields.Checksum = 0
+	tcp := header.TCP(seg)
+	tcp.Encode(&fields)
+	copy(seg[header.TCPMinimumSize:], payload)
+	xsum := header.PseudoHeaderChecksum(header.TCPProtocolNumber, src, dst, uint16(len(seg)))
+	xsum = header.Checksum(payload, xsum)
+	tcp.SetChecksum(^tcp.CalculateChecksum(xsum))
+	return ipv6Packet(src, dst, header.TCPProtocolNumber, seg)
+}
+
+// udpPacket returns an IPv6 UDP datagram from src to dst.
+func udpPacket(src, dst tcpip.Address, srcPort, dstPort uint16, payload []byte) []byte {
+	dgram := make([]byte, header.UDPMinimumSize+len(payload))
+	udp := header.UDP(dgram)
+	udp.Encode(&header.UDPFields{
+		SrcPort: srcPort,
+		DstPort: dstPort,
+		Length:  uint16(len(dgram)),
+	})
+	copy(dgram[header.UDPMinimumSize:], payload)
+	xsum := header.PseudoHeaderChecksum(header.UDPProtocolNumber, src, dst, uint16(len(dgram)))
+	xsum = header.Checksum(payload, xsum)
+	udp.SetChecksum(^udp.CalculateChecksum(xsum))
+	return ipv6Packet(src, dst, header.UDPProtocolNumber, dgram)
+}
+
+// echoRequest returns an ICMPv6 echo request from src to dst.
+func echoRequest(src, dst tcpip.Address, ident, seq uint16, payload []byte) []byte {
+	msg := make([]byte, header.ICMPv6EchoMinimumSize+len(payload))
+	icmp := header.ICMPv6(msg)
+	icmp.SetType(header.ICMPv6EchoRequest)
+	icmp.SetIdent(ident)
+	icmp.SetSequence(seq)
+	copy(msg[header.ICMPv6EchoMinimumSize:], payload)
+	icmp.SetChecksum(header.ICMPv6Checksum(header.ICMPv6ChecksumParams{
+		Header:      icmp[:header.ICMPv6EchoMinimumSize],
+		Src:         src,
+		Dst:         dst,
+		PayloadCsum: header.Checksum(payload, 0),
+		PayloadLen:  len(payload),
+	}))
+	return ipv6Packet(src, dst, header.ICMPv6ProtocolNumber, msg)
+}
+
+// describePacket summarises an IPv6 packet in a tcpdump-like line.
+func describePacket(pkt []byte) string {
+	if len(pkt) < header.IPv6MinimumSize || header.IPVersion(pkt) != header.IPv6Version {
+		return fmt.Sprintf("non-IPv6 packet of %d bytes", len(pkt))
+	}
+	ip := header.IPv6(pkt)
+	src, dst, payload := ip.SourceAddress(), ip.DestinationAddress(), ip.Payload()
+	switch ip.TransportProtocol() {
+	case header.TCPProtocolNumber:
+		if len(payload) < header.TCPMinimumSize {
+			break
+		}
+		tcp := header.TCP(payload)
+		return fmt.Sprintf("TCP [%s]:%d > [%s]:%d %s seq %d ack %d win %d len %d",
+			src, tcp.SourcePort(), dst, tcp.DestinationPort(), strings.Join(strings.Fields(tcp.Flags().String()), ""),
+			tcp.SequenceNumber(), tcp.AckNumber(), tcp.WindowSize(), len(tcp.Payload()))
+	case header.UDPProtocolNumber:
+		if len(payload) < header.UDPMinimumSize {
+			break
+		}
+		udp := header.UDP(payload)
+		return fmt.Sprintf("UDP [%s]:%d > [%s]:%d len %d",
+			src, udp.SourcePort(), dst, udp.DestinationPort(), len(udp.Payload()))
+	case header.ICMPv6ProtocolNumber:
+		if len(payload) < header.ICMPv6MinimumSize {
+			break
+		}
+		icmp := header.ICMPv6(payload)
+		return fmt.Sprintf("ICMPv6 %s > %s type %d code %d", src, dst, icmp.Type(), icmp.Code())
+	}
+	return fmt.Sprintf("IPv6 %s > %s protocol %d len %d", src, dst, ip.TransportProtocol(), len(payload))
+}
+
+// readPackets reads hex-encoded packets from r, one per line. Blank lines
+// and lines starting with # are skipped, as is whitespace within a line, so
+// that packets can be laid out in readable groups of bytes.
+func readPackets(r io.Reader) ([][]byte, error) {
+	var pkts [][]byte
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.Join(strings.Fields(sc.Text()), "")
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		pkt, err := hex.DecodeString(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		pkts = append(pkts, pkt)
+	}
+	return pkts, sc.Err()
+}
+
+// runInject replays the packets in file into an injector whose stack has a
+// test server listening on port 1234, printing each packet and what the
+// stack sent back in response to it.
+func runInject(ctx context.Context, file string, opts stackOptions) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	pkts, err := readPackets(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	in, err := newInjector(opts)
+	if err != nil {
+		return err
+	}
+	go testServer(in.Transport(), 1234)
+	time.Sleep(time.Millisecond)
+	for i, pkt := range pkts {
+		fmt.Printf("%d > %s\n", i, describePacket(pkt))
+		in.inject(pkt)
+		for _, out := range in.outgoing(50 * time.Millisecond) {
+			fmt.Printf("%d < %s\n", i, describePacket(out))
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const interactiveHelp = `commands:
+  listen <port>        serve the test message on the server stack, as testServer
+  echo <port>          echo back whatever arrives on the server stack
+  dial <port>          dial the server stack from the client stack
+  send <conn> <text>   write text to a connection
+  recv <conn>          read whatever arrives on a connection within a second
+  close <conn>         close a connection
+  conns                list the open connections
+  stats                print the counters of both stacks
+  topology             print the NICs, addresses and routes of both stacks as JSON
+  help                 print this
+  quit                 exit`
+
+// interactiveReadTimeout bounds how long recv waits for data.
+const interactiveReadTimeout = time.Second
+
+// runInteractive brings up a gonet pair and then drives it with commands
+// read from in, one per line, until EOF or quit.
+func runInteractive(in io.Reader, opts stackOptions) error {
+	server, client, err := setupGonetPair(opts)
+	if err != nil {
+		return err
+	}
+	conns := make(map[int64]net.Conn)
+	defer func() {
+		for _, c := range conns {
+			_ = c.Close()
+		}
+	}()
+	fmt.Println(interactiveHelp)
+	scanner := bufio.NewScanner(in)
+	for fmt.Print("> "); scanner.Scan(); fmt.Print("> ") {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		cmd, args := fields[0], fields[1:]
+		if cmd == "quit" || cmd == "exit" {
+			return nil
+		}
+		if err := interactiveCommand(cmd, args, server, client, conns); err != nil {
+			fmt.Printf("%s error: %s\n", cmd, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// interactiveCommand runs one command against the pair, keeping the open
+// client connections in conns by connection ID.
+func interactiveCommand(cmd string, args []string, server, client *gonetTransport, conns map[int64]net.Conn) error {
+	switch cmd {
+	case "listen", "echo":
+		port, err := interactivePort(args)
+		if err != nil {
+			return err
+		}
+		if cmd == "listen" {
+			go testServer(server, port)
+		} else {
+			go echoServer(server, port)
+		}
+		fmt.Printf("%s server on port %d\n", cmd, port)
+	case "dial":
+		port, err := interactivePort(args)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		c, err := client.Dial(ctx, port)
+		if err != nil {
+			return fmt.Errorf("%w%s", err, dialErrorHint(err))
+		}
+		id := newConnID()
+		conns[id] = c
+		logConn(id, "connected %s -> %s", c.LocalAddr(), c.RemoteAddr())
+	case "send":
+		id, c, err := interactiveConn(args, conns)
+		if err != nil {
+			return err
+		}
+		if len(args) < 2 {
+			return fmt.Errorf("usage: send <conn> <text>")
+		}
+		n, err := c.Write([]byte(strings.Join(args[1:], " ")))
+		if err != nil {
+			return err
+		}
+		logConn(id, "sent %d bytes", n)
+	case "recv":
+		id, c, err := interactiveConn(args, conns)
+		if err != nil {
+			return err
+		}
+		_ = c.SetReadDeadline(time.Now().Add(interactiveReadTimeout))
+		defer c.SetReadDeadline(time.Time{})
+		b := make([]byte, 64<<10)
+		n, err := c.Read(b)
+		if n > 0 {
+			logConn(id, "received %d bytes: %s", n, abbreviate(b[:n]))
+		}
+		switch {
+		case err == io.EOF:
+			logConn(id, "EOF")
+		case classifyError(err) == failTimeout:
+			if n == 0 {
+				logConn(id, "nothing received in %s", interactiveReadTimeout)
+			}
+		case err != nil:
+			return err
+		}
+	case "close":
+		id, c, err := interactiveConn(args, conns)
+		if err != nil {
+			return err
+		}
+		delete(conns, id)
+		if err := c.Close(); err != nil {
+			return err
+		}
+		logConn(id, "closed")
+	case "conns":
+		ids := make([]int64, 0, len(conns))
+		for id := range conns {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		for _, id := range ids {
+			logConn(id, "%s -> %s", conns[id].LocalAddr(), conns[id].RemoteAddr())
+		}
+		fmt.Printf("%d open connections\n", len(conns))
+	case "stats":
+		dumpStats("server", server.netStack)
+		dumpStats("client", client.netStack)
+		fmt.Printf("server: TCP states: %s\n", formatStates(tcpStates(server.netStack)))
+		fmt.Printf("client: TCP states: %s\n", formatStates(tcpStates(client.netStack)))
+	case "topology":
+		return writeTopologies(os.Stdout, map[string]*gonetTransport{"server": server, "client": client})
+	case "help":
+		fmt.Println(interactiveHelp)
+	default:
+		return fmt.Errorf("unknown command %q; try help", cmd)
+	}
+	return nil
+}
+
+func interactivePort(args []string) (uint16, error) {
+	if len(args) != 1 {
+		return 0, fmt.Errorf("expected a port")
+	}
+	port, err := strconv.ParseUint(args[0], 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid port: %s", args[0])
+	}
+	return uint16(port), nil
+}
+
+func interactiveConn(args []string, conns map[int64]net.Conn) (int64, net.Conn, error) {
+	if len(args) == 0 {
+		return 0, nil, fmt.Errorf("expected a connection ID")
+	}
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid connection ID: %s", args[0])
+	}
+	c, ok := conns[id]
+	if !ok {
+		return 0, nil, fmt.Errorf("no open connection %d", id)
+	}
+	return id, c, nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// isolationPair is one of the independent pairs of an isolation run: a
+// server and a client stack on their own link, with addresses used by no
+// other pair, and the payload only this pair's server sends.
+type isolationPair struct {
+	server, client         *gonetTransport
+	serverAddr, clientAddr tcpip.Address
+	payload                []byte
+	// strays counts connections the server accepted from anyone other
+	// than its own client.
+	strays int64
+}
+
+// isolationServer serves p's payload on port, counting and logging any
+// connection that doesn't come from p's client.
+func isolationServer(p *isolationPair, id int, port uint16) {
+	li, err := serverListen(p.server, port)
+	if err != nil {
+		fmt.Printf("Listen error: %s\n", err)
+		return
+	}
+	for {
+		sc, err := li.Accept()
+		if err != nil {
+			logAcceptError(err)
+			return
+		}
+		if from := sc.RemoteAddr().(*net.TCPAddr).IP; !from.Equal(net.IP(p.clientAddr)) {
+			atomic.AddInt64(&p.strays, 1)
+			fmt.Printf("pair %d: server %s accepted a connection from %s, which is not its client\n", id, p.serverAddr, from)
+		}
+		go serveConn(sc, p.payload)
+	}
+}
+
+// runIsolation brings up nPairs independent gonet pairs and checks that they
+// don't see each other's traffic. Every pair's server sends its own payload
+// on the same port, and nConns clients per pair, all pairs at once, must
+// each receive exactly their own server's payload. Then each client dials
+// the next pair's server, which is not on its link: that must fail, and no
+// server may ever accept a connection from another pair's client.
+func runIsolation(ctx context.Context, nPairs, nConns int, opts stackOptions) error {
+	pairs := make([]*isolationPair, nPairs)
+	for i := range pairs {
+		p := &isolationPair{
+			serverAddr: tcpip.Address(net.ParseIP(fmt.Sprintf("fd00::%x:1", i+1))),
+			clientAddr: tcpip.Address(net.ParseIP(fmt.Sprintf("fd00::%x:2", i+1))),
+		}
+		// Each payload starts with its pair's number, so that a payload
+		// delivered to the wrong pair is recognisable as well as wrong.
+		p.payload = append([]byte(fmt.Sprintf("pair %d ", i)), randomPayload(rand.New(rand.NewSource(opts.seed+int64(i))), 64*1024)...)
+		// A pair's two stacks take seedsPerStack seeds each, so no two
+		// stacks of any pairs share one.
+		pairOpts := opts
+		pairOpts.seed += int64(2 * seedsPerStack * i)
+		server, client, err := setupStackPair(p.serverAddr, p.clientAddr, pairOpts)
+		if err != nil {
+			return err
+		}
+		p.server, p.client = gonetPair(server, p.serverAddr, client, p.clientAddr)
+		pairs[i] = p
+		go isolationServer(p, i, 1234)
+	}
+	time.Sleep(time.Millisecond)
+	var crossDelivered int64
+	intact := make([]int64, nPairs)
+	wg := &sync.WaitGroup{}
+	wg.Add(nPairs * nConns)
+	for i, p := range pairs {
+		i, p := i, p
+		for j := 0; j < nConns; j++ {
+			go func() {
+				defer wg.Done()
+				id := newConnID()
+				start := time.Now()
+				c, err := p.client.Dial(ctx, 1234)
+				if err != nil {
+					resultFrom(ctx).addResult(err, false)
+					logConn(id, "dial TCP error: %s%s", err, dialErrorHint(err))
+					return
+				}
+				b, err := receiveConn(ctx, c, start)
+				resultFrom(ctx).addResult(err, bytes.Equal(b, p.payload))
+				if err != nil {
+					logConn(id, "%s", err)
+					return
+				}
+				if bytes.Equal(b, p.payload) {
+					atomic.AddInt64(&intact[i], 1)
+					return
+				}
+				for k, other := range pairs {
+					if k != i && bytes.Equal(b, other.payload) {
+						atomic.AddInt64(&crossDelivered, 1)
+						logConn(id, "pair %d's client received pair %d's payload", i, k)
+						return
+					}
+				}
+				logConn(id, "incorrect data received: expected %s but got %s", abbreviate(p.payload), abbreviate(b))
+			}()
+		}
+	}
+	wg.Wait()
+	failed := false
+	for i := range pairs {
+		fmt.Printf("pair %d: %d/%d connections received their own payload intact\n", i, intact[i], nConns)
+		if intact[i] != int64(nConns) {
+			failed = true
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	var leaked int64
+	if nPairs > 1 {
+		wg.Add(nPairs)
+		for i, p := range pairs {
+			i, p := i, p
+			go func() {
+				defer wg.Done()
+				other := pairs[(i+1)%nPairs]
+				t := &gonetTransport{netStack: p.client.netStack, remote: other.serverAddr}
+				dctx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+				defer cancel()
+				c, err := t.Dial(dctx, 1234)
+				if err != nil {
+					return
+				}
+				_ = c.Close()
+				atomic.AddInt64(&leaked, 1)
+				fmt.Printf("pair %d: client reached pair %d's server at %s\n", i, (i+1)%nPairs, other.serverAddr)
+			}()
+		}
+		wg.Wait()
+	}
+	var strays int64
+	for _, p := range pairs {
+		strays += atomic.LoadInt64(&p.strays)
+	}
+	fmt.Printf("%d pairs: %d payloads delivered to the wrong pair, %d dials reached another pair, %d connections accepted from another pair\n",
+		nPairs, crossDelivered, leaked, strays)
+	if crossDelivered != 0 || leaked != 0 || strays != 0 {
+		return fmt.Errorf("traffic crossed between pairs")
+	}
+	if failed {
+		return fmt.Errorf("not every connection received its own pair's payload")
+	}
+	return nil
+}
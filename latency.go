@@ -0,0 +1,65 @@
+package main
+
+import (
+	"time"
+)
+
+// maxDelayedPackets bounds the packets a delaying relay holds in flight in
+// one direction. It has to cover the bandwidth-delay product of the link,
+// or the relay, rather than the delay, becomes what limits throughput.
+const maxDelayedPackets = 1 << 16
+
+// delayedSocketpairs is socketpairs with a relay spliced into the middle of
+// each pair that holds every packet for delay before passing it on, in
+// either direction. Packets keep their order, and nothing is lost unless
+// more than maxDelayedPackets are in flight at once, when the relay stops
+// reading and the sender's writes back up into the socket buffer instead.
+func delayedSocketpairs(sockType int, n int, delay time.Duration) ([]int, []int, error) {
+	var fds1, fds2 []int
+	for i := 0; i < n; i++ {
+		fd1, fd2, err := spliceSocketpairs(sockType, newDelayRelay(delay))
+		if err != nil {
+			return nil, nil, err
+		}
+		fds1 = append(fds1, fd1)
+		fds2 = append(fds2, fd2)
+	}
+	return fds1, fds2, nil
+}
+
+// delayedPacket is a packet held by a delay relay until due, to be sent on
+// with send.
+type delayedPacket struct {
+	due  time.Time
+	b    []byte
+	send func(dir int, pkt []byte) error
+}
+
+// newDelayRelay returns a packetRelay that holds every packet for delay,
+// queueing it for a goroutine per direction to send on when due, so that
+// reading goes on meanwhile.
+func newDelayRelay(delay time.Duration) packetRelay {
+	var queues [2]chan delayedPacket
+	for dir := range queues {
+		queue := make(chan delayedPacket, maxDelayedPackets)
+		queues[dir] = queue
+		go func(dir int) {
+			for p := range queue {
+				if d := time.Until(p.due); d > 0 {
+					time.Sleep(d)
+				}
+				if err := p.send(dir, p.b); err != nil {
+					return
+				}
+			}
+		}(dir)
+	}
+	return func(dir int, pkt []byte, send func(int, []byte) error) bool {
+		if pkt == nil {
+			close(queues[dir])
+			return false
+		}
+		queues[dir] <- delayedPacket{due: time.Now().Add(delay), b: append([]byte(nil), pkt...), send: send}
+		return false
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"os"
+	"runtime"
+	"syscall"
+	"time"
+)
+
+// leakTolerance is how many goroutines above the starting count still pass
+// a leak check, for those the runtime and the standard library start of
+// their own accord.
+const leakTolerance = 2
+
+// stopFDsPerNIC is the fds an fdbased endpoint leaks however it is torn
+// down: each of its dispatchers has an eventfd to be told to stop with,
+// which fdbased never closes and gives no access to.
+const stopFDsPerNIC = 1
+
+// resources is a count of the process's goroutines and open fds.
+type resources struct {
+	goroutines int
+	fds        int
+}
+
+func countResources() resources {
+	r := resources{goroutines: runtime.NumGoroutine()}
+	if fds, err := os.ReadDir("/proc/self/fd"); err == nil {
+		r.fds = len(fds)
+	}
+	return r
+}
+
+func (r resources) String() string {
+	return fmt.Sprintf("%d goroutines, %d fds", r.goroutines, r.fds)
+}
+
+// awaitRelease waits up to timeout for the process to be back to within
+// leakTolerance goroutines and fdAllowance fds of before, as goroutines
+// take a moment to notice they are done, and returns how many of each are
+// left over. A check that fails has leaked.
+func awaitRelease(before resources, fdAllowance int, timeout time.Duration) (resources, bool) {
+	deadline := time.Now().Add(timeout)
+	for {
+		now := countResources()
+		leaked := resources{goroutines: now.goroutines - before.goroutines, fds: now.fds - before.fds}
+		if leaked.goroutines <= leakTolerance && leaked.fds <= fdAllowance {
+			return leaked, true
+		}
+		if time.Now().After(deadline) {
+			return leaked, false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// teardownStacks releases what stacks hold: it aborts their endpoints,
+// listeners included, so that servers' accept loops return, removes their
+// NICs, which stops fdbased's dispatch loops, waits for every worker
+// goroutine to halt, and closes the link's fds, which fdbased never closes
+// itself, so nothing else would.
+func teardownStacks(fds []int, stacks ...*stack.Stack) {
+	for _, s := range stacks {
+		s.Close()
+		for id := range s.NICInfo() {
+			_ = s.RemoveNIC(id)
+		}
+		s.Wait()
+	}
+	for _, fd := range fds {
+		_ = syscall.Close(fd)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestLeakDetector(t *testing.T) {
+	if err := checkLeakDetector(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLeaks(t *testing.T) {
+	if err := checkLeaks(testContext(t), testOptions()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkLeakDetector leaks more goroutines than leakTolerance allows and a
+// socketpair on purpose, and checks that awaitRelease reports both leaked,
+// then releases them and checks that it no longer does, so that checkLeaks
+// passing means something.
+func checkLeakDetector() error {
+	runtime.GC()
+	before := countResources()
+	release := make(chan struct{})
+	for i := 0; i <= leakTolerance; i++ {
+		go func() { <-release }()
+	}
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		close(release)
+		return err
+	}
+	leaked, ok := awaitRelease(before, 0, 100*time.Millisecond)
+	fmt.Printf("leak detector, leaking: %s left over\n", leaked)
+	close(release)
+	_ = syscall.Close(fds[0])
+	_ = syscall.Close(fds[1])
+	if ok || leaked.goroutines <= leakTolerance || leaked.fds < len(fds) {
+		return fmt.Errorf("leak detector missed %d goroutines and %d fds leaked on purpose, seeing %s", leakTolerance+1, len(fds), leaked)
+	}
+	leaked, ok = awaitRelease(before, 0, 2*time.Second)
+	fmt.Printf("leak detector, released: %s left over\n", leaked)
+	if !ok {
+		return fmt.Errorf("leak detector still sees %s once the leaks were released", leaked)
+	}
+	return nil
+}
+
+// checkLeaks runs connections over a gonet pair with a testServer, tears the
+// pair down with teardownStacks, and checks that nothing is left behind but
+// fdbased's stop fds.
+func checkLeaks(ctx context.Context, opts stackOptions) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	runtime.GC()
+	before := countResources()
+	fds1, fds2, err := socketpairs(opts.sockType, 1)
+	if err != nil {
+		return err
+	}
+	addr1, addr2 := pairAddresses(opts)
+	stack1, stack2, err := setupStackPairFDs(fds1, fds2, addr1, addr2, opts)
+	if err != nil {
+		return err
+	}
+	server, client := gonetPair(stack1, addr1, stack2, addr2)
+	if err := runPair(ctx, server, client, 1234, 5); err != nil {
+		return fmt.Errorf("leak check: %w", err)
+	}
+	teardownStacks(append(fds1, fds2...), stack1, stack2)
+	leaked, ok := awaitRelease(before, 2*stopFDsPerNIC, 2*time.Second)
+	fmt.Printf("leak check, torn down: %s left over, fdbased's stop fds included\n", leaked)
+	if !ok {
+		return fmt.Errorf("torn down gonet pair leaked %s", leaked)
+	}
+	return nil
+}
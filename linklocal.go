@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/fdbased"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseZonedAddress parses a link-local IPv6 address with its zone, as in
+// fe80::1%2, resolving the zone to a NIC of s: by name, or failing that by
+// ID. A link-local address means nothing without a zone, since every link
+// has its own fe80::/64, so one without is refused.
+func parseZonedAddress(s *stack.Stack, zoned string) (tcpip.Address, tcpip.NICID, error) {
+	parts := strings.SplitN(zoned, "%", 2)
+	ip := net.ParseIP(parts[0])
+	if ip == nil || ip.To4() != nil {
+		return "", 0, fmt.Errorf("%q is not an IPv6 address", parts[0])
+	}
+	addr := tcpip.Address(ip)
+	if !header.IsV6LinkLocalUnicastAddress(addr) {
+		return "", 0, fmt.Errorf("%s is not a link-local address", addr)
+	}
+	if len(parts) < 2 || parts[1] == "" {
+		return "", 0, fmt.Errorf("%s has no zone", addr)
+	}
+	for id, info := range s.NICInfo() {
+		if info.Name == parts[1] {
+			return addr, id, nil
+		}
+	}
+	if id, err := strconv.ParseUint(parts[1], 10, 32); err == nil && s.CheckNIC(tcpip.NICID(id)) {
+		return addr, tcpip.NICID(id), nil
+	}
+	return "", 0, fmt.Errorf("zone %q of %s is not a NIC", parts[1], addr)
+}
+
+// addLinkLocalNIC attaches fd to s as NIC id, named name, with the
+// link-local address addr and an on-link route for fe80::/64 through it.
+func addLinkLocalNIC(s *stack.Stack, id tcpip.NICID, name string, fd int, addr tcpip.Address, opts stackOptions) error {
+	mtu := opts.mtu
+	if mtu == 0 {
+		mtu = 1500
+	}
+	endpoint, err := fdbased.New(&fdbased.Options{
+		FDs:                []int{fd},
+		MTU:                mtu,
+		TXChecksumOffload:  opts.checksumOffload,
+		RXChecksumOffload:  opts.checksumOffload,
+		PacketDispatchMode: opts.dispatchMode,
+	})
+	if err != nil {
+		return nicErr("create link endpoint", err)
+	}
+	if tcpErr := s.CreateNICWithOptions(id, endpoint, stack.NICOptions{Name: name}); tcpErr != nil {
+		return nicErr("create NIC", wrapTCPIP(tcpErr))
+	}
+	if tcpErr := s.AddProtocolAddress(id, tcpip.ProtocolAddress{
+		Protocol:          ipv6.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddressWithPrefix{Address: addr, PrefixLen: 64},
+	}, stack.AddressProperties{}); tcpErr != nil {
+		return stackErr("add address", wrapTCPIP(tcpErr))
+	}
+	s.AddRoute(tcpip.Route{
+		Destination: tcpip.AddressWithPrefix{Address: addr, PrefixLen: 64}.Subnet(),
+		NIC:         id,
+	})
+	return nil
+}
+
+// runLinkLocal checks dialing link-local addresses by zone. The client stack
+// has two NICs, each linked to a server stack, and both servers have the
+// same link-local address, fe80::1, as hosts on different links may: only
+// the zone tells them apart. Each server sends the zone it should be
+// reached by, so a dial scoped to the wrong NIC shows up as the wrong
+// message. netstack doesn't refuse a link-local dial with no zone, but
+// sends it by the first route that fits, so where one goes is reported,
+// as not every stack would get there.
+func runLinkLocal(ctx context.Context, opts stackOptions) error {
+	serverAddr := tcpip.Address(net.ParseIP("fe80::1"))
+	clientAddr := tcpip.Address(net.ParseIP("fe80::2"))
+	client, err := newStack(opts)
+	if err != nil {
+		return err
+	}
+	zones := []struct {
+		nic  tcpip.NICID
+		name string
+	}{{1, "ll1"}, {2, "ll2"}}
+	for _, z := range zones {
+		clientFDs, serverFDs, err := socketpairs(opts.sockType, 1)
+		if err != nil {
+			return err
+		}
+		if err := addLinkLocalNIC(client, z.nic, z.name, clientFDs[0], clientAddr, opts); err != nil {
+			return err
+		}
+		opts.seed += seedsPerStack
+		server, err := newStack(opts)
+		if err != nil {
+			return err
+		}
+		if err := addLinkLocalNIC(server, 1, "1", serverFDs[0], serverAddr, opts); err != nil {
+			return err
+		}
+		go payloadServer(&gonetTransport{netStack: server, remote: clientAddr}, 1234, []byte(z.name))
+	}
+	time.Sleep(time.Millisecond)
+	failed := false
+	for _, z := range zones {
+		zoned := fmt.Sprintf("%s%%%s", serverAddr, z.name)
+		addr, nic, err := parseZonedAddress(client, zoned)
+		if err != nil {
+			return err
+		}
+		id := newConnID()
+		start := time.Now()
+		c, err := (&gonetTransport{netStack: client, remote: addr, nic: nic}).Dial(ctx, 1234)
+		if err != nil {
+			resultFrom(ctx).addResult(err, false)
+			logConn(id, "dial TCP error to %s: %s%s", zoned, err, dialErrorHint(err))
+			failed = true
+			continue
+		}
+		b, err := receiveConn(ctx, c, start)
+		_ = c.Close()
+		resultFrom(ctx).addResult(err, bytes.Equal(b, []byte(z.name)))
+		switch {
+		case err != nil:
+			logConn(id, "%s: %s", zoned, err)
+			failed = true
+		case !bytes.Equal(b, []byte(z.name)):
+			logConn(id, "%s: reached the server on zone %q", zoned, b)
+			failed = true
+		default:
+			fmt.Printf("%s: zone %s is NIC %d, reached the server on it\n", zoned, z.name, nic)
+		}
+	}
+	dctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	start := time.Now()
+	c, err := gonet.DialContextTCP(dctx, client, tcpip.FullAddress{Addr: serverAddr, Port: 1234}, ipv6.ProtocolNumber)
+	if err == nil {
+		b, err := receiveConn(withResult(dctx, nil), c, start)
+		_ = c.Close()
+		if err != nil {
+			fmt.Printf("%s: dial with no zone connected, then: %s\n", serverAddr, err)
+		} else {
+			fmt.Printf("%s: dial with no zone reached the server on zone %s, by the route table\n", serverAddr, b)
+		}
+	} else {
+		fmt.Printf("%s: dial with no zone failed: %s\n", serverAddr, err)
+	}
+	if _, _, err := parseZonedAddress(client, serverAddr.String()); err == nil {
+		fmt.Printf("%s: parsed with no zone\n", serverAddr)
+		failed = true
+	}
+	if failed {
+		return fmt.Errorf("link-local dials did not go by zone")
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// setNICEnabled brings NIC id on s up or down. Disabling a NIC disables its
+// network endpoints and clears its neighbour table, but leaves its addresses
+// and any routes already bound to it in place.
+func setNICEnabled(s *stack.Stack, id tcpip.NICID, enabled bool) error {
+	var tcpErr tcpip.Error
+	if enabled {
+		tcpErr = s.EnableNIC(id)
+	} else {
+		tcpErr = s.DisableNIC(id)
+	}
+	if tcpErr != nil {
+		return fmt.Errorf("set NIC %d enabled %v: %w", id, enabled, wrapTCPIP(tcpErr))
+	}
+	return nil
+}
+
+// nicFlags returns the state flags of NIC id on s. Netstack always reports
+// its NICs as up; it is Running that tracks whether the NIC is enabled.
+func nicFlags(s *stack.Stack, id tcpip.NICID) (stack.NICStateFlags, error) {
+	info, ok := s.NICInfo()[id]
+	if !ok {
+		return stack.NICStateFlags{}, fmt.Errorf("no NIC %d", id)
+	}
+	return info.Flags, nil
+}
+
+func formatNICFlags(f stack.NICStateFlags) string {
+	var names []string
+	for _, flag := range []struct {
+		name string
+		set  bool
+	}{{"up", f.Up}, {"running", f.Running}, {"promiscuous", f.Promiscuous}, {"loopback", f.Loopback}} {
+		if flag.set {
+			names = append(names, flag.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// echoServer writes back whatever each connection sends until the peer
+// closes it.
+func echoServer(t Transport, port uint16) {
+	li, err := serverListen(t, port)
+	if err != nil {
+		fmt.Printf("Listen error: %s\n", err)
+		return
+	}
+	for {
+		sc, err := li.Accept()
+		if err != nil {
+			logAcceptError(err)
+			return
+		}
+		go func() {
+			_, _ = io.Copy(sc, sc)
+			_ = sc.Close()
+		}()
+	}
+}
+
+// errEchoMismatch is returned by echo when what comes back is not what it
+// sent.
+var errEchoMismatch = errors.New("incorrect data received")
+
+// echo sends the test message on c and waits up to timeout for it to come
+// back.
+func echo(c net.Conn, timeout time.Duration) error {
+	_ = c.SetDeadline(time.Now().Add(timeout))
+	defer c.SetDeadline(time.Time{})
+	if _, err := c.Write([]byte(testMsg)); err != nil {
+		return err
+	}
+	b := make([]byte, len(testMsg))
+	if _, err := io.ReadFull(c, b); err != nil {
+		return err
+	}
+	if string(b) != testMsg {
+		return fmt.Errorf("%w: expected %s but got %s", errEchoMismatch, testMsg, b)
+	}
+	return nil
+}
+
+// dialEchoes dials nConns connections to port and checks one echo on each,
+// returning the connections and the failures, and records each in ctx's run.
+// Dials that are meant to fail are left out of the run's result by giving
+// them withResult(ctx, nil).
+func dialEchoes(ctx context.Context, t Transport, port uint16, nConns int, timeout time.Duration) ([]net.Conn, *failureCounts) {
+	var conns []net.Conn
+	failures := &failureCounts{}
+	for i := 0; i < nConns; i++ {
+		dctx, cancel := context.WithTimeout(ctx, timeout)
+		c, err := t.Dial(dctx, port)
+		cancel()
+		if err == nil {
+			err = echo(c, timeout)
+			if err == nil {
+				resultFrom(ctx).addResult(nil, true)
+				conns = append(conns, c)
+				continue
+			}
+			_ = c.Close()
+		}
+		resultFrom(ctx).addResult(err, false)
+		failures.add(err)
+	}
+	return conns, failures
+}
+
+// echoAll checks one echo on each of conns and returns the failures.
+func echoAll(conns []net.Conn, timeout time.Duration) *failureCounts {
+	failures := &failureCounts{}
+	for _, c := range conns {
+		if err := echo(c, timeout); err != nil {
+			failures.add(err)
+		}
+	}
+	return failures
+}
+
+// runLinkState takes the client stack's NIC down under a set of established
+// connections and checks that they stop carrying data and that new dials
+// fail, then brings it back up and checks that new dials succeed again. Since
+// netstack keeps bound routes across a disable, the established connections
+// may recover too; whether they do is reported but not required.
+func runLinkState(ctx context.Context, nConns int, opts stackOptions) error {
+	server, client, err := setupGonetPair(opts)
+	if err != nil {
+		return err
+	}
+	go echoServer(server, 1234)
+	time.Sleep(time.Millisecond)
+	const timeout = 500 * time.Millisecond
+	report := func(event string) {
+		flags, err := nicFlags(client.netStack, 1)
+		if err != nil {
+			fmt.Printf("%s: %s\n", event, err)
+			return
+		}
+		fmt.Printf("%s: client NIC flags %s\n", event, formatNICFlags(flags))
+	}
+
+	report("initial")
+	conns, failures := dialEchoes(ctx, client, 1234, nConns, timeout)
+	defer func() {
+		for _, c := range conns {
+			_ = c.Close()
+		}
+	}()
+	fmt.Printf("up: %d/%d connections established, failures: %s\n", len(conns), nConns, failures)
+	if len(conns) != nConns {
+		return fmt.Errorf("connections failed before the NIC was disabled")
+	}
+
+	if err := setNICEnabled(client.netStack, 1, false); err != nil {
+		return err
+	}
+	report("disabled")
+	var problems []string
+	inFlight := echoAll(conns, timeout)
+	fmt.Printf("down: %d/%d established connections failed: %s\n", inFlight.total(), len(conns), inFlight)
+	if inFlight.total() != int64(len(conns)) {
+		problems = append(problems, fmt.Sprintf("%d established connections still carried data", int64(len(conns))-inFlight.total()))
+	}
+	downConns, failures := dialEchoes(withResult(ctx, nil), client, 1234, nConns, timeout)
+	fmt.Printf("down: %d/%d new dials failed: %s\n", failures.total(), nConns, failures)
+	for _, c := range downConns {
+		_ = c.Close()
+	}
+	if len(downConns) != 0 {
+		problems = append(problems, fmt.Sprintf("%d dials succeeded with the NIC disabled", len(downConns)))
+	}
+
+	if err := setNICEnabled(client.netStack, 1, true); err != nil {
+		return err
+	}
+	report("enabled")
+	upConns, failures := dialEchoes(ctx, client, 1234, nConns, timeout)
+	fmt.Printf("up again: %d/%d new dials succeeded, failures: %s\n", len(upConns), nConns, failures)
+	conns = append(conns, upConns...)
+	if len(upConns) != nConns {
+		problems = append(problems, fmt.Sprintf("%d dials failed after the NIC was re-enabled", nConns-len(upConns)))
+	}
+	recovered := echoAll(conns[:nConns], 2*time.Second)
+	fmt.Printf("up again: %d/%d established connections recovered\n", int64(nConns)-recovered.total(), nConns)
+
+	if len(problems) > 0 {
+		return fmt.Errorf("link state: %s", strings.Join(problems, "; "))
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// loopPollInterval is how often a dial in progress checks its stack for
+// signs of a routing loop.
+const loopPollInterval = 20 * time.Millisecond
+
+// loopCount is the number of packets s has seen go round a loop: its own
+// packets coming back to it, which netstack drops as having a local source
+// address, and, for loops it is not the source of, packets that ran out of
+// hop limit while it forwarded them or that another stack reported with ICMP
+// time exceeded. Between socketpair-linked stacks, nothing but a routing loop
+// causes any of these.
+func loopCount(s *stack.Stack) uint64 {
+	st := s.Stats()
+	return st.IP.InvalidSourceAddressesReceived.Value() +
+		st.IP.Forwarding.ExhaustedTTL.Value() +
+		st.ICMP.V4.PacketsReceived.TimeExceeded.Value() +
+		st.ICMP.V6.PacketsReceived.TimeExceeded.Value()
+}
+
+// mayLoop reports whether s is set up so that its packets could go round a
+// routing loop: it forwards, or it has a route through a gateway, which with
+// HandleLocal can hand a packet to a peer that hands it straight back.
+// Stacks that only reach an on-link subnet can't loop.
+func mayLoop(s *stack.Stack) bool {
+	for _, r := range s.GetRouteTable() {
+		if r.Gateway != "" {
+			return true
+		}
+	}
+	for id := range s.NICInfo() {
+		for _, proto := range []tcpip.NetworkProtocolNumber{ipv4.ProtocolNumber, ipv6.ProtocolNumber} {
+			if on, tcpErr := s.NICForwarding(id, proto); tcpErr == nil && on {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// dialDetectingLoops calls dial, abandoning it if s starts seeing packets
+// go round a loop. Nothing tells netstack's TCP about a looping SYN, so it
+// would otherwise be retransmitted into the loop, silently, until the dial
+// times out or ctx ends.
+func dialDetectingLoops(ctx context.Context, s *stack.Stack, dial func(context.Context) (net.Conn, error)) (net.Conn, error) {
+	before := loopCount(s)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var looped uint64
+	go func() {
+		ticker := time.NewTicker(loopPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if n := loopCount(s); n != before {
+					atomic.StoreUint64(&looped, n-before)
+					cancel()
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	c, err := dial(ctx)
+	if n := atomic.LoadUint64(&looped); err != nil && n != 0 {
+		return nil, fmt.Errorf("%w: %d looping packets seen while dialing (%s); check the routes and forwarding settings with -topology",
+			errRoutingLoop, n, err)
+	}
+	return c, err
+}
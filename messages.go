@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// message returns the i'th message a message server sends.
+func message(i int) []byte {
+	return []byte(fmt.Sprintf("%s %d", testMsg, i))
+}
+
+// messageServer writes nMsgs framed messages to each connection, then the
+// close marker, and leaves the connection open until the client closes it,
+// so that only the marker tells the client the messages are over.
+func messageServer(t Transport, port uint16, nMsgs int) {
+	li, err := serverListen(t, port)
+	if err != nil {
+		fmt.Printf("Listen error: %s\n", err)
+		return
+	}
+	for {
+		sc, err := li.Accept()
+		if err != nil {
+			logAcceptError(err)
+			return
+		}
+		go func() {
+			defer sc.Close()
+			for i := 0; i < nMsgs; i++ {
+				if err := writeFrame(sc, message(i)); err != nil {
+					return
+				}
+			}
+			if err := writeCloseMarker(sc); err != nil {
+				return
+			}
+			_, _ = io.Copy(io.Discard, sc)
+		}()
+	}
+}
+
+// readMessages reads framed messages from c until the close marker,
+// checking each against message, and returns how many there were. Reaching
+// EOF first is an error, as the marker never came. As with receiveConn, the
+// transfer is timed from start and recorded in the run's result.
+func readMessages(ctx context.Context, c net.Conn, start time.Time) (int, error) {
+	defer resultFrom(ctx).startTransfer()()
+	stop := bindDeadline(ctx, c)
+	defer stop()
+	var ttfb time.Duration
+	n, size := 0, 0
+	for {
+		b, err := readFrame(c)
+		if errors.Is(err, errCloseMarker) {
+			resultFrom(ctx).addTransfer(ttfb, time.Since(start), size)
+			return n, nil
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return n, fmt.Errorf("connection closed after %d messages without a close marker", n)
+		}
+		if err != nil {
+			return n, fmt.Errorf("read TCP error: %w", err)
+		}
+		if n == 0 {
+			ttfb = time.Since(start)
+		}
+		if want := message(n); string(b) != string(want) {
+			return n, fmt.Errorf("incorrect message %d received: expected %s but got %s", n, want, abbreviate(b))
+		}
+		n++
+		size += len(b)
+	}
+}
+
+// runMessages has nConns clients each read nMsgs framed messages until the
+// server's close marker, over native TCP and gonet, and checks that every one
+// got exactly nMsgs. Unlike the payload runs, the end of the data is
+// signalled in band rather than by the server closing the connection.
+func runMessages(ctx context.Context, nConns, nMsgs int, opts stackOptions) error {
+	server, client, err := setupGonetPair(opts)
+	if err != nil {
+		return err
+	}
+	paths := []struct {
+		name   string
+		server Transport
+		client Transport
+		port   uint16
+	}{
+		{"net", &netTransport{addr: net.ParseIP("::1")}, &netTransport{addr: net.ParseIP("::1")}, 9012},
+		{"gonet", server, client, 1234},
+	}
+	failed := false
+	for _, path := range paths {
+		go messageServer(path.server, path.port, nMsgs)
+		time.Sleep(time.Millisecond)
+		var complete, mismatched int64
+		wg := &sync.WaitGroup{}
+		wg.Add(nConns)
+		for i := 0; i < nConns; i++ {
+			go func() {
+				defer wg.Done()
+				id := newConnID()
+				start := time.Now()
+				c, err := path.client.Dial(ctx, path.port)
+				if err != nil {
+					resultFrom(ctx).addResult(err, false)
+					logConn(id, "dial TCP error: %s%s", err, dialErrorHint(err))
+					return
+				}
+				defer c.Close()
+				n, err := readMessages(ctx, c, start)
+				resultFrom(ctx).addResult(err, n == nMsgs)
+				switch {
+				case err != nil:
+					logConn(id, "%s", err)
+				case n != nMsgs:
+					atomic.AddInt64(&mismatched, 1)
+					logConn(id, "incorrect message count: expected %d before the close marker but got %d", nMsgs, n)
+				default:
+					atomic.AddInt64(&complete, 1)
+				}
+			}()
+		}
+		wg.Wait()
+		fmt.Printf("%s: %d/%d connections read all %d messages up to the close marker, %d with the wrong count\n",
+			path.name, complete, nConns, nMsgs, mismatched)
+		if complete != int64(nConns) {
+			failed = true
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	if failed {
+		return fmt.Errorf("not every connection read exactly %d messages", nMsgs)
+	}
+	return nil
+}
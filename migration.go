@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// runMigration moves the client stack's address under a set of established
+// echo connections, as a mobile host's address changes when it switches
+// networks, and checks whether the connections survive. TCP has no way to
+// move a connection to a new address, and netstack binds an endpoint to the
+// address it connected from, so the expected outcome is that none survive;
+// what is checked is that they break cleanly, failing their echoes with an
+// error rather than corrupting data, and that new dials from the new address
+// work. The old address is then moved back, to report whether a connection
+// whose address only went away for a while picks up where it left off.
+func runMigration(ctx context.Context, nConns int, opts stackOptions) error {
+	server, client, err := setupGonetPair(opts)
+	if err != nil {
+		return err
+	}
+	go echoServer(server, 1234)
+	time.Sleep(time.Millisecond)
+	const timeout = 500 * time.Millisecond
+	_, addr := pairAddresses(opts)
+	newAddr := tcpip.Address(net.ParseIP("FD00::12"))
+
+	conns, failures := dialEchoes(ctx, client, 1234, nConns, timeout)
+	defer func() {
+		for _, c := range conns {
+			_ = c.Close()
+		}
+	}()
+	fmt.Printf("before: %d/%d connections established from %s, failures: %s\n", len(conns), nConns, addr, failures)
+	if len(conns) != nConns {
+		return fmt.Errorf("connections failed before the client's address changed")
+	}
+	var problems []string
+	// established checks an echo on each of the original connections and
+	// reports how many survived. One that came back wrong didn't break
+	// cleanly. As in runAddressReassignment, an echo that timed out may
+	// still come back later, so whatever else arrives is drained.
+	established := func(phase string, wait time.Duration) {
+		failures := &failureCounts{}
+		mismatched := 0
+		for _, c := range conns[:nConns] {
+			if err := echo(c, wait); err != nil {
+				failures.add(err)
+				if errors.Is(err, errEchoMismatch) {
+					mismatched++
+				}
+			}
+			_ = c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+			_, _ = io.Copy(io.Discard, c)
+			_ = c.SetReadDeadline(time.Time{})
+		}
+		fmt.Printf("%s: %d/%d established connections survived, failures: %s\n", phase,
+			int64(nConns)-failures.total(), nConns, failures)
+		if mismatched != 0 {
+			problems = append(problems, fmt.Sprintf("%s: %d connections echoed the wrong data", phase, mismatched))
+		}
+	}
+
+	if err := setAddress(client.netStack, addr, false); err != nil {
+		return err
+	}
+	if err := setAddress(client.netStack, newAddr, true); err != nil {
+		return err
+	}
+	established("migrated", timeout)
+	newConns, failures := dialEchoes(ctx, client, 1234, nConns, timeout)
+	conns = append(conns, newConns...)
+	fmt.Printf("migrated: %d/%d new dials from %s succeeded, failures: %s\n", len(newConns), nConns, newAddr, failures)
+	if len(newConns) != nConns {
+		problems = append(problems, fmt.Sprintf("migrated: %d dials from the new address failed", nConns-len(newConns)))
+	}
+
+	if err := setAddress(client.netStack, addr, true); err != nil {
+		return err
+	}
+	// The connections had segments dropped while their address was gone,
+	// so they wait out a retransmission timeout before carrying data again.
+	established("moved back", 3*time.Second)
+
+	if len(problems) > 0 {
+		return fmt.Errorf("migration: %s", strings.Join(problems, "; "))
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/nested"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// linkMTU is an MTU shared by the endpoints of a link that can be changed
+// while it carries traffic. A stack set up with it in its options reports
+// the current value as its NIC's MTU, which netstack rereads for every
+// packet it sends; it can never exceed the MTU the link was created with,
+// as fdbased sizes its receive buffers by that.
+type linkMTU struct {
+	mtu uint32
+
+	mu  sync.Mutex
+	eps []*mtuEndpoint
+}
+
+func newLinkMTU(mtu uint32) *linkMTU {
+	return &linkMTU{mtu: mtu}
+}
+
+func (l *linkMTU) get() uint32 {
+	return atomic.LoadUint32(&l.mtu)
+}
+
+// set changes the MTU of every endpoint on the link.
+func (l *linkMTU) set(mtu uint32) {
+	atomic.StoreUint32(&l.mtu, mtu)
+}
+
+// wrap returns child with its MTU governed by l.
+func (l *linkMTU) wrap(child stack.LinkEndpoint) *mtuEndpoint {
+	e := &mtuEndpoint{link: l}
+	e.Endpoint.Init(child, e)
+	l.mu.Lock()
+	l.eps = append(l.eps, e)
+	l.mu.Unlock()
+	return e
+}
+
+// stats sums the write counters of the link's endpoints.
+func (l *linkMTU) stats() (packets, fragments, oversize int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, e := range l.eps {
+		packets += atomic.LoadInt64(&e.packets)
+		fragments += atomic.LoadInt64(&e.fragments)
+		oversize += atomic.LoadInt64(&e.oversize)
+	}
+	return packets, fragments, oversize
+}
+
+// mtuEndpoint is a link endpoint whose MTU is its link's current one. It
+// counts the packets written through it, those that are IPv6 fragments, and
+// those larger than the MTU at the time, which netstack should never send.
+type mtuEndpoint struct {
+	nested.Endpoint
+	link *linkMTU
+
+	packets, fragments, oversize int64
+}
+
+func (e *mtuEndpoint) MTU() uint32 {
+	if mtu := e.Endpoint.MTU(); mtu < e.link.get() {
+		return mtu
+	}
+	return e.link.get()
+}
+
+func (e *mtuEndpoint) WritePackets(pkts stack.PacketBufferList) (int, tcpip.Error) {
+	mtu := int(e.MTU())
+	for pkt := pkts.Front(); pkt != nil; pkt = pkt.Next() {
+		atomic.AddInt64(&e.packets, 1)
+		if pkt.Size() > mtu {
+			atomic.AddInt64(&e.oversize, 1)
+		}
+		if ip := header.IPv6(pkt.NetworkHeader().View()); len(ip) >= header.IPv6MinimumSize &&
+			ip.NextHeader() == uint8(header.IPv6FragmentExtHdrIdentifier) {
+			atomic.AddInt64(&e.fragments, 1)
+		}
+	}
+	return e.Endpoint.WritePackets(pkts)
+}
+
+// runMTUChange has nConns gonet clients each receive a 4MiB payload while
+// the link MTU is cycled between the configured MTU and smaller ones every
+// interval. TCP fixes its segment size at the handshake, so once the MTU
+// drops below it, IPv6 has to fragment established connections' segments;
+// connections made after a change pick the new MTU up. It fails if any data
+// was lost or any packet was ever sent larger than the MTU of the moment.
+func runMTUChange(ctx context.Context, nConns int, interval time.Duration, opts stackOptions) error {
+	max := opts.mtu
+	if max == 0 {
+		max = 1500
+	}
+	if max <= header.IPv6MinimumMTU {
+		return fmt.Errorf("MTU %d leaves no room to change, as IPv6 needs at least %d", max, header.IPv6MinimumMTU)
+	}
+	mtus := []uint32{max, header.IPv6MinimumMTU, (max + header.IPv6MinimumMTU) / 2}
+	payload := randomPayload(newLockedRand(opts.seed), 4*1024*1024)
+	opts.linkMTU = newLinkMTU(max)
+	server, client, err := setupGonetPair(opts)
+	if err != nil {
+		return err
+	}
+	go payloadServer(server, 1234, payload)
+	time.Sleep(time.Millisecond)
+	stop := make(chan struct{})
+	changed := make(chan int)
+	go func() {
+		n := 0
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				n++
+				opts.linkMTU.set(mtus[n%len(mtus)])
+			case <-stop:
+				opts.linkMTU.set(max)
+				changed <- n
+				return
+			}
+		}
+	}()
+	var intact int64
+	wg := &sync.WaitGroup{}
+	wg.Add(nConns)
+	for i := 0; i < nConns; i++ {
+		go func() {
+			defer wg.Done()
+			id := newConnID()
+			start := time.Now()
+			c, err := client.Dial(ctx, 1234)
+			if err != nil {
+				resultFrom(ctx).addResult(err, false)
+				logConn(id, "dial TCP error: %s%s", err, dialErrorHint(err))
+				return
+			}
+			b, err := receiveConn(ctx, c, start)
+			resultFrom(ctx).addResult(err, bytes.Equal(b, payload))
+			switch {
+			case err != nil:
+				logConn(id, "%s", err)
+			case !bytes.Equal(b, payload):
+				logConn(id, "incorrect data received: expected %d bytes but got %d", len(payload), len(b))
+			default:
+				atomic.AddInt64(&intact, 1)
+			}
+		}()
+		// Stagger the dials so that connections start under different MTUs.
+		time.Sleep(interval / 2)
+	}
+	wg.Wait()
+	close(stop)
+	changes := <-changed
+	packets, fragments, oversize := opts.linkMTU.stats()
+	fmt.Printf("%d MTU changes among %v: %d/%d connections received the payload intact\n", changes, mtus, intact, nConns)
+	fmt.Printf("link: %d packets sent, %d of them IPv6 fragments, %d larger than the MTU\n", packets, fragments, oversize)
+	switch {
+	case intact != int64(nConns):
+		return fmt.Errorf("%d connections lost data across the MTU changes", int64(nConns)-intact)
+	case oversize != 0:
+		return fmt.Errorf("%d packets were sent larger than the MTU", oversize)
+	case changes == 0:
+		return fmt.Errorf("the transfers finished before the MTU was changed; try a shorter interval")
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/fdbased"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"hash/fnv"
+	"net"
+	"sync"
+	"time"
+)
+
+// hopTap is spliced into a socketpair like synTap, passing every packet
+// through and noting when each IPv6 packet first crossed it. Packets are
+// told apart by their addresses and everything after the IPv6 header, so a
+// packet forwarded from one link to another, which changes only in its hop
+// limit, is recognisable on both.
+type hopTap struct {
+	mu   sync.Mutex
+	seen map[uint64]time.Time
+}
+
+func newHopTap() *hopTap {
+	return &hopTap{seen: make(map[uint64]time.Time)}
+}
+
+// relay is the tap's packetRelay.
+func (t *hopTap) relay(_ int, pkt []byte, _ func(int, []byte) error) bool {
+	t.note(pkt)
+	return true
+}
+
+// packetKey identifies pkt regardless of its hop limit.
+func packetKey(pkt []byte) (uint64, bool) {
+	if len(pkt) < header.IPv6MinimumSize || header.IPVersion(pkt) != header.IPv6Version {
+		return 0, false
+	}
+	ip := header.IPv6(pkt)
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(ip.SourceAddress()))
+	_, _ = h.Write([]byte(ip.DestinationAddress()))
+	_, _ = h.Write(pkt[header.IPv6MinimumSize:])
+	return h.Sum64(), true
+}
+
+func (t *hopTap) note(pkt []byte) {
+	key, ok := packetKey(pkt)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.seen[key]; !ok {
+		t.seen[key] = now
+	}
+}
+
+// hopDelays returns how long each packet seen by both taps took to get from
+// one to the other, in whichever direction it went, and the number of
+// packets only first saw, which the hop between them dropped or had yet to
+// pass on.
+func hopDelays(first, second *hopTap) ([]time.Duration, int) {
+	first.mu.Lock()
+	defer first.mu.Unlock()
+	second.mu.Lock()
+	defer second.mu.Unlock()
+	var delays []time.Duration
+	unmatched := 0
+	for key, t1 := range first.seen {
+		t2, ok := second.seen[key]
+		if !ok {
+			unmatched++
+			continue
+		}
+		if t2.Before(t1) {
+			t1, t2 = t2, t1
+		}
+		delays = append(delays, t2.Sub(t1))
+	}
+	return delays, unmatched
+}
+
+// chain is three stacks in a line, A, B and C, with B forwarding between
+// the link it shares with A and the one it shares with C. A and C know
+// nothing of B: each takes the whole local subnet to be on-link, so it
+// sends straight out of its one NIC and B routes the packet on.
+type chain struct {
+	a, b, c *stack.Stack
+	aAddr   tcpip.Address
+	cAddr   tcpip.Address
+	ab, bc  *hopTap
+}
+
+// chainNIC is the NIC the middle stack of a chain reaches C through.
+const chainNIC = 2
+
+// setupChain creates a chain of stacks, each link tapped by a hopTap. A and
+// B share fd00:1::/32 and B and C fd00:2::/32.
+func setupChain(opts stackOptions) (*chain, error) {
+	ch := &chain{
+		aAddr: tcpip.Address(net.ParseIP("fd00:1::1")),
+		cAddr: tcpip.Address(net.ParseIP("fd00:2::2")),
+		ab:    newHopTap(),
+		bc:    newHopTap(),
+	}
+	bAddrs := []tcpip.Address{tcpip.Address(net.ParseIP("fd00:1::2")), tcpip.Address(net.ParseIP("fd00:2::1"))}
+	a1, b1, err := spliceSocketpairs(opts.sockType, ch.ab.relay)
+	if err != nil {
+		return nil, err
+	}
+	b2, c2, err := spliceSocketpairs(opts.sockType, ch.bc.relay)
+	if err != nil {
+		return nil, err
+	}
+	if ch.a, err = setupStack([]int{a1}, ch.aAddr, opts); err != nil {
+		return nil, err
+	}
+	opts.seed += seedsPerStack
+	if ch.b, err = setupStack([]int{b1}, bAddrs[0], opts); err != nil {
+		return nil, err
+	}
+	opts.seed += seedsPerStack
+	if ch.c, err = setupStack([]int{c2}, ch.cAddr, opts); err != nil {
+		return nil, err
+	}
+	mtu := opts.mtu
+	if mtu == 0 {
+		mtu = 1500
+	}
+	endpoint, err := fdbased.New(&fdbased.Options{
+		FDs:                []int{b2},
+		MTU:                mtu,
+		TXChecksumOffload:  opts.checksumOffload,
+		RXChecksumOffload:  opts.checksumOffload,
+		PacketDispatchMode: opts.dispatchMode,
+	})
+	if err != nil {
+		return nil, nicErr("create link endpoint", err)
+	}
+	if tcpErr := ch.b.CreateNICWithOptions(chainNIC, endpoint, stack.NICOptions{Name: "2"}); tcpErr != nil {
+		return nil, nicErr("create NIC", wrapTCPIP(tcpErr))
+	}
+	if tcpErr := ch.b.AddProtocolAddress(chainNIC, tcpip.ProtocolAddress{
+		Protocol:          ipv6.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddressWithPrefix{Address: bAddrs[1], PrefixLen: 128},
+	}, stack.AddressProperties{}); tcpErr != nil {
+		return nil, stackErr("add address", wrapTCPIP(tcpErr))
+	}
+	// B's own on-link route for the whole subnet would send everything
+	// back out towards A, so it is replaced by one route per link.
+	var routes []tcpip.Route
+	for i, nic := range []tcpip.NICID{1, chainNIC} {
+		subnet := tcpip.AddressWithPrefix{Address: bAddrs[i], PrefixLen: 32}.Subnet()
+		routes = append(routes, tcpip.Route{Destination: subnet, NIC: nic})
+	}
+	ch.b.SetRouteTable(routes)
+	if tcpErr := ch.b.SetForwardingDefaultAndAllNICs(ipv6.ProtocolNumber, true); tcpErr != nil {
+		return nil, stackErr("enable forwarding", wrapTCPIP(tcpErr))
+	}
+	return ch, nil
+}
+
+// runMultiHop has nConns gonet clients on stack A of a chain each receive a
+// 1MiB payload from a server on stack C, across B, and then repeats the
+// transfer over a direct pair for comparison. It reports how long B took to
+// forward packets, from their crossing the A-B link to their crossing the
+// B-C link or back, which is B's contribution to the latency, and fails if
+// any payload was damaged or B failed to forward anything.
+func runMultiHop(ctx context.Context, nConns int, opts stackOptions) error {
+	payload := randomPayload(newLockedRand(opts.seed), 1024*1024)
+	ch, err := setupChain(opts)
+	if err != nil {
+		return err
+	}
+	// The direct pair is tapped too, so that its link costs the same relay
+	// copy as each of the chain's.
+	direct := newHopTap()
+	fds1, fds2, err := spliceSocketpairs(opts.sockType, direct.relay)
+	if err != nil {
+		return err
+	}
+	addr1, addr2 := pairAddresses(opts)
+	stack1, stack2, err := setupStackPairFDs([]int{fds1}, []int{fds2}, addr1, addr2, opts)
+	if err != nil {
+		return err
+	}
+	directServer, directClient := gonetPair(stack1, addr1, stack2, addr2)
+	paths := []struct {
+		name   string
+		server Transport
+		client Transport
+	}{
+		// B forwards, so a route gone wrong there could loop.
+		{"A-B-C", &gonetTransport{netStack: ch.c, remote: ch.aAddr, detectLoops: true},
+			&gonetTransport{netStack: ch.a, remote: ch.cAddr, detectLoops: true}},
+		{"direct", directServer, directClient},
+	}
+	for _, path := range paths {
+		go payloadServer(path.server, 1234, payload)
+	}
+	time.Sleep(time.Millisecond)
+	failed := false
+	for _, path := range paths {
+		start := time.Now()
+		received, errs := collectConns(ctx, path.client, 1234, nConns, payload)
+		elapsed := time.Since(start)
+		for _, err := range errs {
+			fmt.Printf("%s: %s\n", path.name, err)
+		}
+		mismatched := 0
+		for _, b := range received {
+			if !bytes.Equal(b, payload) {
+				mismatched++
+			}
+		}
+		fmt.Printf("%s: %d/%d connections intact in %s, %.1f MB/s\n", path.name, len(received)-mismatched, nConns,
+			elapsed.Round(time.Millisecond), float64(len(received)*len(payload))/elapsed.Seconds()/1e6)
+		if len(errs) != 0 || mismatched != 0 {
+			failed = true
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	delays, unmatched := hopDelays(ch.ab, ch.bc)
+	fwd := ch.b.Stats().IP.Forwarding
+	fmt.Printf("B forwarding time: %s\n", formatPercentiles(delays))
+	fmt.Printf("B: %d packets not forwarded, %d forwarding errors, %d unrouteable\n",
+		unmatched, fwd.Errors.Value(), fwd.Unrouteable.Value())
+	switch {
+	case failed:
+		return fmt.Errorf("not every connection received the payload intact")
+	case len(delays) == 0:
+		return fmt.Errorf("no packet was forwarded by B")
+	case fwd.Errors.Value() != 0:
+		return fmt.Errorf("B had %d forwarding errors", fwd.Errors.Value())
+	}
+	return nil
+}
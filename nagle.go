@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// frameEchoServer reads frames from each connection and writes each one
+// straight back, until the peer closes.
+func frameEchoServer(t Transport, port uint16) {
+	li, err := serverListen(t, port)
+	if err != nil {
+		fmt.Printf("Listen error: %s\n", err)
+		return
+	}
+	for {
+		sc, err := li.Accept()
+		if err != nil {
+			logAcceptError(err)
+			return
+		}
+		go func() {
+			defer sc.Close()
+			for {
+				b, err := readFrame(sc)
+				if err != nil {
+					return
+				}
+				if err := writeFrame(sc, b); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// pingPong sends nMsgs tiny frames one at a time over a single connection,
+// waiting for each echo before sending the next, and returns the round trip
+// time of each.
+func pingPong(ctx context.Context, t Transport, port uint16, nMsgs int) ([]time.Duration, error) {
+	c, err := t.Dial(ctx, port)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	stop := bindDeadline(ctx, c)
+	defer stop()
+	msg := []byte("x")
+	rtts := make([]time.Duration, 0, nMsgs)
+	for i := 0; i < nMsgs; i++ {
+		start := time.Now()
+		if err := writeFrame(c, msg); err != nil {
+			return rtts, err
+		}
+		if _, err := readFrame(c); err != nil {
+			return rtts, err
+		}
+		rtts = append(rtts, time.Since(start))
+	}
+	return rtts, nil
+}
+
+// runNagle measures small-message round trip latency over native TCP and
+// gonet with Nagle's algorithm off and then on. With it on, each framed
+// message's body waits behind the unacknowledged header until the header is
+// ACKed. The kernel delays that ACK, typically by tens of milliseconds;
+// netstack has no delayed ACKs, so there the cost is only a round trip.
+func runNagle(ctx context.Context, nMsgs int, opts stackOptions) error {
+	p50 := make(map[string][2]time.Duration)
+	for i, nagle := range []bool{false, true} {
+		native := &netTransport{addr: net.ParseIP("::1"), nagle: nagle}
+		nopts := opts
+		nopts.nagle = nagle
+		server, client, err := setupGonetPair(nopts)
+		if err != nil {
+			return err
+		}
+		paths := []struct {
+			name   string
+			server Transport
+			client Transport
+			port   uint16
+		}{
+			{"net", native, native, uint16(7890 + i)},
+			{"gonet", server, client, 1234},
+		}
+		for _, path := range paths {
+			go frameEchoServer(path.server, path.port)
+			time.Sleep(time.Millisecond)
+			rtts, err := pingPong(ctx, path.client, path.port, nMsgs)
+			if err != nil {
+				return fmt.Errorf("%s nagle %v: %w", path.name, nagle, err)
+			}
+			fmt.Printf("%s, nagle %v: round trip %s\n", path.name, nagle, formatPercentiles(rtts))
+			d := p50[path.name]
+			d[i] = percentiles(rtts, 50)[0]
+			p50[path.name] = d
+		}
+	}
+	for _, name := range []string{"net", "gonet"} {
+		fmt.Printf("%s: Nagle adds %s to the median round trip\n", name, p50[name][1]-p50[name][0])
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+// panicError is a panic recovered from a connection's goroutine, with the
+// stack it was raised on.
+type panicError struct {
+	value interface{}
+	stack []byte
+}
+
+func (e *panicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.value)
+}
+
+func (e *panicError) Is(target error) bool {
+	return target == errPanic
+}
+
+// recoverConn is deferred by a client connection's goroutine, so that a
+// panic in it, or in the netstack or gonet code it calls, is recorded as a
+// failure of that connection, its stack logged, rather than crashing the
+// process and losing the run. Panics in netstack's own goroutines, such as
+// its packet dispatchers, can't be caught this way and still crash it.
+func recoverConn(ctx context.Context, id int64) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	err := &panicError{value: v, stack: debug.Stack()}
+	connRecordFrom(ctx).finish(err, false)
+	resultFrom(ctx).addResult(err, false)
+	logConn(id, "%s\n%s", err, err.stack)
+}
+
+// callRun calls runFunc, recovering a panic in it as a panicError, so that a
+// mode that panics, in its own code or in netstack's called from its
+// goroutine, fails its run rather than taking the runs after it down with
+// it. Together with recoverConn and recoverServerConn this covers every
+// goroutine the harness starts; a panic in one of netstack's own still
+// crashes the process.
+func callRun(ctx context.Context, name string, runFunc func(context.Context) error) (err error) {
+	defer func() {
+		v := recover()
+		if v == nil {
+			return
+		}
+		pe := &panicError{value: v, stack: debug.Stack()}
+		fmt.Printf("%s panicked: %v\n%s", name, v, pe.stack)
+		err = pe
+	}()
+	return runFunc(ctx)
+}
+
+// serverPanics counts the panics recoverServerConn has recovered.
+var serverPanics int64
+
+// recoverServerConn is recoverConn for a server's connection handler. The
+// server has no run to record the panic in, so it prints it and closes sc,
+// leaving the client to fail on the truncated transfer.
+func recoverServerConn(sc net.Conn) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	atomic.AddInt64(&serverPanics, 1)
+	fmt.Printf("server panic: %v\n%s", v, debug.Stack())
+	_ = sc.Close()
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/link/nested"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// pinnedEndpoint wraps a link endpoint so that the goroutines delivering its
+// inbound packets, fdbased's dispatch loops, are each locked to an OS thread
+// pinned to cpu. fdbased starts those goroutines itself, so the first packet
+// each one delivers is the earliest point at which they can be caught.
+type pinnedEndpoint struct {
+	nested.Endpoint
+	name string
+	cpu  int
+
+	mu     sync.Mutex
+	pinned map[int]bool
+}
+
+func newPinnedEndpoint(child stack.LinkEndpoint, name string, cpu int) *pinnedEndpoint {
+	e := &pinnedEndpoint{name: name, cpu: cpu, pinned: make(map[int]bool)}
+	e.Endpoint.Init(child, e)
+	return e
+}
+
+func (e *pinnedEndpoint) DeliverNetworkPacket(protocol tcpip.NetworkProtocolNumber, pkt *stack.PacketBuffer) {
+	e.pin()
+	e.Endpoint.DeliverNetworkPacket(protocol, pkt)
+}
+
+// pin locks the calling goroutine to its thread and pins the thread to the
+// endpoint's CPU, unless that has already been done. A thread that is
+// already pinned can only be running the goroutine that pinned it, since
+// that goroutine holds it for good.
+func (e *pinnedEndpoint) pin() {
+	tid := unix.Gettid()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.pinned[tid] {
+		return
+	}
+	runtime.LockOSThread()
+	e.pinned[tid] = true
+	if err := setThreadAffinity(e.cpu); err != nil {
+		fmt.Printf("%s: pin error: %s\n", e.name, err)
+		return
+	}
+	fmt.Printf("%s: dispatch thread %d pinned to CPU %d\n", e.name, tid, e.cpu)
+}
+
+// setThreadAffinity restricts the calling thread to cpu.
+func setThreadAffinity(cpu int) error {
+	var set unix.CPUSet
+	set.Set(cpu)
+	if err := unix.SchedSetaffinity(0, &set); err != nil {
+		return fmt.Errorf("sched_setaffinity CPU %d: %w", cpu, err)
+	}
+	return nil
+}
+
+// parseCPUs parses a comma-separated list of CPU numbers.
+func parseCPUs(s string) ([]int, error) {
+	var cpus []int
+	for _, f := range strings.Split(s, ",") {
+		cpu, err := strconv.Atoi(f)
+		if err != nil || cpu < 0 || cpu >= runtime.NumCPU() {
+			return nil, fmt.Errorf("invalid CPU %q: must be 0 to %d", f, runtime.NumCPU()-1)
+		}
+		cpus = append(cpus, cpu)
+	}
+	return cpus, nil
+}
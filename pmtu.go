@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pmtuRouter stands in for a router with a smaller onward MTU. Spliced into
+// a socketpair, it forwards packets that fit within mtu and answers the
+// rest with an ICMPv6 Packet Too Big, which is the only way netstack learns
+// of a path MTU lower than its link MTU. It follows each TCP flow's segment
+// sizes through its Packet Too Bigs in flows.
+type pmtuRouter struct {
+	mtu  int
+	addr tcpip.Address
+
+	tooBig       int64
+	maxForwarded int64
+
+	mu    sync.Mutex
+	flows map[uint32]*pmtuFlow
+}
+
+// pmtuFlow is what a pmtuRouter saw of one TCP flow, one direction of a
+// connection. A flow has adapted once, after its first Packet Too Big, it
+// sends a segment filling the path MTU but for its TCP options; oversized
+// counts the segments too big for the path it sent after that, which a
+// sender that took the Packet Too Big in would not.
+type pmtuFlow struct {
+	tooBig    int
+	adapted   bool
+	oversized int
+}
+
+// observe notes a TCP segment of pkt, an IPv6 packet, that the router is
+// forwarding, or answering with a Packet Too Big if tooBig is set.
+func (r *pmtuRouter) observe(pkt []byte, tooBig bool) {
+	ip := header.IPv6(pkt)
+	if ip.TransportProtocol() != header.TCPProtocolNumber || len(ip.Payload()) < header.TCPMinimumSize {
+		return
+	}
+	tcp := header.TCP(ip.Payload())
+	key := uint32(tcp.SourcePort())<<16 | uint32(tcp.DestinationPort())
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.flows == nil {
+		r.flows = make(map[uint32]*pmtuFlow)
+	}
+	f, ok := r.flows[key]
+	if !ok {
+		f = &pmtuFlow{}
+		r.flows[key] = f
+	}
+	switch {
+	case tooBig && f.adapted:
+		f.oversized++
+	case tooBig:
+		f.tooBig++
+	case f.tooBig > 0 && len(pkt) > r.mtu-header.TCPOptionsMaximumSize:
+		f.adapted = true
+	}
+}
+
+// flowSizes returns how many flows had a Packet Too Big, how many of those
+// adapted, and how many segments too big for the path they sent after.
+func (r *pmtuRouter) flowSizes() (tooBig, adapted, oversized int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, f := range r.flows {
+		if f.tooBig == 0 {
+			continue
+		}
+		tooBig++
+		if f.adapted {
+			adapted++
+		}
+		oversized += f.oversized
+	}
+	return tooBig, adapted, oversized
+}
+
+// relay is the router's packetRelay.
+func (r *pmtuRouter) relay(dir int, pkt []byte, send func(int, []byte) error) bool {
+	n := len(pkt)
+	isIPv6 := n >= header.IPv6MinimumSize && header.IPVersion(pkt) == header.IPv6Version
+	if isIPv6 {
+		r.observe(pkt, n > r.mtu)
+	}
+	if n > r.mtu && isIPv6 {
+		if send(1-dir, r.packetTooBig(pkt)) == nil {
+			atomic.AddInt64(&r.tooBig, 1)
+		}
+		return false
+	}
+	for {
+		max := atomic.LoadInt64(&r.maxForwarded)
+		if int64(n) <= max || atomic.CompareAndSwapInt64(&r.maxForwarded, max, int64(n)) {
+			return true
+		}
+	}
+}
+
+// packetTooBig builds the ICMPv6 Packet Too Big sent back to the source of
+// pkt, quoting as much of pkt as fits in the IPv6 minimum MTU.
+func (r *pmtuRouter) packetTooBig(pkt []byte) []byte {
+	quoted := pkt
+	if max := header.IPv6MinimumMTU - header.IPv6MinimumSize - header.ICMPv6PacketTooBigMinimumSize; len(quoted) > max {
+		quoted = quoted[:max]
+	}
+	dst := header.IPv6(pkt).SourceAddress()
+	b := make([]byte, header.IPv6MinimumSize+header.ICMPv6PacketTooBigMinimumSize+len(quoted))
+	header.IPv6(b).Encode(&header.IPv6Fields{
+		PayloadLength:     uint16(header.ICMPv6PacketTooBigMinimumSize + len(quoted)),
+		TransportProtocol: header.ICMPv6ProtocolNumber,
+		HopLimit:          64,
+		SrcAddr:           r.addr,
+		DstAddr:           dst,
+	})
+	icmp := header.ICMPv6(b[header.IPv6MinimumSize:])
+	icmp.SetType(header.ICMPv6PacketTooBig)
+	icmp.SetMTU(uint32(r.mtu))
+	copy(icmp.Payload(), quoted)
+	icmp.SetChecksum(header.ICMPv6Checksum(header.ICMPv6ChecksumParams{
+		Header:      icmp[:header.ICMPv6PacketTooBigMinimumSize],
+		Src:         r.addr,
+		Dst:         dst,
+		PayloadCsum: header.Checksum(quoted, 0),
+		PayloadLen:  len(quoted),
+	}))
+	return b
+}
+
+// runPMTUD transfers a payload several times the path MTU across a
+// pmtuRouter capping the path at the IPv6 minimum MTU, then checks that the
+// sender received Packet Too Big messages, that every flow sent one went on
+// to send segments sized to the path MTU and none too big for it after, and
+// that the data arrived intact. netstack routes carry no MTU of their own,
+// so this, a path MTU learned below the link MTU, is the only way the two
+// come to disagree; the smaller always wins.
+func runPMTUD(ctx context.Context, nConns int, opts stackOptions) error {
+	addr1, addr2 := pairAddresses(opts)
+	router := &pmtuRouter{
+		mtu:  header.IPv6MinimumMTU,
+		addr: tcpip.Address(net.ParseIP("FD00::FE")),
+	}
+	fd1, fd2, err := spliceSocketpairs(opts.sockType, router.relay)
+	if err != nil {
+		return err
+	}
+	server, client, err := setupStackPairFDs([]int{fd1}, []int{fd2}, addr1, addr2, opts)
+	if err != nil {
+		return err
+	}
+	serverT, clientT := gonetPair(server, addr1, client, addr2)
+	payload := randomPayload(rand.New(rand.NewSource(opts.seed)), 64*1024)
+	go payloadServer(serverT, 1234, payload)
+	time.Sleep(time.Millisecond)
+	wg := &sync.WaitGroup{}
+	wg.Add(nConns)
+	go runPayloadConns(ctx, clientT, 1234, payload, nConns, wg)
+	wg.Wait()
+	icmp := server.Stats().ICMP.V6
+	linkMTU, routeMTU, err := routeMTUs(server, addr2)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("link MTU %d, route MTU %d (after the IPv6 header), path MTU %d\n", linkMTU, routeMTU, router.mtu)
+	fmt.Printf("path MTU %d: router sent %d Packet Too Big, server received %d, largest packet forwarded %d\n",
+		router.mtu, atomic.LoadInt64(&router.tooBig), icmp.PacketsReceived.PacketTooBig.Value(),
+		atomic.LoadInt64(&router.maxForwarded))
+	tooBig, adapted, oversized := router.flowSizes()
+	fmt.Printf("flows sent Packet Too Big %d, adapted to the path MTU %d, segments too big for it after %d\n",
+		tooBig, adapted, oversized)
+	switch {
+	case icmp.PacketsReceived.PacketTooBig.Value() == 0:
+		return fmt.Errorf("no Packet Too Big received; path MTU discovery was not exercised")
+	case adapted != tooBig:
+		return fmt.Errorf("%d of %d flows sent Packet Too Big never sent segments sized to the path MTU", tooBig-adapted, tooBig)
+	case oversized != 0:
+		return fmt.Errorf("%d segments too big for the path MTU were sent after their flows adapted to it", oversized)
+	}
+	return ctx.Err()
+}
+
+// runMTUMismatch transfers a payload from a server whose link MTU is opts.mtu
+// to a client whose link MTU is the IPv6 minimum, through a pmtuRouter that
+// passes everything and records the largest packet, and checks that every
+// segment fits the client's MTU. netstack routes carry no MTU of their own,
+// so a route MTU below the link MTU is the peer's: the client advertises it
+// as its MSS, and the server has to size segments to the smaller of that and
+// its own route MTU, with no Packet Too Big to fall back on. The link and
+// route MTUs of both ends are reported along with the largest segment, and
+// so is the effective MSS of each connection, as an mssProbe on the server
+// sees it, which has to fit the client's MTU and fill it but for TCP
+// options.
+func runMTUMismatch(ctx context.Context, nConns int, opts stackOptions) error {
+	addr1, addr2 := pairAddresses(opts)
+	linkMTU := opts.mtu
+	if linkMTU == 0 {
+		linkMTU = 1500
+	}
+	const clientMTU = header.IPv6MinimumMTU
+	if linkMTU <= clientMTU {
+		fmt.Printf("skipped: link MTU %d is no larger than the client's %d\n", linkMTU, clientMTU)
+		return ctx.Err()
+	}
+	peer := opts.tuning()
+	if opts.peer != nil {
+		peer = *opts.peer
+	}
+	peer.mtu = clientMTU
+	opts.peer = &peer
+	router := &pmtuRouter{mtu: int(linkMTU), addr: tcpip.Address(net.ParseIP("FD00::FE"))}
+	fd1, fd2, err := spliceSocketpairs(opts.sockType, router.relay)
+	if err != nil {
+		return err
+	}
+	server, client, err := setupStackPairFDs([]int{fd1}, []int{fd2}, addr1, addr2, opts)
+	if err != nil {
+		return err
+	}
+	probe := &mssProbe{payloads: make(map[uint16]int)}
+	server.AddTCPProbe(probe.probe)
+	defer server.RemoveTCPProbe()
+	serverT, clientT := gonetPair(server, addr1, client, addr2)
+	payload := randomPayload(rand.New(rand.NewSource(opts.seed)), 64*1024)
+	go payloadServer(serverT, 1234, payload)
+	time.Sleep(time.Millisecond)
+	wg := &sync.WaitGroup{}
+	wg.Add(nConns)
+	go runPayloadConns(ctx, clientT, 1234, payload, nConns, wg)
+	wg.Wait()
+	for _, end := range []struct {
+		name   string
+		s      *stack.Stack
+		remote tcpip.Address
+	}{{"server", server, addr2}, {"client", client, addr1}} {
+		link, route, err := routeMTUs(end.s, end.remote)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: link MTU %d, route MTU %d\n", end.name, link, route)
+	}
+	// The MSS the server sends to less the room it keeps for TCP options,
+	// which is at most TCPOptionsMaximumSize.
+	maxPayload := int(clientMTU) - header.IPv6MinimumSize - header.TCPMinimumSize
+	minPayload := maxPayload - header.TCPOptionsMaximumSize
+	payloads := probe.byPort()
+	ports := make([]int, 0, len(payloads))
+	for port := range payloads {
+		ports = append(ports, int(port))
+	}
+	sort.Ints(ports)
+	var misfits []string
+	for _, port := range ports {
+		n := payloads[uint16(port)]
+		fmt.Printf("connection from client port %d: server's effective MSS %d bytes of payload, for an MTU of %d\n", port, n, clientMTU)
+		if n > maxPayload || n < minPayload {
+			misfits = append(misfits, fmt.Sprintf("port %d: %d", port, n))
+		}
+	}
+	if len(ports) < nConns {
+		return fmt.Errorf("the probe saw the MSS of %d of %d connections", len(ports), nConns)
+	}
+	if len(misfits) > 0 {
+		return fmt.Errorf("effective MSS not sized to the client's MTU of %d, between %d and %d bytes of payload: %s",
+			clientMTU, minPayload, maxPayload, strings.Join(misfits, ", "))
+	}
+	largest := atomic.LoadInt64(&router.maxForwarded)
+	fmt.Printf("largest packet on the link %d, client MTU %d\n", largest, clientMTU)
+	if atomic.LoadInt64(&router.tooBig) != 0 {
+		return fmt.Errorf("%d packets exceeded the server's own link MTU", atomic.LoadInt64(&router.tooBig))
+	}
+	if largest > clientMTU {
+		return fmt.Errorf("a %d byte packet exceeded the client's MTU of %d", largest, clientMTU)
+	}
+	return ctx.Err()
+}
+
+// mssProbe is a TCP probe that records the effective MSS of each connection
+// of the stack it is installed on: how much payload the stack's sender puts
+// in a segment, which is the smaller of its own route's MSS and the peer's,
+// less room for TCP options, keyed by the peer's port.
+type mssProbe struct {
+	mu       sync.Mutex
+	payloads map[uint16]int
+}
+
+func (p *mssProbe) probe(st stack.TCPEndpointState) {
+	if st.Sender.MaxPayloadSize == 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.payloads[st.ID.RemotePort] = st.Sender.MaxPayloadSize
+}
+
+// byPort returns a copy of the effective MSS recorded for each peer port.
+func (p *mssProbe) byPort() map[uint16]int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	payloads := make(map[uint16]int, len(p.payloads))
+	for port, n := range p.payloads {
+		payloads[port] = n
+	}
+	return payloads
+}
+
+// routeMTUs returns the link MTU of NIC 1 on s and the MTU of the route from
+// s to remote, which is the link MTU less the network header. Neither
+// reflects a path MTU learned from Packet Too Big, which netstack applies
+// per destination when sizing segments.
+func routeMTUs(s *stack.Stack, remote tcpip.Address) (uint32, uint32, error) {
+	info, ok := s.NICInfo()[1]
+	if !ok {
+		return 0, 0, fmt.Errorf("no NIC 1")
+	}
+	r, tcpErr := s.FindRoute(1, "", remote, ipv6.ProtocolNumber, false)
+	if tcpErr != nil {
+		return 0, 0, fmt.Errorf("find route to %s: %w", remote, wrapTCPIP(tcpErr))
+	}
+	defer r.Release()
+	return info.MTU, r.MTU(), nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// copyBuffers holds the buffers pooled copies go through, of
+// defaultReadSize, so that a transfer borrows one for its duration rather
+// than allocating its own.
+var copyBuffers = sync.Pool{New: func() interface{} {
+	b := make([]byte, defaultReadSize)
+	return &b
+}}
+
+// copyBuffer returns a buffer of n bytes, from copyBuffers if n is the size
+// they are, and a function to give it back.
+func copyBuffer(n int) ([]byte, func()) {
+	if n != defaultReadSize {
+		return make([]byte, n), func() {}
+	}
+	b := copyBuffers.Get().(*[]byte)
+	return *b, func() { copyBuffers.Put(b) }
+}
+
+type pooledCopyKey struct{}
+
+// pooledCopy is the pooled copy setting of a run, holding the SHA-256 of
+// each payload its clients verify against, keyed by where the payload is, as
+// a run's connections all expect the same few. The sums go with the run, so
+// that no payload outlives it for their sake.
+type pooledCopy struct {
+	sums sync.Map
+}
+
+type payloadSumKey struct {
+	p *byte
+	n int
+}
+
+// withPooledCopy makes the clients of ctx's run read with io.CopyBuffer into
+// a pooled buffer and verify what they read by its SHA-256, rather than
+// holding all of it to compare.
+func withPooledCopy(ctx context.Context, on bool) context.Context {
+	var pc *pooledCopy
+	if on {
+		pc = &pooledCopy{}
+	}
+	return context.WithValue(ctx, pooledCopyKey{}, pc)
+}
+
+// pooledCopyFrom returns ctx's pooled copy setting, or nil if its clients
+// don't copy through pooled buffers.
+func pooledCopyFrom(ctx context.Context) *pooledCopy {
+	pc, _ := ctx.Value(pooledCopyKey{}).(*pooledCopy)
+	return pc
+}
+
+// payloadSum returns the SHA-256 of payload, computing it only the first
+// time in the run.
+func (pc *pooledCopy) payloadSum(payload []byte) [sha256.Size]byte {
+	if len(payload) == 0 {
+		return sha256.Sum256(nil)
+	}
+	key := payloadSumKey{&payload[0], len(payload)}
+	if sum, ok := pc.sums.Load(key); ok {
+		return sum.([sha256.Size]byte)
+	}
+	sum := sha256.Sum256(payload)
+	pc.sums.Store(key, sum)
+	return sum
+}
+
+// hashers holds the SHA-256 hashers pooled clients verify with, so that a
+// connection doesn't allocate its own.
+var hashers = sync.Pool{New: func() interface{} { return sha256.New() }}
+
+// hasher returns a reset SHA-256 hasher and a function to give it back.
+func hasher() (hash.Hash, func()) {
+	h := hashers.Get().(hash.Hash)
+	h.Reset()
+	return h, func() { hashers.Put(h) }
+}
+
+// pooledServers makes serveConn write payloads with io.CopyBuffer through a
+// pooled buffer. Servers outlive runs and have no run context, so unlike
+// the clients' setting this is process-wide.
+var pooledServers int32
+
+func setPooledServers(on bool) {
+	v := int32(0)
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&pooledServers, v)
+}
+
+// writePooled writes payload to w in copyBuffer-sized writes. Both sides
+// are wrapped so that io.CopyBuffer can't hand the copy to a ReadFrom or
+// WriteTo that skips the buffer.
+func writePooled(w io.Writer, payload []byte) error {
+	buf, release := copyBuffer(defaultReadSize)
+	defer release()
+	_, err := io.CopyBuffer(struct{ io.Writer }{w}, struct{ io.Reader }{bytes.NewReader(payload)}, buf)
+	return err
+}
+
+// timedReader is a net.Conn's reader that notes when the first byte arrived
+// and marks read errors as such, a pooled copy running the read loop.
+type timedReader struct {
+	c     net.Conn
+	start time.Time
+	ttfb  time.Duration
+	total int64
+}
+
+func (r *timedReader) Read(p []byte) (int, error) {
+	n, err := r.c.Read(p)
+	if n > 0 && r.total == 0 {
+		r.ttfb = time.Since(r.start)
+	}
+	r.total += int64(n)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("read TCP error: %w", err)
+	}
+	return n, err
+}
+
+// copyStream is receiveStream's read loop as an io.CopyBuffer through a
+// pooled buffer, returning what it read and when the first byte came.
+func copyStream(ctx context.Context, c net.Conn, start time.Time, w io.Writer) (int64, time.Duration, error) {
+	buf, release := copyBuffer(readSizeFrom(ctx))
+	defer release()
+	r := &timedReader{c: c, start: start}
+	_, err := io.CopyBuffer(struct{ io.Writer }{w}, r, buf)
+	return r.total, r.ttfb, err
+}
+
+func sumOf(h hash.Hash) [sha256.Size]byte {
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+// runCopyComparison has nConns gonet clients each receive a 1MiB payload
+// twice, on a fresh pair each time: first as the runs normally do, the
+// server writing the payload in one Write and the clients reading all of it
+// into memory, much as io.ReadAll would, to compare; then with both sides
+// copying through pooled buffers and the clients verifying by SHA-256. It
+// reports the allocations per connection of each, the server's and
+// netstack's included, and how many fewer the pooled copy made. It can make
+// more: the client saves allocating the payload, but the server's
+// copyBuffer-sized writes each cost netstack allocations that one Write of
+// the whole payload doesn't, and netstack's allocations vary by hundreds per
+// connection from one pair to the next, so that is flagged rather than
+// reported as a negative saving.
+func runCopyComparison(ctx context.Context, nConns int, opts stackOptions) error {
+	payload := randomPayload(newLockedRand(opts.seed), 1024*1024)
+	defer atomic.StoreInt32(&pooledServers, atomic.LoadInt32(&pooledServers))
+	var allocs [2]allocCount
+	for i, pooled := range []bool{false, true} {
+		server, client, err := setupGonetPair(opts)
+		if err != nil {
+			return err
+		}
+		setPooledServers(pooled)
+		go payloadServer(server, 1234, payload)
+		time.Sleep(time.Millisecond)
+		r := resultFrom(ctx)
+		succeeded := atomic.LoadInt64(&r.Succeeded)
+		before := readAllocs()
+		start := time.Now()
+		wg := &sync.WaitGroup{}
+		wg.Add(nConns)
+		runPayloadConns(withPooledCopy(ctx, pooled), client, 1234, payload, nConns, wg)
+		wg.Wait()
+		elapsed := time.Since(start)
+		allocs[i] = readAllocs().sub(before)
+		intact := atomic.LoadInt64(&r.Succeeded) - succeeded
+		name := "read all"
+		if pooled {
+			name = "pooled copy"
+		}
+		fmt.Printf("%s: %d/%d connections intact, %.1f MB/s, %.0f allocs/conn, %.0f KB/conn\n", name,
+			intact, nConns, float64(intact)*float64(len(payload))/elapsed.Seconds()/1e6,
+			float64(allocs[i].objects)/float64(nConns), float64(allocs[i].bytes)/float64(nConns)/1024)
+		if intact != int64(nConns) {
+			return fmt.Errorf("%s: %d connections failed", name, int64(nConns)-intact)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	fewer := (float64(allocs[0].objects) - float64(allocs[1].objects)) / float64(nConns)
+	less := (float64(allocs[0].bytes) - float64(allocs[1].bytes)) / float64(nConns) / 1024
+	if fewer < 0 {
+		fmt.Printf("pooled copy: %.0f more allocs/conn, not fewer, the server's smaller writes and netstack's variation between pairs outweighing what the client saved; %.0f KB/conn less allocated\n",
+			-fewer, less)
+		return nil
+	}
+	fmt.Printf("pooled copy: %.0f fewer allocs/conn, %.0f KB/conn less allocated\n", fewer, less)
+	return nil
+}
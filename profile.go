@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"syscall"
+	"time"
+)
+
+// startTrace starts a Go execution trace written to path, for viewing with
+// "go tool trace". The returned function stops the trace and closes the
+// file, and must be called for the trace to be usable.
+//
+// Tracing records every scheduling, network-blocking and GC event, so it
+// costs CPU roughly in proportion to the goroutine churn; with netstack's
+// goroutine-per-connection workers expect runs to be noticeably slower, and
+// only compare timings between runs that were both traced or both not.
+func startTrace(path string) (func(), error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	err = trace.Start(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return func() {
+		trace.Stop()
+		err := f.Close()
+		if err != nil {
+			fmt.Printf("trace close error: %s\n", err)
+		}
+	}, nil
+}
+
+// startContentionProfile turns on the named runtime profile, "mutex" or
+// "block", at the given rate, and returns a function that writes it to path
+// for "go tool pprof" and turns it off again. The rate is a sampling
+// fraction for the mutex profile, and for the block profile the average
+// number of nanoseconds blocked per sampled event.
+//
+// For contention on netstack's internal locks, use the mutex profile: it
+// charges the time goroutines spent waiting for a sync.Mutex or RWMutex to
+// the call stack that held it, which points at the lock itself. The block
+// profile records every kind of blocking, including channel receives and
+// selects, so it is dominated by goroutines idly waiting for packets and by
+// gonet's waiter queues; it is the one to use to see where connections wait
+// rather than which locks they fight over. Both slow the runs down, the
+// block profile most, so they are off by default and only turned on here.
+func startContentionProfile(name, path string, rate int) (func(), error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	setRate := runtime.SetBlockProfileRate
+	if name == "mutex" {
+		setRate = func(rate int) { runtime.SetMutexProfileFraction(rate) }
+	}
+	setRate(rate)
+	return func() {
+		setRate(0)
+		err := pprof.Lookup(name).WriteTo(f, 0)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			fmt.Printf("%s profile error: %s\n", name, err)
+		}
+	}, nil
+}
+
+// cpuTime returns the user and system CPU time the process has used so far.
+// Differences between two calls cover every goroutine, so the harness's own
+// work is included along with the stacks'.
+func cpuTime() time.Duration {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tokenBucket limits how fast connections are established: it holds up to
+// burst tokens, gains rate of them a second, and each connection takes one.
+// Unlike the arrival patterns, which are spaced from when the last
+// connection was due, a bucket that falls behind catches up by at most
+// burst, so a stall doesn't turn into a surge above the rate afterwards.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a full bucket.
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// take waits for a token, or for ctx to be done. Callers are served in the
+// order they call: each reserves its token straight away, leaving the bucket
+// in debt if it is empty, and waits until the debt would be paid off.
+func (b *tokenBucket) take(ctx context.Context) error {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens--
+	wait := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mu.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// connectLimited dials nConns connections to port, each once it has taken a
+// token from bucket, closing each as soon as it is established, and reports
+// the rate achieved against the bucket's and the dial latencies at that
+// rate. Each dial is recorded in ctx's run. Connections left when ctx is
+// done are not dialed, and count as failed: it returns an error if any
+// connection was not established.
+func connectLimited(ctx context.Context, t Transport, port uint16, nConns int, bucket *tokenBucket) error {
+	var failures failureCounts
+	var succeeded int64
+	var mu sync.Mutex
+	var dials []time.Duration
+	wg := &sync.WaitGroup{}
+	begin := time.Now()
+	launched := 0
+	for ; launched < nConns; launched++ {
+		if err := bucket.take(ctx); err != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id := newConnID()
+			start := time.Now()
+			c, err := t.Dial(ctx, port)
+			resultFrom(ctx).addResult(err, err == nil)
+			if err != nil {
+				failures.add(err)
+				return
+			}
+			d := time.Since(start)
+			mu.Lock()
+			dials = append(dials, d)
+			mu.Unlock()
+			atomic.AddInt64(&succeeded, 1)
+			if err := c.Close(); err != nil {
+				logConn(id, "close TCP error: %s", err)
+			}
+		}()
+	}
+	elapsed := time.Since(begin)
+	wg.Wait()
+	rate := 0.0
+	if launched > 1 && elapsed > 0 {
+		rate = float64(launched-1) / elapsed.Seconds()
+	}
+	fmt.Printf("%d/%d connections launched in %s, %.1f/s (target %.1f/s, burst %.0f)\n",
+		launched, nConns, elapsed.Round(time.Millisecond), rate, bucket.rate, bucket.burst)
+	fmt.Printf("%d connections established, dial %s, failures: %s, not launched %d\n",
+		succeeded, formatPercentiles(dials), &failures, nConns-launched)
+	if failed := int64(nConns) - succeeded; failed > 0 {
+		return fmt.Errorf("%d connections not established: %s, not launched %d", failed, &failures, nConns-launched)
+	}
+	return nil
+}
+
+func runNetConnectLimited(ctx context.Context, nConns int, rate float64, burst int) error {
+	t := &netTransport{addr: net.ParseIP("::1")}
+	go testServer(t, 9802)
+	time.Sleep(time.Millisecond)
+	return connectLimited(ctx, t, 9802, nConns, newTokenBucket(rate, burst))
+}
+
+// runGonetConnectLimited is runNetConnectLimited over a gonet pair. The
+// server's backlog is raised from gonet's 10, which a burst overflows,
+// putting a one second SYN retransmission into the dial latencies that has
+// nothing to do with the rate.
+func runGonetConnectLimited(ctx context.Context, nConns int, rate float64, burst int, opts stackOptions) error {
+	server, client, err := setupGonetPair(opts)
+	if err != nil {
+		return err
+	}
+	server.backlog = 64
+	go testServer(server, 1234)
+	time.Sleep(time.Millisecond)
+	return connectLimited(ctx, client, 1234, nConns, newTokenBucket(rate, burst))
+}
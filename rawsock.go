@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// rawTransport is kernel TCP through bare socket syscalls, with none of the
+// net package: no runtime poller, no non-blocking I/O, just blocking reads
+// and writes on the caller's thread. It is kernel TCP with the least
+// machinery around it, so that, next to netTransport, it separates the net
+// package's own overhead from the kernel's. With many connections at once,
+// though, every blocked call holds an OS thread, which can cost more than
+// the poller saves. It listens on and dials addr, IPv4 or IPv6, with zone
+// naming the interface of a link-local IPv6 address. Ports are offset by
+// portOffset, so that it can run alongside a netTransport on the same
+// address. Like the net package, it sets TCP_NODELAY on connections.
+type rawTransport struct {
+	addr       net.IP
+	zone       string
+	portOffset uint16
+}
+
+// sockaddr returns the socket address family and syscall address of port
+// on t's address.
+func (t *rawTransport) sockaddr(port uint16) (int, syscall.Sockaddr, error) {
+	port += t.portOffset
+	if ip4 := t.addr.To4(); ip4 != nil {
+		sa := &syscall.SockaddrInet4{Port: int(port)}
+		copy(sa.Addr[:], ip4)
+		return syscall.AF_INET, sa, nil
+	}
+	ip6 := t.addr.To16()
+	if ip6 == nil {
+		return 0, nil, fmt.Errorf("invalid address %v", t.addr)
+	}
+	sa := &syscall.SockaddrInet6{Port: int(port)}
+	copy(sa.Addr[:], ip6)
+	if t.zone != "" {
+		ifi, err := net.InterfaceByName(t.zone)
+		if err != nil {
+			return 0, nil, fmt.Errorf("zone %q: %w", t.zone, err)
+		}
+		sa.ZoneId = uint32(ifi.Index)
+	}
+	return syscall.AF_INET6, sa, nil
+}
+
+// tcpAddr converts a syscall address to a net.Addr.
+func tcpAddr(sa syscall.Sockaddr) net.Addr {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return &net.TCPAddr{IP: net.IP(sa.Addr[:]).To16(), Port: sa.Port}
+	case *syscall.SockaddrInet6:
+		a := &net.TCPAddr{IP: append(net.IP(nil), sa.Addr[:]...), Port: sa.Port}
+		if sa.ZoneId != 0 {
+			if ifi, err := net.InterfaceByIndex(int(sa.ZoneId)); err == nil {
+				a.Zone = ifi.Name
+			}
+		}
+		return a
+	}
+	return nil
+}
+
+// rawSocket opens a blocking TCP socket of family.
+func rawSocket(op string, family int) (int, error) {
+	fd, err := syscall.Socket(family, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, syscall.IPPROTO_TCP)
+	if err != nil {
+		return 0, &net.OpError{Op: op, Net: "tcp", Err: os.NewSyscallError("socket", err)}
+	}
+	return fd, nil
+}
+
+func (t *rawTransport) Listen(port uint16) (net.Listener, error) {
+	family, sa, err := t.sockaddr(port)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := rawSocket("listen", family)
+	if err != nil {
+		return nil, err
+	}
+	fail := func(call string, err error) (net.Listener, error) {
+		syscall.Close(fd)
+		return nil, &net.OpError{Op: "listen", Net: "tcp", Addr: tcpAddr(sa), Err: os.NewSyscallError(call, err)}
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		return fail("setsockopt", err)
+	}
+	if err := syscall.Bind(fd, sa); err != nil {
+		return fail("bind", err)
+	}
+	if err := syscall.Listen(fd, syscall.SOMAXCONN); err != nil {
+		return fail("listen", err)
+	}
+	return &rawListener{fd: fd, addr: tcpAddr(sa)}, nil
+}
+
+func (t *rawTransport) Dial(ctx context.Context, port uint16) (net.Conn, error) {
+	family, sa, err := t.sockaddr(port)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := rawSocket("dial", family)
+	if err != nil {
+		return nil, err
+	}
+	c := &rawConn{fd: fd}
+	fail := func(call string, err error) (net.Conn, error) {
+		syscall.Close(fd)
+		if err == syscall.EAGAIN || err == syscall.EINPROGRESS {
+			err = os.ErrDeadlineExceeded
+		} else {
+			err = os.NewSyscallError(call, err)
+		}
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Addr: tcpAddr(sa), Err: err}
+	}
+	// A blocking connect gives up after the send timeout, so that is how
+	// the context's deadline bounds it.
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := c.setTimeout(syscall.SO_SNDTIMEO, deadline); err != nil {
+			return fail("setsockopt", err)
+		}
+	}
+	for {
+		err = syscall.Connect(fd, sa)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		return fail("connect", err)
+	}
+	if err := c.setTimeout(syscall.SO_SNDTIMEO, time.Time{}); err != nil {
+		return fail("setsockopt", err)
+	}
+	if err := c.init(); err != nil {
+		return fail("setsockopt", err)
+	}
+	return c, nil
+}
+
+// rawListener accepts connections on a listening socket with blocking
+// accept calls.
+type rawListener struct {
+	fd   int
+	addr net.Addr
+	once sync.Once
+}
+
+func (l *rawListener) Accept() (net.Conn, error) {
+	for {
+		fd, _, err := syscall.Accept4(l.fd, syscall.SOCK_CLOEXEC)
+		switch err {
+		case nil:
+			c := &rawConn{fd: fd}
+			if err := c.init(); err != nil {
+				syscall.Close(fd)
+				return nil, &net.OpError{Op: "accept", Net: "tcp", Addr: l.addr, Err: os.NewSyscallError("setsockopt", err)}
+			}
+			return c, nil
+		case syscall.EINTR, syscall.ECONNABORTED:
+			continue
+		case syscall.EINVAL, syscall.EBADF:
+			// Close shut the socket down under us.
+			return nil, net.ErrClosed
+		}
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Addr: l.addr, Err: os.NewSyscallError("accept4", err)}
+	}
+}
+
+// Close shuts the socket down before closing it, as closing alone would
+// leave a blocked accept waiting.
+func (l *rawListener) Close() error {
+	l.once.Do(func() {
+		_ = syscall.Shutdown(l.fd, syscall.SHUT_RDWR)
+		syscall.Close(l.fd)
+	})
+	return nil
+}
+
+func (l *rawListener) Addr() net.Addr {
+	return l.addr
+}
+
+// rawConn is a connected TCP socket read and written with blocking
+// syscalls. Deadlines are the socket's receive and send timeouts, which a
+// blocked call does obey; one already in the past can't be set as a
+// timeout, so it shuts the connection down instead, waking any call
+// blocked on it, and the connection can't be used after that.
+type rawConn struct {
+	fd            int
+	local, remote net.Addr
+
+	mu      sync.Mutex
+	expired bool
+	closed  bool
+}
+
+// init sets TCP_NODELAY and looks up the connection's addresses.
+func (c *rawConn) init() error {
+	if err := syscall.SetsockoptInt(c.fd, syscall.IPPROTO_TCP, syscall.TCP_NODELAY, 1); err != nil {
+		return err
+	}
+	if sa, err := syscall.Getsockname(c.fd); err == nil {
+		c.local = tcpAddr(sa)
+	}
+	if sa, err := syscall.Getpeername(c.fd); err == nil {
+		c.remote = tcpAddr(sa)
+	}
+	return nil
+}
+
+func (c *rawConn) opError(op string, err error) error {
+	if err == syscall.EAGAIN || c.isExpired() {
+		err = os.ErrDeadlineExceeded
+	} else if err == syscall.EBADF && c.isClosed() {
+		err = net.ErrClosed
+	} else {
+		err = os.NewSyscallError(op, err)
+	}
+	return &net.OpError{Op: op, Net: "tcp", Source: c.local, Addr: c.remote, Err: err}
+}
+
+func (c *rawConn) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	for {
+		n, err := syscall.Read(c.fd, b)
+		switch {
+		case err == syscall.EINTR:
+			continue
+		case err != nil:
+			return 0, c.opError("read", err)
+		case n == 0 && c.isExpired():
+			return 0, c.opError("read", os.ErrDeadlineExceeded)
+		case n == 0:
+			return 0, io.EOF
+		}
+		return n, nil
+	}
+}
+
+func (c *rawConn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		n, err := syscall.Write(c.fd, b[written:])
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return written, c.opError("write", err)
+		}
+		written += n
+	}
+	return written, nil
+}
+
+func (c *rawConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return &net.OpError{Op: "close", Net: "tcp", Source: c.local, Addr: c.remote, Err: net.ErrClosed}
+	}
+	c.closed = true
+	if err := syscall.Close(c.fd); err != nil {
+		return &net.OpError{Op: "close", Net: "tcp", Source: c.local, Addr: c.remote, Err: os.NewSyscallError("close", err)}
+	}
+	return nil
+}
+
+func (c *rawConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *rawConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *rawConn) isExpired() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.expired
+}
+
+func (c *rawConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// setTimeout sets the socket option opt, SO_RCVTIMEO or SO_SNDTIMEO, to
+// the time left until deadline, or to none for the zero time. A deadline
+// that has already passed shuts the connection down.
+func (c *rawConn) setTimeout(opt int, deadline time.Time) error {
+	var d time.Duration
+	if !deadline.IsZero() {
+		d = time.Until(deadline)
+		if d <= 0 {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if !c.expired && !c.closed {
+				c.expired = true
+				return syscall.Shutdown(c.fd, syscall.SHUT_RDWR)
+			}
+			return nil
+		}
+	}
+	tv := syscall.NsecToTimeval(d.Nanoseconds())
+	if d > 0 && tv.Sec == 0 && tv.Usec == 0 {
+		// Less than a microsecond left would otherwise mean no timeout.
+		tv.Usec = 1
+	}
+	return syscall.SetsockoptTimeval(c.fd, syscall.SOL_SOCKET, opt, &tv)
+}
+
+func (c *rawConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *rawConn) SetReadDeadline(t time.Time) error {
+	return c.setTimeout(syscall.SO_RCVTIMEO, t)
+}
+
+func (c *rawConn) SetWriteDeadline(t time.Time) error {
+	return c.setTimeout(syscall.SO_SNDTIMEO, t)
+}
+
+// runRaw is runNet over rawTransport: kernel TCP without the net package.
+func runRaw(ctx context.Context, nConns int) error {
+	return runLoopback(ctx, &rawTransport{addr: net.ParseIP("::1"), portOffset: 10000}, nConns)
+}
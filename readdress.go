@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// setAddress adds addr to NIC 1 of s, or removes it.
+func setAddress(s *stack.Stack, addr tcpip.Address, present bool) error {
+	var tcpErr tcpip.Error
+	if present {
+		tcpErr = s.AddProtocolAddress(1, tcpip.ProtocolAddress{
+			Protocol:          ipv6.ProtocolNumber,
+			AddressWithPrefix: tcpip.AddressWithPrefix{Address: addr, PrefixLen: 128},
+		}, stack.AddressProperties{})
+	} else {
+		tcpErr = s.RemoveAddress(1, addr)
+	}
+	if tcpErr != nil {
+		return fmt.Errorf("set address %s present %v: %w", addr, present, wrapTCPIP(tcpErr))
+	}
+	return nil
+}
+
+// The address reassignment check waits up to readdressTimeout for each dial
+// and each echo, up to readdressRecovery for an echo on a connection that had
+// segments dropped, and readdressDrain draining each connection after.
+const (
+	readdressTimeout  = 500 * time.Millisecond
+	readdressRecovery = 3 * time.Second
+	readdressDrain    = 50 * time.Millisecond
+)
+
+// readdressRunTimeout is how long runAddressReassignment of nConns may take:
+// most of its dials are meant to time out, so it runs well past a -timeout
+// of the default 10s on its own. Each of its five rounds of dials may wait
+// out a dial and an echo per connection, and each of its three rounds of
+// echoes on the established connections an echo and a drain.
+func readdressRunTimeout(nConns int) time.Duration {
+	perConn := 5*2*readdressTimeout + 2*readdressTimeout + readdressRecovery + 3*readdressDrain
+	return time.Duration(nConns) * perConn
+}
+
+// runAddressReassignment removes the server stack's address from its NIC
+// under a set of established echo connections, then adds it back, and then
+// moves the server to a new address, checking at each step that new dials
+// go as the stack's addresses say they should: they fail while the address
+// is gone and succeed once it is back, and after the move succeed to the new
+// address and fail to the old. netstack drops segments for an address its
+// NIC no longer has, so established connections stall while it is gone;
+// whether they carry data then, recover once it is back, and survive the
+// move is reported but not required, there being no one right answer.
+func runAddressReassignment(ctx context.Context, nConns int, opts stackOptions) error {
+	server, client, err := setupGonetPair(opts)
+	if err != nil {
+		return err
+	}
+	go echoServer(server, 1234)
+	time.Sleep(time.Millisecond)
+	addr, _ := pairAddresses(opts)
+	newAddr := tcpip.Address(net.ParseIP("FD00::11"))
+	moved := *client
+	moved.remote = newAddr
+
+	conns, failures := dialEchoes(ctx, client, 1234, nConns, readdressTimeout)
+	defer func() {
+		for _, c := range conns {
+			_ = c.Close()
+		}
+	}()
+	fmt.Printf("assigned: %d/%d connections established, failures: %s\n", len(conns), nConns, failures)
+	if len(conns) != nConns {
+		return fmt.Errorf("connections failed before the address was removed")
+	}
+	var problems []string
+	// dials dials nConns new connections through t, expecting them all to
+	// succeed or all to fail, and keeps those that succeed. Only those meant
+	// to succeed are recorded in the run.
+	dials := func(phase string, t Transport, succeed bool) {
+		dctx := withResult(ctx, nil)
+		if succeed {
+			dctx = ctx
+		}
+		newConns, failures := dialEchoes(dctx, t, 1234, nConns, readdressTimeout)
+		conns = append(conns, newConns...)
+		fmt.Printf("%s: %d/%d new dials to %s succeeded, failures: %s\n", phase, len(newConns), nConns,
+			t.(*gonetTransport).remote, failures)
+		switch {
+		case succeed && len(newConns) != nConns:
+			problems = append(problems, fmt.Sprintf("%s: %d dials failed", phase, nConns-len(newConns)))
+		case !succeed && len(newConns) != 0:
+			problems = append(problems, fmt.Sprintf("%s: %d dials succeeded", phase, len(newConns)))
+		}
+	}
+	// established checks an echo on each of the original connections. An
+	// echo that timed out may still come back later, retransmitted, so
+	// whatever else arrives is drained to keep it from passing for the
+	// next phase's reply.
+	established := func(phase string, wait time.Duration) {
+		inFlight := echoAll(conns[:nConns], wait)
+		for _, c := range conns[:nConns] {
+			_ = c.SetReadDeadline(time.Now().Add(readdressDrain))
+			_, _ = io.Copy(io.Discard, c)
+			_ = c.SetReadDeadline(time.Time{})
+		}
+		fmt.Printf("%s: %d/%d established connections carried data, failures: %s\n", phase,
+			int64(nConns)-inFlight.total(), nConns, inFlight)
+	}
+
+	if err := setAddress(server.netStack, addr, false); err != nil {
+		return err
+	}
+	established("removed", readdressTimeout)
+	dials("removed", client, false)
+
+	if err := setAddress(server.netStack, addr, true); err != nil {
+		return err
+	}
+	dials("re-added", client, true)
+	// The connections had segments dropped while the address was gone, so
+	// they wait out a retransmission timeout before carrying data again.
+	established("re-added", readdressRecovery)
+
+	if err := setAddress(server.netStack, addr, false); err != nil {
+		return err
+	}
+	if err := setAddress(server.netStack, newAddr, true); err != nil {
+		return err
+	}
+	dials("moved", client, false)
+	dials("moved", &moved, true)
+	established("moved", readdressTimeout)
+
+	if len(problems) > 0 {
+		return fmt.Errorf("address reassignment: %s", strings.Join(problems, "; "))
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultReadSize is the buffer clients read into when the run doesn't set
+// one.
+const defaultReadSize = 32 * 1024
+
+type readSizeKey struct{}
+
+func withReadSize(ctx context.Context, n int) context.Context {
+	return context.WithValue(ctx, readSizeKey{}, n)
+}
+
+// readSizeFrom returns the size of the buffer clients read into in the run
+// ctx belongs to: each Read asks for at most that much, so it sets how
+// finely received data is copied out of the stack.
+func readSizeFrom(ctx context.Context) int {
+	if n, ok := ctx.Value(readSizeKey{}).(int); ok {
+		return n
+	}
+	return defaultReadSize
+}
+
+// parseSizes parses a comma-separated list of positive byte counts.
+func parseSizes(s string) ([]int, error) {
+	var sizes []int
+	for _, f := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(f)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid size %q: must be a positive number of bytes", f)
+		}
+		sizes = append(sizes, n)
+	}
+	return sizes, nil
+}
+
+// readSizePayload is how much each connection of runReadSizes receives:
+// readSizeMaxPayload, or for small read sizes readSizeMaxReads reads' worth,
+// as a few bytes a read would take minutes to move the full payload.
+const (
+	readSizeMaxPayload = 4 * 1024 * 1024
+	readSizeMaxReads   = 64 * 1024
+)
+
+func readSizePayload(size int) int {
+	if size >= readSizeMaxPayload/readSizeMaxReads {
+		return readSizeMaxPayload
+	}
+	return size * readSizeMaxReads
+}
+
+// runReadSizes measures the throughput of nConns concurrent connections
+// each receiving a payload of readSizePayload, over native TCP and gonet,
+// with the client reading into a buffer of each of sizes in turn. On the
+// native path each Read is a syscall; on gonet it is a copy out of the
+// endpoint's receive queue under its lock, so small reads cost the two paths
+// differently. Each size is served on ports of its own, as its payload may
+// be shorter.
+func runReadSizes(ctx context.Context, nConns int, sizes []int, opts stackOptions) error {
+	payload := randomPayload(newLockedRand(opts.seed), readSizeMaxPayload)
+	server, client, err := setupGonetPair(opts)
+	if err != nil {
+		return err
+	}
+	paths := []struct {
+		name   string
+		server Transport
+		client Transport
+		port   uint16
+	}{
+		{"net", &netTransport{addr: net.ParseIP("::1")}, &netTransport{addr: net.ParseIP("::1")}, 9345},
+		{"gonet", server, client, 1234},
+	}
+	for i, size := range sizes {
+		for _, path := range paths {
+			go payloadServer(path.server, path.port+uint16(i), payload[:readSizePayload(size)])
+		}
+	}
+	time.Sleep(time.Millisecond)
+	failed := false
+	for i, size := range sizes {
+		sized := payload[:readSizePayload(size)]
+		for _, path := range paths {
+			start := time.Now()
+			received, errs := collectConns(withReadSize(ctx, size), path.client, path.port+uint16(i), nConns, sized)
+			elapsed := time.Since(start)
+			var n int64
+			mismatched := 0
+			for _, b := range received {
+				if !bytes.Equal(b, sized) {
+					mismatched++
+				}
+				n += int64(len(b))
+			}
+			fmt.Printf("read size %d, %s: %.1f MB/s, %d/%d connections of %d bytes intact\n",
+				size, path.name, float64(n)/elapsed.Seconds()/1e6, len(received)-mismatched, nConns, len(sized))
+			if len(errs) != 0 || mismatched != 0 {
+				failed = true
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+		}
+	}
+	if failed {
+		return fmt.Errorf("not every connection received the payload intact")
+	}
+	return nil
+}
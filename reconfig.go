@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// reconfigure adds an address and a route to NIC 1 of s and removes the ones
+// added by the previous call, i-1, leaving the stack's own address and routes
+// alone. It returns the number of changes that netstack refused.
+func reconfigure(s *stack.Stack, i int) int {
+	extra := func(i int) (tcpip.Address, tcpip.Route) {
+		ip := net.ParseIP("FD00::1:0")
+		ip[14], ip[15] = byte(i>>8), byte(i)
+		route := net.ParseIP("FD99::")
+		route[2], route[3] = byte(i>>8), byte(i)
+		subnet, _ := tcpip.NewSubnet(tcpip.Address(route), tcpip.AddressMask(net.CIDRMask(32, 128)))
+		return tcpip.Address(ip), tcpip.Route{Destination: subnet, NIC: 1}
+	}
+	refused := 0
+	addr, route := extra(i)
+	if tcpErr := s.AddProtocolAddress(1, tcpip.ProtocolAddress{
+		Protocol:          ipv6.ProtocolNumber,
+		AddressWithPrefix: addr.WithPrefix(),
+	}, stack.AddressProperties{}); tcpErr != nil {
+		refused++
+	}
+	s.AddRoute(route)
+	if i > 0 {
+		oldAddr, oldRoute := extra(i - 1)
+		if tcpErr := s.RemoveAddress(1, oldAddr); tcpErr != nil {
+			refused++
+		}
+		s.RemoveRoutes(func(r tcpip.Route) bool { return r == oldRoute })
+	}
+	return refused
+}
+
+// runReconfig transfers payloads over gonet in batches of nConns connections
+// for duration, while both stacks have addresses and routes added and
+// removed rate times a second. None of the changes touch the addresses or
+// routes the connections use, so every connection should still succeed.
+func runReconfig(ctx context.Context, nConns int, rate int, duration time.Duration, opts stackOptions) error {
+	server, client, err := setupGonetPair(opts)
+	if err != nil {
+		return err
+	}
+	payload := randomPayload(newLockedRand(opts.seed), 64*1024)
+	go payloadServer(server, 1234, payload)
+	time.Sleep(time.Millisecond)
+	var changes, refused int64
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(time.Second / time.Duration(rate))
+		defer ticker.Stop()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			for _, s := range []*stack.Stack{server.netStack, client.netStack} {
+				atomic.AddInt64(&refused, int64(reconfigure(s, i)))
+			}
+			atomic.AddInt64(&changes, 1)
+		}
+	}()
+	total, intact := 0, 0
+	deadline := time.Now().Add(duration)
+	for time.Now().Before(deadline) && ctx.Err() == nil {
+		received, errs := collectConns(ctx, client, 1234, nConns, payload)
+		for _, b := range received {
+			if bytes.Equal(b, payload) {
+				intact++
+			} else {
+				fmt.Printf("incorrect data received: expected %d bytes but got %d\n", len(payload), len(b))
+			}
+		}
+		for _, err := range errs {
+			fmt.Printf("failed during reconfiguration: %s\n", err)
+		}
+		total += nConns
+	}
+	close(stop)
+	<-stopped
+	fmt.Printf("%d reconfigurations of each stack (%d changes refused), %d/%d connections intact\n",
+		changes, refused, intact, total)
+	if intact != total {
+		return fmt.Errorf("%d connections failed during reconfiguration", total-intact)
+	}
+	if refused > 0 {
+		return fmt.Errorf("netstack refused %d reconfiguration changes", refused)
+	}
+	return ctx.Err()
+}
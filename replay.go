@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// runSpec is what -record writes and -replay reads back: everything needed
+// to make the same runs again, and how they ended, to check a replay
+// against. Netstack's ephemeral ports, initial sequence numbers and the
+// harness's payloads all come from the seed, so recording it covers them;
+// the kernel's ephemeral ports for the net paths are its own, and are not
+// reproduced.
+type runSpec struct {
+	// Flags holds the value of every flag, defaults and a seed picked from
+	// the clock included, so that a replay by a build whose defaults have
+	// since changed still runs with the recorded ones.
+	Flags map[string]string `json:"flags"`
+	// Env is what the runs were made on, to warn of a replay elsewhere.
+	Env  *environment `json:"env"`
+	Runs []specRun    `json:"runs"`
+}
+
+// specRun is how a recorded run ended.
+type specRun struct {
+	Name       string `json:"name"`
+	Status     string `json:"status"`
+	Succeeded  int64  `json:"succeeded"`
+	Failed     int64  `json:"failed"`
+	Mismatched int64  `json:"mismatched"`
+}
+
+func newSpecRun(r *RunResult) specRun {
+	sum := r.summary()
+	return specRun{
+		Name:       sum.Name,
+		Status:     sum.Status,
+		Succeeded:  sum.Succeeded,
+		Failed:     r.Failures.total(),
+		Mismatched: sum.Mismatched,
+	}
+}
+
+// replayFlags are the flags a replay doesn't take from the recording.
+var replayFlags = map[string]bool{"record": true, "replay": true}
+
+// currentFlags returns the value of every flag. It must be called once the
+// seed has been resolved.
+func currentFlags() map[string]string {
+	flags := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		if !replayFlags[f.Name] {
+			flags[f.Name] = f.Value.String()
+		}
+	})
+	return flags
+}
+
+// newRecordSink writes the runs' spec to path, with their outcomes.
+func newRecordSink(path string, env *environment) *batchSink {
+	flags := currentFlags()
+	return &batchSink{name: "record", write: func(results []*RunResult) error {
+		spec := runSpec{Flags: flags, Env: env}
+		for _, r := range results {
+			spec.Runs = append(spec.Runs, newSpecRun(r))
+		}
+		b, err := json.MarshalIndent(spec, "", "  ")
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(path, append(b, '\n'), 0o644)
+	}}
+}
+
+func loadSpec(path string) (*runSpec, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	spec := &runSpec{}
+	if err := json.Unmarshal(b, spec); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if spec.Flags == nil {
+		return nil, fmt.Errorf("%s records no flags", path)
+	}
+	return spec, nil
+}
+
+// apply sets the flags to their recorded values, except for those given on
+// the command line, which take precedence, and returns the names of those
+// it skipped as this build doesn't have them.
+func (s *runSpec) apply() ([]string, error) {
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	var unknown []string
+	for name, value := range s.Flags {
+		if given[name] || replayFlags[name] {
+			continue
+		}
+		f := flag.Lookup(name)
+		if f == nil {
+			unknown = append(unknown, name)
+			continue
+		}
+		// Only flags that differ are set, so that the environment lists
+		// the same options as the recording's.
+		if f.Value.String() == value {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			return nil, fmt.Errorf("-%s=%s: %w", name, value, err)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown, nil
+}
+
+// environmentChanges lists how env differs from the recorded environment
+// in ways that make the results incomparable.
+func (s *runSpec) environmentChanges(env *environment) []string {
+	if s.Env == nil {
+		return nil
+	}
+	var changes []string
+	diff := func(what string, was, now interface{}) {
+		if was != now {
+			changes = append(changes, fmt.Sprintf("%s %v, now %v", what, was, now))
+		}
+	}
+	diff("Go", s.Env.GoVersion, env.GoVersion)
+	diff("gvisor", s.Env.Gvisor, env.Gvisor)
+	diff("OS", s.Env.OS+"/"+s.Env.Arch, env.OS+"/"+env.Arch)
+	diff("CPUs", s.Env.NumCPU, env.NumCPU)
+	diff("GOMAXPROCS", s.Env.GOMAXPROCS, env.GOMAXPROCS)
+	return changes
+}
+
+// replayCheck is a ResultSink that compares the runs of a replay with those
+// recorded.
+type replayCheck struct {
+	spec *runSpec
+	runs []specRun
+}
+
+func (c *replayCheck) Record(r *RunResult) {
+	c.runs = append(c.runs, newSpecRun(r))
+}
+
+// verify checks that the same runs were made as were recorded and that each
+// ended the same way. A run that succeeded must have had as many connections
+// succeed, fail and mismatch as before, since with the same seed it should
+// have gone the same way; one that didn't only has to end with the same
+// status, as how far a failing run gets before its deadline is down to
+// timing.
+func (c *replayCheck) verify() error {
+	var diffs []string
+	if len(c.runs) != len(c.spec.Runs) {
+		diffs = append(diffs, fmt.Sprintf("%d runs, recorded %d", len(c.runs), len(c.spec.Runs)))
+	}
+	for i := 0; i < len(c.runs) && i < len(c.spec.Runs); i++ {
+		got, want := c.runs[i], c.spec.Runs[i]
+		switch {
+		case got.Name != want.Name:
+			diffs = append(diffs, fmt.Sprintf("run %d is %s, recorded %s", i+1, got.Name, want.Name))
+		case got.Status != want.Status:
+			diffs = append(diffs, fmt.Sprintf("%s %s, recorded %s", got.Name, got.Status, want.Status))
+		case want.Status == "ok" && got != want:
+			diffs = append(diffs, fmt.Sprintf("%s %d ok, %d failed, %d mismatched, recorded %d, %d, %d", got.Name,
+				got.Succeeded, got.Failed, got.Mismatched, want.Succeeded, want.Failed, want.Mismatched))
+		}
+	}
+	if len(diffs) > 0 {
+		return fmt.Errorf("differs from the recording: %s", strings.Join(diffs, "; "))
+	}
+	fmt.Printf("Replay: all %d runs ended as recorded\n", len(c.runs))
+	return nil
+}
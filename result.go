@@ -0,0 +1,571 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// RunResult collects what a single doRun measured. The connection helpers
+// find it through the run's context, so run modes don't have to pass it
+// down themselves.
+type RunResult struct {
+	Name     string
+	Duration time.Duration
+	Err      error
+	// CPU is the user and system time the process used while the run's
+	// connections were transferring data; see startTransfer.
+	CPU time.Duration
+	// Allocs is the number of heap allocations made during the run, and
+	// AllocBytes how many bytes they came to.
+	Allocs     uint64
+	AllocBytes uint64
+	// Env is what the run was measured on.
+	Env *environment
+	// Aborted is why the circuit breaker cancelled the run, if it did.
+	Aborted string
+	// Panicked is whether the run ended in a panic, which Err holds.
+	Panicked bool
+
+	// abortThreshold, if non-zero, is the fraction of finished connections
+	// that may fail before addResult cancels the run's context with cancel.
+	abortThreshold float64
+	cancel         context.CancelFunc
+	abortOnce      sync.Once
+	// maxErrors is how many of the run's errors RunErrors keeps.
+	maxErrors int
+	// Succeeded counts the connections that received their payload intact,
+	// Failures those that failed to dial or read, by category, and
+	// Mismatched those that read to EOF but got the wrong data.
+	Succeeded  int64
+	Failures   failureCounts
+	Mismatched int64
+	// Unverified counts those of Succeeded that read to EOF without their
+	// data being checked, because verification was off or sampled.
+	Unverified int64
+	// WindowUpdates and ZeroWindows count the window updates and zero
+	// windows a windowTap saw during the run, if the stacks' link had one,
+	// which windowTapped records.
+	WindowUpdates int64
+	ZeroWindows   int64
+	windowTapped  int32
+
+	mu sync.Mutex
+	// TTFB holds, per connection that received any data, the time from the
+	// start of the dial until the first byte arrived.
+	TTFB []time.Duration
+	// Transfer holds, per connection read to EOF, the time from the start of
+	// the dial until EOF.
+	Transfer []time.Duration
+	// TransferHist is Transfer as a histogram.
+	TransferHist histogram
+	Bytes        int64
+	// Throughput holds, per connection read to EOF, how many bytes it
+	// received per second of its transfer.
+	Throughput []float64
+	// ClientClose and ServerClose hold how long each Close took, on the
+	// client once it read EOF and on the server once it sent its payload.
+	// Closing starts the FIN exchange, so this is a share of the teardown
+	// cost the transfer times leave out.
+	ClientClose []time.Duration
+	ServerClose []time.Duration
+	// transfers is how many connections are transferring data, and
+	// cpuStart the process's CPU time when the first of them started.
+	transfers int
+	cpuStart  time.Duration
+	// errs holds the first maxErrors errors addResult recorded, and
+	// droppedErrs counts those that came after.
+	errs        []error
+	droppedErrs int64
+	// conns holds a record of each client connection if recordConns is set,
+	// for the CSV output, and of each tagged one, for the tags' summaries.
+	conns       []*connRecord
+	recordConns bool
+	// listeners holds the listeners of the servers the run started, for
+	// doRun to close when the run finishes; see serverListen.
+	listeners []net.Listener
+}
+
+type resultKey struct{}
+
+func withResult(ctx context.Context, r *RunResult) context.Context {
+	return context.WithValue(ctx, resultKey{}, r)
+}
+
+// resultFrom returns the RunResult attached to ctx, or nil outside doRun.
+func resultFrom(ctx context.Context) *RunResult {
+	r, _ := ctx.Value(resultKey{}).(*RunResult)
+	return r
+}
+
+// active is the RunResult of the run in progress, for servers, which
+// outlive runs and have no run context, to record into.
+var active struct {
+	sync.Mutex
+	r *RunResult
+}
+
+func setActiveResult(r *RunResult) {
+	active.Lock()
+	defer active.Unlock()
+	active.r = r
+}
+
+// activeResult returns the RunResult of the run in progress, or nil between
+// runs.
+func activeResult() *RunResult {
+	active.Lock()
+	defer active.Unlock()
+	return active.r
+}
+
+// addListener has the run close li when it finishes. It is a no-op on a nil
+// RunResult.
+func (r *RunResult) addListener(li net.Listener) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.listeners = append(r.listeners, li)
+}
+
+// closeListeners closes the listeners added with addListener, freeing their
+// ports for later runs.
+func (r *RunResult) closeListeners() {
+	r.mu.Lock()
+	listeners := r.listeners
+	r.listeners = nil
+	r.mu.Unlock()
+	for _, li := range listeners {
+		_ = li.Close()
+	}
+}
+
+// startTransfer marks the start of one connection's transfer and returns a
+// func marking its end. CPU counts the process's CPU time while at least one
+// transfer is in progress, so that the run's setup and teardown, and any
+// time between its transfers, are left out of it, as they are of the
+// transfer times.
+func (r *RunResult) startTransfer() func() {
+	if r == nil {
+		return func() {}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.transfers == 0 {
+		r.cpuStart = cpuTime()
+	}
+	r.transfers++
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.transfers--
+		if r.transfers == 0 {
+			r.CPU += cpuTime() - r.cpuStart
+		}
+	}
+}
+
+// addTransfer records one connection read to EOF. A zero ttfb means no data
+// arrived and is left out of the TTFB samples.
+func (r *RunResult) addTransfer(ttfb, total time.Duration, n int) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if ttfb > 0 {
+		r.TTFB = append(r.TTFB, ttfb)
+	}
+	r.Transfer = append(r.Transfer, total)
+	r.TransferHist.add(total)
+	r.Bytes += int64(n)
+	if total > 0 {
+		r.Throughput = append(r.Throughput, float64(n)/total.Seconds())
+	}
+}
+
+// addClose records how long a client's Close took.
+func (r *RunResult) addClose(d time.Duration) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ClientClose = append(r.ClientClose, d)
+}
+
+// addServerClose records how long a server's Close took.
+func (r *RunResult) addServerClose(d time.Duration) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ServerClose = append(r.ServerClose, d)
+}
+
+// addResult records the outcome of one connection: err if it failed to dial
+// or read, otherwise whether it received the expected data.
+func (r *RunResult) addResult(err error, intact bool) {
+	if r == nil {
+		return
+	}
+	switch {
+	case err != nil:
+		r.Failures.add(err)
+		r.addError(err)
+		r.checkBreaker()
+	case intact:
+		atomic.AddInt64(&r.Succeeded, 1)
+	default:
+		atomic.AddInt64(&r.Mismatched, 1)
+	}
+}
+
+// addError keeps err for RunErrors, or counts it as dropped once maxErrors
+// have been kept, so that a run failing en masse doesn't hold every error.
+func (r *RunResult) addError(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.errs) < r.maxErrors {
+		r.errs = append(r.errs, err)
+	} else {
+		r.droppedErrs++
+	}
+}
+
+// RunErrors returns the errors the run's connections failed with, in the
+// order they were recorded, up to the cap. The category counts in Failures
+// cover every error; this is the detail behind them.
+func (r *RunResult) RunErrors() []error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]error(nil), r.errs...)
+}
+
+// DroppedErrors returns how many errors came after RunErrors was full.
+func (r *RunResult) DroppedErrors() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.droppedErrs
+}
+
+// addUnverified records that a connection addResult counted as a success
+// was only read to EOF, its data left unchecked.
+func (r *RunResult) addUnverified() {
+	if r == nil {
+		return
+	}
+	atomic.AddInt64(&r.Unverified, 1)
+}
+
+// breakerMinConns is how many connections must have finished before the
+// circuit breaker judges the failure rate, so that one early failure doesn't
+// abort a run.
+const breakerMinConns = 10
+
+// addWindow records a segment seen by a windowTap, which was a window
+// update or advertised a zero window or neither.
+func (r *RunResult) addWindow(update, zero bool) {
+	if r == nil {
+		return
+	}
+	atomic.StoreInt32(&r.windowTapped, 1)
+	if update {
+		atomic.AddInt64(&r.WindowUpdates, 1)
+	}
+	if zero {
+		atomic.AddInt64(&r.ZeroWindows, 1)
+	}
+}
+
+// checkBreaker cancels the run if its failure rate has gone over the abort
+// threshold, leaving what has been recorded so far as a partial result.
+func (r *RunResult) checkBreaker() {
+	if r.abortThreshold == 0 {
+		return
+	}
+	failed := r.Failures.total()
+	finished := failed + atomic.LoadInt64(&r.Succeeded) + atomic.LoadInt64(&r.Mismatched)
+	if finished < breakerMinConns || float64(failed) <= r.abortThreshold*float64(finished) {
+		return
+	}
+	r.abortOnce.Do(func() {
+		r.mu.Lock()
+		r.Aborted = fmt.Sprintf("%d/%d connections failed, over the %g%% threshold",
+			failed, finished, 100*r.abortThreshold)
+		r.mu.Unlock()
+		r.cancel()
+	})
+}
+
+// percentiles returns the given percentiles (0-100) of d by nearest rank.
+func percentiles(d []time.Duration, ps ...float64) []time.Duration {
+	if len(d) == 0 {
+		return nil
+	}
+	sorted := append([]time.Duration(nil), d...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	out := make([]time.Duration, len(ps))
+	for i, p := range ps {
+		out[i] = sorted[int(p/100*float64(len(sorted)-1)+0.5)]
+	}
+	return out
+}
+
+func formatPercentiles(d []time.Duration) string {
+	p := percentiles(d, 50, 90, 99)
+	if p == nil {
+		return "no samples"
+	}
+	return fmt.Sprintf("p50 %s, p90 %s, p99 %s (%d samples)", p[0], p[1], p[2], len(d))
+}
+
+// fairness describes how evenly throughput was shared between connections,
+// in MB/s per connection. Jain is Jain's fairness index, (Σx)²/(nΣx²), which
+// is 1 when every connection got the same and 1/n when one got everything.
+type fairness struct {
+	Min    float64 `json:"min"`
+	Max    float64 `json:"max"`
+	Mean   float64 `json:"mean"`
+	StdDev float64 `json:"stddev"`
+	Jain   float64 `json:"jain"`
+}
+
+// newFairness returns the fairness of the per-connection throughputs tp, in
+// bytes per second, or nil if there are none.
+func newFairness(tp []float64) *fairness {
+	if len(tp) == 0 {
+		return nil
+	}
+	f := &fairness{Min: math.Inf(1), Max: math.Inf(-1)}
+	var sum, sumSq float64
+	for _, x := range tp {
+		x /= 1e6
+		f.Min = math.Min(f.Min, x)
+		f.Max = math.Max(f.Max, x)
+		sum += x
+		sumSq += x * x
+	}
+	n := float64(len(tp))
+	f.Mean = sum / n
+	f.StdDev = math.Sqrt(math.Max(sumSq/n-f.Mean*f.Mean, 0))
+	if sumSq > 0 {
+		f.Jain = sum * sum / (n * sumSq)
+	}
+	return f
+}
+
+// status sums up how the run ended: ok, failed, aborted or panicked.
+func (r *RunResult) status() string {
+	switch {
+	case r.Panicked:
+		return "panicked"
+	case r.Aborted != "":
+		return "aborted"
+	case r.Err != nil:
+		return "failed"
+	}
+	return "ok"
+}
+
+// runSummary is the reportable form of a RunResult, with the samples
+// reduced to percentiles. Durations are in nanoseconds in JSON.
+type runSummary struct {
+	Name              string            `json:"name"`
+	Status            string            `json:"status"`
+	Duration          time.Duration     `json:"duration_ns"`
+	Succeeded         int64             `json:"succeeded"`
+	Failures          map[string]int64  `json:"failures,omitempty"`
+	Mismatched        int64             `json:"mismatched"`
+	Unverified        int64             `json:"unverified,omitempty"`
+	Bytes             int64             `json:"bytes"`
+	MBPerSec          float64           `json:"mb_per_sec"`
+	TTFB              []time.Duration   `json:"ttfb_p50_p90_p99_ns,omitempty"`
+	Transfer          []time.Duration   `json:"transfer_p50_p90_p99_ns,omitempty"`
+	TransferHistogram []histogramBucket `json:"transfer_histogram,omitempty"`
+	ClientClose       []time.Duration   `json:"close_p50_p90_p99_ns,omitempty"`
+	ServerClose       []time.Duration   `json:"server_close_p50_p90_p99_ns,omitempty"`
+	PerConn           *fairness         `json:"per_conn_mb_per_sec,omitempty"`
+	Window            *windowSummary    `json:"window,omitempty"`
+	Tags              []tagSummary      `json:"tags,omitempty"`
+	CPU               time.Duration     `json:"cpu_ns"`
+	CPUNsPerByte      float64           `json:"cpu_ns_per_byte,omitempty"`
+	Allocs            uint64            `json:"allocs"`
+	AllocBytes        uint64            `json:"alloc_bytes"`
+	// AllocsPerConn and AllocBytesPerConn spread the allocations over the
+	// connections that finished, successfully or not.
+	AllocsPerConn     float64 `json:"allocs_per_conn,omitempty"`
+	AllocBytesPerConn float64 `json:"alloc_bytes_per_conn,omitempty"`
+	Error             string  `json:"error,omitempty"`
+	// Errors are the connection errors RunErrors kept, and ErrorsDropped
+	// the number it didn't.
+	Errors        []string     `json:"errors,omitempty"`
+	ErrorsDropped int64        `json:"errors_dropped,omitempty"`
+	Aborted       string       `json:"aborted,omitempty"`
+	Env           *environment `json:"env,omitempty"`
+}
+
+// windowSummary is the window events of a run whose link was tapped.
+type windowSummary struct {
+	Updates     int64 `json:"updates"`
+	ZeroWindows int64 `json:"zero_windows"`
+}
+
+func (r *RunResult) summary() runSummary {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sum := runSummary{
+		Name:              r.Name,
+		Status:            r.status(),
+		Duration:          r.Duration,
+		Succeeded:         atomic.LoadInt64(&r.Succeeded),
+		Mismatched:        atomic.LoadInt64(&r.Mismatched),
+		Unverified:        atomic.LoadInt64(&r.Unverified),
+		Bytes:             r.Bytes,
+		TTFB:              percentiles(r.TTFB, 50, 90, 99),
+		Transfer:          percentiles(r.Transfer, 50, 90, 99),
+		TransferHistogram: r.TransferHist.buckets(),
+		ClientClose:       percentiles(r.ClientClose, 50, 90, 99),
+		ServerClose:       percentiles(r.ServerClose, 50, 90, 99),
+		PerConn:           newFairness(r.Throughput),
+		CPU:               r.CPU,
+		Allocs:            r.Allocs,
+		AllocBytes:        r.AllocBytes,
+		Aborted:           r.Aborted,
+		Env:               r.Env,
+	}
+	for i := range r.Failures {
+		if n := atomic.LoadInt64(&r.Failures[i]); n != 0 {
+			if sum.Failures == nil {
+				sum.Failures = make(map[string]int64)
+			}
+			sum.Failures[failureCategory(i).String()] = n
+		}
+	}
+	if atomic.LoadInt32(&r.windowTapped) != 0 {
+		sum.Window = &windowSummary{
+			Updates:     atomic.LoadInt64(&r.WindowUpdates),
+			ZeroWindows: atomic.LoadInt64(&r.ZeroWindows),
+		}
+	}
+	sum.Tags = r.tagSummaries(r.Duration)
+	if r.Duration > 0 {
+		sum.MBPerSec = float64(r.Bytes) / r.Duration.Seconds() / 1e6
+	}
+	if r.Bytes > 0 {
+		sum.CPUNsPerByte = float64(r.CPU.Nanoseconds()) / float64(r.Bytes)
+	}
+	if conns := sum.Succeeded + sum.Mismatched + r.Failures.total(); conns > 0 {
+		sum.AllocsPerConn = float64(r.Allocs) / float64(conns)
+		sum.AllocBytesPerConn = float64(r.AllocBytes) / float64(conns)
+	}
+	if r.Err != nil {
+		sum.Error = r.Err.Error()
+	}
+	for _, err := range r.errs {
+		sum.Errors = append(sum.Errors, err.Error())
+	}
+	sum.ErrorsDropped = r.droppedErrs
+	return sum
+}
+
+// tableColumns picks the optional columns of the end-of-run table: the TTFB
+// and transfer time percentiles with ttfb, and the CPU time per byte with
+// cpu.
+type tableColumns struct {
+	ttfb bool
+	cpu  bool
+}
+
+// writeTable writes the results as a table, one run per row, with the
+// optional columns cols selects.
+func writeTable(w io.Writer, results []*RunResult, cols tableColumns) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	header := []string{"RUN", "STATUS", "TIME", "OK", "FAILED", "BAD DATA", "MB/S"}
+	if cols.ttfb {
+		header = append(header, "TTFB P50", "TTFB P99", "XFER P99")
+	}
+	header = append(header, "CLOSE P99", "SRV CLOSE P99", "CONN MB/S MIN-MAX", "JAIN", "WND UPD/ZERO")
+	if cols.cpu {
+		header = append(header, "CPU-NS/B")
+	}
+	header = append(header, "ALLOCS", "ALLOCS/CONN", "KB/CONN", "ERROR")
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, r := range results {
+		sum := r.summary()
+		ok := fmt.Sprint(sum.Succeeded)
+		if sum.Unverified != 0 {
+			ok = fmt.Sprintf("%d (%d verified)", sum.Succeeded, sum.Succeeded-sum.Unverified)
+		}
+		perConn, jain := "-", "-"
+		if f := sum.PerConn; f != nil {
+			perConn = fmt.Sprintf("%.3g-%.3g", f.Min, f.Max)
+			jain = fmt.Sprintf("%.3f", f.Jain)
+		}
+		window := "-"
+		if sum.Window != nil {
+			window = fmt.Sprintf("%d/%d", sum.Window.Updates, sum.Window.ZeroWindows)
+		}
+		row := []string{sum.Name, sum.Status, sum.Duration.Round(time.Microsecond).String(), ok,
+			formatFailures(sum.Failures), fmt.Sprint(sum.Mismatched), fmt.Sprintf("%.2f", sum.MBPerSec)}
+		if cols.ttfb {
+			row = append(row, percentile(sum.TTFB, 0), percentile(sum.TTFB, 2), percentile(sum.Transfer, 2))
+		}
+		row = append(row, percentile(sum.ClientClose, 2), percentile(sum.ServerClose, 2), perConn, jain, window)
+		if cols.cpu {
+			row = append(row, fmt.Sprintf("%.0f", sum.CPUNsPerByte))
+		}
+		row = append(row, fmt.Sprint(sum.Allocs), fmt.Sprintf("%.0f", sum.AllocsPerConn),
+			fmt.Sprintf("%.1f", sum.AllocBytesPerConn/1024), sum.Error)
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	return writeTagTable(w, results)
+}
+
+// writeJSON writes the results as a JSON array.
+func writeJSON(w io.Writer, results []*RunResult) error {
+	sums := make([]runSummary, 0, len(results))
+	for _, r := range results {
+		sums = append(sums, r.summary())
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(sums)
+}
+
+func formatFailures(f map[string]int64) string {
+	if len(f) == 0 {
+		return "0"
+	}
+	var parts []string
+	for i := failureCategory(0); i < numFailureCategories; i++ {
+		if n, ok := f[i.String()]; ok {
+			parts = append(parts, fmt.Sprintf("%s %d", i, n))
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// percentile returns p[i] rounded for display, or "-" if there were no
+// samples.
+func percentile(p []time.Duration, i int) string {
+	if len(p) == 0 {
+		return "-"
+	}
+	return p[i].Round(time.Microsecond).String()
+}
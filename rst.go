@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// rstInjector is spliced into a socketpair like synTap, between a server
+// stack and a client stack, and passes every packet through. Once one
+// connection has carried after bytes of data from the server, it follows
+// that connection's latest segment with a RST forged from the server, with
+// the sequence number the client expects next so that the client accepts it.
+// Only that one connection is reset.
+type rstInjector struct {
+	after int
+
+	mu       sync.Mutex
+	received map[uint16]int
+	injected *rstTarget
+}
+
+// rstTarget is the connection a RST was injected into.
+type rstTarget struct {
+	clientPort uint16
+	seq        uint32
+}
+
+// relay is the injector's packetRelay, for splicing in with the server's end
+// first and the client's second, so that server to client packets go in
+// direction 0 and are followed by any RST to inject.
+func (r *rstInjector) relay(dir int, pkt []byte, send func(int, []byte) error) bool {
+	if dir != 0 || pkt == nil {
+		return true
+	}
+	if err := send(dir, pkt); err != nil {
+		return false
+	}
+	if rst := r.observe(pkt); rst != nil {
+		_ = send(dir, rst)
+	}
+	return false
+}
+
+// observe counts the data in a server to client segment and returns the RST
+// to inject after it, if this is the segment that takes its connection past
+// the threshold and no connection has been reset yet.
+func (r *rstInjector) observe(pkt []byte) []byte {
+	if len(pkt) < header.IPv6MinimumSize || header.IPVersion(pkt) != header.IPv6Version {
+		return nil
+	}
+	ip := header.IPv6(pkt)
+	if ip.TransportProtocol() != header.TCPProtocolNumber || len(ip.Payload()) < header.TCPMinimumSize {
+		return nil
+	}
+	tcp := header.TCP(ip.Payload())
+	n := len(tcp.Payload())
+	if n == 0 {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	port := tcp.DestinationPort()
+	r.received[port] += n
+	if r.injected != nil || r.received[port] < r.after {
+		return nil
+	}
+	seq := tcp.SequenceNumber() + uint32(n)
+	r.injected = &rstTarget{clientPort: port, seq: seq}
+	return tcpPacket(ip.SourceAddress(), ip.DestinationAddress(), header.TCPFields{
+		SrcPort: tcp.SourcePort(),
+		DstPort: port,
+		SeqNum:  seq,
+		Flags:   header.TCPFlagRst,
+	}, nil)
+}
+
+// target returns the connection a RST was injected into, or nil.
+func (r *rstInjector) target() *rstTarget {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.injected
+}
+
+// innermostError returns the last error in err's chain.
+func innermostError(err error) error {
+	for {
+		next := errors.Unwrap(err)
+		if next == nil {
+			return err
+		}
+		err = next
+	}
+}
+
+// awaitNoConnections waits up to timeout for s to have no established TCP
+// connections left, and returns how many it still has.
+func awaitNoConnections(s *stack.Stack, timeout time.Duration) uint64 {
+	deadline := time.Now().Add(timeout)
+	for {
+		n := s.Stats().TCP.CurrentEstablished.Value()
+		if n == 0 || time.Now().After(deadline) {
+			return n
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// runResetInjection has nConns gonet clients each receive a 1MiB payload
+// while an rstInjector resets one of them partway through. It checks that
+// exactly that connection fails with a reset, that the rest arrive intact,
+// that both stacks count the reset, and that neither is left with any
+// connection established afterwards: the client drops its endpoint on the
+// RST, and answers the server's next segment with a RST of its own.
+func runResetInjection(ctx context.Context, nConns int, opts stackOptions) error {
+	if opts.sockType == syscall.SOCK_STREAM {
+		return fmt.Errorf("reset injection needs a socketpair type that keeps packet boundaries")
+	}
+	payload := randomPayload(newLockedRand(opts.seed), 1024*1024)
+	addr1, addr2 := pairAddresses(opts)
+	inj := &rstInjector{after: 64 * 1024, received: make(map[uint16]int)}
+	fd1, fd2, err := spliceSocketpairs(opts.sockType, inj.relay)
+	if err != nil {
+		return err
+	}
+	server, client, err := setupStackPairFDs([]int{fd1}, []int{fd2}, addr1, addr2, opts)
+	if err != nil {
+		return err
+	}
+	serverT, clientT := gonetPair(server, addr1, client, addr2)
+	go payloadServer(serverT, 1234, payload)
+	time.Sleep(time.Millisecond)
+	type outcome struct {
+		port uint16
+		err  error
+	}
+	var mu sync.Mutex
+	var outcomes []outcome
+	intact := 0
+	wg := &sync.WaitGroup{}
+	wg.Add(nConns)
+	for i := 0; i < nConns; i++ {
+		go func() {
+			defer wg.Done()
+			id := newConnID()
+			start := time.Now()
+			c, err := clientT.Dial(ctx, 1234)
+			if err != nil {
+				resultFrom(ctx).addResult(err, false)
+				logConn(id, "dial TCP error: %s%s", err, dialErrorHint(err))
+				return
+			}
+			port := uint16(c.LocalAddr().(*net.TCPAddr).Port)
+			b, err := receiveConn(ctx, c, start)
+			resultFrom(ctx).addResult(err, bytes.Equal(b, payload))
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err != nil:
+				outcomes = append(outcomes, outcome{port, err})
+			case bytes.Equal(b, payload):
+				intact++
+			default:
+				logConn(id, "incorrect data received: expected %d bytes but got %d", len(payload), len(b))
+			}
+		}()
+	}
+	wg.Wait()
+	target := inj.target()
+	if target == nil {
+		return fmt.Errorf("no connection carried %d bytes, so no RST was injected", inj.after)
+	}
+	fmt.Printf("injected RST into the connection from port %d at seq %d\n", target.clientPort, target.seq)
+	failed := false
+	for _, o := range outcomes {
+		inner := innermostError(o.err)
+		fmt.Printf("port %d: %s error, %T: %v\n", o.port, classifyError(o.err), inner, o.err)
+		if o.port != target.clientPort || classifyError(o.err) != failReset {
+			failed = true
+		}
+	}
+	fmt.Printf("%d/%d connections received the payload intact\n", intact, nConns)
+	serverLeft := awaitNoConnections(server, time.Second)
+	clientLeft := awaitNoConnections(client, time.Second)
+	serverTCP, clientTCP := server.Stats().TCP, client.Stats().TCP
+	fmt.Printf("client: resets received %d, established resets %d, still established %d\n",
+		clientTCP.ResetsReceived.Value(), clientTCP.EstablishedResets.Value(), clientLeft)
+	fmt.Printf("server: resets received %d, established resets %d, still established %d\n",
+		serverTCP.ResetsReceived.Value(), serverTCP.EstablishedResets.Value(), serverLeft)
+	switch {
+	case failed || len(outcomes) != 1 || intact != nConns-1:
+		return fmt.Errorf("expected only the connection from port %d to be reset", target.clientPort)
+	case clientTCP.ResetsReceived.Value() == 0:
+		return fmt.Errorf("client stack did not count the RST it received")
+	case clientLeft != 0 || serverLeft != 0:
+		return fmt.Errorf("connections left established after the reset: client %d, server %d", clientLeft, serverLeft)
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/link/nested"
+	"gvisor.dev/gvisor/pkg/tcpip/link/pipe"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"sync"
+	"syscall"
+)
+
+// socketpair is syscall.Socketpair, for the link between the stacks of a
+// pair, and is replaced by checkSocketpairFallback to simulate a sandbox
+// that forbids it. The taps other modes splice into the link call
+// syscall.Socketpair directly: they need the socketpair to observe, so
+// there is nothing for them to fall back to.
+var socketpair = syscall.Socketpair
+
+// sandboxDenied reports whether err is how a sandbox refuses a syscall:
+// seccomp filters commonly return EPERM, or ENOSYS to look as though the
+// call doesn't exist, and some LSM policies EACCES.
+func sandboxDenied(err error) bool {
+	return errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES) || errors.Is(err, syscall.ENOSYS)
+}
+
+// fallbackOnce reports the first fallback to a pipe link, so a run of many
+// pairs says why once rather than for every pair.
+var fallbackOnce sync.Once
+
+// setupPipePair is setupStackPair joining the stacks with a pipe endpoint,
+// which hands each packet straight to the other stack without any fd, for
+// when socketpairs can't be had. Nothing sits between the stacks to delay
+// or tap packets, so opts.latency and opts.countWindows are ignored, and
+// there are no dispatch threads to pin; why is the error setupStackPair got.
+func setupPipePair(addr1, addr2 tcpip.Address, opts stackOptions, why error) (*stack.Stack, *stack.Stack, error) {
+	fallbackOnce.Do(func() {
+		fmt.Printf("socketpair unavailable (%s), linking the stacks with a pipe endpoint instead\n", why)
+		if opts.latency > 0 {
+			fmt.Printf("the pipe endpoint adds no latency; -latency is ignored\n")
+		}
+		if opts.countWindows {
+			fmt.Printf("the pipe endpoint can't be tapped; -countwindows is ignored\n")
+		}
+	})
+	second := opts.second()
+	second.seed += seedsPerStack
+	mtus := [2]uint32{opts.mtu, second.mtu}
+	for i := range mtus {
+		if mtus[i] == 0 {
+			mtus[i] = 1500
+		}
+	}
+	pipe1, pipe2 := pipe.New("", "", mtus[0])
+	var ep1, ep2 stack.LinkEndpoint = pipe1, pipe2
+	if mtus[1] != mtus[0] {
+		ep2 = newFixedMTUEndpoint(pipe2, mtus[1])
+	}
+	var stacks [2]*stack.Stack
+	for i, s := range []struct {
+		ep   stack.LinkEndpoint
+		addr tcpip.Address
+		opts stackOptions
+	}{
+		{ep1, addr1, opts},
+		{ep2, addr2, second},
+	} {
+		netStack, err := newStack(s.opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		ep := s.ep
+		if s.opts.linkMTU != nil {
+			ep = s.opts.linkMTU.wrap(ep)
+		}
+		if err := addNIC(netStack, ep, s.addr, s.opts); err != nil {
+			return nil, nil, err
+		}
+		stacks[i] = netStack
+	}
+	return stacks[0], stacks[1], nil
+}
+
+// fixedMTUEndpoint is a link endpoint with its MTU overridden, for the end
+// of a pipe whose stack has an MTU of its own.
+type fixedMTUEndpoint struct {
+	nested.Endpoint
+	mtu uint32
+}
+
+func newFixedMTUEndpoint(child stack.LinkEndpoint, mtu uint32) *fixedMTUEndpoint {
+	e := &fixedMTUEndpoint{mtu: mtu}
+	e.Endpoint.Init(child, e)
+	return e
+}
+
+func (e *fixedMTUEndpoint) MTU() uint32 {
+	return e.mtu
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSocketpairFallback(t *testing.T) {
+	if err := checkSocketpairFallback(testContext(t), testOptions()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkSocketpairFallback makes socketpairs fail as a seccomp sandbox would,
+// and checks that a gonet pair still comes up, over a pipe endpoint, and
+// carries a connection in each direction.
+func checkSocketpairFallback(ctx context.Context, opts stackOptions) error {
+	socketpair = func(int, int, int) ([2]int, error) {
+		return [2]int{}, syscall.EPERM
+	}
+	defer func() { socketpair = syscall.Socketpair }()
+	if _, _, err := socketpairs(opts.sockType, 1); !sandboxDenied(err) {
+		return fmt.Errorf("simulated socketpair failure returned %v, expected EPERM", err)
+	}
+	server, client, err := setupGonetPair(opts)
+	if err != nil {
+		return fmt.Errorf("gonet pair without socketpairs: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := runPair(ctx, server, client, 1234, 1); err != nil {
+		return fmt.Errorf("gonet pair without socketpairs: %w", err)
+	}
+	fmt.Printf("without socketpairs: connections carried over a pipe endpoint\n")
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// lockedSource makes a rand.Source safe for concurrent use, as netstack
+// requires of stack.Options.RandSource.
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.src.Seed(seed)
+}
+
+func newLockedRand(seed int64) *rand.Rand {
+	return rand.New(&lockedSource{src: rand.NewSource(seed)})
+}
+
+// randomPayload returns n bytes drawn from rng.
+func randomPayload(rng *rand.Rand, n int) []byte {
+	b := make([]byte, n)
+	_, _ = rng.Read(b)
+	return b
+}
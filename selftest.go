@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// collectConns dials nConns connections concurrently and returns what each
+// one received, along with the errors from those that failed. Each is
+// recorded in ctx's run, as intact if it received exactly want, and in the
+// CSV output if the run writes it; a caller expecting connections to fail
+// gives them withResult(ctx, nil) instead.
+func collectConns(ctx context.Context, t Transport, port uint16, nConns int, want []byte) ([][]byte, []error) {
+	var mu sync.Mutex
+	var received [][]byte
+	var errs []error
+	wg := &sync.WaitGroup{}
+	wg.Add(nConns)
+	for i := 0; i < nConns; i++ {
+		go func() {
+			defer wg.Done()
+			id := newConnID()
+			ctx, rec := withConnRecord(ctx, id)
+			start := time.Now()
+			c, err := t.Dial(ctx, port)
+			if err != nil {
+				rec.dialed(nil, port, 0)
+			} else {
+				rec.dialed(c, port, time.Since(start))
+				var b []byte
+				b, err = receiveConn(ctx, c, start)
+				if err == nil {
+					intact := bytes.Equal(b, want)
+					rec.finish(nil, intact)
+					resultFrom(ctx).addResult(nil, intact)
+					mu.Lock()
+					received = append(received, b)
+					mu.Unlock()
+					return
+				}
+			}
+			rec.finish(err, false)
+			resultFrom(ctx).addResult(err, false)
+			mu.Lock()
+			errs = append(errs, fmt.Errorf("conn %d: %w", id, err))
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return received, errs
+}
+
+// runSelfTest is a pass/fail check that netstack behaves like the kernel: the
+// same payload is sent over native TCP and over gonet, and every connection
+// on both paths must succeed and receive exactly that payload. It is repeated
+// with an empty payload, for which the server must still accept and cleanly
+// close, and the client must read EOF with no data. The harness's own checks
+// are tests, run by go test.
+func runSelfTest(ctx context.Context, nConns int, opts stackOptions) error {
+	payloads := []struct {
+		name    string
+		payload []byte
+	}{
+		{"16KiB", randomPayload(rand.New(rand.NewSource(opts.seed)), 16*1024)},
+		{"empty", []byte{}},
+	}
+	native := &netTransport{addr: net.ParseIP("::1")}
+	server, client, err := setupGonetPair(opts)
+	if err != nil {
+		return err
+	}
+	failed := false
+	for i, p := range payloads {
+		paths := []struct {
+			name   string
+			server Transport
+			client Transport
+			port   uint16
+		}{
+			{"net", native, native, uint16(5678 + i)},
+			{"gonet", server, client, uint16(1234 + i)},
+		}
+		for _, path := range paths {
+			go payloadServer(path.server, path.port, p.payload)
+		}
+		time.Sleep(time.Millisecond)
+		for _, path := range paths {
+			received, errs := collectConns(ctx, path.client, path.port, nConns, p.payload)
+			for _, err := range errs {
+				fmt.Printf("%s %s: %s\n", path.name, p.name, err)
+			}
+			mismatched := 0
+			for _, b := range received {
+				if !bytes.Equal(b, p.payload) {
+					mismatched++
+				}
+			}
+			fmt.Printf("%s %s: %d/%d connections received the payload intact, %d failed, %d mismatched\n",
+				path.name, p.name, len(received)-mismatched, nConns, len(errs), mismatched)
+			if len(errs) != 0 || mismatched != 0 {
+				failed = true
+			}
+		}
+	}
+	if failed {
+		return fmt.Errorf("gonet and net results differ from the expected payload")
+	}
+	return nil
+}
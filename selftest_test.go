@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/waiter"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testOptions are the stack options the tests run with: the default
+// socketpair type and a fixed seed, so that a failure reproduces.
+func testOptions() stackOptions {
+	return stackOptions{seed: 1, sockType: syscall.SOCK_SEQPACKET}
+}
+
+// testContext returns a context that ends when t's deadline, if it has one,
+// is near, so that a hung check fails rather than the whole binary.
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	if deadline, ok := t.Deadline(); ok {
+		ctx, cancel = context.WithDeadline(context.Background(), deadline.Add(-5*time.Second))
+	}
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestSelfTest(t *testing.T) {
+	if err := runSelfTest(testContext(t), 5, testOptions()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRebind(t *testing.T) {
+	if err := checkRebind(testContext(t), testOptions()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDefaultRoute(t *testing.T) {
+	if err := checkDefaultRoute(testOptions()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	if err := checkErrors(testOptions()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRoutingLoop(t *testing.T) {
+	if err := checkRoutingLoop(testOptions()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+	if err := checkPanicRecovery(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunPanic(t *testing.T) {
+	if err := checkRunPanic(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	if err := checkRunErrors(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnRecords(t *testing.T) {
+	if err := checkConnRecords(testOptions()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInjection(t *testing.T) {
+	if err := checkInjection(testOptions()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUDPChecksums(t *testing.T) {
+	if err := checkUDPChecksums(testOptions()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkInjection injects packets from a peer that isn't there into a stack
+// listening on port 1234, and checks that the stack answers each with the
+// one packet it should: a SYN-ACK to a SYN for the listening port, a RST for
+// a closed port, an ICMPv6 port unreachable for UDP to a closed port, and an
+// echo reply to an echo request.
+func checkInjection(opts stackOptions) error {
+	in, err := newInjector(opts)
+	if err != nil {
+		return err
+	}
+	go testServer(in.Transport(), 1234)
+	time.Sleep(time.Millisecond)
+	syn := func(port uint16) []byte {
+		return tcpPacket(in.peer, in.addr, header.TCPFields{
+			SrcPort:    40000,
+			DstPort:    port,
+			SeqNum:     1000,
+			Flags:      header.TCPFlagSyn,
+			WindowSize: 65535,
+		}, nil)
+	}
+	cases := []struct {
+		name  string
+		pkt   []byte
+		check func(ip header.IPv6) bool
+	}{
+		{"SYN to a listening port", syn(1234), func(ip header.IPv6) bool {
+			tcp := header.TCP(ip.Payload())
+			return ip.TransportProtocol() == header.TCPProtocolNumber &&
+				tcp.Flags() == header.TCPFlagSyn|header.TCPFlagAck && tcp.AckNumber() == 1001
+		}},
+		{"SYN to a closed port", syn(1235), func(ip header.IPv6) bool {
+			tcp := header.TCP(ip.Payload())
+			return ip.TransportProtocol() == header.TCPProtocolNumber &&
+				tcp.Flags().Contains(header.TCPFlagRst) && tcp.AckNumber() == 1001
+		}},
+		{"UDP to a closed port", udpPacket(in.peer, in.addr, 40000, 9, []byte(testMsg)), func(ip header.IPv6) bool {
+			icmp := header.ICMPv6(ip.Payload())
+			return ip.TransportProtocol() == header.ICMPv6ProtocolNumber &&
+				icmp.Type() == header.ICMPv6DstUnreachable && icmp.Code() == header.ICMPv6PortUnreachable
+		}},
+		{"echo request", echoRequest(in.peer, in.addr, 7, 1, []byte(testMsg)), func(ip header.IPv6) bool {
+			icmp := header.ICMPv6(ip.Payload())
+			return ip.TransportProtocol() == header.ICMPv6ProtocolNumber &&
+				icmp.Type() == header.ICMPv6EchoReply && icmp.Ident() == 7 && icmp.Sequence() == 1
+		}},
+	}
+	for _, c := range cases {
+		in.inject(c.pkt)
+		out := in.outgoing(50 * time.Millisecond)
+		if len(out) != 1 {
+			return fmt.Errorf("%s: stack sent %d packets in response, not 1", c.name, len(out))
+		}
+		fmt.Printf("injected %s: %s\n", c.name, describePacket(out[0]))
+		ip := header.IPv6(out[0])
+		if len(out[0]) < header.IPv6MinimumSize+header.TCPMinimumSize || !c.check(ip) {
+			return fmt.Errorf("%s: unexpected response %s", c.name, describePacket(out[0]))
+		}
+	}
+	return nil
+}
+
+// checkRebind checks that, on both paths, a server can listen on a port
+// again straight after serving a connection on it and closing. The server
+// closes first, so its end of the connection is left in TIME-WAIT. On gonet
+// it also checks that binding the port without SO_REUSEADDR fails then, so
+// that gonetTransport.Listen's setting it is shown to be what lets the
+// listener rebind.
+func checkRebind(ctx context.Context, opts stackOptions) error {
+	server, client, err := setupGonetPair(opts)
+	if err != nil {
+		return err
+	}
+	native := &netTransport{addr: net.ParseIP("::1")}
+	paths := []struct {
+		name   string
+		server Transport
+		client Transport
+		port   uint16
+	}{
+		{"net", native, native, 5700},
+		{"gonet", server, client, 1240},
+	}
+	for _, path := range paths {
+		li, err := path.server.Listen(path.port)
+		if err != nil {
+			return fmt.Errorf("%s first bind: %w", path.name, err)
+		}
+		go func() {
+			if sc, err := li.Accept(); err == nil {
+				serveConn(sc, []byte(testMsg))
+			}
+		}()
+		c, err := path.client.Dial(ctx, path.port)
+		if err == nil {
+			_, err = receiveConn(withResult(ctx, nil), c, time.Now())
+		}
+		_ = li.Close()
+		if err != nil {
+			return fmt.Errorf("%s connection before rebinding: %w", path.name, err)
+		}
+		if gt, ok := path.server.(*gonetTransport); ok {
+			err := bindWithoutReuse(gt.netStack, path.port)
+			fmt.Printf("%s bind of port %d without SO_REUSEADDR: %v\n", path.name, path.port, err)
+			if err == nil {
+				return fmt.Errorf("%s bound port %d without SO_REUSEADDR while TIME-WAIT held it", path.name, path.port)
+			}
+		}
+		li, err = path.server.Listen(path.port)
+		fmt.Printf("%s rebind of port %d: %v\n", path.name, path.port, err)
+		if err != nil {
+			return fmt.Errorf("%s second bind: %w", path.name, err)
+		}
+		_ = li.Close()
+	}
+	return nil
+}
+
+// bindWithoutReuse binds a TCP endpoint on s to port, without SO_REUSEADDR,
+// and closes it again.
+func bindWithoutReuse(s *stack.Stack, port uint16) error {
+	ep, tcpErr := s.NewEndpoint(tcp.ProtocolNumber, ipv6.ProtocolNumber, &waiter.Queue{})
+	if tcpErr != nil {
+		return fmt.Errorf("endpoint: %w", wrapTCPIP(tcpErr))
+	}
+	defer ep.Close()
+	if tcpErr := ep.Bind(tcpip.FullAddress{NIC: 1, Port: port}); tcpErr != nil {
+		return fmt.Errorf("bind: %w", wrapTCPIP(tcpErr))
+	}
+	return nil
+}
+
+// checkDefaultRoute checks that a stack configured with an on-link gateway
+// has a default route through it in its route table, and that an off-link
+// gateway is refused.
+func checkDefaultRoute(opts stackOptions) error {
+	fds1, _, err := socketpairs(opts.sockType, 1)
+	if err != nil {
+		return err
+	}
+	opts.gateway = tcpip.Address(net.ParseIP("FD00::FE"))
+	addr, _ := pairAddresses(opts)
+	s, err := setupStack(fds1, addr, opts)
+	if err != nil {
+		return err
+	}
+	want := defaultRoute(opts.gateway)
+	found := false
+	for _, r := range s.GetRouteTable() {
+		if r == want {
+			found = true
+		}
+	}
+	fmt.Printf("default route %s: found %v\n", want, found)
+	if !found {
+		return fmt.Errorf("default route %s missing from route table %v", want, s.GetRouteTable())
+	}
+	fds2, _, err := socketpairs(opts.sockType, 1)
+	if err != nil {
+		return err
+	}
+	opts.gateway = tcpip.Address(net.ParseIP("2001:db8::1"))
+	if _, err := setupStack(fds2, addr, opts); err == nil {
+		return fmt.Errorf("off-link gateway %s was accepted", opts.gateway)
+	}
+	return nil
+}
+
+// checkRoutingLoop checks that a dial into a routing loop fails promptly with
+// errRoutingLoop rather than hanging, and that a run whose connection does
+// so says so in its error. Both stacks of a pair forward, and each has a
+// default route through the other, so a SYN to an address outside the
+// subnet is passed straight back to the stack that sent it. The transport is
+// gonetPair's, so that this also checks it detects loops on such a stack.
+func checkRoutingLoop(opts stackOptions) error {
+	addr1, addr2 := pairAddresses(opts)
+	stack1, stack2, err := setupStackPair(addr1, addr2, opts)
+	if err != nil {
+		return err
+	}
+	for _, s := range []struct {
+		s       *stack.Stack
+		gateway tcpip.Address
+	}{{stack1, addr2}, {stack2, addr1}} {
+		if tcpErr := s.s.SetForwardingDefaultAndAllNICs(ipv6.ProtocolNumber, true); tcpErr != nil {
+			return fmt.Errorf("enable forwarding: %w", wrapTCPIP(tcpErr))
+		}
+		s.s.AddRoute(defaultRoute(s.gateway))
+	}
+	_, t := gonetPair(stack1, addr1, stack2, addr2)
+	if !t.detectLoops {
+		return fmt.Errorf("gonetPair left loop detection off on a forwarding stack with a default route")
+	}
+	t.remote = tcpip.Address(net.ParseIP("fd99::1"))
+	// The deadline only bounds a failed check; detection should take a
+	// fraction of it.
+	const deadline = 10 * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), deadline)
+	defer cancel()
+	start := time.Now()
+	c, err := t.Dial(ctx, 80)
+	if err == nil {
+		_ = c.Close()
+	}
+	elapsed := time.Since(start)
+	fmt.Printf("dial into a loop: %v after %s\n", err, elapsed.Round(time.Millisecond))
+	if !errors.Is(err, errRoutingLoop) {
+		return fmt.Errorf("dial into a routing loop returned %v, not a routing loop error", err)
+	}
+	r := doRun("routing loop run", deadline, runConfig{}, func(ctx context.Context) error {
+		_, _ = collectConns(ctx, t, 80, 1, nil)
+		return nil
+	})
+	if !errors.Is(r.Err, errRoutingLoop) {
+		return fmt.Errorf("run dialing into a routing loop ended with %v, not a routing loop error", r.Err)
+	}
+	return nil
+}
+
+// checkErrors checks that setup and run errors can be told apart with
+// errors.Is and unwrapTCPIP: a bad address is a stack setup failure, a bad
+// link fd is also a NIC creation failure, and a call on a missing NIC
+// carries netstack's own error.
+func checkErrors(opts stackOptions) error {
+	fds, _, err := socketpairs(opts.sockType, 1)
+	if err != nil {
+		return err
+	}
+	_, err = setupStack(fds, tcpip.Address(net.ParseIP("2001:db8::1")), opts)
+	fmt.Printf("bad address: %v\n", err)
+	if !errors.Is(err, errStackSetup) || errors.Is(err, errCreateNIC) {
+		return fmt.Errorf("bad address error %v is not just a stack setup failure", err)
+	}
+	addr, _ := pairAddresses(opts)
+	_, err = setupStack([]int{-1}, addr, opts)
+	fmt.Printf("bad fd: %v\n", err)
+	if !errors.Is(err, errStackSetup) || !errors.Is(err, errCreateNIC) {
+		return fmt.Errorf("bad fd error %v is not a NIC creation failure", err)
+	}
+	s, err := setupStack(fds, addr, opts)
+	if err != nil {
+		return err
+	}
+	err = setNICEnabled(s, 99, true)
+	fmt.Printf("missing NIC: %v\n", err)
+	if _, ok := unwrapTCPIP(err).(*tcpip.ErrUnknownNICID); !ok {
+		return fmt.Errorf("missing NIC error %v is not tcpip.ErrUnknownNICID", err)
+	}
+	return nil
+}
+
+// checkPanicRecovery panics in a connection goroutine guarded by recoverConn
+// and checks that the run survives it with the panic recorded as a failure
+// in its own category.
+func checkPanicRecovery() error {
+	r := &RunResult{Name: "panic check"}
+	ctx := withResult(context.Background(), r)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer recoverConn(ctx, newConnID())
+		panic("deliberate")
+	}()
+	<-done
+	fmt.Printf("panic in a connection: failures %s\n", &r.Failures)
+	if n := r.Failures[failPanic]; n != 1 || r.Failures.total() != 1 {
+		return fmt.Errorf("panic recorded as failures %s, expected panic 1", &r.Failures)
+	}
+	return nil
+}
+
+// checkRunPanic panics in a run's own goroutine and checks that doRun
+// recovers it as the run's failure.
+func checkRunPanic() error {
+	r := doRun("panic run check", time.Second, runConfig{}, func(context.Context) error {
+		panic("deliberate")
+	})
+	fmt.Printf("panic in a run: status %s\n", r.status())
+	if !r.Panicked || !errors.Is(r.Err, errPanic) {
+		return fmt.Errorf("panicking run ended with status %s, error %v, expected a panic", r.status(), r.Err)
+	}
+	return nil
+}
+
+// checkConnRecords runs runSelfTest, whose connections are dialed by
+// collectConns, in a run recording connections, and checks that the CSV
+// output has a row for every one of them.
+func checkConnRecords(opts stackOptions) error {
+	const nConns = 3
+	r := doRun("conn record check", 10*time.Second, runConfig{recordConns: true}, func(ctx context.Context) error {
+		return runSelfTest(ctx, nConns, opts)
+	})
+	if r.Err != nil {
+		return r.Err
+	}
+	var b bytes.Buffer
+	if err := writeCSV(&b, []*RunResult{r}); err != nil {
+		return err
+	}
+	rows, err := csv.NewReader(&b).ReadAll()
+	if err != nil {
+		return err
+	}
+	// Two payloads over two paths, and a header row.
+	want := 2*2*nConns + 1
+	fmt.Printf("conn records: %d CSV rows\n", len(rows))
+	if len(rows) != want {
+		return fmt.Errorf("CSV output has %d rows for the self-test's connections, expected %d", len(rows), want)
+	}
+	for _, row := range rows[1:] {
+		if row[7] != "ok" {
+			return fmt.Errorf("CSV row %q has status %q, expected ok", row, row[7])
+		}
+	}
+	return nil
+}
+
+// checkRunErrors records more failures than a RunResult keeps and checks
+// that RunErrors returns the first ones, in order, and DroppedErrors counts
+// the rest.
+func checkRunErrors() error {
+	r := &RunResult{Name: "error check", maxErrors: 3}
+	var want []error
+	for i := 0; i < 5; i++ {
+		err := fmt.Errorf("failure %d", i)
+		want = append(want, err)
+		r.addResult(err, false)
+	}
+	errs, dropped := r.RunErrors(), r.DroppedErrors()
+	fmt.Printf("run errors: %d kept, %d dropped\n", len(errs), dropped)
+	if len(errs) != 3 || dropped != 2 {
+		return fmt.Errorf("run kept %d errors and dropped %d, expected 3 and 2", len(errs), dropped)
+	}
+	for i, err := range errs {
+		if err != want[i] {
+			return fmt.Errorf("run error %d is %q, expected %q", i, err, want[i])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A sequenced stream lets a client tell how a stream went wrong, not just
+// that it did. It starts with a 12-byte stream header:
+//
+//	magic  uint32  seqMagic
+//	total  uint64  length of the whole stream, this header included
+//
+// followed by records, each an 8-byte header and a body:
+//
+//	seq    uint32  0 for the first record, then 1, 2, ...
+//	length uint32  length of the body, at most maxSeqRecord
+//	body   length bytes, byte i being byte(seq + i)
+//
+// All integers are big-endian. As each record's body is determined by its
+// sequence number, a record that arrives twice, out of order, or not at all
+// is recognisable as such, and the total tells a stream cut short at a
+// record boundary from a complete one.
+const (
+	seqMagic        = 0x67767371 // "gvsq"
+	seqStreamHeader = 12
+	seqRecordHeader = 8
+	maxSeqRecord    = 64 * 1024
+)
+
+// seqStream returns a sequenced stream of about size bytes, in records of
+// random lengths drawn from rng.
+func seqStream(rng *rand.Rand, size int) []byte {
+	b := make([]byte, seqStreamHeader, size+seqStreamHeader+seqRecordHeader+maxSeqRecord)
+	binary.BigEndian.PutUint32(b, seqMagic)
+	for seq := uint32(0); len(b) < size; seq++ {
+		b = appendSeqRecord(b, seq, 1+rng.Intn(maxSeqRecord))
+	}
+	binary.BigEndian.PutUint64(b[4:], uint64(len(b)))
+	return b
+}
+
+func appendSeqRecord(b []byte, seq uint32, length int) []byte {
+	var hdr [seqRecordHeader]byte
+	binary.BigEndian.PutUint32(hdr[:], seq)
+	binary.BigEndian.PutUint32(hdr[4:], uint32(length))
+	b = append(b, hdr[:]...)
+	for i := 0; i < length; i++ {
+		b = append(b, byte(seq+uint32(i)))
+	}
+	return b
+}
+
+// seqAnomaly is something wrong with a received sequenced stream: its kind,
+// the record it concerns, if any, and the stream offset it was found at.
+type seqAnomaly struct {
+	kind   string
+	seq    uint32
+	offset int64
+}
+
+// The kinds of seqAnomaly.
+const (
+	seqDuplicate = "duplicate"
+	seqReordered = "reordered"
+	seqMissing   = "missing"
+	seqTruncated = "truncated"
+	seqOverrun   = "overrun"
+	seqCorrupt   = "corrupt"
+)
+
+func (a seqAnomaly) String() string {
+	switch a.kind {
+	case seqDuplicate, seqReordered:
+		return fmt.Sprintf("record %d %s at byte %d", a.seq, a.kind, a.offset)
+	case seqMissing:
+		return fmt.Sprintf("record %d missing", a.seq)
+	}
+	return fmt.Sprintf("stream %s at byte %d", a.kind, a.offset)
+}
+
+// summarizeAnomalies counts anomalies by kind, e.g. "duplicate 2, missing 1".
+func summarizeAnomalies(anomalies []seqAnomaly) string {
+	counts := make(map[string]int)
+	for _, a := range anomalies {
+		counts[a.kind]++
+	}
+	var parts []string
+	for kind, n := range counts {
+		parts = append(parts, fmt.Sprintf("%s %d", kind, n))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ", ")
+}
+
+// verifySeqStream reads a sequenced stream from r to EOF and returns what it
+// found wrong with it, along with the number of bytes read and any read
+// error. A record whose header or body is wrong leaves no way to find the
+// next one, so it is reported as corrupt and the rest of the stream is
+// skipped.
+func verifySeqStream(r io.Reader) ([]seqAnomaly, int64, error) {
+	br := bufio.NewReader(r)
+	var offset int64
+	var anomalies []seqAnomaly
+	report := func(kind string, seq uint32) {
+		anomalies = append(anomalies, seqAnomaly{kind: kind, seq: seq, offset: offset})
+	}
+	// finish reports a stream that io.ReadFull found cut short with err
+	// as truncated, and drains whatever is left of it.
+	finish := func(err error) ([]seqAnomaly, int64, error) {
+		if err == io.ErrUnexpectedEOF {
+			err = nil
+			report(seqTruncated, 0)
+		}
+		rest, cerr := io.Copy(io.Discard, br)
+		offset += rest
+		if err == nil && cerr != nil {
+			err = cerr
+		}
+		return anomalies, offset, err
+	}
+	var hdr [seqStreamHeader]byte
+	n, err := io.ReadFull(br, hdr[:])
+	offset += int64(n)
+	if err != nil {
+		if err == io.EOF {
+			err = nil
+			report(seqTruncated, 0)
+		}
+		return finish(err)
+	}
+	if binary.BigEndian.Uint32(hdr[:]) != seqMagic {
+		offset = 0
+		report(seqCorrupt, 0)
+		return finish(nil)
+	}
+	total := int64(binary.BigEndian.Uint64(hdr[4:]))
+	var next uint32
+	seen := make(map[uint32]bool)
+	body := make([]byte, maxSeqRecord)
+	for offset < total {
+		start := offset
+		var rh [seqRecordHeader]byte
+		n, err := io.ReadFull(br, rh[:])
+		offset += int64(n)
+		if err == io.EOF {
+			report(seqTruncated, 0)
+			break
+		}
+		if err != nil {
+			return finish(err)
+		}
+		seq, length := binary.BigEndian.Uint32(rh[:]), binary.BigEndian.Uint32(rh[4:])
+		if length == 0 || length > maxSeqRecord {
+			offset = start
+			report(seqCorrupt, seq)
+			return finish(nil)
+		}
+		n, err = io.ReadFull(br, body[:length])
+		offset += int64(n)
+		if err != nil {
+			return finish(err)
+		}
+		for i, c := range body[:length] {
+			if c != byte(seq+uint32(i)) {
+				offset = start
+				report(seqCorrupt, seq)
+				return finish(nil)
+			}
+		}
+		offset = start
+		switch {
+		case seen[seq]:
+			report(seqDuplicate, seq)
+		case seq < next:
+			report(seqReordered, seq)
+		case seq > next:
+			// The records from next up to seq are missing unless they
+			// turn up later, out of order; those that don't are
+			// reported once the stream ends.
+			next = seq
+		}
+		offset += seqRecordHeader + int64(length)
+		seen[seq] = true
+		if seq >= next {
+			next = seq + 1
+		}
+	}
+	for seq := uint32(0); seq < next; seq++ {
+		if !seen[seq] {
+			anomalies = append(anomalies, seqAnomaly{kind: seqMissing, seq: seq})
+		}
+	}
+	if offset >= total {
+		extra, err := io.Copy(io.Discard, br)
+		if offset > total || extra != 0 {
+			offset = total
+			report(seqOverrun, 0)
+		}
+		return anomalies, total + extra, err
+	}
+	return anomalies, offset, nil
+}
+
+// seqConn receives and verifies one sequenced stream, returning what was
+// wrong with it.
+func seqConn(ctx context.Context, t Transport, port uint16) ([]seqAnomaly, error) {
+	id := newConnID()
+	c, err := t.Dial(ctx, port)
+	if err != nil {
+		logConn(id, "dial TCP error: %s%s", err, dialErrorHint(err))
+		return nil, err
+	}
+	defer c.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = c.SetReadDeadline(deadline)
+	}
+	anomalies, n, err := verifySeqStream(c)
+	if err != nil {
+		logConn(id, "read TCP error after %d bytes: %s", n, err)
+		return anomalies, err
+	}
+	for _, a := range anomalies {
+		logConn(id, "%s", a)
+	}
+	return anomalies, nil
+}
+
+// runSeqCheck has nConns clients each receive a 4MiB sequenced stream, over
+// native TCP and gonet, and reports any duplicated, reordered, missing,
+// truncated or corrupt data each path delivered.
+func runSeqCheck(ctx context.Context, nConns int, opts stackOptions) error {
+	stream := seqStream(newLockedRand(opts.seed), 4*1024*1024)
+	server, client, err := setupGonetPair(opts)
+	if err != nil {
+		return err
+	}
+	paths := []struct {
+		name   string
+		server Transport
+		client Transport
+		port   uint16
+	}{
+		{"net", &netTransport{addr: net.ParseIP("::1")}, &netTransport{addr: net.ParseIP("::1")}, 9567},
+		{"gonet", server, client, 1234},
+	}
+	for _, path := range paths {
+		go payloadServer(path.server, path.port, stream)
+	}
+	time.Sleep(time.Millisecond)
+	failed := false
+	for _, path := range paths {
+		var mu sync.Mutex
+		var all []seqAnomaly
+		bad, errs := 0, 0
+		wg := &sync.WaitGroup{}
+		wg.Add(nConns)
+		for i := 0; i < nConns; i++ {
+			go func() {
+				defer wg.Done()
+				anomalies, err := seqConn(ctx, path.client, path.port)
+				resultFrom(ctx).addResult(err, len(anomalies) == 0)
+				mu.Lock()
+				defer mu.Unlock()
+				all = append(all, anomalies...)
+				if err != nil {
+					errs++
+				} else if len(anomalies) != 0 {
+					bad++
+				}
+			}()
+		}
+		wg.Wait()
+		anomalies := "none"
+		if len(all) != 0 {
+			anomalies = summarizeAnomalies(all)
+		}
+		fmt.Printf("%s: %d/%d sequenced streams clean, %d failed; anomalies: %s\n",
+			path.name, nConns-bad-errs, nConns, errs, anomalies)
+		if bad != 0 || errs != 0 {
+			failed = true
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	if failed {
+		return fmt.Errorf("not every sequenced stream arrived clean")
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestSeqVerifier(t *testing.T) {
+	if err := checkSeqVerifier(testOptions()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkSeqVerifier damages sequenced streams in each of the ways
+// verifySeqStream should recognise and checks that it reports exactly that.
+func checkSeqVerifier(opts stackOptions) error {
+	rng := rand.New(rand.NewSource(opts.seed))
+	// records builds a stream of the records numbered in seqs.
+	records := func(seqs ...uint32) []byte {
+		b := make([]byte, seqStreamHeader)
+		binary.BigEndian.PutUint32(b, seqMagic)
+		for _, seq := range seqs {
+			b = appendSeqRecord(b, seq, 100+int(seq))
+		}
+		binary.BigEndian.PutUint64(b[4:], uint64(len(b)))
+		return b
+	}
+	whole := records(0, 1, 2, 3, 4)
+	corrupt := append([]byte{}, whole...)
+	corrupt[len(corrupt)-50]++
+	cases := []struct {
+		name   string
+		stream []byte
+		want   string
+	}{
+		{"intact", seqStream(rng, 256*1024), ""},
+		{"duplicated record", records(0, 1, 1, 2, 3, 4), "duplicate 1"},
+		{"swapped records", records(0, 2, 1, 3, 4), "reordered 1"},
+		{"dropped record", records(0, 1, 3, 4), "missing 1"},
+		{"cut at a record", whole[:len(whole)-seqRecordHeader-104], "truncated 1"},
+		{"cut mid-record", whole[:len(whole)-50], "truncated 1"},
+		{"extra data", append(append([]byte{}, whole...), 1, 2, 3), "overrun 1"},
+		{"corrupt byte", corrupt, "corrupt 1"},
+	}
+	for _, c := range cases {
+		anomalies, _, err := verifySeqStream(bytes.NewReader(c.stream))
+		if err != nil {
+			return fmt.Errorf("sequence check of %s: %w", c.name, err)
+		}
+		got := summarizeAnomalies(anomalies)
+		fmt.Printf("sequence check of %s: %q\n", c.name, got)
+		if got != c.want {
+			return fmt.Errorf("sequence check of %s: found %q, expected %q", c.name, got, c.want)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// synGateTimeout is how long a synGate holds one side's SYN waiting for the
+// other's before giving up and letting it through alone.
+const synGateTimeout = time.Second
+
+// synGate is spliced into a socketpair like synTap and passes every packet
+// through, except that once armed it holds the first bare SYN to reach it in
+// either direction until one has reached it in the other as well, then
+// releases both together. Each SYN so crosses the link while its sender is
+// already in SYN-SENT, which is what makes a simultaneous open: with no gate,
+// the first SYN to arrive would find nothing to take it and be reset.
+type synGate struct {
+	mu      sync.Mutex
+	armed   bool
+	held    [2]bool
+	open    chan struct{}
+	synAcks [2]int
+}
+
+// arm readies the gate to hold the next pair of SYNs and clears its counts.
+func (g *synGate) arm() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.armed = true
+	g.held = [2]bool{}
+	g.open = make(chan struct{})
+	g.synAcks = [2]int{}
+}
+
+// relay is the gate's packetRelay, holding a bare SYN back until the gate
+// opens or synGateTimeout passes.
+func (g *synGate) relay(dir int, pkt []byte, _ func(int, []byte) error) bool {
+	if open := g.observe(dir, pkt); open != nil {
+		select {
+		case <-open:
+		case <-time.After(synGateTimeout):
+		}
+	}
+	return true
+}
+
+// observe counts a SYN-ACK going in dir, and returns the channel a bare SYN
+// has to wait on, if the gate is holding it.
+func (g *synGate) observe(dir int, pkt []byte) chan struct{} {
+	if len(pkt) < header.IPv6MinimumSize || header.IPVersion(pkt) != header.IPv6Version {
+		return nil
+	}
+	ip := header.IPv6(pkt)
+	if ip.TransportProtocol() != header.TCPProtocolNumber || len(ip.Payload()) < header.TCPMinimumSize {
+		return nil
+	}
+	flags := header.TCP(ip.Payload()).Flags()
+	if !flags.Contains(header.TCPFlagSyn) {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if flags.Contains(header.TCPFlagAck) {
+		g.synAcks[dir]++
+		return nil
+	}
+	if !g.armed || g.held[dir] {
+		return nil
+	}
+	g.held[dir] = true
+	if g.held[1-dir] {
+		g.armed = false
+		close(g.open)
+		return nil
+	}
+	return g.open
+}
+
+// simultaneous reports whether the gate last released a pair of SYNs rather
+// than timing out on one.
+func (g *synGate) simultaneous() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.held[0] && g.held[1]
+}
+
+// simOpenDial connects from port local on s to port remote on addr, as one
+// side of a simultaneous open.
+func simOpenDial(ctx context.Context, s *stack.Stack, from tcpip.Address, local uint16, addr tcpip.Address, remote uint16) (net.Conn, error) {
+	return gonet.DialTCPWithBind(ctx, s,
+		tcpip.FullAddress{NIC: 1, Addr: from, Port: local},
+		tcpip.FullAddress{NIC: 1, Addr: addr, Port: remote},
+		ipv6.ProtocolNumber)
+}
+
+// simOpenExchange writes msg on one connection and reads it back from the
+// other.
+func simOpenExchange(ctx context.Context, from, to net.Conn, msg string) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = from.SetDeadline(deadline)
+		_ = to.SetDeadline(deadline)
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := from.Write([]byte(msg))
+		errCh <- err
+	}()
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(to, buf); err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+	if err := <-errCh; err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	if string(buf) != msg {
+		return fmt.Errorf("read %q, expected %q", buf, msg)
+	}
+	return nil
+}
+
+// simOpenTrial makes one simultaneous open between ports local1 on stack1
+// and local2 on stack2, and checks that it came to exactly one established
+// connection on each stack and that data crosses it both ways.
+func simOpenTrial(ctx context.Context, gate *synGate, stack1 *stack.Stack, addr1 tcpip.Address, local1 uint16,
+	stack2 *stack.Stack, addr2 tcpip.Address, local2 uint16) error {
+	est1 := stack1.Stats().TCP.CurrentEstablished.Value()
+	est2 := stack2.Stats().TCP.CurrentEstablished.Value()
+	gate.arm()
+	var c1, c2 net.Conn
+	var err1, err2 error
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		c1, err1 = simOpenDial(ctx, stack1, addr1, local1, addr2, local2)
+	}()
+	go func() {
+		defer wg.Done()
+		c2, err2 = simOpenDial(ctx, stack2, addr2, local2, addr1, local1)
+	}()
+	wg.Wait()
+	if err1 == nil {
+		defer c1.Close()
+	}
+	if err2 == nil {
+		defer c2.Close()
+	}
+	if !gate.simultaneous() {
+		return fmt.Errorf("the SYNs did not cross: no SYN came the other way within %s", synGateTimeout)
+	}
+	if err1 != nil {
+		return fmt.Errorf("dial from %d: %w", local1, err1)
+	}
+	if err2 != nil {
+		return fmt.Errorf("dial from %d: %w", local2, err2)
+	}
+	if err := simOpenExchange(ctx, c1, c2, "from the first side"); err != nil {
+		return err
+	}
+	if err := simOpenExchange(ctx, c2, c1, "from the second side"); err != nil {
+		return err
+	}
+	n1 := stack1.Stats().TCP.CurrentEstablished.Value() - est1
+	n2 := stack2.Stats().TCP.CurrentEstablished.Value() - est2
+	if n1 != 1 || n2 != 1 {
+		return fmt.Errorf("expected one established connection on each stack, found %d and %d", n1, n2)
+	}
+	gate.mu.Lock()
+	synAcks := gate.synAcks
+	gate.mu.Unlock()
+	if synAcks[0] == 0 || synAcks[1] == 0 {
+		return fmt.Errorf("expected a SYN-ACK each way, as a simultaneous open has, saw %d and %d", synAcks[0], synAcks[1])
+	}
+	return nil
+}
+
+// runSimultaneousOpen makes nTrials TCP simultaneous opens between two
+// stacks, each side dialling the other's port from its own with neither
+// listening, through a synGate that makes sure the SYNs cross. It reports
+// how many resolved to a single established connection, with a SYN-ACK
+// each way as RFC 9293 describes, that carried data in both directions.
+func runSimultaneousOpen(ctx context.Context, nTrials int, opts stackOptions) error {
+	addr1, addr2 := pairAddresses(opts)
+	gate := &synGate{}
+	fd1, fd2, err := spliceSocketpairs(opts.sockType, gate.relay)
+	if err != nil {
+		return err
+	}
+	stack1, stack2, err := setupStackPairFDs([]int{fd1}, []int{fd2}, addr1, addr2, opts)
+	if err != nil {
+		return err
+	}
+	ok := 0
+	for i := 0; i < nTrials; i++ {
+		id := newConnID()
+		local1, local2 := uint16(2000+2*i), uint16(2001+2*i)
+		err := simOpenTrial(ctx, gate, stack1, addr1, local1, stack2, addr2, local2)
+		resultFrom(ctx).addResult(err, err == nil)
+		if err != nil {
+			logConn(id, "simultaneous open of ports %d and %d: %s", local1, local2, err)
+		} else {
+			ok++
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	fmt.Printf("%d/%d simultaneous opens established one connection and carried data both ways\n", ok, nTrials)
+	if ok != nTrials {
+		return fmt.Errorf("%d simultaneous opens failed", nTrials-ok)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// ResultSink is somewhere run results are reported: each run's result is
+// passed to Record as soon as the run finishes, one run at a time. A sink
+// that pushes results elsewhere, to a database or a metrics system, can do
+// so from Record; it should not hold on to r past the end of the process's
+// runs expecting it to change, as it won't.
+type ResultSink interface {
+	Record(r *RunResult)
+}
+
+// flusher is a ResultSink with something to do once all runs are done.
+type flusher interface {
+	Flush() error
+}
+
+// batchSink collects results and writes them all at once on Flush, for the
+// built-in outputs, whose layout depends on every run. name identifies it in
+// errors.
+type batchSink struct {
+	name    string
+	write   func([]*RunResult) error
+	results []*RunResult
+}
+
+func (s *batchSink) Record(r *RunResult) {
+	s.results = append(s.results, r)
+}
+
+// Flush writes the results recorded, if there were any.
+func (s *batchSink) Flush() error {
+	if len(s.results) == 0 {
+		return nil
+	}
+	if err := s.write(s.results); err != nil {
+		return fmt.Errorf("%s error: %w", s.name, err)
+	}
+	return nil
+}
+
+// newTableSink writes the end-of-run table to w, with the optional columns
+// cols selects, followed by each run's transfer time histogram if
+// histograms is set.
+func newTableSink(w io.Writer, cols tableColumns, histograms bool) *batchSink {
+	return &batchSink{name: "summary", write: func(results []*RunResult) error {
+		if err := writeTable(w, results, cols); err != nil {
+			return err
+		}
+		if histograms {
+			return writeHistograms(w, results)
+		}
+		return nil
+	}}
+}
+
+// newJSONSink writes the end-of-run summary to w as JSON.
+func newJSONSink(w io.Writer) *batchSink {
+	return &batchSink{name: "summary", write: func(results []*RunResult) error {
+		return writeJSON(w, results)
+	}}
+}
+
+// newCSVSink writes the connections the runs recorded to path as CSV; see
+// writeCSVFile.
+func newCSVSink(path string) *batchSink {
+	return &batchSink{name: "CSV", write: func(results []*RunResult) error {
+		return writeCSVFile(path, results)
+	}}
+}
+
+// flushSinks flushes those of sinks that need it, reporting any errors.
+func flushSinks(sinks []ResultSink) {
+	for _, s := range sinks {
+		if f, ok := s.(flusher); ok {
+			if err := f.Flush(); err != nil {
+				fmt.Printf("%s\n", err)
+			}
+		}
+	}
+}
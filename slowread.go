@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// slowReadSize is how much a slow reader asks for per read, and
+// slowReadPayload how much each runSlowRead client reads.
+const (
+	slowReadSize    = 16 * 1024
+	slowReadPayload = 4 * 1024 * 1024
+)
+
+// slowReadTimeout is how long a runSlowRead of delay takes at least: its
+// clients read at the same time, each pausing delay after every read of
+// slowReadSize.
+func slowReadTimeout(delay time.Duration) time.Duration {
+	return slowReadPayload / slowReadSize * delay
+}
+
+// readSlowly reads from c until EOF, sleeping delay after every read, and
+// returns what was read. The connection is left open. As with receiveConn,
+// the transfer is timed from start and recorded in the run's result.
+func readSlowly(ctx context.Context, c net.Conn, start time.Time, delay time.Duration) ([]byte, error) {
+	defer resultFrom(ctx).startTransfer()()
+	stop := bindDeadline(ctx, c)
+	defer stop()
+	var b []byte
+	var ttfb time.Duration
+	chunk := make([]byte, slowReadSize)
+	for {
+		n, err := c.Read(chunk)
+		if n > 0 && len(b) == 0 {
+			ttfb = time.Since(start)
+		}
+		b = append(b, chunk[:n]...)
+		if err == io.EOF {
+			resultFrom(ctx).addTransfer(ttfb, time.Since(start), len(b))
+			return b, nil
+		}
+		if err != nil {
+			return b, fmt.Errorf("read TCP error: %w", err)
+		}
+		time.Sleep(delay)
+	}
+}
+
+// windowStats sums the receive window counters of the TCP endpoints on s:
+// how often each advertised a zero window, and how often it wanted to but
+// couldn't without shrinking the window.
+func windowStats(s *stack.Stack) (zero, wantZero uint64) {
+	for _, ep := range s.RegisteredEndpoints() {
+		sep, ok := ep.(interface{ Stats() tcpip.EndpointStats })
+		if !ok {
+			continue
+		}
+		if st, ok := sep.Stats().(*tcp.Stats); ok {
+			zero += st.ReceiveErrors.ZeroRcvWindowState.Value()
+			wantZero += st.ReceiveErrors.WantZeroRcvWindow.Value()
+		}
+	}
+	return zero, wantZero
+}
+
+// runSlowRead has nConns gonet clients read a large payload slowly, delay
+// between reads, while the server writes it as fast as it can. The clients'
+// receive windows fill up, so the server has to stop and probe until they
+// reopen. It fails if any data was lost, or if no client ever advertised a
+// zero window, since then flow control was never exercised. The link is
+// tapped for window events, so the window updates that reopened the windows
+// are counted too.
+func runSlowRead(ctx context.Context, nConns int, delay time.Duration, opts stackOptions) error {
+	payload := randomPayload(newLockedRand(opts.seed), slowReadPayload)
+	opts.countWindows = true
+	server, client, err := setupGonetPair(opts)
+	if err != nil {
+		return err
+	}
+	go payloadServer(server, 1234, payload)
+	time.Sleep(time.Millisecond)
+	var intact int64
+	read := &sync.WaitGroup{}
+	read.Add(nConns)
+	done := &sync.WaitGroup{}
+	done.Add(nConns)
+	release := make(chan struct{})
+	for i := 0; i < nConns; i++ {
+		go func() {
+			defer done.Done()
+			id := newConnID()
+			start := time.Now()
+			c, err := client.Dial(ctx, 1234)
+			if err != nil {
+				read.Done()
+				logConn(id, "dial TCP error: %s%s", err, dialErrorHint(err))
+				return
+			}
+			b, err := readSlowly(ctx, c, start, delay)
+			resultFrom(ctx).addResult(err, bytes.Equal(b, payload))
+			switch {
+			case err != nil:
+				logConn(id, "%s", err)
+			case !bytes.Equal(b, payload):
+				logConn(id, "incorrect data received: expected %d bytes but got %d", len(payload), len(b))
+			default:
+				atomic.AddInt64(&intact, 1)
+			}
+			read.Done()
+			// The endpoint's counters go with it, so keep it open until
+			// they have been read.
+			<-release
+			_ = c.Close()
+		}()
+	}
+	read.Wait()
+	zero, wantZero := windowStats(client.netStack)
+	close(release)
+	done.Wait()
+	st := server.netStack.Stats().TCP
+	fmt.Printf("%d/%d connections received the payload intact\n", intact, nConns)
+	fmt.Printf("client: zero windows advertised %d, zero windows wanted but not advertised %d\n", zero, wantZero)
+	if r := resultFrom(ctx); r != nil {
+		fmt.Printf("link: window updates %d, zero windows %d\n",
+			atomic.LoadInt64(&r.WindowUpdates), atomic.LoadInt64(&r.ZeroWindows))
+	}
+	fmt.Printf("server: segments sent %d, retransmits %d, timeouts %d\n",
+		st.SegmentsSent.Value(), st.Retransmits.Value(), st.Timeouts.Value())
+	if intact != int64(nConns) {
+		return fmt.Errorf("%d connections lost data", int64(nConns)-intact)
+	}
+	if zero == 0 {
+		return fmt.Errorf("no zero window was advertised; try a longer read delay")
+	}
+	return ctx.Err()
+}
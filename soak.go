@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// soakReportInterval is how often a soak run prints its progress.
+const soakReportInterval = 10 * time.Second
+
+// soakStats counts what a soak run's workers have done so far.
+type soakStats struct {
+	conns        int64
+	failures     int64
+	reconnects   int64
+	gaveUp       int64
+	activeWorker int64
+}
+
+func (s *soakStats) String() string {
+	return fmt.Sprintf("%d workers active, %d connections, %d failures, %d reconnections, %d workers gave up",
+		atomic.LoadInt64(&s.activeWorker), atomic.LoadInt64(&s.conns), atomic.LoadInt64(&s.failures),
+		atomic.LoadInt64(&s.reconnects), atomic.LoadInt64(&s.gaveUp))
+}
+
+// soakConn makes one connection of a soak worker, receiving and checking
+// payload.
+func soakConn(ctx context.Context, t Transport, port uint16, payload []byte) error {
+	id := newConnID()
+	start := time.Now()
+	c, err := t.Dial(ctx, port)
+	if err != nil {
+		err = fmt.Errorf("dial TCP error: %w", err)
+		resultFrom(ctx).addResult(err, false)
+		logConn(id, "%s%s", err, dialErrorHint(err))
+		return err
+	}
+	b, err := receiveConn(ctx, c, start)
+	resultFrom(ctx).addResult(err, bytes.Equal(b, payload))
+	switch {
+	case err != nil:
+		logConn(id, "%s", err)
+		return err
+	case !bytes.Equal(b, payload):
+		err = fmt.Errorf("incorrect data received: expected %s but got %s", abbreviate(payload), abbreviate(b))
+		logConn(id, "%s", err)
+		return err
+	}
+	return nil
+}
+
+// soakWorker makes connections one after another until the soak ends. A
+// failed connection is retried after a short backoff, so that concurrency
+// stays where it was, unless it is the worker's maxReconnects'th failure in
+// a row, when the worker gives up. Any success resets the count.
+func soakWorker(ctx context.Context, t Transport, port uint16, payload []byte, until time.Time, maxReconnects int, st *soakStats) {
+	atomic.AddInt64(&st.activeWorker, 1)
+	defer atomic.AddInt64(&st.activeWorker, -1)
+	failures := 0
+	for time.Now().Before(until) && ctx.Err() == nil {
+		atomic.AddInt64(&st.conns, 1)
+		if err := soakConn(ctx, t, port, payload); err == nil {
+			failures = 0
+			continue
+		}
+		atomic.AddInt64(&st.failures, 1)
+		if ctx.Err() != nil {
+			return
+		}
+		failures++
+		if failures > maxReconnects {
+			atomic.AddInt64(&st.gaveUp, 1)
+			return
+		}
+		atomic.AddInt64(&st.reconnects, 1)
+		select {
+		case <-time.After(time.Duration(failures) * 10 * time.Millisecond):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// runSoak keeps nWorkers gonet connections going for duration, each worker
+// reconnecting after a failure rather than stopping, and reports progress
+// as it goes. It fails if any worker gave up.
+func runSoak(ctx context.Context, nWorkers int, duration time.Duration, maxReconnects int, opts stackOptions) error {
+	payload := randomPayload(newLockedRand(opts.seed), 16*1024)
+	server, client, err := setupGonetPair(opts)
+	if err != nil {
+		return err
+	}
+	go payloadServer(server, 1234, payload)
+	time.Sleep(time.Millisecond)
+	st := &soakStats{}
+	until := time.Now().Add(duration)
+	wg := &sync.WaitGroup{}
+	wg.Add(nWorkers)
+	for i := 0; i < nWorkers; i++ {
+		go func() {
+			defer wg.Done()
+			soakWorker(ctx, client, 1234, payload, until, maxReconnects, st)
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	ticker := time.NewTicker(soakReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			fmt.Printf("soak: %s\n", st)
+		case <-done:
+			fmt.Printf("soak finished: %s\n", st)
+			if n := atomic.LoadInt64(&st.gaveUp); n != 0 {
+				return fmt.Errorf("%d workers gave up after %d reconnections in a row", n, maxReconnects)
+			}
+			return ctx.Err()
+		}
+	}
+}
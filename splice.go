@@ -0,0 +1,66 @@
+package main
+
+import (
+	"syscall"
+)
+
+// packetRelay is what a relay spliced into a link does with each packet it
+// reads, pkt, going in direction dir: 0 from the first end of the splice to
+// the second, 1 back. It passes pkt on by returning true, after rewriting it
+// in place if it likes, or holds it back by returning false. It can also
+// write packets of its own either way with send, before it returns, when
+// they go ahead of pkt, or later from another goroutine. pkt is only valid
+// until it returns. Once a direction's reader stops, as it does when the
+// link is torn down, relay is called a last time with a nil pkt, so that a
+// relay holding packets can let go of them.
+type packetRelay func(dir int, pkt []byte, send func(dir int, pkt []byte) error) bool
+
+// spliceSocketpairs returns two socketpair ends joined through relay, which
+// sees every packet crossing between them; the first end goes to one stack
+// and the second to the other. Both socketpairs are closed if either can't
+// be made.
+func spliceSocketpairs(sockType int, relay packetRelay) (int, int, error) {
+	a, err := socketpair(syscall.AF_UNIX, sockType, 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	b, err := socketpair(syscall.AF_UNIX, sockType, 0)
+	if err != nil {
+		_ = syscall.Close(a[0])
+		_ = syscall.Close(a[1])
+		return 0, 0, err
+	}
+	spliceFDs(a[1], b[1], relay)
+	return a[0], b[0], nil
+}
+
+// spliceFDs relays packets between the fds first and second through relay,
+// in direction 0 from first to second and 1 back, until each side's reads
+// fail.
+func spliceFDs(first, second int, relay packetRelay) {
+	to := [2]int{second, first}
+	send := func(dir int, pkt []byte) error {
+		_, err := syscall.Write(to[dir], pkt)
+		return err
+	}
+	go relayPackets(0, first, relay, send)
+	go relayPackets(1, second, relay, send)
+}
+
+// relayPackets reads packets from the fd from, going in direction dir, and
+// passes each to relay, sending on those it lets through.
+func relayPackets(dir int, from int, relay packetRelay, send func(dir int, pkt []byte) error) {
+	defer relay(dir, nil, send)
+	buf := make([]byte, 65536)
+	for {
+		n, err := syscall.Read(from, buf)
+		if err != nil || n == 0 {
+			return
+		}
+		if relay(dir, buf[:n], send) {
+			if err := send(dir, buf[:n]); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"io"
+	"math/bits"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// sourcePolicy picks the local address a gonet connection is made from.
+type sourcePolicy interface {
+	// source returns the address to dial remote from, or "" to leave the
+	// choice to netstack.
+	source(remote tcpip.Address) tcpip.Address
+}
+
+// fixedSource makes every connection from the same address.
+type fixedSource struct {
+	addr tcpip.Address
+}
+
+func (p *fixedSource) source(tcpip.Address) tcpip.Address {
+	return p.addr
+}
+
+// roundRobinSource makes each connection from the next of its addresses.
+type roundRobinSource struct {
+	addrs []tcpip.Address
+	next  uint32
+}
+
+func (p *roundRobinSource) source(tcpip.Address) tcpip.Address {
+	n := atomic.AddUint32(&p.next, 1) - 1
+	return p.addrs[int(n)%len(p.addrs)]
+}
+
+// destinationSource makes each connection from the address sharing the
+// longest prefix with the destination, which is RFC 6724's last tie-breaking
+// rule and what netstack would be expected to choose among addresses that
+// are otherwise alike. Ties go to the earlier address.
+type destinationSource struct {
+	addrs []tcpip.Address
+}
+
+func (p *destinationSource) source(remote tcpip.Address) tcpip.Address {
+	best, bestLen := tcpip.Address(""), -1
+	for _, a := range p.addrs {
+		if n := commonPrefixLen(a, remote); n > bestLen {
+			best, bestLen = a, n
+		}
+	}
+	return best
+}
+
+// commonPrefixLen returns the number of leading bits a and b share.
+func commonPrefixLen(a, b tcpip.Address) int {
+	n := 0
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if x := a[i] ^ b[i]; x != 0 {
+			return n + bits.LeadingZeros8(x)
+		}
+		n += 8
+	}
+	return n
+}
+
+// recordingSource passes the choice on to policy, if there is one, and
+// remembers the last address chosen.
+type recordingSource struct {
+	policy sourcePolicy
+	last   tcpip.Address
+}
+
+func (p *recordingSource) source(remote tcpip.Address) tcpip.Address {
+	p.last = ""
+	if p.policy != nil {
+		p.last = p.policy.source(remote)
+	}
+	return p.last
+}
+
+// sourcePolicies are the -srcpolicy names. "netstack" leaves the choice to
+// netstack, so its results are reported but not checked.
+var sourcePolicies = []string{"netstack", "fixed", "roundrobin", "destination"}
+
+// newSourcePolicy returns the named policy choosing among addrs.
+func newSourcePolicy(name string, addrs []tcpip.Address) (sourcePolicy, error) {
+	switch name {
+	case "netstack":
+		return nil, nil
+	case "fixed":
+		return &fixedSource{addr: addrs[len(addrs)-1]}, nil
+	case "roundrobin":
+		return &roundRobinSource{addrs: addrs}, nil
+	case "destination":
+		return &destinationSource{addrs: addrs}, nil
+	}
+	return nil, fmt.Errorf("unknown source address policy %q: must be one of %s", name, strings.Join(sourcePolicies, ", "))
+}
+
+// parseSourcePolicies parses a comma-separated list of -srcpolicy names.
+func parseSourcePolicies(s string) ([]string, error) {
+	names := strings.Split(s, ",")
+	for _, name := range names {
+		if _, err := newSourcePolicy(name, []tcpip.Address{""}); err != nil {
+			return nil, err
+		}
+	}
+	return names, nil
+}
+
+// addAddresses adds each of addrs to NIC 1 of s.
+func addAddresses(s *stack.Stack, addrs []tcpip.Address) error {
+	for _, a := range addrs {
+		if tcpErr := s.AddProtocolAddress(1, tcpip.ProtocolAddress{
+			Protocol:          ipv6.ProtocolNumber,
+			AddressWithPrefix: tcpip.AddressWithPrefix{Address: a, PrefixLen: 128},
+		}, stack.AddressProperties{}); tcpErr != nil {
+			return stackErr("add address", wrapTCPIP(tcpErr))
+		}
+	}
+	return nil
+}
+
+// sourceServer writes each connection's remote address, as the server saw
+// it, back to the client and closes the connection.
+func sourceServer(t Transport, port uint16) {
+	li, err := serverListen(t, port)
+	if err != nil {
+		fmt.Printf("Listen error: %s\n", err)
+		return
+	}
+	for {
+		sc, err := li.Accept()
+		if err != nil {
+			logAcceptError(err)
+			return
+		}
+		go func() {
+			_, _ = io.WriteString(sc, sc.RemoteAddr().(*net.TCPAddr).IP.String())
+			err := sc.Close()
+			if err != nil {
+				fmt.Printf("close error: %s\n", err)
+			}
+		}()
+	}
+}
+
+// runSourceSelection gives a gonet client and server three addresses each,
+// in different /32s, and for each named policy dials each server address
+// nConns times in turn, with the policy choosing the client's source
+// address. The server reports back the address each connection came from,
+// which must be the client's local address and, except under "netstack",
+// the one the policy chose. It prints how many connections each source
+// address carried for each destination.
+func runSourceSelection(ctx context.Context, policies []string, nConns int, opts stackOptions) error {
+	serverAddr, clientAddr := pairAddresses(opts)
+	serverAddrs := []tcpip.Address{serverAddr,
+		tcpip.Address(net.ParseIP("fd00:1::1")), tcpip.Address(net.ParseIP("fd00:2::1"))}
+	clientAddrs := []tcpip.Address{clientAddr,
+		tcpip.Address(net.ParseIP("fd00:1::2")), tcpip.Address(net.ParseIP("fd00:2::2"))}
+	server, client, err := setupGonetPair(opts)
+	if err != nil {
+		return err
+	}
+	if err := addAddresses(server.netStack, serverAddrs[1:]); err != nil {
+		return err
+	}
+	if err := addAddresses(client.netStack, clientAddrs[1:]); err != nil {
+		return err
+	}
+	go sourceServer(server, 1234)
+	time.Sleep(time.Millisecond)
+	wrong := 0
+	for _, name := range policies {
+		policy, err := newSourcePolicy(name, clientAddrs)
+		if err != nil {
+			return err
+		}
+		for _, dst := range serverAddrs {
+			rec := &recordingSource{policy: policy}
+			t := &gonetTransport{netStack: client.netStack, remote: dst, source: rec}
+			used := make(map[string]int)
+			for i := 0; i < nConns; i++ {
+				id := newConnID()
+				c, err := t.Dial(ctx, 1234)
+				want := rec.last
+				if err != nil {
+					resultFrom(ctx).addResult(err, false)
+					logConn(id, "dial TCP error: %s%s", err, dialErrorHint(err))
+					continue
+				}
+				local := c.LocalAddr().(*net.TCPAddr).IP
+				b, err := io.ReadAll(c)
+				_ = c.Close()
+				seen := net.ParseIP(string(b))
+				intact := err == nil && seen.Equal(local) && (want == "" || seen.Equal(net.IP(want)))
+				resultFrom(ctx).addResult(err, intact)
+				switch {
+				case err != nil:
+					logConn(id, "%s", err)
+				case !seen.Equal(local):
+					logConn(id, "server saw the connection come from %q, but its local address is %s", b, local)
+				case want != "" && !seen.Equal(net.IP(want)):
+					logConn(id, "policy %s chose %s to reach %s, but the connection came from %s", name, net.IP(want), net.IP(dst), seen)
+				}
+				if !intact {
+					wrong++
+				}
+				used[string(b)]++
+			}
+			var counts []string
+			for a, n := range used {
+				counts = append(counts, fmt.Sprintf("%s %d", a, n))
+			}
+			sort.Strings(counts)
+			fmt.Printf("policy %s, to %s: from %s\n", name, net.IP(dst), strings.Join(counts, ", "))
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+		}
+	}
+	if wrong != 0 {
+		return fmt.Errorf("%d connections did not come from the expected source address", wrong)
+	}
+	return nil
+}
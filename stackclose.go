@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// connOutcomes counts how a run's connections have ended so far.
+type connOutcomes struct {
+	succeeded  int64
+	mismatched int64
+	failures   failureCounts
+}
+
+func outcomesOf(r *RunResult) connOutcomes {
+	o := connOutcomes{
+		succeeded:  atomic.LoadInt64(&r.Succeeded),
+		mismatched: atomic.LoadInt64(&r.Mismatched),
+	}
+	for i := range o.failures {
+		o.failures[i] = atomic.LoadInt64(&r.Failures[i])
+	}
+	return o
+}
+
+// sub returns how many more connections ended each way in o than in before.
+func (o connOutcomes) sub(before connOutcomes) connOutcomes {
+	d := connOutcomes{succeeded: o.succeeded - before.succeeded, mismatched: o.mismatched - before.mismatched}
+	for i := range d.failures {
+		d.failures[i] = o.failures[i] - before.failures[i]
+	}
+	return d
+}
+
+func (o connOutcomes) total() int64 {
+	return o.succeeded + o.mismatched + o.failures.total()
+}
+
+// runStackClose starts nConns runTestConns connections over a gonet pair,
+// each receiving a payload large enough to still be in flight, and once
+// they are all established closes one of the stacks under them: the
+// client's, then, on a fresh pair, the server's. Every connection must then
+// end promptly with an error of its own, a reset or an abort rather than
+// its deadline, and without panicking, and every runTestConns goroutine
+// must have returned, as the WaitGroup shows. How the connections ended is
+// reported for each.
+func runStackClose(ctx context.Context, nConns int, opts stackOptions) error {
+	const settle = 3 * time.Second
+	payload := randomPayload(newLockedRand(opts.seed), 8*1024*1024)
+	r := resultFrom(ctx)
+	var problems []string
+	for _, closed := range []string{"client", "server"} {
+		server, client, err := setupGonetPair(opts)
+		if err != nil {
+			return err
+		}
+		server.backlog = nConns
+		go payloadServer(server, 1234, payload)
+		time.Sleep(time.Millisecond)
+		before := outcomesOf(r)
+		wg := &sync.WaitGroup{}
+		wg.Add(nConns)
+		runPayloadConns(ctx, client, 1234, payload, nConns, wg)
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		established := client.netStack.Stats().TCP.CurrentEstablished
+		for deadline := time.Now().Add(time.Second); established.Value() < uint64(nConns) && time.Now().Before(deadline); {
+			time.Sleep(time.Millisecond)
+		}
+		ended := outcomesOf(r).sub(before).total()
+		fmt.Printf("closing the %s stack with %d connections established, %d ended already\n", closed, established.Value(), ended)
+		s := client.netStack
+		if closed == "server" {
+			s = server.netStack
+		}
+		closing := time.Now()
+		s.Close()
+		s.Wait()
+		select {
+		case <-done:
+			fmt.Printf("%s stack closed: every connection returned in %s\n", closed, time.Since(closing).Round(time.Millisecond))
+		case <-time.After(settle):
+			hung := int64(nConns) - outcomesOf(r).sub(before).total()
+			problems = append(problems, fmt.Sprintf("%s stack closed: %d connections still running after %s", closed, hung, settle))
+			<-done
+		}
+		o := outcomesOf(r).sub(before)
+		fmt.Printf("%s stack closed: %d intact, %d mismatched, failures: %s\n", closed, o.succeeded, o.mismatched, &o.failures)
+		if n := o.failures[failTimeout]; n != 0 {
+			problems = append(problems, fmt.Sprintf("%s stack closed: %d connections only ended at their deadline", closed, n))
+		}
+		if n := o.failures[failPanic]; n != 0 {
+			problems = append(problems, fmt.Sprintf("%s stack closed: %d connections panicked", closed, n))
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("closing a stack under its connections: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"sort"
+	"strings"
+)
+
+// dumpStats prints the stack counters most relevant to the test workload.
+func dumpStats(name string, s *stack.Stack) {
+	st := s.Stats()
+	fmt.Printf("%s: IP received %d, sent %d, malformed %d\n", name,
+		st.IP.PacketsReceived.Value(), st.IP.PacketsSent.Value(), st.IP.MalformedPacketsReceived.Value())
+	fmt.Printf("%s: TCP active opens %d, passive opens %d, established %d, segments sent %d, received %d\n", name,
+		st.TCP.ActiveConnectionOpenings.Value(), st.TCP.PassiveConnectionOpenings.Value(),
+		st.TCP.CurrentEstablished.Value(), st.TCP.SegmentsSent.Value(), st.TCP.ValidSegmentsReceived.Value())
+	fmt.Printf("%s: TCP retransmits %d, timeouts %d, resets sent %d, received %d, checksum errors %d\n", name,
+		st.TCP.Retransmits.Value(), st.TCP.Timeouts.Value(), st.TCP.ResetsSent.Value(),
+		st.TCP.ResetsReceived.Value(), st.TCP.ChecksumErrors.Value())
+}
+
+// checksumErrors returns the malformed IP packet and TCP checksum error
+// counts for s.
+func checksumErrors(s *stack.Stack) (uint64, uint64) {
+	st := s.Stats()
+	return st.IP.MalformedPacketsReceived.Value(), st.TCP.ChecksumErrors.Value()
+}
+
+// dumpConnectStats prints the counters that show where connection setup is
+// being held up: SYN and ACK drops from a full accept queue, port allocation
+// failures, and failed connection attempts.
+func dumpConnectStats(name string, s *stack.Stack) {
+	st := s.Stats().TCP
+	fmt.Printf("%s: SYN drops %d, ACK drops %d, failed port reservations %d, failed connection attempts %d\n", name,
+		st.ListenOverflowSynDrop.Value(), st.ListenOverflowAckDrop.Value(),
+		st.FailedPortReservations.Value(), st.FailedConnectionAttempts.Value())
+}
+
+// tcpStates counts the TCP endpoints registered with s by state.
+func tcpStates(s *stack.Stack) map[tcp.EndpointState]int {
+	states := make(map[tcp.EndpointState]int)
+	for _, ep := range s.RegisteredEndpoints() {
+		if tep, ok := ep.(interface{ EndpointState() tcp.EndpointState }); ok {
+			states[tep.EndpointState()]++
+		}
+	}
+	return states
+}
+
+func formatStates(states map[tcp.EndpointState]int) string {
+	var parts []string
+	for state, n := range states {
+		parts = append(parts, fmt.Sprintf("%s %d", state, n))
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+type tagKey struct{}
+
+// withTag labels the connections runTestConns and runPayloadConns dial with
+// ctx with tag, so that the run's result breaks them out by tag, as the
+// tenants of a shared stack for instance.
+func withTag(ctx context.Context, tag string) context.Context {
+	return context.WithValue(ctx, tagKey{}, tag)
+}
+
+// tagFrom returns the tag attached to ctx, or "" if there is none.
+func tagFrom(ctx context.Context) string {
+	tag, _ := ctx.Value(tagKey{}).(string)
+	return tag
+}
+
+// tagSummary is the reportable form of the connections of a run with one
+// tag, drawn from their connRecords. Durations are in nanoseconds in JSON.
+type tagSummary struct {
+	Tag        string           `json:"tag"`
+	Conns      int64            `json:"conns"`
+	Succeeded  int64            `json:"succeeded"`
+	Failures   map[string]int64 `json:"failures,omitempty"`
+	Mismatched int64            `json:"mismatched"`
+	Bytes      int64            `json:"bytes"`
+	// MBPerSec is the tag's bytes over the whole run's duration, so that
+	// the tags of a run add up to its MBPerSec.
+	MBPerSec float64         `json:"mb_per_sec"`
+	TTFB     []time.Duration `json:"ttfb_p50_p90_p99_ns,omitempty"`
+	Transfer []time.Duration `json:"transfer_p50_p90_p99_ns,omitempty"`
+	PerConn  *fairness       `json:"per_conn_mb_per_sec,omitempty"`
+}
+
+// tagSummaries breaks r's tagged connections out by tag, in tag order. The
+// caller must hold r.mu.
+func (r *RunResult) tagSummaries(duration time.Duration) []tagSummary {
+	type samples struct {
+		sum        tagSummary
+		ttfb       []time.Duration
+		transfer   []time.Duration
+		throughput []float64
+	}
+	byTag := make(map[string]*samples)
+	for _, rec := range r.conns {
+		if rec.tag == "" {
+			continue
+		}
+		s := byTag[rec.tag]
+		if s == nil {
+			s = &samples{sum: tagSummary{Tag: rec.tag}}
+			byTag[rec.tag] = s
+		}
+		s.sum.Conns++
+		s.sum.Bytes += rec.bytes
+		switch rec.status {
+		case "ok":
+			s.sum.Succeeded++
+		case "bad data":
+			s.sum.Mismatched++
+		default:
+			if s.sum.Failures == nil {
+				s.sum.Failures = make(map[string]int64)
+			}
+			s.sum.Failures[rec.status]++
+		}
+		if rec.ttfb > 0 {
+			s.ttfb = append(s.ttfb, rec.ttfb)
+		}
+		if rec.transfer > 0 {
+			s.transfer = append(s.transfer, rec.transfer)
+			s.throughput = append(s.throughput, float64(rec.bytes)/rec.transfer.Seconds())
+		}
+	}
+	sums := make([]tagSummary, 0, len(byTag))
+	for _, s := range byTag {
+		if duration > 0 {
+			s.sum.MBPerSec = float64(s.sum.Bytes) / duration.Seconds() / 1e6
+		}
+		s.sum.TTFB = percentiles(s.ttfb, 50, 90, 99)
+		s.sum.Transfer = percentiles(s.transfer, 50, 90, 99)
+		s.sum.PerConn = newFairness(s.throughput)
+		sums = append(sums, s.sum)
+	}
+	sort.Slice(sums, func(i, j int) bool { return sums[i].Tag < sums[j].Tag })
+	return sums
+}
+
+// writeTagTable writes the tags of those results that have any as a table,
+// one tag of a run per row.
+func writeTagTable(w io.Writer, results []*RunResult) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	header := false
+	for _, r := range results {
+		sum := r.summary()
+		for _, t := range sum.Tags {
+			if !header {
+				fmt.Fprintln(tw, "RUN\tTAG\tCONNS\tOK\tFAILED\tBAD DATA\tMB/S\tTTFB P50\tTTFB P99\tXFER P99\tCONN MB/S MEAN")
+				header = true
+			}
+			mean := "-"
+			if t.PerConn != nil {
+				mean = fmt.Sprintf("%.3g", t.PerConn.Mean)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\t%d\t%.2f\t%s\t%s\t%s\t%s\n", sum.Name, t.Tag, t.Conns, t.Succeeded,
+				formatFailures(t.Failures), t.Mismatched, t.MBPerSec, percentile(t.TTFB, 0), percentile(t.TTFB, 2),
+				percentile(t.Transfer, 2), mean)
+		}
+	}
+	return tw.Flush()
+}
+
+// tenant is a group of connections of a multi-tenant mix, each receiving
+// size bytes, or the test message if size is zero.
+type tenant struct {
+	name  string
+	conns int
+	size  int
+}
+
+// parseTenants parses comma-separated name=conns or name=conns:bytes
+// tenants, as -tenants takes them.
+func parseTenants(s string) ([]tenant, error) {
+	var tenants []tenant
+	seen := make(map[string]bool)
+	for _, field := range strings.Split(s, ",") {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("%q is not name=conns[:bytes]", field)
+		}
+		if seen[kv[0]] {
+			return nil, fmt.Errorf("tenant %s given twice", kv[0])
+		}
+		seen[kv[0]] = true
+		t := tenant{name: kv[0]}
+		spec := strings.SplitN(kv[1], ":", 2)
+		n, err := strconv.Atoi(spec[0])
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("tenant %s: %q is not a positive connection count", kv[0], spec[0])
+		}
+		t.conns = n
+		if len(spec) == 2 {
+			size, err := strconv.Atoi(spec[1])
+			if err != nil || size < 1 {
+				return nil, fmt.Errorf("tenant %s: %q is not a positive payload size", kv[0], spec[1])
+			}
+			t.size = size
+		}
+		tenants = append(tenants, t)
+	}
+	return tenants, nil
+}
+
+// runTenants runs a mix of tenants over one gonet pair at once, each with a
+// test server on a port of its own from 1234 up and its connections dialed
+// by runPayloadConns under its tag, and reports each tenant's share of the
+// traffic and how fairly the stacks served them: Jain's index over the
+// tenants' mean per-connection throughput, which is 1 if every tenant's
+// connections went as fast as every other's.
+func runTenants(ctx context.Context, tenants []tenant, opts stackOptions) error {
+	server, client, err := setupGonetPair(opts)
+	if err != nil {
+		return err
+	}
+	rng := newLockedRand(opts.seed)
+	payloads := make([][]byte, len(tenants))
+	total := 0
+	for i, t := range tenants {
+		payloads[i] = []byte(testMsg)
+		if t.size > 0 {
+			payloads[i] = randomPayload(rng, t.size)
+		}
+		go payloadServer(server, 1234+uint16(i), payloads[i])
+		total += t.conns
+	}
+	time.Sleep(time.Millisecond)
+	start := time.Now()
+	wg := &sync.WaitGroup{}
+	wg.Add(total)
+	for i, t := range tenants {
+		go runPayloadConns(withTag(ctx, t.name), client, 1234+uint16(i), payloads[i], t.conns, wg)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	r := resultFrom(ctx)
+	if r == nil {
+		return ctx.Err()
+	}
+	r.mu.Lock()
+	sums := r.tagSummaries(elapsed)
+	r.mu.Unlock()
+	// The means go back to bytes a second, which newFairness takes.
+	var means []float64
+	for _, t := range sums {
+		mean := 0.0
+		if t.PerConn != nil {
+			mean = t.PerConn.Mean
+		}
+		means = append(means, mean*1e6)
+		fmt.Printf("%s: %d/%d ok, failures: %s, %d mismatched, %.2f MB/s, %.3g MB/s per connection, TTFB p50 %s, transfer p99 %s\n",
+			t.Tag, t.Succeeded, t.Conns, formatFailures(t.Failures), t.Mismatched, t.MBPerSec, mean,
+			percentile(t.TTFB, 0), percentile(t.Transfer, 2))
+	}
+	if f := newFairness(means); f != nil {
+		fmt.Printf("fairness between tenants: Jain %.3f over mean per-connection throughput\n", f.Jain)
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// tcpiOptSynData is TCPI_OPT_SYN_DATA from linux/tcp.h: the SYN this
+// connection sent carried data, and the server acknowledged it.
+const tcpiOptSynData = 0x20
+
+// synDataAcked reports whether c's data rode in its SYN.
+func synDataAcked(c net.Conn) (bool, error) {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return false, fmt.Errorf("%T is not a kernel TCP connection", c)
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return false, err
+	}
+	var info *unix.TCPInfo
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		info, sockErr = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	}); err != nil {
+		return false, err
+	}
+	if sockErr != nil {
+		return false, sockErr
+	}
+	return info.Options&tcpiOptSynData != 0, nil
+}
+
+// fastOpenExchange dials port on t, sends one frame and waits for its echo,
+// returning how long that took and whether the frame went out in the SYN.
+// check says whether the latter can be asked at all.
+func fastOpenExchange(ctx context.Context, t Transport, port uint16, check bool) (time.Duration, bool, error) {
+	start := time.Now()
+	c, err := t.Dial(ctx, port)
+	if err != nil {
+		return 0, false, err
+	}
+	defer c.Close()
+	stop := bindDeadline(ctx, c)
+	defer stop()
+	if err := writeFrame(c, []byte(testMsg)); err != nil {
+		return 0, false, err
+	}
+	if _, err := readFrame(c); err != nil {
+		return 0, false, err
+	}
+	rtt := time.Since(start)
+	if !check {
+		return rtt, false, nil
+	}
+	inSYN, err := synDataAcked(c)
+	return rtt, inSYN, err
+}
+
+// runFastOpen opens nConns connections one after another to the same
+// server, each sending one message and waiting for the reply, over native
+// TCP without and with TCP Fast Open and over gonet. Once the first
+// connection has fetched a cookie, the rest can send their message in the
+// SYN and save a round trip. Netstack has no TCP Fast Open, so gonet always
+// takes a full handshake.
+func runFastOpen(ctx context.Context, nConns int, opts stackOptions) error {
+	server, client, err := setupGonetPair(opts)
+	if err != nil {
+		return err
+	}
+	paths := []struct {
+		name     string
+		server   Transport
+		client   Transport
+		port     uint16
+		fastOpen bool
+	}{
+		{"net", &netTransport{addr: net.ParseIP("::1")}, &netTransport{addr: net.ParseIP("::1")}, 8901, false},
+		{"net", &netTransport{addr: net.ParseIP("::1"), fastOpen: true}, &netTransport{addr: net.ParseIP("::1"), fastOpen: true}, 8902, true},
+		{"gonet", server, client, 1234, false},
+	}
+	for _, path := range paths {
+		go frameEchoServer(path.server, path.port)
+		time.Sleep(time.Millisecond)
+		rtts := make([]time.Duration, 0, nConns)
+		inSYN := 0
+		for i := 0; i < nConns; i++ {
+			id := newConnID()
+			rtt, used, err := fastOpenExchange(ctx, path.client, path.port, path.fastOpen)
+			if err != nil {
+				logConn(id, "%s", err)
+				continue
+			}
+			rtts = append(rtts, rtt)
+			if used {
+				inSYN++
+			}
+			if path.fastOpen {
+				logConn(id, "data in SYN %v", used)
+			}
+		}
+		fmt.Printf("%s, fast open %v: exchange %s, %d/%d connections sent their data in the SYN\n",
+			path.name, path.fastOpen, formatPercentiles(rtts), inSYN, nConns)
+		if path.fastOpen && inSYN == 0 && nConns > 1 {
+			fmt.Printf("%s: TCP Fast Open was never used%s\n", path.name, fastOpenHint())
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	fmt.Printf("gonet: netstack has no TCP Fast Open, so every connection takes a full handshake\n")
+	return nil
+}
+
+// fastOpenHint explains a fast open that never happened if the kernel is
+// configured not to serve it.
+func fastOpenHint() string {
+	b, err := os.ReadFile("/proc/sys/net/ipv4/tcp_fastopen")
+	if err != nil {
+		return ""
+	}
+	mode := strings.TrimSpace(string(b))
+	return fmt.Sprintf(" (net.ipv4.tcp_fastopen is %s; the server side needs bit 2 set, e.g. 3)", mode)
+}
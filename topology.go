@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"io"
+	"sort"
+)
+
+// topology is the NIC and route configuration of a stack, in a stable form
+// for printing and comparing: NICs in ID order, their addresses sorted, and
+// routes in table order, which is the order netstack matches them in.
+type topology struct {
+	NICs   []nicTopology   `json:"nics"`
+	Routes []routeTopology `json:"routes"`
+}
+
+type nicTopology struct {
+	ID          tcpip.NICID         `json:"id"`
+	Name        string              `json:"name"`
+	LinkAddress string              `json:"link_address,omitempty"`
+	MTU         uint32              `json:"mtu"`
+	Flags       stack.NICStateFlags `json:"flags"`
+	Addresses   []string            `json:"addresses"`
+	Forwarding  []string            `json:"forwarding,omitempty"`
+}
+
+type routeTopology struct {
+	Destination string      `json:"destination"`
+	Gateway     string      `json:"gateway,omitempty"`
+	NIC         tcpip.NICID `json:"nic"`
+}
+
+// protocolNames names the network protocols in a topology.
+var protocolNames = map[tcpip.NetworkProtocolNumber]string{
+	ipv4.ProtocolNumber: "ipv4",
+	ipv6.ProtocolNumber: "ipv6",
+}
+
+func protocolName(p tcpip.NetworkProtocolNumber) string {
+	if name, ok := protocolNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("protocol %#x", uint32(p))
+}
+
+// stackTopology returns the NICs, addresses and routes of s.
+func stackTopology(s *stack.Stack) topology {
+	var topo topology
+	for id, info := range s.NICInfo() {
+		nic := nicTopology{
+			ID:        id,
+			Name:      info.Name,
+			MTU:       info.MTU,
+			Flags:     info.Flags,
+			Addresses: []string{},
+		}
+		if info.LinkAddress != "" {
+			nic.LinkAddress = info.LinkAddress.String()
+		}
+		for _, pa := range info.ProtocolAddresses {
+			nic.Addresses = append(nic.Addresses, fmt.Sprintf("%s %s", protocolName(pa.Protocol), pa.AddressWithPrefix))
+		}
+		sort.Strings(nic.Addresses)
+		for proto, on := range info.Forwarding {
+			if on {
+				nic.Forwarding = append(nic.Forwarding, protocolName(proto))
+			}
+		}
+		sort.Strings(nic.Forwarding)
+		topo.NICs = append(topo.NICs, nic)
+	}
+	sort.Slice(topo.NICs, func(i, j int) bool { return topo.NICs[i].ID < topo.NICs[j].ID })
+	topo.Routes = []routeTopology{}
+	for _, r := range s.GetRouteTable() {
+		route := routeTopology{Destination: r.Destination.String(), NIC: r.NIC}
+		if r.Gateway != "" {
+			route.Gateway = r.Gateway.String()
+		}
+		topo.Routes = append(topo.Routes, route)
+	}
+	return topo
+}
+
+// Topology returns the NIC and route configuration of the transport's
+// stack, for attaching to bug reports or diffing between runs.
+func (t *gonetTransport) Topology() topology {
+	return stackTopology(t.netStack)
+}
+
+// writeTopologies writes the topologies of the named stacks as a JSON
+// object.
+func writeTopologies(w io.Writer, stacks map[string]*gonetTransport) error {
+	topos := make(map[string]topology, len(stacks))
+	for name, t := range stacks {
+		topos[name] = t.Topology()
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(topos)
+}
@@ -0,0 +1,542 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/waiter"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// Transport is a way of making stream connections. Listen serves a port on
+// the transport's own end and Dial connects to that port on its peer, so a
+// server and its clients may use the same Transport or the two halves of a
+// pair.
+type Transport interface {
+	Listen(port uint16) (net.Listener, error)
+	Dial(ctx context.Context, port uint16) (net.Conn, error)
+}
+
+// gonetTransport listens on netStack and dials remote through it.
+type gonetTransport struct {
+	netStack *stack.Stack
+	remote   tcpip.Address
+	// reusePort sets SO_REUSEPORT on listeners. gonet.ListenTCP binds as soon
+	// as it creates the endpoint, leaving no chance to set the option, so a
+	// second gonet.ListenTCP on the same port fails with "port is in use".
+	// Building the endpoint by hand lets us set it before Bind, after which
+	// netstack hashes connections across the listeners much like the kernel.
+	reusePort bool
+	// abortiveClose sets a zero linger time on accepted connections, so that
+	// closing them sends RST rather than FIN. netstack does not carry the
+	// option over from the listener, so it has to be set on each accepted
+	// endpoint, which gonet's listener gives no access to.
+	abortiveClose bool
+	// source, if set, chooses the local address of dialed connections,
+	// which are then bound to it before connecting rather than left to
+	// netstack's source address selection.
+	source sourcePolicy
+	// receiveBuffer, if non-zero, is the receive buffer size of dialed
+	// endpoints, which bounds the window they advertise and turns off
+	// netstack's receive buffer auto-tuning for them. It has to be set
+	// before connecting, for the window scale to suit it, which gonet's
+	// dialers leave no chance to do, so the endpoint is built by hand.
+	receiveBuffer int
+	// backlog, if non-zero, is the listen backlog of listeners, which bounds
+	// the connections netstack completes the handshake for before they are
+	// accepted. Zero means 10, as gonet.ListenTCP uses.
+	backlog int
+	// nic, if non-zero, is the NIC dialed connections leave by, as the zone
+	// of a link-local remote chooses it. Zero means NIC 1.
+	nic tcpip.NICID
+	// detectLoops has dials watch the stack for a routing loop and fail
+	// with errRoutingLoop if they are caught in one; see
+	// dialDetectingLoops. It costs a goroutine polling the stack's
+	// counters per dial, so gonetPair sets it only for stacks that mayLoop,
+	// and paths through a forwarding stack set it themselves.
+	detectLoops bool
+}
+
+// gonetPair returns transports for two stacks that dial each other,
+// detecting routing loops on those that mayLoop.
+func gonetPair(stack1 *stack.Stack, addr1 tcpip.Address, stack2 *stack.Stack, addr2 tcpip.Address) (*gonetTransport, *gonetTransport) {
+	return &gonetTransport{netStack: stack1, remote: addr2, detectLoops: mayLoop(stack1)},
+		&gonetTransport{netStack: stack2, remote: addr1, detectLoops: mayLoop(stack2)}
+}
+
+// Listen sets SO_REUSEADDR, as netTransport does and for the same reason:
+// netstack, like the kernel, refuses to bind a port that TIME-WAIT endpoints
+// still hold unless the listener has it, as checkRebind shows, and
+// gonet.ListenTCP gives no chance to set it.
+func (t *gonetTransport) Listen(port uint16) (net.Listener, error) {
+	wq := &waiter.Queue{}
+	ep, tcpErr := t.netStack.NewEndpoint(tcp.ProtocolNumber, ipv6.ProtocolNumber, wq)
+	if tcpErr != nil {
+		return nil, fmt.Errorf("endpoint: %w", wrapTCPIP(tcpErr))
+	}
+	ep.SocketOptions().SetReuseAddress(true)
+	ep.SocketOptions().SetReusePort(t.reusePort)
+	if tcpErr := ep.Bind(tcpip.FullAddress{NIC: 1, Port: port}); tcpErr != nil {
+		ep.Close()
+		return nil, fmt.Errorf("bind: %w", wrapTCPIP(tcpErr))
+	}
+	backlog := t.backlog
+	if backlog == 0 {
+		backlog = 10
+	}
+	if tcpErr := ep.Listen(backlog); tcpErr != nil {
+		ep.Close()
+		return nil, fmt.Errorf("listen: %w", wrapTCPIP(tcpErr))
+	}
+	if t.abortiveClose {
+		return &abortiveListener{ep: ep, wq: wq, done: make(chan struct{})}, nil
+	}
+	return gonet.NewTCPListener(t.netStack, wq, ep), nil
+}
+
+// abortiveListener is gonet's TCPListener, except that it sets a zero linger
+// time on each endpoint it accepts.
+type abortiveListener struct {
+	ep   tcpip.Endpoint
+	wq   *waiter.Queue
+	done chan struct{}
+	once sync.Once
+}
+
+func (l *abortiveListener) Accept() (net.Conn, error) {
+	waitEntry, notifyCh := waiter.NewChannelEntry(waiter.ReadableEvents)
+	l.wq.EventRegister(&waitEntry)
+	defer l.wq.EventUnregister(&waitEntry)
+	for {
+		ep, wq, tcpErr := l.ep.Accept(nil)
+		if _, ok := tcpErr.(*tcpip.ErrWouldBlock); ok {
+			select {
+			case <-notifyCh:
+				continue
+			case <-l.done:
+				return nil, net.ErrClosed
+			}
+		}
+		if tcpErr != nil {
+			return nil, fmt.Errorf("accept: %w", wrapTCPIP(tcpErr))
+		}
+		ep.SocketOptions().SetLinger(tcpip.LingerOption{Enabled: true, Timeout: 0})
+		return gonet.NewTCPConn(wq, ep), nil
+	}
+}
+
+func (l *abortiveListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.ep.Close()
+	})
+	return nil
+}
+
+func (l *abortiveListener) Addr() net.Addr {
+	a, _ := l.ep.GetLocalAddress()
+	return &net.TCPAddr{IP: net.IP(a.Addr), Port: int(a.Port)}
+}
+
+func (t *gonetTransport) Dial(ctx context.Context, port uint16) (net.Conn, error) {
+	nic := t.nic
+	if nic == 0 {
+		nic = 1
+	}
+	remote := tcpip.FullAddress{
+		NIC:  nic,
+		Addr: t.remote,
+		Port: port,
+	}
+	var local tcpip.FullAddress
+	if t.source != nil {
+		if addr := t.source.source(t.remote); addr != "" {
+			local = tcpip.FullAddress{NIC: nic, Addr: addr}
+		}
+	}
+	dial := func(ctx context.Context) (net.Conn, error) {
+		if t.receiveBuffer != 0 {
+			return t.dialEndpoint(ctx, local, remote)
+		}
+		if local != (tcpip.FullAddress{}) {
+			return gonet.DialTCPWithBind(ctx, t.netStack, local, remote, ipv6.ProtocolNumber)
+		}
+		return gonet.DialContextTCP(ctx, t.netStack, remote, ipv6.ProtocolNumber)
+	}
+	if t.detectLoops {
+		return dialDetectingLoops(ctx, t.netStack, dial)
+	}
+	return dial(ctx)
+}
+
+// dialEndpoint is gonet.DialTCPWithBind, setting the endpoint's receive
+// buffer size before it connects.
+func (t *gonetTransport) dialEndpoint(ctx context.Context, local, remote tcpip.FullAddress) (net.Conn, error) {
+	wq := &waiter.Queue{}
+	ep, tcpErr := t.netStack.NewEndpoint(tcp.ProtocolNumber, ipv6.ProtocolNumber, wq)
+	if tcpErr != nil {
+		return nil, fmt.Errorf("endpoint: %w", wrapTCPIP(tcpErr))
+	}
+	ep.SocketOptions().SetReceiveBufferSize(int64(t.receiveBuffer), true)
+	waitEntry, notifyCh := waiter.NewChannelEntry(waiter.WritableEvents)
+	wq.EventRegister(&waitEntry)
+	defer wq.EventUnregister(&waitEntry)
+	if local != (tcpip.FullAddress{}) {
+		if tcpErr := ep.Bind(local); tcpErr != nil {
+			ep.Close()
+			return nil, fmt.Errorf("bind: %w", wrapTCPIP(tcpErr))
+		}
+	}
+	tcpErr = ep.Connect(remote)
+	if _, ok := tcpErr.(*tcpip.ErrConnectStarted); ok {
+		select {
+		case <-ctx.Done():
+			ep.Close()
+			return nil, ctx.Err()
+		case <-notifyCh:
+		}
+		tcpErr = ep.LastError()
+	}
+	if tcpErr != nil {
+		ep.Close()
+		return nil, &net.OpError{
+			Op:   "connect",
+			Net:  "tcp",
+			Addr: &net.TCPAddr{IP: net.IP(remote.Addr), Port: int(remote.Port)},
+			Err:  wrapTCPIP(tcpErr),
+		}
+	}
+	return gonet.NewTCPConn(wq, ep), nil
+}
+
+// netTransport is native kernel TCP, listening on and dialing addr.
+type netTransport struct {
+	addr net.IP
+	// reusePort sets SO_REUSEPORT before bind, so several listeners can share
+	// a port and the kernel spreads incoming connections across them.
+	reusePort bool
+	// abortiveClose sets a zero linger time on accepted connections, so that
+	// closing them sends RST rather than FIN.
+	abortiveClose bool
+	// nagle turns TCP_NODELAY off, which Go otherwise sets on every TCP
+	// connection, on both dialed and accepted connections.
+	nagle bool
+	// fastOpen enables TCP Fast Open on listeners and dialed connections.
+	// Where the kernel doesn't allow it, connections fall back to a full
+	// handshake.
+	fastOpen bool
+}
+
+func (t *netTransport) tcpAddr(port uint16) *net.TCPAddr {
+	return &net.TCPAddr{
+		IP:   t.addr,
+		Port: int(port),
+	}
+}
+
+func (t *netTransport) Listen(port uint16) (net.Listener, error) {
+	li, err := t.listen(port)
+	if err != nil || (!t.abortiveClose && !t.nagle) {
+		return li, err
+	}
+	return &optionListener{Listener: li, t: t}, nil
+}
+
+// setOptions applies the transport's socket options to c.
+func (t *netTransport) setOptions(c *net.TCPConn, accepted bool) error {
+	if accepted && t.abortiveClose {
+		if err := c.SetLinger(0); err != nil {
+			return err
+		}
+	}
+	if t.nagle {
+		if err := c.SetNoDelay(false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listen binds with SO_REUSEADDR, so that a server can listen again on a
+// port whose earlier connections are still in TIME-WAIT, as back-to-back
+// runs on a fixed port otherwise may not. Go's net package happens to set it
+// on every listener already; setting it here keeps that from being
+// something the harness quietly depends on.
+func (t *netTransport) listen(port uint16) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+				if t.reusePort && sockErr == nil {
+					sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+				}
+				if t.fastOpen && sockErr == nil {
+					fastOpenOption(int(fd), unix.TCP_FASTOPEN, 16)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	return lc.Listen(context.Background(), "tcp6", t.tcpAddr(port).String())
+}
+
+// fastOpenOption sets the TCP Fast Open option opt on fd, only reporting a
+// failure, since the connection works without it.
+func fastOpenOption(fd int, opt int, value int) {
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, opt, value); err != nil {
+		fmt.Printf("TCP Fast Open unavailable, falling back to a full handshake: %s\n", err)
+	}
+}
+
+func (t *netTransport) Dial(ctx context.Context, port uint16) (net.Conn, error) {
+	d := &net.Dialer{}
+	if t.fastOpen {
+		// With TCP_FASTOPEN_CONNECT, connect returns at once and the SYN
+		// goes out with the first write, carrying its data if the kernel
+		// has a cookie for the server.
+		d.Control = func(network, address string, c syscall.RawConn) error {
+			return c.Control(func(fd uintptr) {
+				fastOpenOption(int(fd), unix.TCP_FASTOPEN_CONNECT, 1)
+			})
+		}
+	}
+	c, err := d.DialContext(ctx, "tcp6", t.tcpAddr(port).String())
+	if err != nil {
+		return nil, err
+	}
+	if err := t.setOptions(c.(*net.TCPConn), false); err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// optionListener applies its transport's socket options to the connections
+// it accepts.
+type optionListener struct {
+	net.Listener
+	t *netTransport
+}
+
+func (l *optionListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if err := l.t.setOptions(c.(*net.TCPConn), true); err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// unixTransport maps ports onto UNIX domain sockets in dir: kernel sockets,
+// but no TCP/IP.
+type unixTransport struct {
+	dir string
+}
+
+func (t *unixTransport) path(port uint16) string {
+	return filepath.Join(t.dir, fmt.Sprintf("gvisortest-%d-%d.sock", os.Getpid(), port))
+}
+
+// Listen replaces any stale socket file left at the port's path.
+func (t *unixTransport) Listen(port uint16) (net.Listener, error) {
+	_ = os.Remove(t.path(port))
+	return net.Listen("unix", t.path(port))
+}
+
+func (t *unixTransport) Dial(ctx context.Context, port uint16) (net.Conn, error) {
+	d := &net.Dialer{}
+	return d.DialContext(ctx, "unix", t.path(port))
+}
+
+// pipeTransport connects over in-memory net.Pipes, so no socket or network
+// stack is involved at all.
+type pipeTransport struct {
+	mu        sync.Mutex
+	listeners map[uint16]*pipeListener
+}
+
+func newPipeTransport() *pipeTransport {
+	return &pipeTransport{listeners: make(map[uint16]*pipeListener)}
+}
+
+func (t *pipeTransport) Listen(port uint16) (net.Listener, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.listeners[port]; ok {
+		return nil, &net.OpError{Op: "listen", Net: "pipe", Addr: pipeAddr(port), Err: syscall.EADDRINUSE}
+	}
+	l := &pipeListener{
+		t:     t,
+		port:  port,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	t.listeners[port] = l
+	return l, nil
+}
+
+func (t *pipeTransport) Dial(ctx context.Context, port uint16) (net.Conn, error) {
+	t.mu.Lock()
+	l, ok := t.listeners[port]
+	t.mu.Unlock()
+	refused := &net.OpError{Op: "dial", Net: "pipe", Addr: pipeAddr(port), Err: syscall.ECONNREFUSED}
+	if !ok {
+		return nil, refused
+	}
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		_ = client.Close()
+		_ = server.Close()
+		return nil, refused
+	case <-ctx.Done():
+		_ = client.Close()
+		_ = server.Close()
+		return nil, ctx.Err()
+	}
+}
+
+type pipeListener struct {
+	t     *pipeTransport
+	port  uint16
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.t.mu.Lock()
+		delete(l.t.listeners, l.port)
+		l.t.mu.Unlock()
+	})
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr(l.port)
+}
+
+type pipeAddr uint16
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return fmt.Sprintf("pipe:%d", uint16(a)) }
+
+// countingTransport wraps a Transport so that every connection accepted by
+// its listeners increments accepted.
+type countingTransport struct {
+	Transport
+	accepted *int64
+}
+
+func (t *countingTransport) Listen(port uint16) (net.Listener, error) {
+	li, err := t.Transport.Listen(port)
+	if err != nil {
+		return nil, err
+	}
+	return &countingListener{Listener: li, accepted: t.accepted}, nil
+}
+
+type countingListener struct {
+	net.Listener
+	accepted *int64
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt64(l.accepted, 1)
+	}
+	return c, err
+}
+
+// limitingTransport wraps a Transport so that each of its listeners hands
+// out at most limit connections at a time, a slot being freed when the
+// connection is closed. A connection accepted with every slot taken either
+// waits for one or, if reject is set, is closed at once. The counters are
+// shared by all of the transport's listeners.
+type limitingTransport struct {
+	Transport
+	limit    int
+	reject   bool
+	waited   int64
+	rejected int64
+}
+
+func (t *limitingTransport) Listen(port uint16) (net.Listener, error) {
+	li, err := t.Transport.Listen(port)
+	if err != nil {
+		return nil, err
+	}
+	return &limitingListener{Listener: li, t: t, slots: make(chan struct{}, t.limit)}, nil
+}
+
+type limitingListener struct {
+	net.Listener
+	t     *limitingTransport
+	slots chan struct{}
+}
+
+func (l *limitingListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		select {
+		case l.slots <- struct{}{}:
+			return &limitedConn{Conn: c, slots: l.slots}, nil
+		default:
+		}
+		if l.t.reject {
+			atomic.AddInt64(&l.t.rejected, 1)
+			_ = c.Close()
+			continue
+		}
+		atomic.AddInt64(&l.t.waited, 1)
+		l.slots <- struct{}{}
+		return &limitedConn{Conn: c, slots: l.slots}, nil
+	}
+}
+
+// limitedConn gives its slot back the first time it is closed.
+type limitedConn struct {
+	net.Conn
+	slots chan struct{}
+	once  sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { <-c.slots })
+	return err
+}
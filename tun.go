@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/fdbased"
+	"gvisor.dev/gvisor/pkg/tcpip/link/tun"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// setupTUNStack creates a stack on the TUN device name with address addr,
+// IPv4 or IPv6, and default routes for both families out of the device,
+// through opts.gateway for its family if set.
+// Getting packets any further than the host end of the device is up to the
+// host: typically an address on the device, forwarding and masquerading, e.g.
+//
+//	ip tuntap add dev gvt0 mode tun
+//	ip addr add 10.99.0.1/24 dev gvt0
+//	ip link set gvt0 up
+//	sysctl -w net.ipv4.ip_forward=1
+//	iptables -t nat -A POSTROUTING -s 10.99.0.0/24 -j MASQUERADE
+func setupTUNStack(name string, addr tcpip.Address, opts stackOptions) (*stack.Stack, error) {
+	fd, err := tun.Open(name)
+	if err != nil {
+		return nil, nicErr("open TUN device "+name, err)
+	}
+	mtu := opts.mtu
+	if mtu == 0 {
+		mtu = 1500
+	}
+	netStack, err := newStack(opts)
+	if err != nil {
+		return nil, err
+	}
+	endpoint, err := fdbased.New(&fdbased.Options{
+		FDs:               []int{fd},
+		MTU:               mtu,
+		TXChecksumOffload: opts.checksumOffload,
+		RXChecksumOffload: opts.checksumOffload,
+	})
+	if err != nil {
+		return nil, nicErr("create link endpoint", err)
+	}
+	if tcpErr := netStack.CreateNICWithOptions(1, endpoint, stack.NICOptions{Name: name}); tcpErr != nil {
+		return nil, nicErr("create NIC", wrapTCPIP(tcpErr))
+	}
+	proto := ipv6.ProtocolNumber
+	if len(addr) == header.IPv4AddressSize {
+		proto = ipv4.ProtocolNumber
+	}
+	if tcpErr := netStack.AddProtocolAddress(1,
+		tcpip.ProtocolAddress{
+			Protocol:          proto,
+			AddressWithPrefix: addr.WithPrefix(),
+		},
+		stack.AddressProperties{},
+	); tcpErr != nil {
+		return nil, stackErr("add address", wrapTCPIP(tcpErr))
+	}
+	// The device is point to point, so a gateway is optional and any gateway
+	// is on-link.
+	routes := []tcpip.Route{
+		{Destination: header.IPv4EmptySubnet, NIC: 1},
+		{Destination: header.IPv6EmptySubnet, NIC: 1},
+	}
+	if opts.gateway != "" {
+		gw := defaultRoute(opts.gateway)
+		for i := range routes {
+			if routes[i].Destination == gw.Destination {
+				routes[i] = gw
+			}
+		}
+	}
+	netStack.SetRouteTable(routes)
+	return netStack, nil
+}
+
+// parseStackAddress parses s as an IPv4 or IPv6 address in the form netstack
+// expects, four bytes for IPv4 and sixteen for IPv6.
+func parseStackAddress(s string) (tcpip.Address, error) {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return "", fmt.Errorf("invalid address: %s", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return tcpip.Address(ip4), nil
+	}
+	return tcpip.Address(ip), nil
+}
+
+// gonetHTTPClient returns an HTTP client that makes its connections through
+// netStack. There is no resolver on the stack, so URLs must use IP literals.
+func gonetHTTPClient(netStack *stack.Stack) *http.Client {
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, portStr, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		addr, err := parseStackAddress(host)
+		if err != nil {
+			return nil, fmt.Errorf("%w (no DNS resolution through the stack; use an IP literal)", err)
+		}
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil {
+			return nil, err
+		}
+		proto := ipv6.ProtocolNumber
+		if len(addr) == header.IPv4AddressSize {
+			proto = ipv4.ProtocolNumber
+		}
+		return gonet.DialContextTCP(ctx, netStack, tcpip.FullAddress{NIC: 1, Addr: addr, Port: uint16(port)}, proto)
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: dial,
+			Proxy:       nil,
+		},
+	}
+}
+
+// runFetch fetches url through a stack on the TUN device name, showing that
+// gonet can reach whatever the host routes the device to.
+func runFetch(ctx context.Context, name string, addr tcpip.Address, url string, opts stackOptions) error {
+	netStack, err := setupTUNStack(name, addr, opts)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := gonetHTTPClient(netStack).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	n, err := io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		return fmt.Errorf("read body: %w", err)
+	}
+	fmt.Printf("GET %s: %s, %d bytes\n", url, resp.Status, n)
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"strconv"
+	"strings"
+)
+
+// stackTuning is the part of a stack's configuration that may differ between
+// the two stacks of a pair, so that differently tuned netstacks can be run
+// against each other. Zero fields mean netstack's defaults, or, for the
+// second stack's tuning, the first stack's setting.
+type stackTuning struct {
+	// mtu is the link MTU of the stack's NIC.
+	mtu uint32
+	// congestionControl is the TCP congestion control algorithm, reno or
+	// cubic.
+	congestionControl string
+	// receiveBuffer and sendBuffer are the default TCP buffer sizes new
+	// endpoints start with, raising the maximum where they exceed it.
+	receiveBuffer int
+	sendBuffer    int
+}
+
+// congestionControls are the congestion control algorithms netstack offers.
+var congestionControls = []string{"reno", "cubic"}
+
+// tuning returns the tuning opts gives a stack.
+func (opts stackOptions) tuning() stackTuning {
+	return stackTuning{
+		mtu:               opts.mtu,
+		congestionControl: opts.congestionControl,
+		receiveBuffer:     opts.receiveBuffer,
+		sendBuffer:        opts.sendBuffer,
+	}
+}
+
+// second returns opts for the second stack of a pair: opts with the non-zero
+// fields of opts.peer in place of its own.
+func (opts stackOptions) second() stackOptions {
+	p := opts.peer
+	if p == nil {
+		return opts
+	}
+	opts.peer = nil
+	if p.mtu != 0 {
+		opts.mtu = p.mtu
+	}
+	if p.congestionControl != "" {
+		opts.congestionControl = p.congestionControl
+	}
+	if p.receiveBuffer != 0 {
+		opts.receiveBuffer = p.receiveBuffer
+	}
+	if p.sendBuffer != 0 {
+		opts.sendBuffer = p.sendBuffer
+	}
+	return opts
+}
+
+func (t stackTuning) String() string {
+	setting := func(v string) string {
+		if v == "" || v == "0" {
+			return "default"
+		}
+		return v
+	}
+	return fmt.Sprintf("mtu %s, cc %s, rcvbuf %s, sndbuf %s", setting(strconv.Itoa(int(t.mtu))),
+		setting(t.congestionControl), setting(strconv.Itoa(t.receiveBuffer)), setting(strconv.Itoa(t.sendBuffer)))
+}
+
+// parseStackTuning parses a comma-separated list of key=value settings, the
+// keys being mtu, cc, rcvbuf and sndbuf, e.g. "mtu=9000,cc=cubic".
+func parseStackTuning(s string) (*stackTuning, error) {
+	t := &stackTuning{}
+	for _, setting := range strings.Split(s, ",") {
+		kv := strings.SplitN(setting, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("%q is not key=value", setting)
+		}
+		key, value := kv[0], kv[1]
+		switch key {
+		case "mtu":
+			n, err := strconv.ParseUint(value, 10, 32)
+			if err != nil || n == 0 {
+				return nil, fmt.Errorf("invalid mtu %q", value)
+			}
+			t.mtu = uint32(n)
+		case "cc":
+			if err := checkCongestionControl(value); err != nil {
+				return nil, err
+			}
+			t.congestionControl = value
+		case "rcvbuf", "sndbuf":
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid %s %q", key, value)
+			}
+			if key == "rcvbuf" {
+				t.receiveBuffer = n
+			} else {
+				t.sendBuffer = n
+			}
+		default:
+			return nil, fmt.Errorf("unknown setting %q", key)
+		}
+	}
+	return t, nil
+}
+
+func checkCongestionControl(name string) error {
+	for _, cc := range congestionControls {
+		if name == cc {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown congestion control %q, expected one of %s", name, strings.Join(congestionControls, ", "))
+}
+
+// applyTuning sets the congestion control and buffer sizes of opts on
+// netStack. The MTU belongs to the link and is set with the NIC.
+func applyTuning(netStack *stack.Stack, opts stackOptions) error {
+	if opts.congestionControl != "" {
+		opt := tcpip.CongestionControlOption(opts.congestionControl)
+		if tcpErr := netStack.SetTransportProtocolOption(tcp.ProtocolNumber, &opt); tcpErr != nil {
+			return stackErr("set congestion control", wrapTCPIP(tcpErr))
+		}
+	}
+	if opts.receiveBuffer != 0 {
+		var opt tcpip.TCPReceiveBufferSizeRangeOption
+		if tcpErr := netStack.TransportProtocolOption(tcp.ProtocolNumber, &opt); tcpErr != nil {
+			return stackErr("get receive buffer sizes", wrapTCPIP(tcpErr))
+		}
+		opt.Default = opts.receiveBuffer
+		if opt.Max < opt.Default {
+			opt.Max = opt.Default
+		}
+		if tcpErr := netStack.SetTransportProtocolOption(tcp.ProtocolNumber, &opt); tcpErr != nil {
+			return stackErr("set receive buffer sizes", wrapTCPIP(tcpErr))
+		}
+	}
+	if opts.sendBuffer != 0 {
+		var opt tcpip.TCPSendBufferSizeRangeOption
+		if tcpErr := netStack.TransportProtocolOption(tcp.ProtocolNumber, &opt); tcpErr != nil {
+			return stackErr("get send buffer sizes", wrapTCPIP(tcpErr))
+		}
+		opt.Default = opts.sendBuffer
+		if opt.Max < opt.Default {
+			opt.Max = opt.Default
+		}
+		if tcpErr := netStack.SetTransportProtocolOption(tcp.ProtocolNumber, &opt); tcpErr != nil {
+			return stackErr("set send buffer sizes", wrapTCPIP(tcpErr))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"net"
+	"strings"
+	"time"
+)
+
+// receiveDatagram reads one datagram from c, returning nil if none arrives
+// within wait.
+func receiveDatagram(c net.PacketConn, wait time.Duration) []byte {
+	_ = c.SetReadDeadline(time.Now().Add(wait))
+	defer c.SetReadDeadline(time.Time{})
+	b := make([]byte, 64*1024)
+	n, _, err := c.ReadFrom(b)
+	if err != nil {
+		return nil
+	}
+	return b[:n]
+}
+
+// checkUDPChecksums injects UDP datagrams from the injector's peer at a
+// socket on its stack, one with a valid checksum and the rest with a checksum
+// that is wrong in one way each, and checks that only the valid one is
+// delivered and that each of the others counts as a UDP checksum error. A
+// checksum computed over the wrong source address, or none, only fails if
+// netstack covers the IPv6 pseudo-header, and a zero one only if it holds
+// that UDP over IPv6 may not go without. The datagrams are then injected
+// again with the NIC claiming RX checksum offload, which is netstack's only
+// way to turn verification off, and every one must be delivered uncounted.
+// Finally the stack sends a datagram with and without TX checksum offload,
+// which must carry a valid checksum unless the offload is claimed.
+func checkUDPChecksums(opts stackOptions) error {
+	in, err := newInjector(opts)
+	if err != nil {
+		return err
+	}
+	const port = 7777
+	conn, err := gonet.DialUDP(in.netStack, &tcpip.FullAddress{NIC: 1, Addr: in.addr, Port: port}, nil, ipv6.ProtocolNumber)
+	if err != nil {
+		return fmt.Errorf("UDP checksums: %w", err)
+	}
+	defer conn.Close()
+	valid := func() []byte { return udpPacket(in.peer, in.addr, 40000, port, []byte(testMsg)) }
+	udpOf := func(pkt []byte) header.UDP { return header.UDP(header.IPv6(pkt).Payload()) }
+	cases := []struct {
+		name  string
+		valid bool
+		pkt   func() []byte
+	}{
+		{"valid checksum", true, valid},
+		{"corrupt payload", false, func() []byte {
+			pkt := valid()
+			pkt[len(pkt)-1] ^= 1
+			return pkt
+		}},
+		{"pseudo-header of another source", false, func() []byte {
+			pkt := udpPacket(tcpip.Address(net.ParseIP("FD00::99")), in.addr, 40000, port, []byte(testMsg))
+			header.IPv6(pkt).SetSourceAddress(in.peer)
+			return pkt
+		}},
+		{"no pseudo-header", false, func() []byte {
+			pkt := valid()
+			udp := udpOf(pkt)
+			udp.SetChecksum(0)
+			udp.SetChecksum(^udp.CalculateChecksum(header.Checksum(udp.Payload(), 0)))
+			return pkt
+		}},
+		{"zero checksum", false, func() []byte {
+			pkt := valid()
+			udpOf(pkt).SetChecksum(0)
+			return pkt
+		}},
+	}
+	checksumErrors := in.netStack.Stats().UDP.ChecksumErrors
+	var problems []string
+	for _, verify := range []bool{true, false} {
+		in.ep.LinkEPCapabilities &^= stack.CapabilityRXChecksumOffload
+		mode := "verified"
+		if !verify {
+			in.ep.LinkEPCapabilities |= stack.CapabilityRXChecksumOffload
+			mode = "offloaded"
+		}
+		for _, c := range cases {
+			before := checksumErrors.Value()
+			in.inject(c.pkt())
+			delivered := receiveDatagram(conn, 50*time.Millisecond) != nil
+			counted := checksumErrors.Value() - before
+			fmt.Printf("UDP checksum %s, %s: delivered %v, checksum errors +%d\n", mode, c.name, delivered, counted)
+			if want := c.valid || !verify; delivered != want || (counted != 0) != !want {
+				problems = append(problems, fmt.Sprintf("%s %s", mode, c.name))
+			}
+		}
+	}
+	in.ep.LinkEPCapabilities &^= stack.CapabilityRXChecksumOffload
+	for _, offload := range []bool{false, true} {
+		in.ep.LinkEPCapabilities &^= stack.CapabilityTXChecksumOffload
+		mode := "computed"
+		if offload {
+			in.ep.LinkEPCapabilities |= stack.CapabilityTXChecksumOffload
+			mode = "offloaded"
+		}
+		// A new socket for each, as a route notes whether it needs
+		// checksums when it is made.
+		out, err := gonet.DialUDP(in.netStack, nil, &tcpip.FullAddress{NIC: 1, Addr: in.peer, Port: 40000}, ipv6.ProtocolNumber)
+		if err != nil {
+			return fmt.Errorf("UDP checksums: %w", err)
+		}
+		_, err = out.Write([]byte(testMsg))
+		_ = out.Close()
+		if err != nil {
+			return fmt.Errorf("UDP checksums: send: %w", err)
+		}
+		pkts := in.outgoing(50 * time.Millisecond)
+		if len(pkts) != 1 {
+			return fmt.Errorf("UDP checksum %s: stack sent %d packets, not 1", mode, len(pkts))
+		}
+		ip := header.IPv6(pkts[0])
+		udp := header.UDP(ip.Payload())
+		ok := udp.IsChecksumValid(ip.SourceAddress(), ip.DestinationAddress(), header.Checksum(udp.Payload(), 0))
+		fmt.Printf("UDP checksum %s, sent: checksum %#04x, valid %v\n", mode, udp.Checksum(), ok)
+		if !offload && !ok {
+			problems = append(problems, fmt.Sprintf("%s sent", mode))
+		}
+	}
+	in.ep.LinkEPCapabilities &^= stack.CapabilityTXChecksumOffload
+	fmt.Printf("UDP checksum errors: %d\n", checksumErrors.Value())
+	if len(problems) > 0 {
+		return fmt.Errorf("UDP checksums handled wrongly: %s", strings.Join(problems, ", "))
+	}
+	return nil
+}
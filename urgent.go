@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The urgent checks send urgentBefore, then urgentByte as urgent data, then
+// urgentAfter, none of which contain urgentByte but itself.
+const (
+	urgentBefore = "before urgent "
+	urgentByte   = '!'
+	urgentAfter  = " after urgent"
+)
+
+// urgentTap is spliced into a socketpair like rstInjector, between a server
+// stack and a client stack, and passes every packet through, except that it
+// marks the first client to server segment carrying urgentByte as urgent,
+// with the URG flag and an urgent pointer to the byte after it, as a BSD or
+// Linux sender would. gonet has no way to send urgent data, so this is the
+// only way to have netstack receive any.
+type urgentTap struct {
+	mu     sync.Mutex
+	marked bool
+}
+
+// relay is the tap's packetRelay, for splicing in with the server's end
+// first and the client's second, so that client to server packets go in
+// direction 1.
+func (t *urgentTap) relay(dir int, pkt []byte, _ func(int, []byte) error) bool {
+	if dir == 1 {
+		t.mark(pkt)
+	}
+	return true
+}
+
+// mark sets URG and the urgent pointer on pkt, in place, if it is the first
+// segment to carry urgentByte, and fixes up its checksum.
+func (t *urgentTap) mark(pkt []byte) {
+	if len(pkt) < header.IPv6MinimumSize || header.IPVersion(pkt) != header.IPv6Version {
+		return
+	}
+	ip := header.IPv6(pkt)
+	if ip.TransportProtocol() != header.TCPProtocolNumber || len(ip.Payload()) < header.TCPMinimumSize {
+		return
+	}
+	tcp := header.TCP(ip.Payload())
+	i := strings.IndexByte(string(tcp.Payload()), urgentByte)
+	if i < 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.marked {
+		return
+	}
+	t.marked = true
+	tcp.SetFlags(uint8(tcp.Flags() | header.TCPFlagUrg))
+	tcp.SetUrgentPointer(uint16(i + 1))
+	tcp.SetChecksum(0)
+	xsum := header.PseudoHeaderChecksum(header.TCPProtocolNumber, ip.SourceAddress(), ip.DestinationAddress(), uint16(len(tcp)))
+	xsum = header.Checksum(tcp.Payload(), xsum)
+	tcp.SetChecksum(^tcp.CalculateChecksum(xsum))
+}
+
+// wasMarked reports whether a segment has been marked urgent.
+func (t *urgentTap) wasMarked() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.marked
+}
+
+// sendUrgent writes urgentBefore, urgentByte and urgentAfter to c, which
+// sends urgentByte as urgent data if oob is set and c is a *net.TCPConn, and
+// half-closes it.
+func sendUrgent(c net.Conn, oob bool) error {
+	if _, err := c.Write([]byte(urgentBefore)); err != nil {
+		return fmt.Errorf("write TCP error: %w", err)
+	}
+	// Each part in a segment of its own, as the tap looks for urgentByte
+	// and a native receiver stops reading at the mark anyway.
+	time.Sleep(10 * time.Millisecond)
+	if tc, ok := c.(*net.TCPConn); ok && oob {
+		raw, err := tc.SyscallConn()
+		if err != nil {
+			return err
+		}
+		var sendErr error
+		if err := raw.Write(func(fd uintptr) bool {
+			sendErr = syscall.Sendmsg(int(fd), []byte{urgentByte}, nil, nil, syscall.MSG_OOB)
+			return sendErr != syscall.EAGAIN
+		}); err != nil {
+			return err
+		}
+		if sendErr != nil {
+			return fmt.Errorf("send urgent data: %w", sendErr)
+		}
+	} else if _, err := c.Write([]byte{urgentByte}); err != nil {
+		return fmt.Errorf("write TCP error: %w", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if _, err := c.Write([]byte(urgentAfter)); err != nil {
+		return fmt.Errorf("write TCP error: %w", err)
+	}
+	return c.(closeWriter).CloseWrite()
+}
+
+// receiveOOB reads the urgent byte out of band from c, waiting up to wait
+// for it to arrive. It returns an error wrapping EINVAL if there is none to
+// read, as with SO_OOBINLINE set.
+func receiveOOB(c *net.TCPConn, wait time.Duration) (byte, error) {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	deadline := time.Now().Add(wait)
+	for {
+		b := make([]byte, 1)
+		var n int
+		var recvErr error
+		if err := raw.Read(func(fd uintptr) bool {
+			n, _, recvErr = syscall.Recvfrom(int(fd), b, syscall.MSG_OOB)
+			return true
+		}); err != nil {
+			return 0, err
+		}
+		// EAGAIN is the urgent pointer having arrived ahead of the byte,
+		// and EINVAL neither having arrived yet.
+		retry := errors.Is(recvErr, syscall.EAGAIN) || errors.Is(recvErr, syscall.EINVAL)
+		switch {
+		case recvErr == nil && n == 1:
+			return b[0], nil
+		case recvErr == nil:
+			return 0, fmt.Errorf("no urgent byte to read")
+		case !retry || time.Now().After(deadline):
+			return 0, fmt.Errorf("receive urgent data: %w", recvErr)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// urgentCase is one way of handling urgent data, and what the receiver reads
+// inline and out of band for it.
+type urgentCase struct {
+	name   string
+	inline string
+	// oob is the byte read out of band, or zero if reading one must fail.
+	oob byte
+}
+
+// receiveUrgent accepts one connection from l and reads what sendUrgent
+// sent: urgentBefore, which ends at the urgent mark, then the urgent byte
+// out of band if checkOOB is set, then the rest of the stream inline. It
+// returns an error saying how that differs from want.
+func receiveUrgent(l net.Listener, want urgentCase, checkOOB bool, timeout time.Duration) error {
+	c, err := l.Accept()
+	if err != nil {
+		return fmt.Errorf("accept TCP error: %w", err)
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(timeout))
+	inline := make([]byte, len(urgentBefore))
+	if _, err := io.ReadFull(c, inline); err != nil {
+		return fmt.Errorf("read TCP error: %w", err)
+	}
+	var problems []string
+	if checkOOB {
+		b, err := receiveOOB(c.(*net.TCPConn), timeout/2)
+		switch {
+		case want.oob == 0 && err == nil:
+			problems = append(problems, fmt.Sprintf("urgent byte %q read out of band", b))
+		case want.oob != 0 && err != nil:
+			problems = append(problems, err.Error())
+		case want.oob != 0 && b != want.oob:
+			problems = append(problems, fmt.Sprintf("urgent byte %q read out of band, not %q", b, want.oob))
+		}
+	}
+	rest, err := io.ReadAll(c)
+	if err != nil {
+		return fmt.Errorf("read TCP error: %w", err)
+	}
+	if got := string(inline) + string(rest); got != want.inline {
+		problems = append(problems, fmt.Sprintf("read %q inline, not %q", got, want.inline))
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// runUrgent sends a byte of urgent data in the middle of a stream and checks
+// that the receiver sees it where it should. Over native TCP, the urgent
+// byte is sent with MSG_OOB, and has to be read out of band and left out of
+// the stream, or, with SO_OOBINLINE, left in it in order with nothing to read
+// out of band. netstack can neither send nor receive urgent data out of
+// band, so over gonet an urgentTap marks the byte urgent on the link
+// instead, and netstack has to deliver it inline and in order, as with
+// SO_OOBINLINE, rather than drop it or lose the stream. That needs a
+// socketpair type that keeps packet boundaries; with one that doesn't, the
+// gonet case is skipped.
+func runUrgent(ctx context.Context, opts stackOptions) error {
+	const timeout = 2 * time.Second
+	stripped := urgentCase{"out of band", urgentBefore + urgentAfter, urgentByte}
+	inline := urgentCase{"SO_OOBINLINE", urgentBefore + string(urgentByte) + urgentAfter, 0}
+	var problems []string
+	report := func(path string, want urgentCase, err error) {
+		resultFrom(ctx).addResult(err, err == nil)
+		if err != nil {
+			fmt.Printf("%s, %s: %s\n", path, want.name, err)
+			problems = append(problems, fmt.Sprintf("%s %s", path, want.name))
+			return
+		}
+		fmt.Printf("%s, %s: urgent data delivered correctly\n", path, want.name)
+	}
+	native := &netTransport{addr: net.ParseIP("::1")}
+	for _, want := range []urgentCase{stripped, inline} {
+		l, err := native.Listen(9804)
+		if err != nil {
+			return err
+		}
+		if want.oob == 0 {
+			// Accepted connections inherit the option from the listener.
+			raw, err := l.(*net.TCPListener).SyscallConn()
+			if err != nil {
+				l.Close()
+				return err
+			}
+			var optErr error
+			if err := raw.Control(func(fd uintptr) {
+				optErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_OOBINLINE, 1)
+			}); err != nil || optErr != nil {
+				l.Close()
+				fmt.Printf("net, %s: skipped, the option can't be set: %v%v\n", want.name, err, optErr)
+				continue
+			}
+		}
+		received := make(chan error, 1)
+		go func() { received <- receiveUrgent(l, want, true, timeout) }()
+		c, err := native.Dial(ctx, 9804)
+		if err != nil {
+			l.Close()
+			return err
+		}
+		err = sendUrgent(c, true)
+		if errors.Is(err, syscall.EOPNOTSUPP) {
+			c.Close()
+			l.Close()
+			<-received
+			fmt.Printf("net, %s: skipped, urgent data unsupported: %s\n", want.name, err)
+			continue
+		}
+		if err == nil {
+			err = <-received
+		}
+		c.Close()
+		l.Close()
+		report("net", want, err)
+	}
+	if opts.sockType == syscall.SOCK_STREAM {
+		fmt.Printf("gonet, %s: skipped, marking data urgent on the link needs a socketpair type that keeps packet boundaries\n", inline.name)
+	} else {
+		addr1, addr2 := pairAddresses(opts)
+		tap := &urgentTap{}
+		fd1, fd2, err := spliceSocketpairs(opts.sockType, tap.relay)
+		if err != nil {
+			return err
+		}
+		server, client, err := setupStackPairFDs([]int{fd1}, []int{fd2}, addr1, addr2, opts)
+		if err != nil {
+			return err
+		}
+		serverT, clientT := gonetPair(server, addr1, client, addr2)
+		l, err := serverT.Listen(1234)
+		if err != nil {
+			return err
+		}
+		received := make(chan error, 1)
+		go func() { received <- receiveUrgent(l, inline, false, timeout) }()
+		c, err := clientT.Dial(ctx, 1234)
+		if err != nil {
+			l.Close()
+			return err
+		}
+		err = sendUrgent(c, false)
+		if err == nil {
+			err = <-received
+		}
+		c.Close()
+		l.Close()
+		if err == nil && !tap.wasMarked() {
+			err = fmt.Errorf("no segment carried the urgent byte to mark")
+		}
+		report("gonet", inline, err)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("urgent data mishandled: %s", strings.Join(problems, ", "))
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/waiter"
+	"io"
+	"net"
+	"sort"
+	"time"
+)
+
+// windowLatency is the one-way delay a window clamp run adds to the link when
+// -latency doesn't set one: without a delay the round trip is too short for
+// any window to matter.
+const windowLatency = 5 * time.Millisecond
+
+// streamServer writes data to each connection until the write fails, for
+// clients that read for as long as they like and then close.
+func streamServer(t Transport, port uint16) {
+	li, err := serverListen(t, port)
+	if err != nil {
+		fmt.Printf("Listen error: %s\n", err)
+		return
+	}
+	buf := make([]byte, 64*1024)
+	for {
+		sc, err := li.Accept()
+		if err != nil {
+			logAcceptError(err)
+			return
+		}
+		go func() {
+			defer sc.Close()
+			for {
+				if _, err := sc.Write(buf); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// readFor reads from c for duration, or until ctx is done, and returns the
+// number of bytes read.
+func readFor(ctx context.Context, c net.Conn, duration time.Duration) (int64, error) {
+	deadline := time.Now().Add(duration)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	_ = c.SetReadDeadline(deadline)
+	n, err := io.Copy(io.Discard, c)
+	if time.Now().After(deadline) && ctx.Err() == nil {
+		err = nil
+	}
+	return n, err
+}
+
+// settledReceiveBuffer returns the receive buffer size an endpoint of s ends
+// up with when asked for size.
+func settledReceiveBuffer(s *stack.Stack, size int) (int64, error) {
+	ep, tcpErr := s.NewEndpoint(tcp.ProtocolNumber, ipv6.ProtocolNumber, &waiter.Queue{})
+	if tcpErr != nil {
+		return 0, fmt.Errorf("endpoint: %w", wrapTCPIP(tcpErr))
+	}
+	defer ep.Close()
+	ep.SocketOptions().SetReceiveBufferSize(int64(size), true)
+	return ep.SocketOptions().GetReceiveBufferSize(), nil
+}
+
+// runWindowClamp measures the throughput of a single gonet connection reading
+// for duration with its receive buffer clamped to each of windows bytes,
+// over a link with a latency injected. A receiver can have no more than its
+// window unacknowledged, so once the link is fast enough throughput is the
+// window over the round trip time, whatever the link could otherwise carry:
+// the bandwidth-delay product. For each window it reports the throughput
+// achieved next to that bound, and the retransmissions there were: a window
+// larger than the socketpair can queue has packets dropped, and throughput
+// then falls well short of the bound.
+//
+// The window is clamped through the receive buffer, as SO_RCVBUF would, since
+// netstack accepts TCP_WINDOW_CLAMP but does nothing with it. netstack, like
+// Linux by default, advertises at most half its receive buffer, keeping the
+// rest for the overhead of the segments it holds, so the bound is figured
+// from half the buffer netstack settles on within the stack's limits.
+func runWindowClamp(ctx context.Context, windows []int, duration time.Duration, opts stackOptions) error {
+	if opts.latency == 0 {
+		opts.latency = windowLatency
+	}
+	rtt := 2 * opts.latency
+	server, client, err := setupGonetPair(opts)
+	if err != nil {
+		return err
+	}
+	go streamServer(server, 1234)
+	time.Sleep(time.Millisecond)
+	sort.Ints(windows)
+	fmt.Printf("round trip time %s\n", rtt)
+	for _, window := range windows {
+		id := newConnID()
+		t := *client
+		t.receiveBuffer = window
+		c, err := t.Dial(ctx, 1234)
+		if err != nil {
+			resultFrom(ctx).addResult(err, false)
+			logConn(id, "dial TCP error: %s%s", err, dialErrorHint(err))
+			return err
+		}
+		buffer, err := settledReceiveBuffer(client.netStack, window)
+		if err != nil {
+			_ = c.Close()
+			return err
+		}
+		retransmits := server.netStack.Stats().TCP.Retransmits.Value()
+		start := time.Now()
+		n, err := readFor(ctx, c, duration)
+		elapsed := time.Since(start)
+		_ = c.Close()
+		resultFrom(ctx).addResult(err, err == nil)
+		if err != nil {
+			logConn(id, "%s", err)
+			return err
+		}
+		retransmits = server.netStack.Stats().TCP.Retransmits.Value() - retransmits
+		achieved := float64(n) / elapsed.Seconds()
+		bound := float64(buffer/2) / rtt.Seconds()
+		fmt.Printf("receive buffer %d (asked for %d): %.2f MB/s, %.0f%% of the %.2f MB/s window/RTT bound, %d segments retransmitted\n",
+			buffer, window, achieved/1e6, 100*achieved/bound, bound/1e6, retransmits)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"sync"
+	"syscall"
+)
+
+// windowTap is spliced into the fds of one stack of a pair, passing every
+// packet through unchanged, and counts the receive window events in the TCP
+// segments crossing in either direction, recording them in the run in
+// progress. netstack's counters say how often an endpoint advertised a zero
+// window, but only while the endpoint lives, and not at all how often it
+// reopened one, so this watches the advertisements themselves.
+type windowTap struct {
+	mu    sync.Mutex
+	flows map[flowKey]flowWindow
+}
+
+// flowKey identifies one direction of a connection.
+type flowKey struct {
+	src, dst         tcpip.Address
+	srcPort, dstPort uint16
+}
+
+// flowWindow is the last acknowledgement and window a flow advertised.
+type flowWindow struct {
+	ack uint32
+	wnd uint16
+}
+
+// tapWindows returns fds with a windowTap spliced in front of each, to be
+// used in their place.
+func tapWindows(sockType int, fds []int) ([]int, error) {
+	t := &windowTap{flows: make(map[flowKey]flowWindow)}
+	var tapped []int
+	for _, fd := range fds {
+		s, err := socketpair(syscall.AF_UNIX, sockType, 0)
+		if err != nil {
+			for _, fd := range tapped {
+				_ = syscall.Close(fd)
+			}
+			return nil, err
+		}
+		spliceFDs(s[1], fd, t.relay)
+		tapped = append(tapped, s[0])
+	}
+	return tapped, nil
+}
+
+// relay is the tap's packetRelay.
+func (t *windowTap) relay(_ int, pkt []byte, _ func(int, []byte) error) bool {
+	t.observe(pkt)
+	return true
+}
+
+// observe records pkt's window advertisement. A window update is a bare ACK
+// that acknowledges nothing new and only opens the window further, as a
+// receiver sends when its application reads; a zero window is an
+// advertisement closing the window to nothing, counted once until it
+// reopens. Windows are compared unscaled, the scale being fixed for the life
+// of a connection.
+func (t *windowTap) observe(pkt []byte) {
+	if len(pkt) < header.IPv6MinimumSize || header.IPVersion(pkt) != header.IPv6Version {
+		return
+	}
+	ip := header.IPv6(pkt)
+	if ip.TransportProtocol() != header.TCPProtocolNumber || len(ip.Payload()) < header.TCPMinimumSize {
+		return
+	}
+	tcp := header.TCP(ip.Payload())
+	flags := tcp.Flags()
+	if !flags.Contains(header.TCPFlagAck) || flags.Intersects(header.TCPFlagSyn|header.TCPFlagRst) {
+		return
+	}
+	key := flowKey{src: ip.SourceAddress(), dst: ip.DestinationAddress(), srcPort: tcp.SourcePort(), dstPort: tcp.DestinationPort()}
+	cur := flowWindow{ack: tcp.AckNumber(), wnd: tcp.WindowSize()}
+	bare := len(tcp) <= int(tcp.DataOffset()) && !flags.Contains(header.TCPFlagFin)
+	t.mu.Lock()
+	prev, seen := t.flows[key]
+	t.flows[key] = cur
+	t.mu.Unlock()
+	update := seen && bare && cur.ack == prev.ack && cur.wnd > prev.wnd
+	zero := cur.wnd == 0 && (!seen || prev.wnd != 0)
+	activeResult().addWindow(update, zero)
+}
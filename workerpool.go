@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// poolServer is payloadServer with a fixed pool of workers goroutines
+// serving connections, rather than a goroutine for each: the accept loop
+// queues each connection it accepts, and whichever worker is free takes the
+// next. The queue is deep enough that accepting never waits on the workers.
+func poolServer(t Transport, port uint16, payload []byte, workers int) {
+	li, err := serverListen(t, port)
+	if err != nil {
+		fmt.Printf("Listen error: %s\n", err)
+		return
+	}
+	queue := make(chan net.Conn, 1024)
+	defer close(queue)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for sc := range queue {
+				serveConn(sc, payload)
+			}
+		}()
+	}
+	for {
+		sc, err := li.Accept()
+		if err != nil {
+			logAcceptError(err)
+			return
+		}
+		queue <- sc
+	}
+}
+
+// runServerModels compares a server with a goroutine per connection to one
+// with a pool of workers handler goroutines, over native TCP and gonet.
+// Each model serves a 256KiB payload to rounds batches of nConns concurrent
+// connections, and the throughput and connection rate of each are
+// reported. With fewer workers than connections, the pool makes
+// connections wait their turn, so it trades latency for a bound on the
+// goroutines serving at once.
+func runServerModels(ctx context.Context, workers int, nConns int, rounds int, opts stackOptions) error {
+	payload := randomPayload(newLockedRand(opts.seed), 256*1024)
+	models := []struct {
+		name  string
+		serve func(t Transport, port uint16)
+	}{
+		{"goroutine per connection", func(t Transport, port uint16) { payloadServer(t, port, payload) }},
+		{fmt.Sprintf("pool of %d", workers), func(t Transport, port uint16) { poolServer(t, port, payload, workers) }},
+	}
+	failed := false
+	for i, model := range models {
+		server, client, err := setupGonetPair(opts)
+		if err != nil {
+			return err
+		}
+		paths := []struct {
+			name   string
+			server Transport
+			client Transport
+			port   uint16
+		}{
+			{"net", &netTransport{addr: net.ParseIP("::1")}, &netTransport{addr: net.ParseIP("::1")}, uint16(9789 + i)},
+			{"gonet", server, client, 1234},
+		}
+		for _, path := range paths {
+			go model.serve(path.server, path.port)
+			time.Sleep(time.Millisecond)
+			intact, total := 0, 0
+			start := time.Now()
+			for r := 0; r < rounds && ctx.Err() == nil; r++ {
+				received, errs := collectConns(ctx, path.client, path.port, nConns, payload)
+				for _, b := range received {
+					if bytes.Equal(b, payload) {
+						intact++
+					}
+				}
+				for _, err := range errs {
+					fmt.Printf("%s, %s: %s\n", path.name, model.name, err)
+				}
+				total += nConns
+			}
+			elapsed := time.Since(start)
+			fmt.Printf("%s, %s: %d/%d connections intact in %s, %.1f MB/s, %.0f conn/s\n", path.name, model.name,
+				intact, total, elapsed.Round(time.Millisecond), float64(intact*len(payload))/elapsed.Seconds()/1e6,
+				float64(intact)/elapsed.Seconds())
+			if intact != rounds*nConns {
+				failed = true
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+		}
+	}
+	if failed {
+		return fmt.Errorf("not every connection received the payload intact")
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// xorKeySeed seeds xorKey. The key is fixed, not drawn from the run's seed,
+// as it is something both ends know in advance.
+const xorKeySeed = 0x786f72
+
+// xorFrameSize is the size of the frames a round trip client sends.
+const xorFrameSize = 16 * 1024
+
+// xorKey is what a round trip server XORs the stream with: byte i of the
+// stream with byte i mod len(xorKey) of the key. Its length is prime, so
+// that it doesn't line up with any frame or segment size and a piece of the
+// stream that comes back in the wrong place is XORed with the wrong key.
+var xorKey = func() []byte {
+	b := make([]byte, 251)
+	rand.New(rand.NewSource(xorKeySeed)).Read(b)
+	return b
+}()
+
+// xorAt XORs b, which starts at offset off of the stream, with xorKey in
+// place. Applying it twice restores b.
+func xorAt(b []byte, off int64) {
+	k := int(off % int64(len(xorKey)))
+	for i := range b {
+		b[i] ^= xorKey[k]
+		if k++; k == len(xorKey) {
+			k = 0
+		}
+	}
+}
+
+// xorEchoServer reads framed data from each connection and sends every
+// frame straight back XORed with xorKey, until the client's close marker,
+// which it echoes before closing.
+func xorEchoServer(t Transport, port uint16) {
+	li, err := serverListen(t, port)
+	if err != nil {
+		fmt.Printf("Listen error: %s\n", err)
+		return
+	}
+	for {
+		sc, err := li.Accept()
+		if err != nil {
+			logAcceptError(err)
+			return
+		}
+		go func() {
+			defer sc.Close()
+			var off int64
+			for {
+				b, err := readFrame(sc)
+				if errors.Is(err, errCloseMarker) {
+					_ = writeCloseMarker(sc)
+					return
+				}
+				if err != nil {
+					return
+				}
+				xorAt(b, off)
+				off += int64(len(b))
+				if err := writeFrame(sc, b); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// xorRoundTrip sends payload over c in frames to an xorEchoServer while
+// reading back what it returns, undoing the XOR and comparing each frame
+// with what was sent. A mismatch is reported at the stream offset of its
+// first wrong byte. As with receiveConn, the round trip is timed from start
+// and recorded in the run's result.
+func xorRoundTrip(ctx context.Context, c net.Conn, payload []byte, start time.Time) error {
+	defer resultFrom(ctx).startTransfer()()
+	stop := bindDeadline(ctx, c)
+	defer stop()
+	sent := make(chan error, 1)
+	go func() {
+		for off := 0; off < len(payload); off += xorFrameSize {
+			end := off + xorFrameSize
+			if end > len(payload) {
+				end = len(payload)
+			}
+			if err := writeFrame(c, payload[off:end]); err != nil {
+				sent <- fmt.Errorf("write TCP error: %w", err)
+				return
+			}
+		}
+		sent <- writeCloseMarker(c)
+	}()
+	var off int64
+	var ttfb time.Duration
+	for {
+		b, err := readFrame(c)
+		if errors.Is(err, errCloseMarker) {
+			break
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return fmt.Errorf("connection closed at offset %d without a close marker", off)
+		}
+		if err != nil {
+			return fmt.Errorf("read TCP error at offset %d: %w", off, err)
+		}
+		if off == 0 {
+			ttfb = time.Since(start)
+		}
+		if off+int64(len(b)) > int64(len(payload)) {
+			return fmt.Errorf("integrity failure: %d bytes echoed past the end of the %d byte payload", off+int64(len(b))-int64(len(payload)), len(payload))
+		}
+		xorAt(b, off)
+		if want := payload[off : off+int64(len(b))]; !bytes.Equal(b, want) {
+			i := 0
+			for b[i] == want[i] {
+				i++
+			}
+			return fmt.Errorf("integrity failure at offset %d: expected %#02x but got %#02x", off+int64(i), want[i], b[i])
+		}
+		off += int64(len(b))
+	}
+	if err := <-sent; err != nil {
+		return err
+	}
+	if off != int64(len(payload)) {
+		return fmt.Errorf("integrity failure: close marker at offset %d of %d", off, len(payload))
+	}
+	resultFrom(ctx).addTransfer(ttfb, time.Since(start), int(off))
+	return nil
+}
+
+// runXorEcho has nConns clients each send a 1MiB payload to a server that
+// XORs it with a known key and sends it back, over native TCP and gonet,
+// and undoes the XOR to check it against what was sent. Both directions
+// carry different bytes, so corruption anywhere in the round trip, going
+// out, in the server or coming back, fails the final comparison, where a
+// plain echo could be fooled by the same error both ways.
+func runXorEcho(ctx context.Context, nConns int, opts stackOptions) error {
+	payload := randomPayload(newLockedRand(opts.seed), 1024*1024)
+	server, client, err := setupGonetPair(opts)
+	if err != nil {
+		return err
+	}
+	// The clients all dial at once, and a full accept queue loses
+	// connections to the bug runGonet shows, which is not what this checks.
+	server.backlog = 64
+	paths := []struct {
+		name   string
+		server Transport
+		client Transport
+		port   uint16
+	}{
+		{"net", &netTransport{addr: net.ParseIP("::1")}, &netTransport{addr: net.ParseIP("::1")}, 9801},
+		{"gonet", server, client, 1234},
+	}
+	failed := false
+	for _, path := range paths {
+		go xorEchoServer(path.server, path.port)
+		time.Sleep(time.Millisecond)
+		var intact int64
+		wg := &sync.WaitGroup{}
+		wg.Add(nConns)
+		for i := 0; i < nConns; i++ {
+			go func() {
+				defer wg.Done()
+				id := newConnID()
+				start := time.Now()
+				c, err := path.client.Dial(ctx, path.port)
+				if err != nil {
+					resultFrom(ctx).addResult(err, false)
+					logConn(id, "dial TCP error: %s%s", err, dialErrorHint(err))
+					return
+				}
+				defer c.Close()
+				err = xorRoundTrip(ctx, c, payload, start)
+				resultFrom(ctx).addResult(err, err == nil)
+				if err != nil {
+					logConn(id, "%s", err)
+					return
+				}
+				atomic.AddInt64(&intact, 1)
+			}()
+		}
+		wg.Wait()
+		fmt.Printf("%s: %d/%d round trips intact\n", path.name, intact, nConns)
+		if intact != int64(nConns) {
+			failed = true
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	if failed {
+		return fmt.Errorf("not every round trip came back intact")
+	}
+	return nil
+}